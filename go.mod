@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/gorilla/websocket v1.5.1
 	github.com/lib/pq v1.10.9
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/net v0.17.0 // indirect
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminAuth returns middleware that protects admin endpoints with a bearer
+// token. When no token is configured the admin API is disabled.
+func adminAuth(token string) func(http.HandlerFunc) http.HandlerFunc {
+	return tokenAuth("admin", token)
+}
+
+// tokenAuth returns middleware that protects the endpoints of the named API
+// with a bearer token. When token is empty the API is disabled.
+func tokenAuth(api, token string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, api+" API disabled", http.StatusForbidden)
+				return
+			}
+
+			provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				logger.Warn(api+" request rejected", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleLogLevel reports the current log level on GET and changes it on PUT
+// or POST with a body like {"level": "debug"}.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		level, err := parseLogLevel(req.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+		logger.Info("log level changed", "level", level.String(), "remote_addr", r.RemoteAddr)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"level": logLevel.Level().String(),
+	})
+}
+
+// ConnectionInfo is the admin view of a single live connection.
+type ConnectionInfo struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"userId"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	Chats         []string  `json:"chats"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	QueueDepth    int       `json:"queueDepth"`
+	QueueCapacity int       `json:"queueCapacity"`
+	LastSeen      time.Time `json:"lastSeen"`
+}
+
+func (c *Client) info(now time.Time) ConnectionInfo {
+	c.mu.Lock()
+	chats := make([]string, 0, len(c.chats))
+	for chatID := range c.chats {
+		chats = append(chats, chatID)
+	}
+	lastSeen := c.LastSeen
+	c.mu.Unlock()
+	sort.Strings(chats)
+
+	return ConnectionInfo{
+		ID:            c.ID,
+		UserID:        c.UserID,
+		RemoteAddr:    c.RemoteAddr,
+		Chats:         chats,
+		ConnectedAt:   c.ConnectedAt,
+		UptimeSeconds: int64(now.Sub(c.ConnectedAt).Seconds()),
+		QueueDepth:    len(c.Send),
+		QueueCapacity: cap(c.Send),
+		LastSeen:      lastSeen,
+	}
+}
+
+// inChat reports whether the client has joined chatID.
+func (c *Client) inChat(chatID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.chats[chatID]
+	return ok
+}
+
+// disconnect sends a close frame and closes the connection. The read pump
+// then fails and unregisters the client through the normal path.
+func (c *Client) disconnect(reason string) {
+	closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	c.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	c.Conn.Close()
+	c.log.Info("client disconnected by admin", "reason", reason)
+}
+
+// Connections returns a snapshot of all registered clients, optionally
+// limited to a single user.
+func (h *Hub) Connections(userID string) []ConnectionInfo {
+	now := time.Now()
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	conns := make([]ConnectionInfo, 0, len(h.clients))
+	for client := range h.clients {
+		if userID != "" && client.UserID != userID {
+			continue
+		}
+		conns = append(conns, client.info(now))
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+	return conns
+}
+
+// DisconnectClient closes the connection with the given client ID.
+func (h *Hub) DisconnectClient(clientID, reason string) bool {
+	var target *Client
+	h.mutex.RLock()
+	for client := range h.clients {
+		if client.ID == clientID {
+			target = client
+			break
+		}
+	}
+	h.mutex.RUnlock()
+
+	if target == nil {
+		return false
+	}
+	target.disconnect(reason)
+	return true
+}
+
+// DisconnectUser closes every session of userID and returns how many were
+// closed.
+func (h *Hub) DisconnectUser(userID, reason string) int {
+	var targets []*Client
+	h.mutex.RLock()
+	for client := range h.clients {
+		if client.UserID == userID {
+			targets = append(targets, client)
+		}
+	}
+	h.mutex.RUnlock()
+
+	for _, client := range targets {
+		client.disconnect(reason)
+	}
+	return len(targets)
+}
+
+// Announce delivers a system message to every member of chatID, or to all
+// clients when chatID is empty, and returns the number of recipients.
+func (h *Hub) Announce(chatID, content string) int {
+	msg := Message{
+		Type:      TypeSystem,
+		Content:   content,
+		ChatID:    chatID,
+		Timestamp: time.Now().Unix(),
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delivered := 0
+	for client := range h.clients {
+		if chatID != "" && !client.inChat(chatID) {
+			continue
+		}
+		if h.deliver(client, msg) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// Stats returns hub level counters.
+func (h *Hub) Stats() map[string]interface{} {
+	h.mutex.RLock()
+	clients := len(h.clients)
+	users := make(map[string]struct{})
+	for client := range h.clients {
+		users[client.UserID] = struct{}{}
+	}
+	h.mutex.RUnlock()
+
+	stats := map[string]interface{}{
+		"connections":        clients,
+		"unique_users":       len(users),
+		"broadcast_queue":    len(h.broadcast),
+		"broadcast_capacity": cap(h.broadcast),
+		"broadcasts_total":   atomic.LoadUint64(&h.broadcastCount),
+		"dropped_clients":    atomic.LoadUint64(&h.droppedCount),
+	}
+	if h.cluster != nil {
+		stats["cluster"] = h.cluster.stats()
+	}
+	return stats
+}
+
+// handleAdminConnections lists live connections. ?userId= narrows the list
+// to a single user.
+func (h *Hub) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conns := h.Connections(r.URL.Query().Get("userId"))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":       len(conns),
+		"connections": conns,
+	})
+}
+
+// handleAdminDisconnect force-disconnects a single client ({"clientId": ...})
+// or all sessions of a user ({"userId": ...}).
+func (h *Hub) handleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ClientID string `json:"clientId"`
+		UserID   string `json:"userId"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "disconnected by administrator"
+	}
+
+	disconnected := 0
+	switch {
+	case req.ClientID != "":
+		if h.DisconnectClient(req.ClientID, req.Reason) {
+			disconnected = 1
+		}
+	case req.UserID != "":
+		disconnected = h.DisconnectUser(req.UserID, req.Reason)
+	default:
+		http.Error(w, "clientId or userId is required", http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("admin disconnect",
+		"client_id", req.ClientID, "user_id", req.UserID, "disconnected", disconnected)
+
+	status := http.StatusOK
+	if disconnected == 0 {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"disconnected": disconnected,
+	})
+}
+
+// handleAdminAnnounce broadcasts a system announcement to one chat
+// ({"chatId": ..., "content": ...}) or to everyone when chatId is omitted.
+func (h *Hub) handleAdminAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ChatID  string `json:"chatId"`
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Content == "" {
+		http.Error(w, "content is required", http.StatusBadRequest)
+		return
+	}
+
+	delivered := h.Announce(req.ChatID, req.Content)
+	logger.Info("admin announcement", "chat_id", req.ChatID, "recipients", delivered)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"recipients": delivered,
+	})
+}
+
+// handleAdminCacheInvalidate drops a key ({"key": ...}) or every key with
+// a prefix ({"prefix": ...}) from the cache of every instance, e.g. after
+// changing the database by hand.
+func handleAdminCacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key    string `json:"key"`
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Key != "":
+		GlobalUltraCache.Delete(req.Key)
+	case req.Prefix != "":
+		GlobalUltraCache.DeletePrefix(req.Prefix)
+	default:
+		http.Error(w, "key or prefix is required", http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("admin cache invalidation", "key", req.Key, "prefix", req.Prefix)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"invalidated": true,
+	})
+}
+
+// handleAdminStats reports hub, message processor and cache statistics.
+func (h *Hub) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := map[string]interface{}{
+		"hub":            h.Stats(),
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	}
+	if GlobalMessageProcessor != nil {
+		stats["processor"] = GlobalMessageProcessor.GetStats()
+	}
+	if GlobalUltraCache != nil {
+		stats["cache"] = GlobalUltraCache.GetStats()
+	}
+	if GlobalDBPool != nil {
+		stats["database"] = GlobalDBPool.GetStats()
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTestHub runs a hub behind a test server and returns the hub and
+// its WebSocket URL.
+func startTestHub(t *testing.T) (*Hub, string) {
+	t.Helper()
+	hub := newHub(DefaultConfig().WebSocket)
+	go hub.run()
+	server := httptest.NewServer(http.HandlerFunc(hub.handleWebSocket))
+	t.Cleanup(server.Close)
+	return hub, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+}
+
+// dialTestHub connects as userID and reads the welcome message.
+func dialTestHub(t *testing.T, url, userID string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?userId="+userID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	readFrame(t, conn)
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// adminRequest serves one request to an admin handler and decodes the
+// JSON reply into out, if given.
+func adminRequest(t *testing.T, handler http.HandlerFunc, method, target, body string, out interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if out != nil && w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	for _, tc := range []struct {
+		name, token, auth string
+		want              int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusForbidden},
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"token", "secret", "Bearer secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/log-level", nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		adminAuth(tc.token)(handleLogLevel)(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	captureLogs(t, slog.LevelInfo)
+	var reply struct {
+		Level string `json:"level"`
+	}
+	if code := adminRequest(t, handleLogLevel, http.MethodPut, "/admin/log-level", `{"level": "debug"}`, &reply); code != http.StatusOK || reply.Level != "DEBUG" {
+		t.Fatalf("PUT = %d %q", code, reply.Level)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("level %v after PUT, want debug", logLevel.Level())
+	}
+	if code := adminRequest(t, handleLogLevel, http.MethodPut, "/admin/log-level", `{"level": "loud"}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("PUT of an unknown level = %d", code)
+	}
+	if code := adminRequest(t, handleLogLevel, http.MethodDelete, "/admin/log-level", "", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE = %d", code)
+	}
+}
+
+func TestAdminConnections(t *testing.T) {
+	hub, url := startTestHub(t)
+	alice := dialTestHub(t, url, "alice")
+	dialTestHub(t, url, "alice")
+	bob := dialTestHub(t, url, "bob")
+
+	if err := alice.WriteJSON(Message{Type: TypeJoinChat, ChatID: "chat"}); err != nil {
+		t.Fatal(err)
+	}
+	var listed struct {
+		Count       int              `json:"count"`
+		Connections []ConnectionInfo `json:"connections"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if code := adminRequest(t, hub.handleAdminConnections, http.MethodGet, "/admin/connections?userId=alice", "", &listed); code != http.StatusOK {
+			t.Fatalf("GET = %d", code)
+		}
+		if listed.Count == 2 && len(listed.Connections[0].Chats) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice's connections %+v, want two, the first in chat", listed)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if c := listed.Connections[0]; c.UserID != "alice" || c.Chats[0] != "chat" || c.QueueCapacity == 0 || c.RemoteAddr == "" {
+		t.Fatalf("connection %+v", c)
+	}
+	adminRequest(t, hub.handleAdminConnections, http.MethodGet, "/admin/connections", "", &listed)
+	if listed.Count != 3 {
+		t.Fatalf("%d connections, want 3", listed.Count)
+	}
+
+	// Announcements go to a chat's members, or to everyone
+	var announced struct {
+		Recipients int `json:"recipients"`
+	}
+	adminRequest(t, hub.handleAdminAnnounce, http.MethodPost, "/admin/announce", `{"chatId": "chat", "content": "maintenance"}`, &announced)
+	if announced.Recipients != 1 {
+		t.Fatalf("chat announcement reached %d clients, want 1", announced.Recipients)
+	}
+	if msg := readFrame(t, alice); msg.Type != TypeSystem || msg.Content != "maintenance" || msg.ChatID != "chat" {
+		t.Fatalf("alice received %+v", msg)
+	}
+	adminRequest(t, hub.handleAdminAnnounce, http.MethodPost, "/admin/announce", `{"content": "hello all"}`, &announced)
+	if announced.Recipients != 3 {
+		t.Fatalf("announcement reached %d clients, want 3", announced.Recipients)
+	}
+	if msg := readFrame(t, bob); msg.Content != "hello all" {
+		t.Fatalf("bob received %+v", msg)
+	}
+	if code := adminRequest(t, hub.handleAdminAnnounce, http.MethodPost, "/admin/announce", `{"chatId": "chat"}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("announcement without content = %d", code)
+	}
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	hub, url := startTestHub(t)
+	dialTestHub(t, url, "alice")
+	dialTestHub(t, url, "alice")
+	bob := dialTestHub(t, url, "bob")
+	waitConnections(t, hub, 3)
+
+	var disconnected struct {
+		Disconnected int `json:"disconnected"`
+	}
+	bobID := hub.Connections("bob")[0].ID
+	body := `{"clientId": "` + bobID + `", "reason": "spam"}`
+	if code := adminRequest(t, hub.handleAdminDisconnect, http.MethodPost, "/admin/disconnect", body, &disconnected); code != http.StatusOK || disconnected.Disconnected != 1 {
+		t.Fatalf("disconnecting bob = %d, %d", code, disconnected.Disconnected)
+	}
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var closeErr *websocket.CloseError
+	if _, _, err := bob.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "spam" {
+		t.Fatalf("bob's connection ended with %v, want a policy violation close", err)
+	}
+
+	adminRequest(t, hub.handleAdminDisconnect, http.MethodPost, "/admin/disconnect", `{"userId": "alice"}`, &disconnected)
+	if disconnected.Disconnected != 2 {
+		t.Fatalf("disconnected %d of alice's sessions, want 2", disconnected.Disconnected)
+	}
+	waitConnections(t, hub, 0)
+
+	for _, tc := range []struct {
+		method, body string
+		want         int
+	}{
+		{http.MethodPost, `{"userId": "nobody"}`, http.StatusNotFound},
+		{http.MethodPost, `{}`, http.StatusBadRequest},
+		{http.MethodPost, `not json`, http.StatusBadRequest},
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+	} {
+		if code := adminRequest(t, hub.handleAdminDisconnect, tc.method, "/admin/disconnect", tc.body, nil); code != tc.want {
+			t.Fatalf("%s %s = %d, want %d", tc.method, tc.body, code, tc.want)
+		}
+	}
+}
+
+// waitConnections waits until the hub has n registered clients.
+func waitConnections(t *testing.T, hub *Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.ClientCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections, want %d", hub.ClientCount(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
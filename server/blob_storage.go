@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUploadNotFound is returned for unknown or expired upload IDs.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrFileNotFound is returned for unknown file IDs.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrChunkOffset is returned when a chunk does not start where the
+	// upload currently ends. The client resumes from UploadMeta.Offset.
+	ErrChunkOffset = errors.New("chunk offset does not match upload offset")
+	// ErrUploadChecksum is returned when the received bytes do not hash to
+	// the declared SHA-256.
+	ErrUploadChecksum = errors.New("upload checksum mismatch")
+	// ErrUploadIncomplete is returned when completing an upload that has
+	// not received all of its bytes.
+	ErrUploadIncomplete = errors.New("upload incomplete")
+)
+
+// UploadMeta describes an upload in progress. Offset is the number of
+// bytes received so far.
+type UploadMeta struct {
+	UploadID  string    `json:"uploadId"`
+	UserID    string    `json:"userId"`
+	Name      string    `json:"name"`
+	MimeType  string    `json:"mimeType"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// FileInfo describes a stored blob. ID is the hex SHA-256 of the content,
+// so identical uploads share one blob.
+type FileInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	MimeType  string    `json:"mimeType"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BlobReader is an open blob. Implementations backed by *os.File let
+// net/http serve downloads with sendfile.
+type BlobReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// BlobStorage stores resumable uploads and the content-addressed blobs
+// they produce.
+type BlobStorage interface {
+	CreateUpload(ctx context.Context, meta UploadMeta) (UploadMeta, error)
+	GetUpload(ctx context.Context, uploadID string) (UploadMeta, error)
+	// WriteChunk appends data at offset and returns the new offset.
+	WriteChunk(ctx context.Context, uploadID string, offset int64, data []byte) (int64, error)
+	// CompleteUpload verifies the upload's size and SHA-256 and turns it
+	// into a blob.
+	CompleteUpload(ctx context.Context, uploadID string) (FileInfo, error)
+	AbortUpload(ctx context.Context, uploadID string) error
+	Stat(ctx context.Context, fileID string) (FileInfo, error)
+	Open(ctx context.Context, fileID string) (BlobReader, FileInfo, error)
+	// PurgeUploads removes uploads started before cutoff.
+	PurgeUploads(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// LocalBlobStorage keeps blobs on local disk:
+//
+//	<dir>/uploads/<uploadID>.json   upload metadata
+//	<dir>/uploads/<uploadID>.part   bytes received so far
+//	<dir>/blobs/<id[:2]>/<id>       completed blob
+//	<dir>/blobs/<id[:2]>/<id>.json  blob metadata
+type LocalBlobStorage struct {
+	dir   string
+	locks sync.Map // upload ID -> *sync.Mutex
+}
+
+func NewLocalBlobStorage(dir string) (*LocalBlobStorage, error) {
+	for _, sub := range []string{"uploads", "blobs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalBlobStorage{dir: dir}, nil
+}
+
+func (s *LocalBlobStorage) lock(uploadID string) func() {
+	mu, _ := s.locks.LoadOrStore(uploadID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func (s *LocalBlobStorage) uploadPath(uploadID, ext string) string {
+	return filepath.Join(s.dir, "uploads", uploadID+ext)
+}
+
+func (s *LocalBlobStorage) blobPath(fileID string) string {
+	return filepath.Join(s.dir, "blobs", fileID[:2], fileID)
+}
+
+func (s *LocalBlobStorage) CreateUpload(ctx context.Context, meta UploadMeta) (UploadMeta, error) {
+	meta.UploadID = randomID()
+	meta.SHA256 = strings.ToLower(meta.SHA256)
+	meta.Offset = 0
+	meta.CreatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return UploadMeta{}, err
+	}
+	if err := os.WriteFile(s.uploadPath(meta.UploadID, ".part"), nil, 0o600); err != nil {
+		return UploadMeta{}, err
+	}
+	if err := writeFileAtomic(s.uploadPath(meta.UploadID, ".json"), data); err != nil {
+		return UploadMeta{}, err
+	}
+	return meta, nil
+}
+
+func (s *LocalBlobStorage) GetUpload(ctx context.Context, uploadID string) (UploadMeta, error) {
+	if !validUploadID(uploadID) {
+		return UploadMeta{}, ErrUploadNotFound
+	}
+	data, err := os.ReadFile(s.uploadPath(uploadID, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return UploadMeta{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return UploadMeta{}, err
+	}
+
+	var meta UploadMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return UploadMeta{}, err
+	}
+	info, err := os.Stat(s.uploadPath(uploadID, ".part"))
+	if errors.Is(err, os.ErrNotExist) {
+		return UploadMeta{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return UploadMeta{}, err
+	}
+	meta.Offset = info.Size()
+	return meta, nil
+}
+
+func (s *LocalBlobStorage) WriteChunk(ctx context.Context, uploadID string, offset int64, data []byte) (int64, error) {
+	unlock := s.lock(uploadID)
+	defer unlock()
+
+	meta, err := s.GetUpload(ctx, uploadID)
+	if err != nil {
+		return 0, err
+	}
+	if offset != meta.Offset {
+		return meta.Offset, ErrChunkOffset
+	}
+	if offset+int64(len(data)) > meta.Size {
+		return meta.Offset, fmt.Errorf("chunk ends at %d, past the declared size %d", offset+int64(len(data)), meta.Size)
+	}
+
+	f, err := os.OpenFile(s.uploadPath(uploadID, ".part"), os.O_WRONLY, 0)
+	if err != nil {
+		return meta.Offset, err
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		f.Close()
+		// Drop a partial write so the offset stays at a chunk boundary
+		os.Truncate(s.uploadPath(uploadID, ".part"), offset)
+		return meta.Offset, err
+	}
+	if err := f.Close(); err != nil {
+		return meta.Offset, err
+	}
+	return offset + int64(len(data)), nil
+}
+
+func (s *LocalBlobStorage) CompleteUpload(ctx context.Context, uploadID string) (FileInfo, error) {
+	unlock := s.lock(uploadID)
+	defer unlock()
+
+	meta, err := s.GetUpload(ctx, uploadID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if meta.Offset != meta.Size {
+		return FileInfo{}, ErrUploadIncomplete
+	}
+
+	part := s.uploadPath(uploadID, ".part")
+	sum, err := hashFile(part)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if sum != meta.SHA256 {
+		return FileInfo{}, ErrUploadChecksum
+	}
+
+	info := FileInfo{
+		ID:        sum,
+		Name:      meta.Name,
+		MimeType:  meta.MimeType,
+		Size:      meta.Size,
+		CreatedAt: time.Now().UTC(),
+	}
+	blob := s.blobPath(sum)
+	if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+		return FileInfo{}, err
+	}
+	if existing, err := s.Stat(ctx, sum); err == nil {
+		// Same content uploaded before; keep the first copy
+		info = existing
+	} else {
+		f, err := os.Open(part)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if err := os.Rename(part, blob); err != nil {
+			return FileInfo{}, err
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if err := writeFileAtomic(blob+".json", data); err != nil {
+			return FileInfo{}, err
+		}
+	}
+
+	s.removeUpload(uploadID)
+	return info, nil
+}
+
+func (s *LocalBlobStorage) AbortUpload(ctx context.Context, uploadID string) error {
+	if !validUploadID(uploadID) {
+		return ErrUploadNotFound
+	}
+	unlock := s.lock(uploadID)
+	defer unlock()
+
+	s.removeUpload(uploadID)
+	return nil
+}
+
+func (s *LocalBlobStorage) removeUpload(uploadID string) {
+	os.Remove(s.uploadPath(uploadID, ".part"))
+	os.Remove(s.uploadPath(uploadID, ".json"))
+	s.locks.Delete(uploadID)
+}
+
+func (s *LocalBlobStorage) Stat(ctx context.Context, fileID string) (FileInfo, error) {
+	if !validFileID(fileID) {
+		return FileInfo{}, ErrFileNotFound
+	}
+	data, err := os.ReadFile(s.blobPath(fileID) + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return FileInfo{}, ErrFileNotFound
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	var info FileInfo
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+func (s *LocalBlobStorage) Open(ctx context.Context, fileID string) (BlobReader, FileInfo, error) {
+	info, err := s.Stat(ctx, fileID)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	f, err := os.Open(s.blobPath(fileID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, FileInfo{}, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return f, info, nil
+}
+
+func (s *LocalBlobStorage) PurgeUploads(ctx context.Context, cutoff time.Time) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "uploads", "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, path := range paths {
+		uploadID := strings.TrimSuffix(filepath.Base(path), ".json")
+		meta, err := s.GetUpload(ctx, uploadID)
+		if err != nil && !errors.Is(err, ErrUploadNotFound) {
+			continue
+		}
+		if err == nil && meta.CreatedAt.After(cutoff) {
+			continue
+		}
+		if s.AbortUpload(ctx, uploadID) == nil {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validFileID accepts a lowercase hex SHA-256, which also keeps IDs from
+// escaping the blob directory.
+func validFileID(id string) bool {
+	return len(id) == sha256.Size*2 && isLowerHex(id)
+}
+
+func validUploadID(id string) bool {
+	return len(id) == 32 && isLowerHex(id)
+}
+
+func isLowerHex(s string) bool {
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+)
+
+// invalidationBatch bounds the keys and prefixes sent in one event.
+const invalidationBatch = 256
+
+// cacheInvalidation is a batch of keys and prefixes for the other
+// instances to drop from their caches. The prefix "" drops everything.
+type cacheInvalidation struct {
+	Node     string   `json:"node"`
+	Keys     []string `json:"keys,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+type cacheEviction struct {
+	key    string
+	prefix bool
+}
+
+// cacheInvalidator keeps UltraCache coherent across instances: writes and
+// deletes on this instance are published in batches over a PubSub, and
+// invalidations from other instances are applied locally. If evictions
+// cannot be queued, or the PubSub reports that notifications may have
+// been lost, whole caches are dropped rather than left stale.
+type cacheInvalidator struct {
+	cache       *UltraCache
+	pubsub      PubSub
+	node        string
+	channel     string
+	queue       chan cacheEviction
+	overflowed  int32 // accessed atomically, set when an eviction was not queued
+	unsubscribe func()
+	stop        chan struct{}
+	done        chan struct{}
+
+	published uint64 // accessed atomically
+	failed    uint64 // accessed atomically
+	received  uint64 // accessed atomically
+	flushes   uint64 // accessed atomically, whole cache drops
+}
+
+// EnableInvalidation connects the cache to the other instances sharing
+// channel. It must be called before the cache is shared between
+// goroutines.
+func (uc *UltraCache) EnableInvalidation(pubsub PubSub, node, channel string) error {
+	inv := &cacheInvalidator{
+		cache:   uc,
+		pubsub:  pubsub,
+		node:    node,
+		channel: channel,
+		queue:   make(chan cacheEviction, 4*invalidationBatch),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	unsubscribe, err := pubsub.Subscribe(channel, inv.receive)
+	if err != nil {
+		return err
+	}
+	inv.unsubscribe = unsubscribe
+	if r, ok := pubsub.(interface{ OnReconnect(func()) }); ok {
+		r.OnReconnect(inv.flush)
+	}
+	uc.invalidator = inv
+	go inv.publishLoop()
+	return nil
+}
+
+// StopInvalidation publishes the evictions still queued and stops
+// receiving invalidations. The PubSub is left open.
+func (uc *UltraCache) StopInvalidation() {
+	if inv := uc.invalidator; inv != nil {
+		inv.unsubscribe()
+		close(inv.stop)
+		<-inv.done
+	}
+}
+
+// publish queues an eviction for the other instances without blocking.
+func (inv *cacheInvalidator) publish(key string, prefix bool) {
+	select {
+	case inv.queue <- cacheEviction{key: key, prefix: prefix}:
+	default:
+		atomic.StoreInt32(&inv.overflowed, 1)
+	}
+}
+
+func (inv *cacheInvalidator) publishLoop() {
+	defer close(inv.done)
+	for {
+		select {
+		case ev := <-inv.queue:
+			inv.send(inv.batch(ev))
+		case <-inv.stop:
+			for {
+				select {
+				case ev := <-inv.queue:
+					inv.send(inv.batch(ev))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// batch collects first and the evictions queued behind it. After an
+// overflow every key is dropped instead, as some were never queued.
+func (inv *cacheInvalidator) batch(first cacheEviction) cacheInvalidation {
+	event := cacheInvalidation{Node: inv.node}
+	if atomic.SwapInt32(&inv.overflowed, 0) == 1 {
+		logger.Warn("cache invalidation queue overflowed, invalidating all keys on other instances")
+		event.Prefixes = []string{""}
+		return event
+	}
+
+	add := func(ev cacheEviction) {
+		if ev.prefix {
+			event.Prefixes = append(event.Prefixes, ev.key)
+		} else {
+			event.Keys = append(event.Keys, ev.key)
+		}
+	}
+	add(first)
+	for len(event.Keys)+len(event.Prefixes) < invalidationBatch {
+		select {
+		case ev := <-inv.queue:
+			add(ev)
+		default:
+			return event
+		}
+	}
+	return event
+}
+
+func (inv *cacheInvalidator) send(event cacheInvalidation) {
+	payload, err := json.Marshal(event)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+		err = inv.pubsub.Publish(ctx, inv.channel, payload)
+		cancel()
+	}
+	if err != nil {
+		// The other instances keep stale entries until their TTL runs out
+		atomic.AddUint64(&inv.failed, 1)
+		logger.Warn("cache invalidation publish failed",
+			"keys", len(event.Keys), "prefixes", len(event.Prefixes), "error", err)
+		return
+	}
+	atomic.AddUint64(&inv.published, 1)
+}
+
+// receive applies an invalidation from another instance.
+func (inv *cacheInvalidator) receive(payload []byte) {
+	var event cacheInvalidation
+	if err := json.Unmarshal(payload, &event); err != nil {
+		logger.Warn("invalid cache invalidation", "error", err)
+		return
+	}
+	if event.Node == inv.node {
+		return
+	}
+	atomic.AddUint64(&inv.received, 1)
+	for _, key := range event.Keys {
+		inv.cache.invalidate(key)
+	}
+	for _, prefix := range event.Prefixes {
+		inv.cache.invalidatePrefix(prefix)
+	}
+}
+
+// flush drops the whole local cache, after invalidations may have been
+// missed.
+func (inv *cacheInvalidator) flush() {
+	atomic.AddUint64(&inv.flushes, 1)
+	logger.Warn("cache invalidations may have been missed, invalidating all keys")
+	inv.cache.invalidatePrefix("")
+}
+
+func (inv *cacheInvalidator) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"channel":   inv.channel,
+		"queue":     len(inv.queue),
+		"published": atomic.LoadUint64(&inv.published),
+		"failed":    atomic.LoadUint64(&inv.failed),
+		"received":  atomic.LoadUint64(&inv.received),
+		"flushes":   atomic.LoadUint64(&inv.flushes),
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reconnectingPubSub is a MemoryPubSub that can report a reconnect, as
+// PostgresPubSub does after losing its listener.
+type reconnectingPubSub struct {
+	*MemoryPubSub
+	hooks []func()
+}
+
+func (ps *reconnectingPubSub) OnReconnect(fn func()) { ps.hooks = append(ps.hooks, fn) }
+
+// newInvalidatedCaches returns two caches of different nodes kept coherent
+// over one PubSub.
+func newInvalidatedCaches(t *testing.T) (a, b *UltraCache, ps *reconnectingPubSub) {
+	t.Helper()
+	ps = &reconnectingPubSub{MemoryPubSub: NewMemoryPubSub()}
+	t.Cleanup(func() { ps.Close() })
+	a, b = newTestCache(t, 1), newTestCache(t, 1)
+	for node, uc := range map[string]*UltraCache{"a": a, "b": b} {
+		if err := uc.EnableInvalidation(ps, node, "cache"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(uc.StopInvalidation)
+	}
+	return a, b, ps
+}
+
+// fill stores keys in uc as read from the source, without telling the
+// other instances.
+func fill(uc *UltraCache, keys ...string) {
+	for _, key := range keys {
+		uc.Fill(key, "v", time.Hour, uc.Version())
+	}
+}
+
+// cached returns which of keys uc holds.
+func cached(uc *UltraCache, keys ...string) []string {
+	var held []string
+	for _, key := range keys {
+		if _, ok := uc.Get(key); ok {
+			held = append(held, key)
+		}
+	}
+	return held
+}
+
+// waitReceived waits until uc applied n invalidations from other nodes.
+func waitReceived(t *testing.T, uc *UltraCache, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadUint64(&uc.invalidator.received) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d invalidations, want %d", atomic.LoadUint64(&uc.invalidator.received), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheInvalidationAcrossInstances(t *testing.T) {
+	a, b, _ := newInvalidatedCaches(t)
+	keys := []string{"k1", "k2", "chat:1:x", "chat:1:y", "chat:2:z"}
+	fill(b, keys...)
+
+	a.Set("k1", "new", time.Hour)
+	waitReceived(t, b, 1)
+	if got, want := cached(b, keys...), []string{"k2", "chat:1:x", "chat:1:y", "chat:2:z"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after Set b holds %v, want %v", got, want)
+	}
+	// The writer ignores its own event and keeps the new value
+	if v, ok := a.Get("k1"); !ok || v != "new" {
+		t.Fatalf("writer holds %v, %v after its own invalidation", v, ok)
+	}
+
+	a.Delete("k2")
+	waitReceived(t, b, 2)
+	a.DeletePrefix("chat:1:")
+	waitReceived(t, b, 3)
+	if got, want := cached(b, keys...), []string{"chat:2:z"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after Delete and DeletePrefix b holds %v, want %v", got, want)
+	}
+
+	// Fills are not published
+	fill(b, "k3")
+	fill(a, "k3")
+	time.Sleep(10 * time.Millisecond)
+	if got := cached(b, "k3"); len(got) != 1 {
+		t.Fatal("a fill on a evicted b's copy")
+	}
+}
+
+func TestCacheInvalidationBatches(t *testing.T) {
+	inv := &cacheInvalidator{node: "a", queue: make(chan cacheEviction, 2*invalidationBatch)}
+	for i := 0; i < invalidationBatch+10; i++ {
+		inv.publish(fmt.Sprintf("k%d", i), i%2 == 1)
+	}
+
+	first := inv.batch(<-inv.queue)
+	if n := len(first.Keys) + len(first.Prefixes); n != invalidationBatch || first.Node != "a" {
+		t.Fatalf("first batch of %d evictions from %q, want %d", n, first.Node, invalidationBatch)
+	}
+	if first.Keys[0] != "k0" || first.Prefixes[0] != "k1" {
+		t.Fatalf("first batch starts with key %q and prefix %q", first.Keys[0], first.Prefixes[0])
+	}
+	rest := inv.batch(<-inv.queue)
+	if n := len(rest.Keys) + len(rest.Prefixes); n != 10 {
+		t.Fatalf("second batch of %d evictions, want 10", n)
+	}
+
+	// An eviction that did not fit turns the next batch into a flush
+	inv = &cacheInvalidator{node: "a", queue: make(chan cacheEviction, 1)}
+	inv.publish("k1", false)
+	inv.publish("k2", false)
+	if event := inv.batch(<-inv.queue); len(event.Keys) != 0 || !reflect.DeepEqual(event.Prefixes, []string{""}) {
+		t.Fatalf("batch after an overflow = %+v, want a flush", event)
+	}
+}
+
+func TestCacheInvalidationOverflowFlushesOtherInstances(t *testing.T) {
+	a, b, _ := newInvalidatedCaches(t)
+	fill(b, "k1", "k2", "chat:1:x")
+
+	// As if evictions had been dropped from a full queue
+	atomic.StoreInt32(&a.invalidator.overflowed, 1)
+	a.Set("k1", "new", time.Hour)
+	waitReceived(t, b, 1)
+	if got := cached(b, "k1", "k2", "chat:1:x"); len(got) != 0 {
+		t.Fatalf("b holds %v after an overflow, want nothing", got)
+	}
+}
+
+func TestCacheInvalidationIgnoresOwnEvents(t *testing.T) {
+	a, _, _ := newInvalidatedCaches(t)
+	fill(a, "k1")
+
+	payload, _ := json.Marshal(cacheInvalidation{Node: "a", Keys: []string{"k1"}, Prefixes: []string{""}})
+	a.invalidator.receive(payload)
+	if got := cached(a, "k1"); len(got) != 1 {
+		t.Fatal("own invalidation applied")
+	}
+	a.invalidator.receive([]byte("not json"))
+	if got := cached(a, "k1"); len(got) != 1 {
+		t.Fatal("malformed invalidation applied")
+	}
+}
+
+func TestCacheInvalidationFlushesOnReconnect(t *testing.T) {
+	a, b, ps := newInvalidatedCaches(t)
+	fill(a, "k1", "chat:1:x")
+	fill(b, "k1")
+
+	// Notifications may have been lost while disconnected
+	for _, hook := range ps.hooks {
+		hook()
+	}
+	if got := cached(a, "k1", "chat:1:x"); len(got) != 0 {
+		t.Fatalf("a holds %v after a reconnect, want nothing", got)
+	}
+	if got := atomic.LoadUint64(&a.invalidator.flushes); got != 1 {
+		t.Fatalf("a counted %d flushes, want 1", got)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// clusterPublishTimeout bounds relaying one broadcast to the other
+// instances.
+const clusterPublishTimeout = 5 * time.Second
+
+// clusterEnvelope is a hub broadcast as relayed to the other instances.
+// User is set for messages addressed to one user's sessions only; Direct
+// when such a message was sent to the channel of a node the routing table
+// says hosts them. With Joined the envelope carries no message but
+// announces that User connected to Node.
+type clusterEnvelope struct {
+	Node    string  `json:"node"`
+	User    string  `json:"user,omitempty"`
+	Direct  bool    `json:"direct,omitempty"`
+	Joined  bool    `json:"joined,omitempty"`
+	Message Message `json:"message"`
+
+	fallback bool // publish on the cluster channel whatever the routing table says
+}
+
+// clusterBridge connects the hub to the other instances. Everything the
+// hub broadcasts (chat messages, changes to them, receipts, presence) is
+// published on the cluster channel by a goroutine of its own, so a slow
+// backend never stalls the hub loop; broadcasts from other nodes are
+// handed to the hub for local delivery, which picks the recipients as for
+// its own (see Client.receives).
+//
+// With a membership, messages for one user go only to the channels of
+// the nodes hosting them. Users the routing table does not know are
+// reached through the cluster channel. Nodes announce users connecting to
+// them, so the table does not wait for the next heartbeat to learn of a
+// new session, and a node sent a message for a user it no longer hosts
+// republishes it on the cluster channel (see reroute).
+type clusterBridge struct {
+	hub         *Hub
+	pubsub      PubSub
+	members     *clusterMembership // nil without a registry
+	node        string
+	channel     string
+	queue       chan clusterEnvelope
+	unsubscribe []func()
+	stop        chan struct{}
+	done        chan struct{}
+
+	published uint64 // accessed atomically
+	routed    uint64 // accessed atomically, sent to node channels
+	rerouted  uint64 // accessed atomically, routed to a node the user had left
+	failed    uint64 // accessed atomically
+	dropped   uint64 // accessed atomically, queue full
+	received  uint64 // accessed atomically
+}
+
+// defaultNodeID names this instance after its host and listening port.
+func defaultNodeID(port int) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// nodeChannel is the channel for messages routed to one node. Hashing the
+// ID keeps it within PostgreSQL's 63 byte identifier limit.
+func nodeChannel(prefix, nodeID string) string {
+	h := fnv.New64a()
+	h.Write([]byte(nodeID))
+	return fmt.Sprintf("%s_%016x", prefix, h.Sum64())
+}
+
+// newClusterBridge subscribes to the cluster channel and this node's own
+// channel. members may be nil.
+func newClusterBridge(hub *Hub, pubsub PubSub, members *clusterMembership, node string, cfg ClusterConfig) (*clusterBridge, error) {
+	b := &clusterBridge{
+		hub:     hub,
+		pubsub:  pubsub,
+		members: members,
+		node:    node,
+		channel: cfg.Channel,
+		queue:   make(chan clusterEnvelope, cfg.PublishBuffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, channel := range []string{cfg.Channel, nodeChannel(cfg.Channel, node)} {
+		unsubscribe, err := pubsub.Subscribe(channel, b.receive)
+		if err != nil {
+			b.unsubscribeAll()
+			return nil, err
+		}
+		b.unsubscribe = append(b.unsubscribe, unsubscribe)
+	}
+	go b.publishLoop()
+	return b, nil
+}
+
+func (b *clusterBridge) unsubscribeAll() {
+	for _, unsubscribe := range b.unsubscribe {
+		unsubscribe()
+	}
+}
+
+// relay queues a local broadcast for the other instances, to userID's
+// sessions only if it is set. It never blocks.
+func (b *clusterBridge) relay(userID string, msg Message) {
+	b.enqueue(clusterEnvelope{Node: b.node, User: userID, Message: msg})
+}
+
+// announce tells the other instances that userID connected here.
+func (b *clusterBridge) announce(userID string) {
+	if b.members != nil {
+		b.enqueue(clusterEnvelope{Node: b.node, User: userID, Joined: true})
+	}
+}
+
+// reroute republishes a message routed here for a user with no session on
+// this instance, the sender's routing table being stale, on the cluster
+// channel. It keeps the sender's node, which has delivered it already.
+func (b *clusterBridge) reroute(env clusterEnvelope) {
+	atomic.AddUint64(&b.rerouted, 1)
+	env.Direct, env.fallback = false, true
+	b.enqueue(env)
+}
+
+func (b *clusterBridge) enqueue(env clusterEnvelope) {
+	select {
+	case b.queue <- env:
+	default:
+		if atomic.AddUint64(&b.dropped, 1)%1000 == 1 {
+			logger.Warn("cluster publish queue full, broadcast delivered locally only",
+				"type", env.Message.Type, "chat_id", env.Message.ChatID)
+		}
+	}
+}
+
+func (b *clusterBridge) publishLoop() {
+	defer close(b.done)
+	for {
+		select {
+		case env := <-b.queue:
+			b.publish(env)
+		case <-b.stop:
+			// Relay what the hub already broadcast locally
+			for {
+				select {
+				case env := <-b.queue:
+					b.publish(env)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *clusterBridge) publish(env clusterEnvelope) {
+	channels := []string{b.channel}
+	if env.User != "" && !env.Joined && !env.fallback && b.members != nil {
+		if nodes, ok := b.members.nodesFor(env.User); ok {
+			var routed []string
+			for _, node := range nodes {
+				if node != b.node {
+					routed = append(routed, nodeChannel(b.channel, node))
+				}
+			}
+			switch {
+			case len(routed) > 0:
+				channels, env.Direct = routed, true
+				atomic.AddUint64(&b.routed, uint64(len(routed)))
+			case b.hub.hosts(env.User):
+				// Only this node hosts the user and it has delivered already
+				return
+			}
+			// Otherwise the user left this node since the table was built
+		}
+	}
+
+	payload, err := json.Marshal(env)
+	if err != nil {
+		atomic.AddUint64(&b.failed, 1)
+		logger.Warn("cluster publish failed", "type", env.Message.Type, "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterPublishTimeout)
+	defer cancel()
+	for _, channel := range channels {
+		if err := b.pubsub.Publish(ctx, channel, payload); err != nil {
+			atomic.AddUint64(&b.failed, 1)
+			logger.Warn("cluster publish failed",
+				"type", env.Message.Type, "chat_id", env.Message.ChatID, "channel", channel, "error", err)
+			continue
+		}
+		atomic.AddUint64(&b.published, 1)
+	}
+}
+
+// receive hands a broadcast from another node to the hub. The node's own
+// broadcasts come back too and are skipped, having been delivered already.
+func (b *clusterBridge) receive(payload []byte) {
+	var env clusterEnvelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		logger.Warn("invalid cluster broadcast", "error", err)
+		return
+	}
+	if env.Node == b.node {
+		return
+	}
+	atomic.AddUint64(&b.received, 1)
+	if env.Joined {
+		if b.members != nil {
+			b.members.joined(env.User, env.Node)
+		}
+		return
+	}
+	b.hub.remote <- env
+}
+
+func (b *clusterBridge) stats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"node_id":        b.node,
+		"queue":          len(b.queue),
+		"queue_capacity": cap(b.queue),
+		"published":      atomic.LoadUint64(&b.published),
+		"routed":         atomic.LoadUint64(&b.routed),
+		"rerouted":       atomic.LoadUint64(&b.rerouted),
+		"publish_failed": atomic.LoadUint64(&b.failed),
+		"dropped":        atomic.LoadUint64(&b.dropped),
+		"received":       atomic.LoadUint64(&b.received),
+	}
+	if b.members != nil {
+		stats["nodes"] = b.members.stats()
+	}
+	if s, ok := b.pubsub.(interface{ Stats() map[string]interface{} }); ok {
+		stats["pubsub"] = s.Stats()
+	}
+	return stats
+}
+
+// Close stops receiving, relays the broadcasts still queued, leaves the
+// registry and closes the PubSub.
+func (b *clusterBridge) Close(ctx context.Context) error {
+	b.unsubscribeAll()
+	close(b.stop)
+	<-b.done
+	if b.members != nil {
+		if err := b.members.Close(ctx); err != nil {
+			logger.Warn("leaving cluster registry failed", "node_id", b.node, "error", err)
+		}
+	}
+	return b.pubsub.Close()
+}
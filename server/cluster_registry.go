@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClusterNode is a server instance as recorded in the cluster registry.
+type ClusterNode struct {
+	ID          string    `json:"id"`
+	Address     string    `json:"address"`
+	Users       []string  `json:"users"`
+	StartedAt   time.Time `json:"startedAt"`
+	HeartbeatAt time.Time `json:"heartbeatAt"`
+}
+
+// ClusterRegistry records which instances are alive and which users are
+// connected to each. Liveness is judged by the registry's clock, so
+// instances need not agree on the time.
+type ClusterRegistry interface {
+	// Heartbeat records node as alive now, replacing its address and users.
+	Heartbeat(ctx context.Context, node ClusterNode) error
+	// Nodes lists the nodes that sent a heartbeat within ttl.
+	Nodes(ctx context.Context, ttl time.Duration) ([]ClusterNode, error)
+	// Leave removes a node that is shutting down.
+	Leave(ctx context.Context, nodeID string) error
+	// Expire removes the nodes without a heartbeat within ttl and returns
+	// how many there were.
+	Expire(ctx context.Context, ttl time.Duration) (int, error)
+}
+
+// MemoryClusterRegistry is an in-process ClusterRegistry for tests.
+type MemoryClusterRegistry struct {
+	mu    sync.Mutex
+	nodes map[string]ClusterNode
+}
+
+func NewMemoryClusterRegistry() *MemoryClusterRegistry {
+	return &MemoryClusterRegistry{nodes: make(map[string]ClusterNode)}
+}
+
+func (r *MemoryClusterRegistry) Heartbeat(ctx context.Context, node ClusterNode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	node.Users = append([]string(nil), node.Users...)
+	node.HeartbeatAt = time.Now().UTC()
+	r.nodes[node.ID] = node
+	return nil
+}
+
+func (r *MemoryClusterRegistry) Nodes(ctx context.Context, ttl time.Duration) ([]ClusterNode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := time.Now().Add(-ttl)
+	var nodes []ClusterNode
+	for _, node := range r.nodes {
+		if node.HeartbeatAt.After(cutoff) {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+func (r *MemoryClusterRegistry) Leave(ctx context.Context, nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.nodes, nodeID)
+	return nil
+}
+
+func (r *MemoryClusterRegistry) Expire(ctx context.Context, ttl time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := time.Now().Add(-ttl)
+	expired := 0
+	for id, node := range r.nodes {
+		if !node.HeartbeatAt.After(cutoff) {
+			delete(r.nodes, id)
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// clusterMembership heartbeats this instance into the registry with the
+// users connected to its hub, expires nodes that stopped doing so, and
+// keeps a routing table of which nodes host each user. The table is
+// rebuilt after every heartbeat, so on its own it lags connections by up
+// to one heartbeat interval; sessions other nodes announce are added as
+// they arrive and kept across rebuilds until the announcing node must have
+// heartbeated them into the registry.
+type clusterMembership struct {
+	registry ClusterRegistry
+	self     ClusterNode
+	users    func() []string
+	interval time.Duration
+	ttl      time.Duration
+
+	mu        sync.RWMutex
+	nodes     []ClusterNode
+	routes    map[string][]string             // user ID -> IDs of the nodes hosting them
+	announced map[string]map[string]time.Time // user ID -> node ID -> when it announced them
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newClusterMembership(registry ClusterRegistry, self ClusterNode, users func() []string, cfg ClusterConfig) *clusterMembership {
+	return &clusterMembership{
+		registry:  registry,
+		self:      self,
+		users:     users,
+		interval:  cfg.HeartbeatInterval.Std(),
+		ttl:       cfg.NodeTTL.Std(),
+		routes:    make(map[string][]string),
+		announced: make(map[string]map[string]time.Time),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// start sends the first heartbeat, so the node is routable before it
+// accepts connections, then keeps heartbeating in the background.
+func (m *clusterMembership) start(ctx context.Context) error {
+	if err := m.heartbeat(ctx); err != nil {
+		return err
+	}
+	go m.loop()
+	return nil
+}
+
+func (m *clusterMembership) loop() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+			if err := m.heartbeat(ctx); err != nil {
+				logger.Warn("cluster heartbeat failed", "node_id", m.self.ID, "error", err)
+			}
+			cancel()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// heartbeat records this node, expires stale ones and rebuilds the
+// routing table from the nodes still alive.
+func (m *clusterMembership) heartbeat(ctx context.Context) error {
+	node := m.self
+	node.Users = m.users()
+	if err := m.registry.Heartbeat(ctx, node); err != nil {
+		return err
+	}
+	if expired, err := m.registry.Expire(ctx, m.ttl); err != nil {
+		logger.Warn("expiring cluster nodes failed", "error", err)
+	} else if expired > 0 {
+		logger.Info("expired stale cluster nodes", "count", expired)
+	}
+
+	nodes, err := m.registry.Nodes(ctx, m.ttl)
+	if err != nil {
+		return err
+	}
+	routes := make(map[string][]string)
+	for _, n := range nodes {
+		for _, userID := range n.Users {
+			routes[userID] = append(routes[userID], n.ID)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().Add(-m.ttl)
+	for userID, byNode := range m.announced {
+		for nodeID, at := range byNode {
+			if at.Before(cutoff) {
+				delete(byNode, nodeID)
+			} else {
+				routes[userID] = addRoute(routes[userID], nodeID)
+			}
+		}
+		if len(byNode) == 0 {
+			delete(m.announced, userID)
+		}
+	}
+	m.nodes, m.routes = nodes, routes
+	return nil
+}
+
+// joined records that nodeID announced a session of userID.
+func (m *clusterMembership) joined(userID, nodeID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.announced[userID] == nil {
+		m.announced[userID] = make(map[string]time.Time)
+	}
+	m.announced[userID][nodeID] = time.Now()
+	m.routes[userID] = addRoute(m.routes[userID], nodeID)
+}
+
+func addRoute(nodes []string, nodeID string) []string {
+	for _, n := range nodes {
+		if n == nodeID {
+			return nodes
+		}
+	}
+	return append(nodes, nodeID)
+}
+
+// nodesFor returns the nodes hosting userID, this one included, and false
+// when the routing table does not know the user.
+func (m *clusterMembership) nodesFor(userID string) ([]string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes, ok := m.routes[userID]
+	return nodes, ok
+}
+
+func (m *clusterMembership) stats() []map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]map[string]interface{}, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		nodes = append(nodes, map[string]interface{}{
+			"id":           n.ID,
+			"address":      n.Address,
+			"users":        len(n.Users),
+			"started_at":   n.StartedAt,
+			"heartbeat_at": n.HeartbeatAt,
+		})
+	}
+	return nodes
+}
+
+// Close stops heartbeating and removes this node from the registry.
+func (m *clusterMembership) Close(ctx context.Context) error {
+	close(m.stop)
+	<-m.done
+	return m.registry.Leave(ctx, m.self.ID)
+}
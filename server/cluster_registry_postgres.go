@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// registryNow is the database clock in UTC, which all instances share.
+const registryNow = `(now() AT TIME ZONE 'UTC')`
+
+// PostgresClusterRegistry keeps the cluster registry in the cluster_nodes
+// table, one row per instance with its users in an array.
+type PostgresClusterRegistry struct {
+	pool *UltraDBPool
+}
+
+func NewPostgresClusterRegistry(pool *UltraDBPool) *PostgresClusterRegistry {
+	return &PostgresClusterRegistry{pool: pool}
+}
+
+func (r *PostgresClusterRegistry) withConn(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := r.pool.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.pool.ReturnConnection(conn)
+	return fn(conn)
+}
+
+func (r *PostgresClusterRegistry) Heartbeat(ctx context.Context, node ClusterNode) error {
+	users := node.Users
+	if users == nil {
+		users = []string{}
+	}
+	return r.pool.retryWrite(ctx, func() error {
+		return r.withConn(ctx, func(conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, `
+				INSERT INTO cluster_nodes (id, address, users, started_at, heartbeat_at)
+				VALUES ($1, $2, $3, $4, `+registryNow+`)
+				ON CONFLICT (id) DO UPDATE SET
+					address = EXCLUDED.address,
+					users = EXCLUDED.users,
+					started_at = EXCLUDED.started_at,
+					heartbeat_at = EXCLUDED.heartbeat_at`,
+				node.ID, node.Address, pq.Array(users), node.StartedAt.UTC())
+			return err
+		})
+	})
+}
+
+// Nodes reads from the primary: a replica could miss recent heartbeats
+// and report live nodes as gone.
+func (r *PostgresClusterRegistry) Nodes(ctx context.Context, ttl time.Duration) ([]ClusterNode, error) {
+	var nodes []ClusterNode
+	err := r.withConn(ctx, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `
+			SELECT id, address, users, started_at, heartbeat_at
+			FROM cluster_nodes
+			WHERE heartbeat_at > `+registryNow+` - make_interval(secs => $1)
+			ORDER BY id`, ttl.Seconds())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var n ClusterNode
+			if err := rows.Scan(&n.ID, &n.Address, pq.Array(&n.Users), &n.StartedAt, &n.HeartbeatAt); err != nil {
+				return err
+			}
+			nodes = append(nodes, n)
+		}
+		return rows.Err()
+	})
+	return nodes, err
+}
+
+func (r *PostgresClusterRegistry) Leave(ctx context.Context, nodeID string) error {
+	return r.withConn(ctx, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, `DELETE FROM cluster_nodes WHERE id = $1`, nodeID)
+		return err
+	})
+}
+
+func (r *PostgresClusterRegistry) Expire(ctx context.Context, ttl time.Duration) (int, error) {
+	var expired int64
+	err := r.withConn(ctx, func(conn *sql.Conn) error {
+		res, err := conn.ExecContext(ctx, `
+			DELETE FROM cluster_nodes
+			WHERE heartbeat_at <= `+registryNow+` - make_interval(secs => $1)`, ttl.Seconds())
+		if err != nil {
+			return err
+		}
+		expired, err = res.RowsAffected()
+		return err
+	})
+	return int(expired), err
+}
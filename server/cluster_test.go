@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testClusterConfig(interval, ttl time.Duration) ClusterConfig {
+	return ClusterConfig{
+		Channel:           "test",
+		PublishBuffer:     64,
+		HeartbeatInterval: Duration(interval),
+		NodeTTL:           Duration(ttl),
+	}
+}
+
+func TestClusterMembershipRoutesAndExpires(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	ctx := context.Background()
+	registry := NewMemoryClusterRegistry()
+	cfg := testClusterConfig(10*time.Millisecond, ttl)
+
+	a := newClusterMembership(registry, ClusterNode{ID: "a"}, func() []string { return []string{"u1"} }, cfg)
+	b := newClusterMembership(registry, ClusterNode{ID: "b"}, func() []string { return []string{"u1", "u2"} }, cfg)
+	for _, m := range []*clusterMembership{a, b, a} {
+		if err := m.heartbeat(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if nodes, _ := a.nodesFor("u1"); !reflect.DeepEqual(nodes, []string{"a", "b"}) {
+		t.Fatalf("u1 routed to %v, want [a b]", nodes)
+	}
+	if nodes, _ := a.nodesFor("u2"); !reflect.DeepEqual(nodes, []string{"b"}) {
+		t.Fatalf("u2 routed to %v, want [b]", nodes)
+	}
+	if _, ok := a.nodesFor("u3"); ok {
+		t.Fatal("unknown user has a route")
+	}
+
+	// An announced session is routed before the next heartbeat and kept
+	// across it
+	a.joined("u3", "c")
+	if err := a.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, _ := a.nodesFor("u3"); !reflect.DeepEqual(nodes, []string{"c"}) {
+		t.Fatalf("announced u3 routed to %v, want [c]", nodes)
+	}
+
+	// b stops heartbeating and expires; the announcement runs out too
+	time.Sleep(ttl + 50*time.Millisecond)
+	if err := a.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.nodesFor("u2"); ok {
+		t.Fatal("user of an expired node still routed")
+	}
+	if _, ok := a.nodesFor("u3"); ok {
+		t.Fatal("announcement outlived the node TTL")
+	}
+	nodes, err := registry.Nodes(ctx, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != "a" {
+		t.Fatalf("registry lists %v, want only a", nodes)
+	}
+}
+
+type testClusterNode struct {
+	id      string
+	hub     *Hub
+	bridge  *clusterBridge
+	members *clusterMembership
+}
+
+// newTestCluster starts n hubs sharing a registry and a MemoryPubSub. The
+// heartbeat interval is long, so routing tables only change through
+// heartbeatAll and announcements.
+func newTestCluster(t *testing.T, n int) []*testClusterNode {
+	t.Helper()
+	registry := NewMemoryClusterRegistry()
+	pubsub := NewMemoryPubSub()
+	cfg := testClusterConfig(time.Hour, 2*time.Hour)
+
+	nodes := make([]*testClusterNode, n)
+	for i := range nodes {
+		id := fmt.Sprintf("node-%d", i)
+		hub := newHub(WebSocketConfig{BroadcastBuffer: 64})
+		members := newClusterMembership(registry, ClusterNode{ID: id}, hub.UserIDs, cfg)
+		if err := members.start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		bridge, err := newClusterBridge(hub, pubsub, members, id, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub.cluster = bridge
+		go hub.run()
+		t.Cleanup(func() { bridge.Close(context.Background()) })
+		nodes[i] = &testClusterNode{id: id, hub: hub, bridge: bridge, members: members}
+	}
+	return nodes
+}
+
+func heartbeatAll(t *testing.T, nodes []*testClusterNode) {
+	t.Helper()
+	// Twice, so every table is rebuilt after every node heartbeated
+	for round := 0; round < 2; round++ {
+		for _, n := range nodes {
+			if err := n.members.heartbeat(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// connect registers a session of userID through the hub loop, which
+// announces it to the cluster.
+func (n *testClusterNode) connect(t *testing.T, userID string) *Client {
+	t.Helper()
+	c := &Client{ID: userID + "@" + n.id, UserID: userID, Send: make(chan Message, 16), chats: make(map[string]struct{}), log: logger}
+	n.hub.register <- c
+	expectMessage(t, c) // welcome
+	return c
+}
+
+// attach adds a session of userID without announcing it, as if the
+// announcement was lost.
+func (n *testClusterNode) attach(userID string) *Client {
+	c := &Client{ID: userID + "@" + n.id, UserID: userID, Send: make(chan Message, 16), chats: make(map[string]struct{}), log: logger}
+	n.hub.mutex.Lock()
+	n.hub.clients[c] = true
+	n.hub.mutex.Unlock()
+	return c
+}
+
+func expectMessage(t *testing.T, c *Client) Message {
+	t.Helper()
+	select {
+	case msg := <-c.Send:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s received nothing", c.ID)
+		return Message{}
+	}
+}
+
+func expectNoMessage(t *testing.T, c *Client) {
+	t.Helper()
+	select {
+	case msg := <-c.Send:
+		t.Fatalf("%s received unexpected %s %q", c.ID, msg.Type, msg.Content)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClusterRoutesToNodesHostingUser(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	target := b.connect(t, "u")
+	other := c.connect(t, "v")
+	heartbeatAll(t, nodes)
+
+	a.hub.SendToUser("u", Message{Type: TypeSystem, Content: "hello"})
+	if msg := expectMessage(t, target); msg.Content != "hello" {
+		t.Fatalf("u received %q", msg.Content)
+	}
+	expectNoMessage(t, other)
+	if routed := atomic.LoadUint64(&a.bridge.routed); routed != 1 {
+		t.Fatalf("routed to %d node channels, want 1", routed)
+	}
+}
+
+func TestClusterReroutesWhenUserMoved(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	old := b.connect(t, "u")
+	heartbeatAll(t, nodes)
+
+	// u moves to c and a's table still says b
+	b.hub.unregister <- old
+	moved := c.attach("u")
+
+	a.hub.SendToUser("u", Message{Type: TypeSystem, Content: "hello"})
+	if msg := expectMessage(t, moved); msg.Content != "hello" {
+		t.Fatalf("u received %q", msg.Content)
+	}
+	if rerouted := atomic.LoadUint64(&b.bridge.rerouted); rerouted != 1 {
+		t.Fatalf("b rerouted %d messages, want 1", rerouted)
+	}
+}
+
+func TestClusterRoutesToAnnouncedSessions(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	first := b.connect(t, "u")
+	heartbeatAll(t, nodes)
+
+	// A second session on c is known to a before any heartbeat
+	second := c.connect(t, "u")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if routes, _ := a.members.nodesFor("u"); len(routes) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("announcement of the session on c never reached a")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	a.hub.SendToUser("u", Message{Type: TypeSystem, Content: "hello"})
+	for _, session := range []*Client{first, second} {
+		if msg := expectMessage(t, session); msg.Content != "hello" {
+			t.Fatalf("%s received %q", session.ID, msg.Content)
+		}
+	}
+}
+
+func TestClusterSendsNothingForLocalOnlyUser(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	a, b := nodes[0], nodes[1]
+	a.connect(t, "u")
+	heartbeatAll(t, nodes)
+	// Let the announcement of u settle before counting
+	time.Sleep(50 * time.Millisecond)
+	before := atomic.LoadUint64(&b.bridge.received)
+
+	a.hub.SendToUser("u", Message{Type: TypeSystem, Content: "hello"})
+	time.Sleep(50 * time.Millisecond)
+	if received := atomic.LoadUint64(&b.bridge.received) - before; received != 0 {
+		t.Fatalf("b received %d envelopes for a user only a hosts", received)
+	}
+}
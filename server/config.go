@@ -0,0 +1,675 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration. Values come from the
+// built-in defaults, then an optional YAML or JSON file, then environment
+// variables, in that order of precedence.
+type Config struct {
+	Server       ServerConfig       `json:"server" yaml:"server"`
+	WebSocket    WebSocketConfig    `json:"websocket" yaml:"websocket"`
+	Processor    ProcessorConfig    `json:"processor" yaml:"processor"`
+	Messages     MessagesConfig     `json:"messages" yaml:"messages"`
+	Files        FilesConfig        `json:"files" yaml:"files"`
+	History      HistoryConfig      `json:"history" yaml:"history"`
+	Cache        CacheConfig        `json:"cache" yaml:"cache"`
+	Database     DatabaseConfig     `json:"database" yaml:"database"`
+	Cluster      ClusterConfig      `json:"cluster" yaml:"cluster"`
+	LoadBalancer LoadBalancerConfig `json:"loadBalancer" yaml:"loadBalancer"`
+	Log          LogConfig          `json:"log" yaml:"log"`
+	Admin        AdminConfig        `json:"admin" yaml:"admin"`
+}
+
+type ServerConfig struct {
+	Host             string    `json:"host" yaml:"host"`
+	Port             int       `json:"port" yaml:"port"`
+	DrainGracePeriod Duration  `json:"drainGracePeriod" yaml:"drainGracePeriod"`
+	ShutdownTimeout  Duration  `json:"shutdownTimeout" yaml:"shutdownTimeout"`
+	TLS              TLSConfig `json:"tls" yaml:"tls"`
+}
+
+// TLSConfig enables native TLS on the listener. ClientAuth is one of "none",
+// "request", "verify_if_given" or "require"; the latter enables mutual TLS
+// against ClientCAFile.
+type TLSConfig struct {
+	Enabled        bool     `json:"enabled" yaml:"enabled"`
+	CertFile       string   `json:"certFile" yaml:"certFile"`
+	KeyFile        string   `json:"keyFile" yaml:"keyFile"`
+	MinVersion     string   `json:"minVersion" yaml:"minVersion"`
+	CipherSuites   []string `json:"cipherSuites" yaml:"cipherSuites"`
+	ClientCAFile   string   `json:"clientCaFile" yaml:"clientCaFile"`
+	ClientAuth     string   `json:"clientAuth" yaml:"clientAuth"`
+	ReloadInterval Duration `json:"reloadInterval" yaml:"reloadInterval"`
+}
+
+type WebSocketConfig struct {
+	ReadBufferSize    int      `json:"readBufferSize" yaml:"readBufferSize"`
+	WriteBufferSize   int      `json:"writeBufferSize" yaml:"writeBufferSize"`
+	EnableCompression bool     `json:"enableCompression" yaml:"enableCompression"`
+	ReadLimit         int64    `json:"readLimit" yaml:"readLimit"`
+	PingPeriod        Duration `json:"pingPeriod" yaml:"pingPeriod"`
+	PongWait          Duration `json:"pongWait" yaml:"pongWait"`
+	WriteWait         Duration `json:"writeWait" yaml:"writeWait"`
+	SendQueueSize     int      `json:"sendQueueSize" yaml:"sendQueueSize"`
+	BroadcastBuffer   int      `json:"broadcastBuffer" yaml:"broadcastBuffer"`
+}
+
+type ProcessorConfig struct {
+	BatchSize     int              `json:"batchSize" yaml:"batchSize"`
+	QueueSize     int              `json:"queueSize" yaml:"queueSize"`
+	WorkersPerCPU int              `json:"workersPerCpu" yaml:"workersPerCpu"`
+	SubmitTimeout Duration         `json:"submitTimeout" yaml:"submitTimeout"`
+	Retry         RetryConfig      `json:"retry" yaml:"retry"`
+	DeadLetter    DeadLetterConfig `json:"deadLetter" yaml:"deadLetter"`
+	WAL           WALConfig        `json:"wal" yaml:"wal"`
+}
+
+// RetryConfig is the exponential backoff applied to retryable stages.
+type RetryConfig struct {
+	MaxAttempts    int      `json:"maxAttempts" yaml:"maxAttempts"`
+	InitialBackoff Duration `json:"initialBackoff" yaml:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff" yaml:"maxBackoff"`
+	Multiplier     float64  `json:"multiplier" yaml:"multiplier"`
+}
+
+// DeadLetterConfig selects where failed messages are kept: "file" (an
+// append-only file at Path) or "postgres" (the dead_letters table).
+type DeadLetterConfig struct {
+	Backend string `json:"backend" yaml:"backend"`
+	Path    string `json:"path" yaml:"path"`
+}
+
+// WALConfig controls the write-ahead log that makes accepted messages
+// survive a crash. FsyncPolicy is "batch" (sync every group commit before
+// acknowledging), "interval" (sync every FsyncInterval) or "never".
+type WALConfig struct {
+	Enabled          bool     `json:"enabled" yaml:"enabled"`
+	Dir              string   `json:"dir" yaml:"dir"`
+	SegmentSize      int64    `json:"segmentSize" yaml:"segmentSize"`
+	FsyncPolicy      string   `json:"fsyncPolicy" yaml:"fsyncPolicy"`
+	FsyncInterval    Duration `json:"fsyncInterval" yaml:"fsyncInterval"`
+	TruncateInterval Duration `json:"truncateInterval" yaml:"truncateInterval"`
+}
+
+// MessagesConfig bounds how long after sending a message its sender may
+// still edit it or delete it for everyone.
+type MessagesConfig struct {
+	EditWindow   Duration `json:"editWindow" yaml:"editWindow"`
+	DeleteWindow Duration `json:"deleteWindow" yaml:"deleteWindow"`
+}
+
+// FilesConfig controls chunked uploads over the WebSocket connection and
+// the blob store behind /files. ChunkSize is the largest chunk a client may
+// send in one frame; the connection read limit is raised to fit it.
+//
+// Download links are signed with URLSecret and expire after URLTTL. Nodes
+// of a cluster share the secret so links work on any of them; without one
+// a random key is used and links last until the node restarts.
+type FilesConfig struct {
+	Dir         string   `json:"dir" yaml:"dir"`
+	MaxFileSize int64    `json:"maxFileSize" yaml:"maxFileSize"`
+	ChunkSize   int      `json:"chunkSize" yaml:"chunkSize"`
+	UploadTTL   Duration `json:"uploadTtl" yaml:"uploadTtl"`
+	URLSecret   string   `json:"urlSecret" yaml:"urlSecret"`
+	URLTTL      Duration `json:"urlTtl" yaml:"urlTtl"`
+}
+
+// HistoryConfig controls chat history pages. The newest HotWindowSize
+// messages of active chats are kept in the cache so opening a chat does not
+// hit the database.
+//
+// Token is the bearer token GET /history requires. The endpoint acts for
+// whichever userId it is given, so only a backend that authenticated the
+// user should hold it; without a token the endpoint is disabled.
+// WebSocket clients use history frames instead.
+type HistoryConfig struct {
+	DefaultLimit  int      `json:"defaultLimit" yaml:"defaultLimit"`
+	MaxLimit      int      `json:"maxLimit" yaml:"maxLimit"`
+	HotWindowSize int      `json:"hotWindowSize" yaml:"hotWindowSize"`
+	HotWindowTTL  Duration `json:"hotWindowTtl" yaml:"hotWindowTtl"`
+	MembershipTTL Duration `json:"membershipTtl" yaml:"membershipTtl"`
+	Token         string   `json:"token" yaml:"token"`
+}
+
+type CacheConfig struct {
+	MaxMemoryMB int `json:"maxMemoryMb" yaml:"maxMemoryMb"`
+}
+
+// DatabaseConfig sizes the connection pool. Connections idle for longer
+// than ConnMaxIdleTime are closed; acquiring a connection fails after
+// AcquireTimeout instead of queueing without bound. With AutoMigrate,
+// which is off by default so instances do not all run DDL, the server
+// applies pending schema migrations on start; otherwise run the migrate
+// command first. Read-only queries go to Replicas that lag the
+// primary by at most MaxReplicaLag, and to the primary when none does.
+// Idempotent writes are attempted up to WriteAttempts times when the
+// connection fails.
+type DatabaseConfig struct {
+	URL                 string   `json:"url" yaml:"url"`
+	Replicas            []string `json:"replicas" yaml:"replicas"`
+	MaxReplicaLag       Duration `json:"maxReplicaLag" yaml:"maxReplicaLag"`
+	WriteAttempts       int      `json:"writeAttempts" yaml:"writeAttempts"`
+	AutoMigrate         bool     `json:"autoMigrate" yaml:"autoMigrate"`
+	MaxConns            int      `json:"maxConns" yaml:"maxConns"`
+	MaxIdleConns        int      `json:"maxIdleConns" yaml:"maxIdleConns"`
+	ConnMaxLifetime     Duration `json:"connMaxLifetime" yaml:"connMaxLifetime"`
+	ConnMaxIdleTime     Duration `json:"connMaxIdleTime" yaml:"connMaxIdleTime"`
+	AcquireTimeout      Duration `json:"acquireTimeout" yaml:"acquireTimeout"`
+	HealthCheckInterval Duration `json:"healthCheckInterval" yaml:"healthCheckInterval"`
+}
+
+// ClusterConfig relays broadcasts between instances so clients connected
+// to different servers reach each other, and keeps their caches coherent.
+// Backend is "none" for a single instance or "postgres" for LISTEN/NOTIFY
+// and a node registry on database.url. NodeID must be unique in the
+// cluster; it and Address, the address other instances and the load
+// balancer reach this one on, default to the host name and port. Each
+// node heartbeats every HeartbeatInterval and is dropped after NodeTTL
+// without one. When more than PublishBuffer broadcasts wait to be
+// relayed, further ones only reach local clients.
+type ClusterConfig struct {
+	Backend           string   `json:"backend" yaml:"backend"`
+	NodeID            string   `json:"nodeId" yaml:"nodeId"`
+	Address           string   `json:"address" yaml:"address"`
+	Channel           string   `json:"channel" yaml:"channel"`
+	PublishBuffer     int      `json:"publishBuffer" yaml:"publishBuffer"`
+	HeartbeatInterval Duration `json:"heartbeatInterval" yaml:"heartbeatInterval"`
+	NodeTTL           Duration `json:"nodeTtl" yaml:"nodeTtl"`
+}
+
+type LoadBalancerConfig struct {
+	Backends          []string         `json:"backends" yaml:"backends"`
+	MaxConnsPerServer uint64           `json:"maxConnsPerServer" yaml:"maxConnsPerServer"`
+	HealthInterval    Duration         `json:"healthInterval" yaml:"healthInterval"`
+	HealthTimeout     Duration         `json:"healthTimeout" yaml:"healthTimeout"`
+	TLS               BackendTLSConfig `json:"tls" yaml:"tls"`
+}
+
+// BackendTLSConfig secures load balancer to backend links. Setting CertFile
+// and KeyFile presents a client certificate for mutual TLS.
+type BackendTLSConfig struct {
+	CAFile     string `json:"caFile" yaml:"caFile"`
+	CertFile   string `json:"certFile" yaml:"certFile"`
+	KeyFile    string `json:"keyFile" yaml:"keyFile"`
+	ServerName string `json:"serverName" yaml:"serverName"`
+	MinVersion string `json:"minVersion" yaml:"minVersion"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level" yaml:"level"`
+	Format string `json:"format" yaml:"format"`
+}
+
+type AdminConfig struct {
+	Token string `json:"token" yaml:"token"`
+}
+
+// Duration is a time.Duration written as "54s" or "10ms" in config files.
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration { return time.Duration(d) }
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// DefaultConfig returns the settings the server used before they became
+// configurable.
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Host:             "0.0.0.0",
+			Port:             8080,
+			DrainGracePeriod: Duration(10 * time.Second),
+			ShutdownTimeout:  Duration(10 * time.Second),
+			TLS: TLSConfig{
+				MinVersion:     "1.2",
+				ClientAuth:     "none",
+				ReloadInterval: Duration(time.Minute),
+			},
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:    4096,
+			WriteBufferSize:   4096,
+			EnableCompression: true,
+			ReadLimit:         8192,
+			PingPeriod:        Duration(54 * time.Second),
+			PongWait:          Duration(60 * time.Second),
+			WriteWait:         Duration(10 * time.Second),
+			SendQueueSize:     256,
+			BroadcastBuffer:   1000,
+		},
+		Processor: ProcessorConfig{
+			BatchSize:     1000,
+			QueueSize:     100000,
+			WorkersPerCPU: 8,
+			SubmitTimeout: Duration(5 * time.Second),
+			Retry: RetryConfig{
+				MaxAttempts:    5,
+				InitialBackoff: Duration(100 * time.Millisecond),
+				MaxBackoff:     Duration(5 * time.Second),
+				Multiplier:     2,
+			},
+			DeadLetter: DeadLetterConfig{
+				Backend: "file",
+				Path:    "data/dead_letters.jsonl",
+			},
+			WAL: WALConfig{
+				Dir:              "data/wal",
+				SegmentSize:      64 << 20,
+				FsyncPolicy:      FsyncBatch,
+				FsyncInterval:    Duration(100 * time.Millisecond),
+				TruncateInterval: Duration(10 * time.Second),
+			},
+		},
+		Messages: MessagesConfig{
+			EditWindow:   Duration(48 * time.Hour),
+			DeleteWindow: Duration(48 * time.Hour),
+		},
+		Files: FilesConfig{
+			Dir:         "data/files",
+			MaxFileSize: 100 << 20,
+			ChunkSize:   256 << 10,
+			UploadTTL:   Duration(24 * time.Hour),
+			URLTTL:      Duration(24 * time.Hour),
+		},
+		History: HistoryConfig{
+			DefaultLimit:  50,
+			MaxLimit:      200,
+			HotWindowSize: 100,
+			HotWindowTTL:  Duration(10 * time.Minute),
+			MembershipTTL: Duration(time.Minute),
+		},
+		Cache: CacheConfig{
+			MaxMemoryMB: 1024,
+		},
+		Database: DatabaseConfig{
+			AutoMigrate:         false,
+			MaxReplicaLag:       Duration(5 * time.Second),
+			WriteAttempts:       3,
+			MaxConns:            20,
+			MaxIdleConns:        10,
+			ConnMaxLifetime:     Duration(time.Hour),
+			ConnMaxIdleTime:     Duration(5 * time.Minute),
+			AcquireTimeout:      Duration(5 * time.Second),
+			HealthCheckInterval: Duration(30 * time.Second),
+		},
+		Cluster: ClusterConfig{
+			Backend:           "none",
+			Channel:           "ultra_broadcast",
+			PublishBuffer:     1000,
+			HeartbeatInterval: Duration(5 * time.Second),
+			NodeTTL:           Duration(15 * time.Second),
+		},
+		LoadBalancer: LoadBalancerConfig{
+			Backends: []string{
+				"http://0.0.0.0:8080",
+				"http://0.0.0.0:8081",
+				"http://0.0.0.0:8082",
+			},
+			MaxConnsPerServer: 25000,
+			HealthInterval:    Duration(5 * time.Second),
+			HealthTimeout:     Duration(5 * time.Second),
+			TLS: BackendTLSConfig{
+				MinVersion: "1.2",
+			},
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+	}
+}
+
+// LoadConfig builds the effective configuration from defaults, the file at
+// path (if any) and the environment, then validates it.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.applyEnv(os.Getenv); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+	case ".json":
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return fmt.Errorf("config %s: unsupported format, use .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// envOverride maps one environment variable onto a config field.
+type envOverride struct {
+	name  string
+	apply func(c *Config, value string) error
+}
+
+var envOverrides = []envOverride{
+	{"WS_HOST", func(c *Config, v string) error { c.Server.Host = v; return nil }},
+	{"WS_PORT", func(c *Config, v string) error { return setInt(&c.Server.Port, v) }},
+	{"WS_TLS_ENABLED", func(c *Config, v string) error { return setBool(&c.Server.TLS.Enabled, v) }},
+	{"WS_TLS_CERT_FILE", func(c *Config, v string) error { c.Server.TLS.CertFile = v; return nil }},
+	{"WS_TLS_KEY_FILE", func(c *Config, v string) error { c.Server.TLS.KeyFile = v; return nil }},
+	{"WS_TLS_CLIENT_CA_FILE", func(c *Config, v string) error { c.Server.TLS.ClientCAFile = v; return nil }},
+	{"WS_TLS_CLIENT_AUTH", func(c *Config, v string) error { c.Server.TLS.ClientAuth = v; return nil }},
+	{"WS_DRAIN_GRACE_PERIOD", func(c *Config, v string) error { return c.Server.DrainGracePeriod.UnmarshalText([]byte(v)) }},
+	{"WS_READ_BUFFER_SIZE", func(c *Config, v string) error { return setInt(&c.WebSocket.ReadBufferSize, v) }},
+	{"WS_WRITE_BUFFER_SIZE", func(c *Config, v string) error { return setInt(&c.WebSocket.WriteBufferSize, v) }},
+	{"WS_READ_LIMIT", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		c.WebSocket.ReadLimit = n
+		return err
+	}},
+	{"WS_PING_PERIOD", func(c *Config, v string) error { return c.WebSocket.PingPeriod.UnmarshalText([]byte(v)) }},
+	{"WS_PONG_WAIT", func(c *Config, v string) error { return c.WebSocket.PongWait.UnmarshalText([]byte(v)) }},
+	{"WS_SEND_QUEUE_SIZE", func(c *Config, v string) error { return setInt(&c.WebSocket.SendQueueSize, v) }},
+	{"WS_BROADCAST_BUFFER", func(c *Config, v string) error { return setInt(&c.WebSocket.BroadcastBuffer, v) }},
+	{"PROCESSOR_BATCH_SIZE", func(c *Config, v string) error { return setInt(&c.Processor.BatchSize, v) }},
+	{"PROCESSOR_SUBMIT_TIMEOUT", func(c *Config, v string) error { return c.Processor.SubmitTimeout.UnmarshalText([]byte(v)) }},
+	{"PROCESSOR_QUEUE_SIZE", func(c *Config, v string) error { return setInt(&c.Processor.QueueSize, v) }},
+	{"DEAD_LETTER_BACKEND", func(c *Config, v string) error { c.Processor.DeadLetter.Backend = v; return nil }},
+	{"DEAD_LETTER_PATH", func(c *Config, v string) error { c.Processor.DeadLetter.Path = v; return nil }},
+	{"WAL_ENABLED", func(c *Config, v string) error { return setBool(&c.Processor.WAL.Enabled, v) }},
+	{"WAL_DIR", func(c *Config, v string) error { c.Processor.WAL.Dir = v; return nil }},
+	{"WAL_FSYNC_POLICY", func(c *Config, v string) error { c.Processor.WAL.FsyncPolicy = v; return nil }},
+	{"PROCESSOR_WORKERS_PER_CPU", func(c *Config, v string) error { return setInt(&c.Processor.WorkersPerCPU, v) }},
+	{"MESSAGE_EDIT_WINDOW", func(c *Config, v string) error { return c.Messages.EditWindow.UnmarshalText([]byte(v)) }},
+	{"MESSAGE_DELETE_WINDOW", func(c *Config, v string) error { return c.Messages.DeleteWindow.UnmarshalText([]byte(v)) }},
+	{"FILES_DIR", func(c *Config, v string) error { c.Files.Dir = v; return nil }},
+	{"FILES_MAX_FILE_SIZE", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		c.Files.MaxFileSize = n
+		return err
+	}},
+	{"FILES_CHUNK_SIZE", func(c *Config, v string) error { return setInt(&c.Files.ChunkSize, v) }},
+	{"FILES_URL_SECRET", func(c *Config, v string) error { c.Files.URLSecret = v; return nil }},
+	{"HISTORY_MAX_LIMIT", func(c *Config, v string) error { return setInt(&c.History.MaxLimit, v) }},
+	{"HISTORY_HOT_WINDOW_SIZE", func(c *Config, v string) error { return setInt(&c.History.HotWindowSize, v) }},
+	{"HISTORY_TOKEN", func(c *Config, v string) error { c.History.Token = v; return nil }},
+	{"CACHE_MAX_MEMORY_MB", func(c *Config, v string) error { return setInt(&c.Cache.MaxMemoryMB, v) }},
+	{"DATABASE_URL", func(c *Config, v string) error { c.Database.URL = v; return nil }},
+	{"DB_REPLICAS", func(c *Config, v string) error { c.Database.Replicas = splitList(v); return nil }},
+	{"DB_MAX_REPLICA_LAG", func(c *Config, v string) error { return c.Database.MaxReplicaLag.UnmarshalText([]byte(v)) }},
+	{"DB_AUTO_MIGRATE", func(c *Config, v string) error { return setBool(&c.Database.AutoMigrate, v) }},
+	{"DB_MAX_CONNS", func(c *Config, v string) error { return setInt(&c.Database.MaxConns, v) }},
+	{"DB_MAX_IDLE_CONNS", func(c *Config, v string) error { return setInt(&c.Database.MaxIdleConns, v) }},
+	{"DB_ACQUIRE_TIMEOUT", func(c *Config, v string) error { return c.Database.AcquireTimeout.UnmarshalText([]byte(v)) }},
+	{"CLUSTER_BACKEND", func(c *Config, v string) error { c.Cluster.Backend = v; return nil }},
+	{"CLUSTER_NODE_ID", func(c *Config, v string) error { c.Cluster.NodeID = v; return nil }},
+	{"CLUSTER_ADDRESS", func(c *Config, v string) error { c.Cluster.Address = v; return nil }},
+	{"LB_BACKENDS", func(c *Config, v string) error { c.LoadBalancer.Backends = splitList(v); return nil }},
+	{"LOG_LEVEL", func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"LOG_FORMAT", func(c *Config, v string) error { c.Log.Format = v; return nil }},
+	{"ADMIN_TOKEN", func(c *Config, v string) error { c.Admin.Token = v; return nil }},
+}
+
+func (c *Config) applyEnv(getenv func(string) string) error {
+	for _, o := range envOverrides {
+		value := getenv(o.name)
+		if value == "" {
+			continue
+		}
+		if err := o.apply(c, value); err != nil {
+			return fmt.Errorf("env %s=%q: %w", o.name, value, err)
+		}
+	}
+	return nil
+}
+
+func setInt(dst *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+func setBool(dst *bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port %d out of range", c.Server.Port)
+	check(c.Server.DrainGracePeriod >= 0, "server.drainGracePeriod must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+
+	if t := c.Server.TLS; t.Enabled {
+		check(t.CertFile != "" && t.KeyFile != "", "server.tls.certFile and keyFile are required when TLS is enabled")
+		check(t.ReloadInterval > 0, "server.tls.reloadInterval must be positive")
+		_, err := parseTLSVersion(t.MinVersion)
+		check(err == nil, "server.tls.minVersion: %v", err)
+		_, err = parseCipherSuites(t.CipherSuites)
+		check(err == nil, "server.tls.cipherSuites: %v", err)
+		auth, err := parseClientAuth(t.ClientAuth)
+		check(err == nil, "server.tls.clientAuth: %v", err)
+		check(auth < tls.VerifyClientCertIfGiven || t.ClientCAFile != "",
+			"server.tls.clientCaFile is required when client certificates are verified")
+	}
+
+	ws := c.WebSocket
+	check(ws.ReadBufferSize > 0, "websocket.readBufferSize must be positive")
+	check(ws.WriteBufferSize > 0, "websocket.writeBufferSize must be positive")
+	check(ws.ReadLimit > 0, "websocket.readLimit must be positive")
+	check(ws.PingPeriod > 0, "websocket.pingPeriod must be positive")
+	check(ws.PongWait > ws.PingPeriod, "websocket.pongWait (%s) must exceed pingPeriod (%s)",
+		ws.PongWait.Std(), ws.PingPeriod.Std())
+	check(ws.WriteWait > 0, "websocket.writeWait must be positive")
+	check(ws.SendQueueSize > 0, "websocket.sendQueueSize must be positive")
+	check(ws.BroadcastBuffer > 0, "websocket.broadcastBuffer must be positive")
+
+	p := c.Processor
+	check(p.BatchSize > 0, "processor.batchSize must be positive")
+	check(p.QueueSize > 0, "processor.queueSize must be positive")
+	check(p.WorkersPerCPU > 0, "processor.workersPerCpu must be positive")
+	check(p.SubmitTimeout > 0, "processor.submitTimeout must be positive")
+	check(p.Retry.MaxAttempts > 0, "processor.retry.maxAttempts must be positive")
+	check(p.Retry.InitialBackoff >= 0 && p.Retry.MaxBackoff >= p.Retry.InitialBackoff,
+		"processor.retry backoffs must satisfy 0 <= initialBackoff <= maxBackoff")
+	check(p.Retry.Multiplier >= 1, "processor.retry.multiplier must be at least 1")
+	switch p.DeadLetter.Backend {
+	case "file":
+		check(p.DeadLetter.Path != "", "processor.deadLetter.path is required for the file backend")
+	case "postgres":
+		check(c.Database.URL != "", "processor.deadLetter backend postgres needs database.url")
+	default:
+		check(false, "processor.deadLetter.backend %q must be file or postgres", p.DeadLetter.Backend)
+	}
+	if w := p.WAL; w.Enabled {
+		check(w.Dir != "", "processor.wal.dir is required when the WAL is enabled")
+		check(w.SegmentSize >= 1<<20, "processor.wal.segmentSize must be at least 1MiB")
+		check(w.FsyncPolicy == FsyncBatch || w.FsyncPolicy == FsyncInterval || w.FsyncPolicy == FsyncNever,
+			"processor.wal.fsyncPolicy %q must be batch, interval or never", w.FsyncPolicy)
+		check(w.FsyncPolicy != FsyncInterval || w.FsyncInterval > 0, "processor.wal.fsyncInterval must be positive")
+		check(w.TruncateInterval > 0, "processor.wal.truncateInterval must be positive")
+	}
+
+	check(c.Messages.EditWindow > 0, "messages.editWindow must be positive")
+	check(c.Messages.DeleteWindow > 0, "messages.deleteWindow must be positive")
+
+	check(c.Files.Dir != "", "files.dir is required")
+	check(c.Files.MaxFileSize > 0, "files.maxFileSize must be positive")
+	check(c.Files.ChunkSize > 0 && c.Files.ChunkSize <= 4<<20, "files.chunkSize must be between 1 byte and 4MiB")
+	check(c.Files.UploadTTL > 0, "files.uploadTtl must be positive")
+	check(c.Files.URLTTL > 0, "files.urlTtl must be positive")
+
+	h := c.History
+	check(h.DefaultLimit > 0 && h.DefaultLimit <= h.MaxLimit, "history.defaultLimit must be between 1 and maxLimit")
+	check(h.HotWindowSize >= 0, "history.hotWindowSize must not be negative")
+	check(h.HotWindowTTL > 0, "history.hotWindowTtl must be positive")
+	check(h.MembershipTTL > 0, "history.membershipTtl must be positive")
+
+	check(c.Cache.MaxMemoryMB > 0, "cache.maxMemoryMb must be positive")
+	db := c.Database
+	check(db.MaxConns > 0, "database.maxConns must be positive")
+	check(db.MaxIdleConns >= 0 && db.MaxIdleConns <= db.MaxConns, "database.maxIdleConns must be between 0 and maxConns")
+	check(db.ConnMaxLifetime >= 0, "database.connMaxLifetime must not be negative")
+	check(db.ConnMaxIdleTime >= 0, "database.connMaxIdleTime must not be negative")
+	check(db.AcquireTimeout > 0, "database.acquireTimeout must be positive")
+	check(db.HealthCheckInterval > 0, "database.healthCheckInterval must be positive")
+	check(db.MaxReplicaLag > 0, "database.maxReplicaLag must be positive")
+	check(db.WriteAttempts > 0, "database.writeAttempts must be positive")
+	for i, replica := range db.Replicas {
+		check(replica != "", "database.replicas[%d] must not be empty", i)
+	}
+
+	cl := c.Cluster
+	switch cl.Backend {
+	case "none":
+	case "postgres":
+		check(db.URL != "", "cluster backend postgres needs database.url")
+	default:
+		check(false, "cluster.backend %q must be none or postgres", cl.Backend)
+	}
+	// Node channels append 17 bytes (see nodeChannel), the cache channel 6
+	check(cl.Channel != "" && len(cl.Channel) <= 46, "cluster.channel must be 1 to 46 bytes")
+	check(cl.PublishBuffer > 0, "cluster.publishBuffer must be positive")
+	check(cl.HeartbeatInterval > 0, "cluster.heartbeatInterval must be positive")
+	check(cl.NodeTTL > cl.HeartbeatInterval, "cluster.nodeTtl (%s) must exceed heartbeatInterval (%s)",
+		cl.NodeTTL.Std(), cl.HeartbeatInterval.Std())
+
+	var err error
+	lb := c.LoadBalancer
+	for _, backend := range lb.Backends {
+		var u *url.URL
+		u, err = url.Parse(backend)
+		check(err == nil && u.Scheme != "" && u.Host != "", "loadBalancer.backends: invalid URL %q", backend)
+	}
+	check(lb.MaxConnsPerServer > 0, "loadBalancer.maxConnsPerServer must be positive")
+	check(lb.HealthInterval > 0, "loadBalancer.healthInterval must be positive")
+	check(lb.HealthTimeout > 0, "loadBalancer.healthTimeout must be positive")
+	check((lb.TLS.CertFile == "") == (lb.TLS.KeyFile == ""), "loadBalancer.tls.certFile and keyFile must be set together")
+	_, err = parseTLSVersion(lb.TLS.MinVersion)
+	check(err == nil, "loadBalancer.tls.minVersion: %v", err)
+
+	_, err = parseLogLevel(c.Log.Level)
+	check(err == nil, "log.level %q is not one of debug, info, warn, error", c.Log.Level)
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format %q must be json or text", c.Log.Format)
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy that is safe to print, with secrets masked.
+func (c Config) Redacted() Config {
+	if c.Admin.Token != "" {
+		c.Admin.Token = "********"
+	}
+	if c.History.Token != "" {
+		c.History.Token = "********"
+	}
+	if c.Files.URLSecret != "" {
+		c.Files.URLSecret = "********"
+	}
+	c.Database.URL = redactURL(c.Database.URL)
+	if len(c.Database.Replicas) > 0 {
+		replicas := make([]string, len(c.Database.Replicas))
+		for i, replica := range c.Database.Replicas {
+			replicas[i] = redactURL(replica)
+		}
+		c.Database.Replicas = replicas
+	}
+	return c
+}
+
+var (
+	// dsnPassword matches the password of a key=value connection string,
+	// quoted or not.
+	dsnPassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+	// queryPassword matches a password passed as a URL query parameter.
+	queryPassword = regexp.MustCompile(`(?i)((?:^|&)password=)[^&]*`)
+)
+
+// redactURL masks the password of a connection URL or key=value
+// connection string.
+func redactURL(raw string) string {
+	if !strings.Contains(raw, "://") {
+		return dsnPassword.ReplaceAllString(raw, "${1}********")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	redacted := queryPassword.ReplaceAllString(u.RawQuery, "${1}********")
+	if u.User == nil && redacted == u.RawQuery {
+		return raw
+	}
+	u.RawQuery = redacted
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), "********")
+		}
+	}
+	return u.String()
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned for unknown dead-letter IDs.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a message the pipeline gave up on, with the reason.
+type DeadLetter struct {
+	ID            string    `json:"id"`
+	Message       Message   `json:"message"`
+	Stage         string    `json:"stage"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"firstFailedAt"`
+	LastFailedAt  time.Time `json:"lastFailedAt"`
+}
+
+// DeadLetterStore persists dead-lettered messages.
+type DeadLetterStore interface {
+	Add(ctx context.Context, dl DeadLetter) error
+	List(ctx context.Context, limit int) ([]DeadLetter, error)
+	Get(ctx context.Context, id string) (DeadLetter, error)
+	Remove(ctx context.Context, ids ...string) error
+	Purge(ctx context.Context) (int, error)
+}
+
+// RetryPolicy describes exponential backoff between attempts.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter spreads each delay by up to ±Jitter of itself.
+	Jitter float64
+}
+
+func newRetryPolicy(cfg RetryConfig) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: cfg.InitialBackoff.Std(),
+		MaxBackoff:     cfg.MaxBackoff.Std(),
+		Multiplier:     cfg.Multiplier,
+		Jitter:         0.2,
+	}
+}
+
+// Backoff returns the delay before the given attempt (attempt 2 is the
+// first retry).
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt <= 1 || p.InitialBackoff <= 0 {
+		return 0
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-2))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*mathrand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// DeadLetterQueue receives failed messages from the pipeline and lets
+// operators inspect, replay or purge them.
+type DeadLetterQueue struct {
+	store     DeadLetterStore
+	processor *UltraMessageProcessor
+}
+
+func NewDeadLetterQueue(store DeadLetterStore, processor *UltraMessageProcessor) *DeadLetterQueue {
+	dlq := &DeadLetterQueue{store: store, processor: processor}
+	processor.SetDeadLetterHandler(dlq.handle)
+	return dlq
+}
+
+// handle is the pipeline's DeadLetterFunc. The message is copied so later
+// pipeline activity on it cannot change the stored record. A replayed
+// message that fails again keeps the history of the record it was
+// replayed from: its first failure and the attempts made so far. The new
+// record gets a new ID, as Replay may not have removed the old one yet.
+func (q *DeadLetterQueue) handle(msg *Message, stage string, attempts int, err error) error {
+	now := time.Now()
+	dl := DeadLetter{
+		ID:            randomID(),
+		Message:       *msg,
+		Stage:         stage,
+		Error:         err.Error(),
+		Attempts:      attempts,
+		FirstFailedAt: now,
+		LastFailedAt:  now,
+	}
+	if earlier := msg.deadLetter; earlier != nil {
+		dl.Attempts += earlier.Attempts
+		dl.FirstFailedAt = earlier.FirstFailedAt
+	}
+	dl.Message.deadLetter = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if storeErr := q.store.Add(ctx, dl); storeErr != nil {
+		logger.Error("dead letter store failed",
+			"stage", stage, "chat_id", msg.ChatID, "error", err, "store_error", storeErr)
+		return storeErr
+	}
+	logger.Warn("message dead-lettered",
+		"id", dl.ID, "stage", stage, "attempts", attempts, "chat_id", msg.ChatID, "error", err)
+	return nil
+}
+
+// Replay resubmits the given dead letters to the processor and removes the
+// ones that were accepted. It returns the IDs that were replayed.
+func (q *DeadLetterQueue) Replay(ctx context.Context, ids []string) ([]string, error) {
+	replayed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		dl, err := q.store.Get(ctx, id)
+		if err != nil {
+			return replayed, fmt.Errorf("dead letter %s: %w", id, err)
+		}
+		msg := dl.Message
+		msg.deadLetter = &dl
+		if err := q.processor.Submit(ctx, &msg); err != nil {
+			return replayed, fmt.Errorf("replay %s: %w", id, err)
+		}
+		if err := q.store.Remove(ctx, id); err != nil {
+			return replayed, err
+		}
+		replayed = append(replayed, id)
+	}
+	return replayed, nil
+}
+
+// FileDeadLetterStore keeps dead letters in an append-only JSON lines file.
+// Removals and purges are appended as records too; the file is compacted
+// when it is opened.
+type FileDeadLetterStore struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]DeadLetter
+	order   []string
+}
+
+type deadLetterRecord struct {
+	Op    string      `json:"op"`
+	Entry *DeadLetter `json:"entry,omitempty"`
+	IDs   []string    `json:"ids,omitempty"`
+}
+
+func OpenFileDeadLetterStore(path string) (*FileDeadLetterStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &FileDeadLetterStore{path: path, entries: make(map[string]DeadLetter)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDeadLetterStore) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A torn final write is expected after a crash; skip it
+			logger.Warn("skipping corrupt dead letter record", "path", s.path, "line", line, "error", err)
+			continue
+		}
+		s.apply(rec)
+	}
+	return scanner.Err()
+}
+
+func (s *FileDeadLetterStore) apply(rec deadLetterRecord) {
+	switch rec.Op {
+	case "add":
+		if rec.Entry == nil {
+			return
+		}
+		if _, exists := s.entries[rec.Entry.ID]; !exists {
+			s.order = append(s.order, rec.Entry.ID)
+		}
+		s.entries[rec.Entry.ID] = *rec.Entry
+		return
+	case "remove":
+		for _, id := range rec.IDs {
+			delete(s.entries, id)
+		}
+	case "purge":
+		s.entries = make(map[string]DeadLetter)
+	}
+
+	live := s.order[:0]
+	for _, id := range s.order {
+		if _, ok := s.entries[id]; ok {
+			live = append(live, id)
+		}
+	}
+	s.order = live
+}
+
+// compact rewrites the file with only the live entries and opens it for
+// appending.
+func (s *FileDeadLetterStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, id := range s.order {
+		entry := s.entries[id]
+		if err := enc.Encode(deadLetterRecord{Op: "add", Entry: &entry}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	return err
+}
+
+func (s *FileDeadLetterStore) append(rec deadLetterRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileDeadLetterStore) Add(ctx context.Context, dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := deadLetterRecord{Op: "add", Entry: &dl}
+	if err := s.append(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	return nil
+}
+
+func (s *FileDeadLetterStore) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit <= 0 || limit > len(s.order) {
+		limit = len(s.order)
+	}
+	list := make([]DeadLetter, 0, limit)
+	for _, id := range s.order[:limit] {
+		list = append(list, s.entries[id])
+	}
+	return list, nil
+}
+
+func (s *FileDeadLetterStore) Get(ctx context.Context, id string) (DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dl, ok := s.entries[id]
+	if !ok {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return dl, nil
+}
+
+func (s *FileDeadLetterStore) Remove(ctx context.Context, ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := deadLetterRecord{Op: "remove", IDs: ids}
+	if err := s.append(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	return nil
+}
+
+func (s *FileDeadLetterStore) Purge(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.entries)
+	rec := deadLetterRecord{Op: "purge"}
+	if err := s.append(rec); err != nil {
+		return 0, err
+	}
+	s.apply(rec)
+	return n, nil
+}
+
+func (s *FileDeadLetterStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// PostgresDeadLetterStore keeps dead letters in the dead_letters table.
+type PostgresDeadLetterStore struct {
+	pool *UltraDBPool
+}
+
+// NewPostgresDeadLetterStore checks that the dead_letters table, created by
+// the migrations, exists.
+func NewPostgresDeadLetterStore(ctx context.Context, pool *UltraDBPool) (*PostgresDeadLetterStore, error) {
+	s := &PostgresDeadLetterStore{pool: pool}
+	var exists bool
+	err := s.withConn(ctx, func(db *sql.Conn) error {
+		return db.QueryRowContext(ctx, `SELECT to_regclass('dead_letters') IS NOT NULL`).Scan(&exists)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("dead_letters table missing; run the migrate command")
+	}
+	return s, nil
+}
+
+func (s *PostgresDeadLetterStore) withConn(ctx context.Context, fn func(db *sql.Conn) error) error {
+	db, err := s.pool.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.pool.ReturnConnection(db)
+	return fn(db)
+}
+
+func (s *PostgresDeadLetterStore) Add(ctx context.Context, dl DeadLetter) error {
+	payload, err := json.Marshal(dl.Message)
+	if err != nil {
+		return err
+	}
+	return s.withConn(ctx, func(db *sql.Conn) error {
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO dead_letters (id, message, stage, error, attempts, first_failed_at, last_failed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			dl.ID, payload, dl.Stage, dl.Error, dl.Attempts, dl.FirstFailedAt, dl.LastFailedAt)
+		return err
+	})
+}
+
+const deadLetterColumns = `id, message, stage, error, attempts, first_failed_at, last_failed_at`
+
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (DeadLetter, error) {
+	var (
+		dl      DeadLetter
+		payload []byte
+	)
+	err := row.Scan(&dl.ID, &payload, &dl.Stage, &dl.Error, &dl.Attempts, &dl.FirstFailedAt, &dl.LastFailedAt)
+	if err != nil {
+		return dl, err
+	}
+	return dl, json.Unmarshal(payload, &dl.Message)
+}
+
+func (s *PostgresDeadLetterStore) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+
+	var list []DeadLetter
+	err := s.withConn(ctx, func(db *sql.Conn) error {
+		rows, err := db.QueryContext(ctx,
+			`SELECT `+deadLetterColumns+` FROM dead_letters ORDER BY first_failed_at LIMIT $1`, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			dl, err := scanDeadLetter(rows)
+			if err != nil {
+				return err
+			}
+			list = append(list, dl)
+		}
+		return rows.Err()
+	})
+	return list, err
+}
+
+func (s *PostgresDeadLetterStore) Get(ctx context.Context, id string) (DeadLetter, error) {
+	var dl DeadLetter
+	err := s.withConn(ctx, func(db *sql.Conn) error {
+		var err error
+		dl, err = scanDeadLetter(db.QueryRowContext(ctx,
+			`SELECT `+deadLetterColumns+` FROM dead_letters WHERE id = $1`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDeadLetterNotFound
+		}
+		return err
+	})
+	return dl, err
+}
+
+func (s *PostgresDeadLetterStore) Remove(ctx context.Context, ids ...string) error {
+	return s.withConn(ctx, func(db *sql.Conn) error {
+		for _, id := range ids {
+			if _, err := db.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = $1`, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresDeadLetterStore) Purge(ctx context.Context) (int, error) {
+	var n int64
+	err := s.withConn(ctx, func(db *sql.Conn) error {
+		res, err := db.ExecContext(ctx, `DELETE FROM dead_letters`)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// handleAdminDeadLetters lists dead letters on GET (?limit=N, default 100)
+// and purges all of them on DELETE.
+func (q *DeadLetterQueue) handleAdminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		list, err := q.store.List(r.Context(), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"count":        len(list),
+			"dead_letters": list,
+		})
+
+	case http.MethodDelete:
+		n, err := q.store.Purge(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("dead letters purged", "count", n, "remote_addr", r.RemoteAddr)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"purged": n})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminReplay resubmits dead letters to the processor. The body names
+// the entries to replay, {"ids": [...]}, or {"all": true}.
+func (q *DeadLetterQueue) handleAdminReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		IDs []string `json:"ids"`
+		All bool     `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if req.All {
+		list, err := q.store.List(r.Context(), 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.IDs = req.IDs[:0]
+		for _, dl := range list {
+			req.IDs = append(req.IDs, dl.ID)
+		}
+	}
+	if len(req.IDs) == 0 {
+		http.Error(w, "ids or all is required", http.StatusBadRequest)
+		return
+	}
+
+	replayed, err := q.Replay(r.Context(), req.IDs)
+	logger.Info("dead letters replayed", "count", len(replayed), "remote_addr", r.RemoteAddr)
+
+	resp := map[string]interface{}{"replayed": replayed}
+	status := http.StatusOK
+	if err != nil {
+		resp["error"] = err.Error()
+		status = http.StatusConflict
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			status = http.StatusNotFound
+		}
+	}
+	writeJSON(w, status, resp)
+}
+
+// openDeadLetterQueue creates the configured store and attaches the queue to
+// the processor.
+func openDeadLetterQueue(cfg DeadLetterConfig, processor *UltraMessageProcessor, pool *UltraDBPool) (*DeadLetterQueue, error) {
+	var (
+		store DeadLetterStore
+		err   error
+	)
+	switch cfg.Backend {
+	case "postgres":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		store, err = NewPostgresDeadLetterStore(ctx, pool)
+	default:
+		store, err = OpenFileDeadLetterStore(cfg.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewDeadLetterQueue(store, processor), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestDeadLetterStore(t *testing.T, path string) *FileDeadLetterStore {
+	t.Helper()
+	s, err := OpenFileDeadLetterStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func deadLetterIDs(list []DeadLetter) []string {
+	ids := make([]string, len(list))
+	for i := range list {
+		ids[i] = list[i].ID
+	}
+	return ids
+}
+
+func addDeadLetters(t *testing.T, s DeadLetterStore, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		dl := DeadLetter{
+			ID:            id,
+			Message:       Message{Type: TypeMessage, ChatID: "chat", MessageID: "msg-" + id, Content: "hello"},
+			Stage:         "persistence",
+			Error:         "connection refused",
+			Attempts:      3,
+			FirstFailedAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			LastFailedAt:  time.Date(2024, 1, 1, 12, 5, 0, 0, time.UTC),
+		}
+		if err := s.Add(context.Background(), dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileDeadLetterStoreSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dlq", "dead_letters.jsonl")
+	s := openTestDeadLetterStore(t, path)
+
+	addDeadLetters(t, s, "a", "b", "c")
+	if err := s.Remove(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "b"); err != ErrDeadLetterNotFound {
+		t.Fatalf("Get of a removed entry = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+	list, err := s.List(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deadLetterIDs(list); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("List(1) = %v, want [a]", got)
+	}
+	s.Close()
+
+	// A write torn by a crash is skipped, and the file compacted
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"add","entry":{"id":"torn"`)
+	f.Close()
+
+	s = openTestDeadLetterStore(t, path)
+	list, err = s.List(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deadLetterIDs(list); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Fatalf("reopened store lists %v, want [a c]", got)
+	}
+	dl, err := s.Get(ctx, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Message.MessageID != "msg-c" || dl.Attempts != 3 {
+		t.Fatalf("reopened entry = %+v", dl)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Fatalf("compacted file has %d records, want 2", lines)
+	}
+
+	if n, err := s.Purge(ctx); err != nil || n != 2 {
+		t.Fatalf("Purge = %d, %v, want 2", n, err)
+	}
+	s.Close()
+	s = openTestDeadLetterStore(t, path)
+	if list, _ := s.List(ctx, 0); len(list) != 0 {
+		t.Fatalf("purged store lists %v after reopening", deadLetterIDs(list))
+	}
+}
+
+// newTestDeadLetterQueue returns a queue over a file store whose processor
+// records the messages that reach it.
+func newTestDeadLetterQueue(t *testing.T) (*DeadLetterQueue, func() []string) {
+	t.Helper()
+	ump := newTestProcessor(t)
+	var (
+		mu        sync.Mutex
+		processed []string
+	)
+	err := ump.Use(Stage{
+		Name: "record",
+		Handle: func(ctx context.Context, msg *Message) error {
+			mu.Lock()
+			processed = append(processed, msg.MessageID)
+			mu.Unlock()
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := openTestDeadLetterStore(t, filepath.Join(t.TempDir(), "dead_letters.jsonl"))
+	dlq := NewDeadLetterQueue(store, ump)
+
+	return dlq, func() []string {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mu.Lock()
+			got := append([]string(nil), processed...)
+			mu.Unlock()
+			if len(got) > 0 || time.Now().After(deadline) {
+				return got
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestDeadLetterQueueStoresPipelineFailures(t *testing.T) {
+	dlq, _ := newTestDeadLetterQueue(t)
+	msg := &Message{Type: TypeMessage, ChatID: "chat", MessageID: "m1", Content: "hello"}
+	if err := dlq.handle(msg, "persistence", 3, os.ErrDeadlineExceeded); err != nil {
+		t.Fatal(err)
+	}
+	// The stored copy does not follow later changes to the message
+	msg.Content = "changed"
+
+	list, err := dlq.store.List(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("stored %d dead letters, want 1", len(list))
+	}
+	dl := list[0]
+	if dl.ID == "" || dl.Stage != "persistence" || dl.Attempts != 3 || dl.Error != os.ErrDeadlineExceeded.Error() {
+		t.Fatalf("stored %+v", dl)
+	}
+	if dl.Message.Content != "hello" {
+		t.Fatalf("stored content %q, want the content at failure", dl.Message.Content)
+	}
+}
+
+func TestDeadLetterQueueReplays(t *testing.T) {
+	dlq, processed := newTestDeadLetterQueue(t)
+	addDeadLetters(t, dlq.store, "a", "b")
+
+	replayed, err := dlq.Replay(context.Background(), []string{"a", "missing", "b"})
+	if err == nil {
+		t.Fatal("replaying an unknown ID succeeded")
+	}
+	if !reflect.DeepEqual(replayed, []string{"a"}) {
+		t.Fatalf("replayed %v, want [a]", replayed)
+	}
+	if got := processed(); !reflect.DeepEqual(got, []string{"msg-a"}) {
+		t.Fatalf("processor received %v, want [msg-a]", got)
+	}
+	list, _ := dlq.store.List(context.Background(), 0)
+	if got := deadLetterIDs(list); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("store holds %v after replay, want [b]", got)
+	}
+
+	// Failing again adds to the history of the replayed record
+	err = dlq.processor.Use(Stage{
+		Name:    "reject",
+		OnError: PolicyDeadLetter,
+		Handle: func(ctx context.Context, msg *Message) error {
+			return os.ErrDeadlineExceeded
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlier := list[0]
+	if _, err := dlq.Replay(context.Background(), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		list, _ = dlq.store.List(context.Background(), 0)
+		if len(list) == 1 && list[0].ID != "b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("store holds %v after a failed replay", deadLetterIDs(list))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	dl := list[0]
+	if dl.Attempts != earlier.Attempts+1 {
+		t.Fatalf("re-dead-lettered after %d attempts, want %d", dl.Attempts, earlier.Attempts+1)
+	}
+	if !dl.FirstFailedAt.Equal(earlier.FirstFailedAt) || !dl.LastFailedAt.After(earlier.LastFailedAt) {
+		t.Fatalf("re-dead-lettered failing first at %v, last at %v; want first at %v",
+			dl.FirstFailedAt, dl.LastFailedAt, earlier.FirstFailedAt)
+	}
+}
+
+func TestDeadLetterAdminEndpoints(t *testing.T) {
+	dlq, processed := newTestDeadLetterQueue(t)
+	addDeadLetters(t, dlq.store, "a", "b", "c")
+
+	serve := func(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := serve(dlq.handleAdminDeadLetters, http.MethodGet, "/admin/dead-letters?limit=2", "")
+	var listed struct {
+		Count       int          `json:"count"`
+		DeadLetters []DeadLetter `json:"dead_letters"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || listed.Count != 2 || !reflect.DeepEqual(deadLetterIDs(listed.DeadLetters), []string{"a", "b"}) {
+		t.Fatalf("GET = %d, %+v", w.Code, listed)
+	}
+	if w := serve(dlq.handleAdminDeadLetters, http.MethodGet, "/admin/dead-letters?limit=x", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("GET with a bad limit = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"ids": ["b"]}`, http.StatusOK},
+		{`{"ids": ["missing"]}`, http.StatusNotFound},
+		{`{}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	} {
+		if w := serve(dlq.handleAdminReplay, http.MethodPost, "/admin/dead-letters/replay", tc.body); w.Code != tc.want {
+			t.Fatalf("replay %s = %d, want %d", tc.body, w.Code, tc.want)
+		}
+	}
+	if w := serve(dlq.handleAdminReplay, http.MethodGet, "/admin/dead-letters/replay", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET replay = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if got := processed(); !reflect.DeepEqual(got, []string{"msg-b"}) {
+		t.Fatalf("processor received %v, want [msg-b]", got)
+	}
+
+	w = serve(dlq.handleAdminDeadLetters, http.MethodDelete, "/admin/dead-letters", "")
+	var purged struct {
+		Purged int `json:"purged"`
+	}
+	json.NewDecoder(w.Body).Decode(&purged)
+	if w.Code != http.StatusOK || purged.Purged != 2 {
+		t.Fatalf("DELETE = %d, purged %d, want 2", w.Code, purged.Purged)
+	}
+	if list, _ := dlq.store.List(context.Background(), 0); len(list) != 0 {
+		t.Fatalf("store holds %v after purge", deadLetterIDs(list))
+	}
+}
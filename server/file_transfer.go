@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadPurgeInterval is how often abandoned uploads are looked for.
+const uploadPurgeInterval = time.Hour
+
+// fileService implements the chunked upload protocol on the WebSocket
+// connection and serves the resulting blobs over HTTP.
+//
+// A client sends upload_init with the file's name, size, MIME type and
+// SHA-256 and gets an upload_status with the upload ID and offset 0. It then
+// sends upload_chunk frames at increasing offsets, each answered with the
+// new offset, and finally upload_complete, answered with the file ID once
+// the digest matches. To resume after a disconnect, upload_init with just
+// the upload ID returns the offset to continue from. The file ID is the
+// content's SHA-256 and goes into a message's attachments.
+type fileService struct {
+	storage BlobStorage
+	cfg     FilesConfig
+}
+
+func newFileService(storage BlobStorage, cfg FilesConfig) *fileService {
+	return &fileService{storage: storage, cfg: cfg}
+}
+
+// frameLimit is the read limit that fits an upload_chunk frame carrying a
+// full chunk.
+func (fs *fileService) frameLimit() int64 {
+	return int64(base64.StdEncoding.EncodedLen(fs.cfg.ChunkSize)) + 4096
+}
+
+// handleFrame answers one upload frame from c.
+func (fs *fileService) handleFrame(c *Client, msg Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	frame := msg.Upload
+	if frame == nil {
+		frame = &UploadFrame{}
+	}
+
+	var (
+		reply Message
+		err   error
+	)
+	switch msg.Type {
+	case TypeUploadInit:
+		reply, err = fs.init(ctx, c, frame)
+	case TypeUploadChunk:
+		reply, err = fs.chunk(ctx, c, frame)
+	case TypeUploadComplete:
+		reply, err = fs.complete(ctx, c, frame)
+	case TypeUploadAbort:
+		reply, err = fs.abort(ctx, c, frame)
+	}
+
+	if err != nil {
+		c.log.Debug("upload frame rejected", "type", msg.Type, "upload_id", frame.UploadID, "error", err)
+		reply = Message{
+			Type:    TypeError,
+			Content: uploadErrorText(err),
+			Upload:  &UploadFrame{UploadID: frame.UploadID, Offset: reply.uploadOffset()},
+		}
+	}
+	reply.Timestamp = time.Now().Unix()
+	c.reply(reply)
+}
+
+func (fs *fileService) init(ctx context.Context, c *Client, frame *UploadFrame) (Message, error) {
+	if frame.UploadID != "" {
+		meta, err := fs.ownUpload(ctx, c, frame.UploadID)
+		if err != nil {
+			return Message{}, err
+		}
+		return uploadStatus(meta.UploadID, meta.Offset), nil
+	}
+
+	switch {
+	case frame.Name == "" || len(frame.Name) > 255:
+		return Message{}, rejectUpload("file name must be 1 to 255 bytes")
+	case frame.Size <= 0 || frame.Size > fs.cfg.MaxFileSize:
+		return Message{}, rejectUpload("file size must be between 1 and %d bytes", fs.cfg.MaxFileSize)
+	case !validFileID(strings.ToLower(frame.SHA256)):
+		return Message{}, rejectUpload("sha256 must be a hex SHA-256 digest")
+	}
+	mimeType := frame.MimeType
+	if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+		mimeType = "application/octet-stream"
+	}
+
+	meta, err := fs.storage.CreateUpload(ctx, UploadMeta{
+		UserID:   c.UserID,
+		Name:     frame.Name,
+		MimeType: mimeType,
+		Size:     frame.Size,
+		SHA256:   frame.SHA256,
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	c.log.Info("upload started", "upload_id", meta.UploadID, "size", meta.Size)
+	return uploadStatus(meta.UploadID, 0), nil
+}
+
+func (fs *fileService) chunk(ctx context.Context, c *Client, frame *UploadFrame) (Message, error) {
+	meta, err := fs.ownUpload(ctx, c, frame.UploadID)
+	if err != nil {
+		return Message{}, err
+	}
+	switch {
+	case len(frame.Chunk) == 0:
+		return uploadStatus(meta.UploadID, meta.Offset), rejectUpload("empty chunk")
+	case len(frame.Chunk) > fs.cfg.ChunkSize:
+		return uploadStatus(meta.UploadID, meta.Offset), rejectUpload("chunk larger than %d bytes", fs.cfg.ChunkSize)
+	case frame.Offset+int64(len(frame.Chunk)) > meta.Size:
+		return uploadStatus(meta.UploadID, meta.Offset), rejectUpload("chunk extends past the declared size of %d bytes", meta.Size)
+	}
+	if frame.SHA256 != "" {
+		sum := sha256.Sum256(frame.Chunk)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), frame.SHA256) {
+			return uploadStatus(meta.UploadID, meta.Offset), ErrUploadChecksum
+		}
+	}
+
+	offset, err := fs.storage.WriteChunk(ctx, meta.UploadID, frame.Offset, frame.Chunk)
+	return uploadStatus(meta.UploadID, offset), err
+}
+
+func (fs *fileService) complete(ctx context.Context, c *Client, frame *UploadFrame) (Message, error) {
+	meta, err := fs.ownUpload(ctx, c, frame.UploadID)
+	if err != nil {
+		return Message{}, err
+	}
+	info, err := fs.storage.CompleteUpload(ctx, meta.UploadID)
+	if err != nil {
+		if errors.Is(err, ErrUploadChecksum) {
+			// The bytes are wrong somewhere; start over
+			fs.storage.AbortUpload(ctx, meta.UploadID)
+			return uploadStatus(meta.UploadID, 0), err
+		}
+		return uploadStatus(meta.UploadID, meta.Offset), err
+	}
+
+	c.log.Info("upload complete", "upload_id", meta.UploadID, "file_id", info.ID, "size", info.Size)
+	return Message{
+		Type: TypeUploadComplete,
+		Upload: &UploadFrame{
+			UploadID: meta.UploadID,
+			FileID:   info.ID,
+			Name:     info.Name,
+			MimeType: info.MimeType,
+			Size:     info.Size,
+			Offset:   info.Size,
+			URL:      fileURL(info.ID),
+		},
+	}, nil
+}
+
+func (fs *fileService) abort(ctx context.Context, c *Client, frame *UploadFrame) (Message, error) {
+	meta, err := fs.ownUpload(ctx, c, frame.UploadID)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := fs.storage.AbortUpload(ctx, meta.UploadID); err != nil {
+		return Message{}, err
+	}
+	return uploadStatus(meta.UploadID, 0), nil
+}
+
+// ownUpload loads an upload started by c's user.
+func (fs *fileService) ownUpload(ctx context.Context, c *Client, uploadID string) (UploadMeta, error) {
+	meta, err := fs.storage.GetUpload(ctx, uploadID)
+	if err != nil {
+		return UploadMeta{}, err
+	}
+	if meta.UserID != c.UserID {
+		return UploadMeta{}, ErrUploadNotFound
+	}
+	return meta, nil
+}
+
+func uploadStatus(uploadID string, offset int64) Message {
+	return Message{
+		Type:   TypeUploadStatus,
+		Upload: &UploadFrame{UploadID: uploadID, Offset: offset},
+	}
+}
+
+// uploadOffset is the offset carried by an upload reply, 0 if none.
+func (m Message) uploadOffset() int64 {
+	if m.Upload == nil {
+		return 0
+	}
+	return m.Upload.Offset
+}
+
+// uploadRejection is a client error whose text is safe to send back.
+type uploadRejection string
+
+func (e uploadRejection) Error() string { return string(e) }
+
+func rejectUpload(format string, args ...interface{}) error {
+	return uploadRejection(fmt.Sprintf(format, args...))
+}
+
+// uploadErrorText is the error shown to the client; storage errors are not
+// passed through.
+func uploadErrorText(err error) string {
+	var rejection uploadRejection
+	if errors.As(err, &rejection) {
+		return rejection.Error()
+	}
+	for _, known := range []error{ErrUploadNotFound, ErrChunkOffset, ErrUploadChecksum, ErrUploadIncomplete} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "upload timed out"
+	}
+	return "upload failed"
+}
+
+// fileLinks signs download URLs. A file ID is the content's SHA-256, which
+// anyone holding the content can compute, so /files serves a file only to
+// a link handed out by an upload, an attachment or a history page, and
+// only until it expires.
+type fileLinks struct {
+	key []byte
+	ttl time.Duration
+}
+
+// downloadLinks signs the URLs fileURL returns; main keys it at startup.
+// Without a key no link is valid.
+var downloadLinks fileLinks
+
+func newFileLinks(cfg FilesConfig) fileLinks {
+	links := fileLinks{key: []byte(cfg.URLSecret), ttl: cfg.URLTTL.Std()}
+	if len(links.key) == 0 {
+		links.key = make([]byte, 32)
+		rand.Read(links.key)
+		logger.Warn("files.urlSecret not set; download links only work on this node until it restarts")
+	}
+	return links
+}
+
+func (l fileLinks) sign(fileID string, expires int64) string {
+	mac := hmac.New(sha256.New, l.key)
+	fmt.Fprintf(mac, "%s\n%d", fileID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// url returns a link to fileID that expires ttl after now.
+func (l fileLinks) url(fileID string, now time.Time) string {
+	expires := now.Add(l.ttl).Unix()
+	return "/files/" + fileID + "?expires=" + strconv.FormatInt(expires, 10) + "&sig=" + l.sign(fileID, expires)
+}
+
+// valid reports whether query carries an unexpired signature for fileID.
+func (l fileLinks) valid(fileID string, query url.Values, now time.Time) bool {
+	if len(l.key) == 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("sig")), []byte(l.sign(fileID, expires)))
+}
+
+func fileURL(fileID string) string {
+	return downloadLinks.url(fileID, time.Now())
+}
+
+// handleDownload serves GET and HEAD /files/{id} to signed links (see
+// fileLinks). Range and conditional requests are handled by
+// http.ServeContent; for file-backed storage net/http copies the body with
+// sendfile.
+func (fs *fileService) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID := strings.TrimPrefix(r.URL.Path, "/files/")
+	if !downloadLinks.valid(fileID, r.URL.Query(), time.Now()) {
+		http.Error(w, "link invalid or expired", http.StatusForbidden)
+		return
+	}
+	blob, info, err := fs.storage.Open(r.Context(), fileID)
+	if errors.Is(err, ErrFileNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger.Error("file open failed", "file_id", fileID, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", info.MimeType)
+	h.Set("ETag", `"`+info.ID+`"`)
+	h.Set("Cache-Control", "private, max-age=31536000, immutable")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
+	http.ServeContent(w, r, "", info.CreatedAt, blob)
+}
+
+// purgeLoop removes uploads abandoned for longer than the upload TTL.
+func (fs *fileService) purgeLoop(ctx context.Context) {
+	ticker := time.NewTicker(uploadPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := fs.storage.PurgeUploads(ctx, time.Now().Add(-fs.cfg.UploadTTL.Std()))
+		if err != nil {
+			logger.Error("upload purge failed", "error", err)
+		} else if purged > 0 {
+			logger.Info("purged abandoned uploads", "count", purged)
+		}
+	}
+}
+
+// attachmentStage checks that every attachment of a message refers to a
+// stored file and fills in its size, type and URL from the store.
+func attachmentStage(fs *fileService) Stage {
+	return Stage{
+		Name:    "attachments",
+		Order:   OrderAttachments,
+		Types:   chatMessageTypes,
+		Timeout: time.Second,
+		OnError: PolicyDrop,
+		Handle: func(ctx context.Context, msg *Message) error {
+			for i := range msg.Attachments {
+				a := &msg.Attachments[i]
+				info, err := fs.storage.Stat(ctx, a.ID)
+				if err != nil {
+					return fmt.Errorf("attachment %q: %w", a.ID, err)
+				}
+				if a.Name == "" {
+					a.Name = info.Name
+				}
+				a.MimeType = info.MimeType
+				a.Size = info.Size
+				a.URL = fileURL(info.ID)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFileService returns a file service over a temporary store with
+// download links keyed for the test, and a client of user "alice".
+func newTestFileService(t *testing.T) (*fileService, *Client) {
+	t.Helper()
+	storage, err := NewLocalBlobStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := downloadLinks
+	downloadLinks = fileLinks{key: []byte("test key"), ttl: time.Hour}
+	t.Cleanup(func() { downloadLinks = links })
+
+	cfg := DefaultConfig().Files
+	cfg.MaxFileSize = 64
+	cfg.ChunkSize = 4
+	return newFileService(storage, cfg), newTestClient(newHub(WebSocketConfig{BroadcastBuffer: 8}), "alice")
+}
+
+func newTestClient(hub *Hub, userID string) *Client {
+	c := &Client{ID: userID + "-session", UserID: userID, Hub: hub, Send: make(chan Message, 4), chats: make(map[string]struct{}), log: logger}
+	hub.clients[c] = true
+	return c
+}
+
+// uploadFrame sends an upload frame from c and returns the reply.
+func uploadFrame(t *testing.T, fs *fileService, c *Client, typ MessageType, frame UploadFrame) Message {
+	t.Helper()
+	fs.handleFrame(c, Message{Type: typ, Upload: &frame})
+	select {
+	case reply := <-c.Send:
+		return reply
+	default:
+		t.Fatalf("no reply to %s", typ)
+		return Message{}
+	}
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFileUploadResumesInChunks(t *testing.T) {
+	fs, c := newTestFileService(t)
+	content := "hello, world"
+
+	reply := uploadFrame(t, fs, c, TypeUploadInit, UploadFrame{Name: "a.txt", MimeType: "text/plain", Size: int64(len(content)), SHA256: sha256Hex(content)})
+	if reply.Type != TypeUploadStatus || reply.Upload.UploadID == "" || reply.Upload.Offset != 0 {
+		t.Fatalf("upload_init = %s %+v", reply.Type, reply.Upload)
+	}
+	uploadID := reply.Upload.UploadID
+
+	reply = uploadFrame(t, fs, c, TypeUploadChunk, UploadFrame{UploadID: uploadID, Offset: 0, Chunk: []byte(content[:4])})
+	if reply.Type != TypeUploadStatus || reply.Upload.Offset != 4 {
+		t.Fatalf("first chunk = %s %+v", reply.Type, reply.Upload)
+	}
+	// A chunk at the wrong offset reports where to continue
+	reply = uploadFrame(t, fs, c, TypeUploadChunk, UploadFrame{UploadID: uploadID, Offset: 8, Chunk: []byte(content[8:])})
+	if reply.Type != TypeError || reply.Content != ErrChunkOffset.Error() || reply.Upload.Offset != 4 {
+		t.Fatalf("chunk at the wrong offset = %s %q %+v", reply.Type, reply.Content, reply.Upload)
+	}
+
+	// Another session of the user resumes; other users cannot see it
+	resumed := newTestClient(c.Hub, "alice")
+	reply = uploadFrame(t, fs, resumed, TypeUploadInit, UploadFrame{UploadID: uploadID})
+	if reply.Type != TypeUploadStatus || reply.Upload.Offset != 4 {
+		t.Fatalf("resuming upload_init = %s %+v", reply.Type, reply.Upload)
+	}
+	mallory := newTestClient(c.Hub, "mallory")
+	reply = uploadFrame(t, fs, mallory, TypeUploadInit, UploadFrame{UploadID: uploadID})
+	if reply.Type != TypeError || reply.Content != ErrUploadNotFound.Error() {
+		t.Fatalf("upload_init by another user = %s %q", reply.Type, reply.Content)
+	}
+
+	for offset := 4; offset < len(content); offset += 4 {
+		reply = uploadFrame(t, fs, resumed, TypeUploadChunk, UploadFrame{UploadID: uploadID, Offset: int64(offset), Chunk: []byte(content[offset : offset+4])})
+		if reply.Type != TypeUploadStatus || reply.Upload.Offset != int64(offset+4) {
+			t.Fatalf("chunk at %d = %s %q %+v", offset, reply.Type, reply.Content, reply.Upload)
+		}
+	}
+	reply = uploadFrame(t, fs, resumed, TypeUploadComplete, UploadFrame{UploadID: uploadID})
+	if reply.Type != TypeUploadComplete || reply.Upload.FileID != sha256Hex(content) || reply.Upload.Size != int64(len(content)) {
+		t.Fatalf("upload_complete = %s %q %+v", reply.Type, reply.Content, reply.Upload)
+	}
+	if !strings.HasPrefix(reply.Upload.URL, "/files/"+sha256Hex(content)+"?") {
+		t.Fatalf("file URL %q", reply.Upload.URL)
+	}
+}
+
+func TestFileUploadLimits(t *testing.T) {
+	fs, c := newTestFileService(t)
+	content := "12345678"
+	start := func(sha string) string {
+		t.Helper()
+		reply := uploadFrame(t, fs, c, TypeUploadInit, UploadFrame{Name: "a.bin", Size: int64(len(content)), SHA256: sha})
+		if reply.Type != TypeUploadStatus {
+			t.Fatalf("upload_init = %s %q", reply.Type, reply.Content)
+		}
+		return reply.Upload.UploadID
+	}
+
+	for _, tc := range []struct {
+		name  string
+		frame UploadFrame
+	}{
+		{"too large", UploadFrame{Name: "a.bin", Size: fs.cfg.MaxFileSize + 1, SHA256: sha256Hex(content)}},
+		{"empty", UploadFrame{Name: "a.bin", SHA256: sha256Hex(content)}},
+		{"no name", UploadFrame{Size: 8, SHA256: sha256Hex(content)}},
+		{"bad digest", UploadFrame{Name: "a.bin", Size: 8, SHA256: "abc"}},
+	} {
+		if reply := uploadFrame(t, fs, c, TypeUploadInit, tc.frame); reply.Type != TypeError {
+			t.Fatalf("%s: upload_init = %s, want an error", tc.name, reply.Type)
+		}
+	}
+
+	uploadID := start(sha256Hex(content))
+	for _, tc := range []struct {
+		name  string
+		frame UploadFrame
+	}{
+		{"chunk too large", UploadFrame{UploadID: uploadID, Chunk: []byte("12345")}},
+		{"past the declared size", UploadFrame{UploadID: uploadID, Offset: 6, Chunk: []byte("7890")}},
+		{"chunk digest", UploadFrame{UploadID: uploadID, Chunk: []byte("1234"), SHA256: sha256Hex("abcd")}},
+	} {
+		if reply := uploadFrame(t, fs, c, TypeUploadChunk, tc.frame); reply.Type != TypeError || reply.Upload.Offset != 0 {
+			t.Fatalf("%s: upload_chunk = %s %+v, want an error at offset 0", tc.name, reply.Type, reply.Upload)
+		}
+	}
+	uploadFrame(t, fs, c, TypeUploadChunk, UploadFrame{UploadID: uploadID, Chunk: []byte("1234")})
+	if reply := uploadFrame(t, fs, c, TypeUploadComplete, UploadFrame{UploadID: uploadID}); reply.Content != ErrUploadIncomplete.Error() {
+		t.Fatalf("completing a partial upload = %s %q", reply.Type, reply.Content)
+	}
+
+	// Bytes that do not match the declared digest restart the upload
+	uploadID = start(sha256Hex("87654321"))
+	uploadFrame(t, fs, c, TypeUploadChunk, UploadFrame{UploadID: uploadID, Chunk: []byte("1234")})
+	uploadFrame(t, fs, c, TypeUploadChunk, UploadFrame{UploadID: uploadID, Offset: 4, Chunk: []byte("5678")})
+	if reply := uploadFrame(t, fs, c, TypeUploadComplete, UploadFrame{UploadID: uploadID}); reply.Content != ErrUploadChecksum.Error() || reply.Upload.Offset != 0 {
+		t.Fatalf("completing with the wrong digest = %s %q %+v", reply.Type, reply.Content, reply.Upload)
+	}
+	if reply := uploadFrame(t, fs, c, TypeUploadInit, UploadFrame{UploadID: uploadID}); reply.Content != ErrUploadNotFound.Error() {
+		t.Fatalf("upload with the wrong digest kept: %s %+v", reply.Type, reply.Upload)
+	}
+}
+
+func TestFileDownloadNeedsSignedLink(t *testing.T) {
+	fs, _ := newTestFileService(t)
+	ctx := context.Background()
+	content := "0123456789"
+	meta, err := fs.storage.CreateUpload(ctx, UploadMeta{UserID: "alice", Name: "digits.txt", MimeType: "text/plain", Size: int64(len(content)), SHA256: sha256Hex(content)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.storage.WriteChunk(ctx, meta.UploadID, 0, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.storage.CompleteUpload(ctx, meta.UploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(method, target, rangeHeader string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, nil)
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		fs.handleDownload(w, r)
+		return w
+	}
+
+	link := fileURL(info.ID)
+	other := fileLinks{key: []byte("other key"), ttl: time.Hour}
+	for _, tc := range []struct {
+		name, target string
+		want         int
+	}{
+		{"unsigned", "/files/" + info.ID, http.StatusForbidden},
+		{"signed by another key", other.url(info.ID, time.Now()), http.StatusForbidden},
+		{"expired", downloadLinks.url(info.ID, time.Now().Add(-2*time.Hour)), http.StatusForbidden},
+		{"for another file", strings.Replace(link, info.ID, sha256Hex("x"), 1), http.StatusForbidden},
+		{"unknown file", fileURL(sha256Hex("x")), http.StatusNotFound},
+	} {
+		if w := get(http.MethodGet, tc.target, ""); w.Code != tc.want {
+			t.Fatalf("%s: GET = %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+
+	w := get(http.MethodGet, link, "")
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusOK || string(body) != content {
+		t.Fatalf("GET = %d %q", w.Code, body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain" {
+		t.Fatalf("Content-Type %q", got)
+	}
+	w = get(http.MethodGet, link, "bytes=2-5")
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusPartialContent || string(body) != "2345" {
+		t.Fatalf("ranged GET = %d %q, want 206 \"2345\"", w.Code, body)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Fatalf("Content-Range %q", got)
+	}
+	if w := get(http.MethodPost, link, ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST = %d", w.Code)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// healthCheckTimeout bounds every individual check.
+	healthCheckTimeout = 2 * time.Second
+
+	// processorSaturationLimit is the queue fill ratio above which the
+	// instance reports itself as not ready.
+	processorSaturationLimit = 0.9
+)
+
+// draining is set once shutdown starts so load balancers stop routing new
+// connections here while existing ones finish.
+var draining atomic.Bool
+
+// healthCheck is a single named readiness probe. It returns a short detail
+// string on success and an error when the dependency is unhealthy.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) (string, error)
+}
+
+// checkResult is the per-check entry in the JSON body.
+type checkResult struct {
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// HealthChecker serves /livez, /readyz and the legacy /health endpoint.
+type HealthChecker struct {
+	hub      *Hub
+	liveness []healthCheck
+	ready    []healthCheck
+}
+
+func newHealthChecker(hub *Hub) *HealthChecker {
+	hubLoop := healthCheck{name: "hub_loop", check: hub.checkLoop}
+
+	return &HealthChecker{
+		hub:      hub,
+		liveness: []healthCheck{hubLoop},
+		ready: []healthCheck{
+			{name: "draining", check: checkDraining},
+			hubLoop,
+			{name: "message_processor", check: checkProcessor},
+			{name: "database", check: checkDatabase},
+		},
+	}
+}
+
+// run executes checks concurrently and reports whether all of them passed.
+func (hc *HealthChecker) run(ctx context.Context, checks []healthCheck) (bool, map[string]checkResult) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		healthy = true
+		results = make(map[string]checkResult, len(checks))
+	)
+
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			detail, err := c.check(checkCtx)
+			result := checkResult{
+				Status:    "ok",
+				Detail:    detail,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			results[c.name] = result
+			if err != nil {
+				healthy = false
+			}
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	return healthy, results
+}
+
+func (hc *HealthChecker) respond(w http.ResponseWriter, r *http.Request, checks []healthCheck, okStatus, failStatus string) {
+	healthy, results := hc.run(r.Context(), checks)
+
+	status, code := okStatus, http.StatusOK
+	if !healthy {
+		status, code = failStatus, http.StatusServiceUnavailable
+		logger.Warn("health check failed", "path", r.URL.Path, "checks", results)
+	}
+
+	writeJSON(w, code, map[string]interface{}{
+		"status":    status,
+		"timestamp": time.Now().Unix(),
+		"uptime":    time.Since(startTime).String(),
+		"checks":    results,
+	})
+}
+
+// handleLivez reports whether the process is alive, i.e. its hub loop is
+// still making progress. A failure here means the instance should be
+// restarted.
+func (hc *HealthChecker) handleLivez(w http.ResponseWriter, r *http.Request) {
+	hc.respond(w, r, hc.liveness, "alive", "dead")
+}
+
+// handleReadyz reports whether the instance should receive new traffic.
+func (hc *HealthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	hc.respond(w, r, hc.ready, "ready", "not_ready")
+}
+
+// handleHealth keeps the original /health contract for existing callers but
+// now reflects readiness instead of always reporting healthy.
+func (hc *HealthChecker) handleHealth(w http.ResponseWriter, r *http.Request) {
+	healthy, results := hc.run(r.Context(), hc.ready)
+
+	status, code := "healthy", http.StatusOK
+	if !healthy {
+		status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, map[string]interface{}{
+		"status":    status,
+		"timestamp": time.Now().Unix(),
+		"version":   "3.0",
+		"server":    "Go WebSocket",
+		"uptime":    time.Since(startTime).String(),
+		"checks":    results,
+	})
+}
+
+func checkDraining(ctx context.Context) (string, error) {
+	if draining.Load() {
+		return "", errors.New("server is draining")
+	}
+	return "accepting connections", nil
+}
+
+func checkProcessor(ctx context.Context) (string, error) {
+	if GlobalMessageProcessor == nil {
+		return "not configured", nil
+	}
+
+	saturation := GlobalMessageProcessor.QueueSaturation()
+	detail := fmt.Sprintf("queue %.1f%% full", saturation*100)
+	if saturation >= processorSaturationLimit {
+		return detail, errors.New("message queue saturated")
+	}
+	return detail, nil
+}
+
+func checkDatabase(ctx context.Context) (string, error) {
+	if GlobalDBPool == nil {
+		return "not configured", nil
+	}
+	if err := GlobalDBPool.Ping(ctx); err != nil {
+		return "", err
+	}
+	return "reachable", nil
+}
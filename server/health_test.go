@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type healthReply struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// probe serves one health request, cut short after timeout.
+func probe(t *testing.T, handler http.HandlerFunc, timeout time.Duration) (int, healthReply) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	var reply healthReply
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, reply
+}
+
+func TestReadyzFailsWithoutDatabase(t *testing.T) {
+	hub := newHub(WebSocketConfig{BroadcastBuffer: 8})
+	go hub.run()
+	hc := newHealthChecker(hub)
+
+	pool, fake := newTestDBPool(t)
+	saved := GlobalDBPool
+	GlobalDBPool = pool
+	t.Cleanup(func() { GlobalDBPool = saved })
+
+	code, reply := probe(t, hc.handleReadyz, time.Second)
+	if code != http.StatusOK || reply.Status != "ready" || reply.Checks["database"].Status != "ok" {
+		t.Fatalf("readyz = %d %+v", code, reply)
+	}
+
+	fake.setDown(syscall.ECONNREFUSED)
+	code, reply = probe(t, hc.handleReadyz, time.Second)
+	if code != http.StatusServiceUnavailable || reply.Status != "not_ready" {
+		t.Fatalf("readyz with the database down = %d %q", code, reply.Status)
+	}
+	if db := reply.Checks["database"]; db.Status != "fail" || db.Error == "" {
+		t.Fatalf("database check %+v", db)
+	}
+	if reply.Checks["hub_loop"].Status != "ok" {
+		t.Fatalf("hub loop check %+v", reply.Checks["hub_loop"])
+	}
+	// The legacy endpoint follows readiness
+	if code, reply := probe(t, hc.handleHealth, time.Second); code != http.StatusServiceUnavailable || reply.Status != "unhealthy" {
+		t.Fatalf("health with the database down = %d %q", code, reply.Status)
+	}
+	// Liveness does not depend on the database
+	if code, reply := probe(t, hc.handleLivez, time.Second); code != http.StatusOK || reply.Status != "alive" {
+		t.Fatalf("livez with the database down = %d %q", code, reply.Status)
+	}
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	hub := newHub(WebSocketConfig{BroadcastBuffer: 8})
+	go hub.run()
+	hc := newHealthChecker(hub)
+
+	draining.Store(true)
+	t.Cleanup(func() { draining.Store(false) })
+	code, reply := probe(t, hc.handleReadyz, time.Second)
+	if code != http.StatusServiceUnavailable || reply.Checks["draining"].Status != "fail" {
+		t.Fatalf("readyz while draining = %d %+v", code, reply)
+	}
+	if code, _ := probe(t, hc.handleLivez, time.Second); code != http.StatusOK {
+		t.Fatalf("livez while draining = %d", code)
+	}
+}
+
+func TestLivezFailsWhenHubLoopStops(t *testing.T) {
+	// The hub loop is never started, so it does not answer
+	hc := newHealthChecker(newHub(WebSocketConfig{BroadcastBuffer: 8}))
+	code, reply := probe(t, hc.handleLivez, 50*time.Millisecond)
+	if code != http.StatusServiceUnavailable || reply.Status != "dead" {
+		t.Fatalf("livez = %d %q", code, reply.Status)
+	}
+	if loop := reply.Checks["hub_loop"]; loop.Status != "fail" || loop.Error != "hub loop unresponsive" {
+		t.Fatalf("hub loop check %+v", loop)
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var (
+	// ErrNotChatMember is returned when a user asks for the history of a
+	// chat they do not belong to.
+	ErrNotChatMember = errors.New("not a member of this chat")
+	// ErrInvalidCursor is returned for malformed or conflicting cursors.
+	ErrInvalidCursor = errors.New("invalid history cursor")
+	// errMembershipUnknown means membership cannot be checked because there
+	// is no database.
+	errMembershipUnknown = errors.New("chat membership cannot be verified without a database")
+)
+
+const historyLockCount = 64
+
+// HistoryFrame is a history request (Before or After cursor and Limit) and
+// the page that answers it. Messages are in chronological order. Before is
+// the cursor for the page older than this one and After for the newer one;
+// HasMore says whether the requested direction has more messages.
+type HistoryFrame struct {
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+	Limit    int       `json:"limit,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	HasMore  bool      `json:"hasMore"`
+}
+
+// historyCursor is a position in a chat's (created_at, id) order.
+type historyCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c historyCursor) encode() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixMicro(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*historyCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	micros, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return nil, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &historyCursor{CreatedAt: time.UnixMicro(n).UTC(), ID: id}, nil
+}
+
+func cursorOf(msg *Message) historyCursor {
+	return historyCursor{CreatedAt: time.UnixMicro(msg.CreatedAt).UTC(), ID: msg.MessageID}
+}
+
+// less orders messages like the database does, by creation time then ID.
+func (c historyCursor) less(o historyCursor) bool {
+	if !c.CreatedAt.Equal(o.CreatedAt) {
+		return c.CreatedAt.Before(o.CreatedAt)
+	}
+	return c.ID < o.ID
+}
+
+// HistoryQuery selects a page of messages for UltraDBPool.MessageHistory.
+type HistoryQuery struct {
+	ChatID string
+	UserID string // messages this user deleted for themselves are skipped
+	Before *historyCursor
+	After  *historyCursor
+	Limit  int
+	// Primary skips replicas, for reads that must see every committed
+	// message.
+	Primary bool
+}
+
+// hotWindow holds the newest messages of a chat in chronological order.
+// complete means it holds the chat's whole history.
+type hotWindow struct {
+	mu       sync.Mutex
+	messages []Message
+	complete bool
+}
+
+func (w *hotWindow) snapshot() ([]Message, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Message(nil), w.messages...), w.complete
+}
+
+// Size approximates the window's memory for UltraCache.
+func (w *hotWindow) Size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	size := int(unsafe.Sizeof(*w))
+	for i := range w.messages {
+		size += w.messages[i].memorySize()
+	}
+	return size
+}
+
+// historyService answers history requests from the cached hot window of a
+// chat when it can and from the database otherwise. Without a database the
+// hot window is the only history there is.
+type historyService struct {
+	pool    *UltraDBPool
+	cfg     HistoryConfig
+	windows *TypedCache[string, *hotWindow]
+	members *TypedCache[membershipKey, bool]
+	locks   [historyLockCount]sync.Mutex
+}
+
+func newHistoryService(pool *UltraDBPool, cfg HistoryConfig) *historyService {
+	return &historyService{
+		pool:    pool,
+		cfg:     cfg,
+		windows: NewTypedCache[string, *hotWindow](GlobalUltraCache, CacheNamespace{Name: "history", TTL: cfg.HotWindowTTL.Std()}, stringKey),
+		members: newMembershipCache(GlobalUltraCache, cfg.MembershipTTL.Std()),
+	}
+}
+
+// lock serialises loading a chat's hot window against the pipeline
+// updating it, so a message persisted during the load is not lost.
+func (hs *historyService) lock(chatID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(chatID))
+	mu := &hs.locks[h.Sum32()%historyLockCount]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// authorize checks chat membership through chat_members, caching answers
+// for MembershipTTL.
+func (hs *historyService) authorize(ctx context.Context, chatID, userID string) error {
+	if hs.pool == nil {
+		return errMembershipUnknown
+	}
+	member, err := hs.members.GetOrLoad(ctx, membershipKey{chatID, userID}, func(ctx context.Context) (bool, error) {
+		return hs.pool.IsChatMember(ctx, chatID, userID)
+	})
+	if err != nil {
+		return err
+	}
+	if !member {
+		return ErrNotChatMember
+	}
+	return nil
+}
+
+// membershipKey identifies a cached answer to whether a user is a member
+// of a chat.
+type membershipKey struct {
+	chatID, userID string
+}
+
+func (k membershipKey) String() string {
+	return k.chatID + ":" + k.userID
+}
+
+func newMembershipCache(cache *UltraCache, ttl time.Duration) *TypedCache[membershipKey, bool] {
+	return NewTypedCache[membershipKey, bool](cache, CacheNamespace{Name: "member", TTL: ttl}, membershipKey.String)
+}
+
+// forgetMembership drops the cached answer to whether userID is a member
+// of chatID, on every instance.
+func forgetMembership(chatID, userID string) {
+	if GlobalUltraCache != nil {
+		newMembershipCache(GlobalUltraCache, 0).Delete(membershipKey{chatID, userID})
+	}
+}
+
+// Page returns one page of chatID's history as seen by userID. The caller
+// has checked membership.
+func (hs *historyService) Page(ctx context.Context, chatID, userID string, req HistoryFrame) (*HistoryFrame, error) {
+	before, err := decodeCursor(req.Before)
+	if err != nil {
+		return nil, err
+	}
+	after, err := decodeCursor(req.After)
+	if err != nil {
+		return nil, err
+	}
+	if before != nil && after != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = hs.cfg.DefaultLimit
+	}
+	if limit > hs.cfg.MaxLimit {
+		limit = hs.cfg.MaxLimit
+	}
+
+	if hs.pool == nil {
+		var messages []Message
+		if w, found := hs.windows.Get(chatID); found {
+			messages, _ = w.snapshot()
+		}
+		page, hasMore := pageOf(messages, before, after, limit)
+		return newHistoryPage(page, hasMore), nil
+	}
+
+	// The newest page is the one clients ask for most; serve it from the
+	// hot window when the window covers it
+	if before == nil && after == nil && limit <= hs.cfg.HotWindowSize {
+		w, err := hs.window(ctx, chatID)
+		if err != nil {
+			return nil, err
+		}
+		messages, complete := w.snapshot()
+		if len(messages) >= limit || complete {
+			page, hasMore := pageOf(messages, nil, nil, limit)
+			hasMore = hasMore || !complete
+			if ok, err := hs.withoutHidden(ctx, userID, page); err != nil {
+				return nil, err
+			} else if ok {
+				return newHistoryPage(page, hasMore), nil
+			}
+		}
+	}
+
+	messages, err := hs.pool.MessageHistory(ctx, HistoryQuery{
+		ChatID: chatID,
+		UserID: userID,
+		Before: before,
+		After:  after,
+		Limit:  limit + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	hasMore := len(messages) > limit
+	if hasMore {
+		if after != nil {
+			messages = messages[:limit]
+		} else {
+			messages = messages[len(messages)-limit:]
+		}
+	}
+	return newHistoryPage(messages, hasMore), nil
+}
+
+// withoutHidden reports whether none of page was deleted by userID for
+// themselves; the shared hot window cannot serve such a user.
+func (hs *historyService) withoutHidden(ctx context.Context, userID string, page []Message) (bool, error) {
+	ids := make([]string, len(page))
+	for i := range page {
+		ids[i] = page[i].MessageID
+	}
+	hidden, err := hs.pool.HiddenMessages(ctx, userID, ids)
+	return len(hidden) == 0, err
+}
+
+func newHistoryPage(messages []Message, hasMore bool) *HistoryFrame {
+	page := &HistoryFrame{Messages: messages, HasMore: hasMore}
+	if len(messages) > 0 {
+		page.Before = cursorOf(&messages[0]).encode()
+		page.After = cursorOf(&messages[len(messages)-1]).encode()
+	}
+	return page
+}
+
+// pageOf pages through chronologically ordered messages in memory the same
+// way MessageHistory pages through the table.
+func pageOf(messages []Message, before, after *historyCursor, limit int) ([]Message, bool) {
+	if after != nil {
+		start := len(messages)
+		for i := range messages {
+			if after.less(cursorOf(&messages[i])) {
+				start = i
+				break
+			}
+		}
+		rest := messages[start:]
+		if len(rest) > limit {
+			return rest[:limit], true
+		}
+		return rest, false
+	}
+
+	end := len(messages)
+	if before != nil {
+		end = 0
+		for i := len(messages) - 1; i >= 0; i-- {
+			if cursorOf(&messages[i]).less(*before) {
+				end = i + 1
+				break
+			}
+		}
+	}
+	rest := messages[:end]
+	if len(rest) > limit {
+		return rest[len(rest)-limit:], true
+	}
+	return rest, false
+}
+
+// window returns the chat's hot window, loading it from the database on a
+// miss.
+func (hs *historyService) window(ctx context.Context, chatID string) (*hotWindow, error) {
+	unlock := hs.lock(chatID)
+	defer unlock()
+
+	return hs.windows.GetOrLoad(ctx, chatID, func(ctx context.Context) (*hotWindow, error) {
+		// A window loaded from a lagging replica would miss messages the
+		// history stage already skipped, so load it from the primary
+		messages, err := hs.pool.MessageHistory(ctx, HistoryQuery{ChatID: chatID, Limit: hs.cfg.HotWindowSize + 1, Primary: true})
+		if err != nil {
+			return nil, err
+		}
+		w := &hotWindow{complete: len(messages) <= hs.cfg.HotWindowSize}
+		if !w.complete {
+			messages = messages[1:]
+		}
+		w.messages = messages
+		return w, nil
+	})
+}
+
+// apply updates the chat's hot window with a processed message. With a
+// database, windows are only updated while cached; without one they are
+// created here. Other instances drop their copy of the window either way.
+func (hs *historyService) apply(msg *Message) {
+	unlock := hs.lock(msg.ChatID)
+	defer unlock()
+
+	w, found := hs.windows.Get(msg.ChatID)
+	if !found {
+		if hs.pool != nil {
+			hs.windows.Delete(msg.ChatID)
+			return
+		}
+		if !msg.Type.IsContent() {
+			return
+		}
+		w = &hotWindow{complete: true}
+	}
+
+	w.mu.Lock()
+	switch {
+	case msg.Type.IsContent():
+		entry := *msg
+		entry.walSeq, entry.deadLetter = 0, nil
+		entry.Upload, entry.History = nil, nil
+		w.insert(entry)
+		if excess := len(w.messages) - hs.cfg.HotWindowSize; excess > 0 {
+			w.messages = append([]Message(nil), w.messages[excess:]...)
+			w.complete = false
+		}
+	case msg.Type == TypeEdit:
+		if i := w.find(msg.MessageID); i >= 0 {
+			w.messages[i].Content = msg.Content
+			w.messages[i].EditedAt = msg.EditedAt
+		}
+	case msg.Type == TypeDelete && msg.Scope == DeleteForEveryone:
+		if i := w.find(msg.MessageID); i >= 0 {
+			w.messages = append(w.messages[:i:i], w.messages[i+1:]...)
+		}
+	case msg.Type == TypeReactionUpdate:
+		if i := w.find(msg.MessageID); i >= 0 {
+			w.messages[i].Reactions = msg.Reactions
+		}
+	}
+	w.mu.Unlock()
+
+	hs.windows.Set(msg.ChatID, w)
+}
+
+// insert adds msg in (created_at, id) order unless it is already present,
+// e.g. when a window loaded from the database raced its persistence.
+// Called with mu held.
+func (w *hotWindow) insert(msg Message) {
+	if w.find(msg.MessageID) >= 0 {
+		return
+	}
+	c := cursorOf(&msg)
+	i := len(w.messages)
+	for i > 0 && c.less(cursorOf(&w.messages[i-1])) {
+		i--
+	}
+	w.messages = append(w.messages, Message{})
+	copy(w.messages[i+1:], w.messages[i:])
+	w.messages[i] = msg
+}
+
+func (w *hotWindow) find(messageID string) int {
+	for i := len(w.messages) - 1; i >= 0; i-- {
+		if w.messages[i].MessageID == messageID {
+			return i
+		}
+	}
+	return -1
+}
+
+// historyStage keeps hot windows in step with new, edited, deleted and
+// reacted-to messages. It runs after persistence so a window loaded from
+// the database never misses a message the stage skipped.
+func historyStage(hs *historyService) Stage {
+	return Stage{
+		Name:    "history",
+		Order:   OrderHistory,
+		Types:   concatTypes(chatMessageTypes, changeMessageTypes, []MessageType{TypeReactionUpdate}),
+		OnError: PolicyContinue,
+		Handle: func(ctx context.Context, msg *Message) error {
+			hs.apply(msg)
+			return nil
+		},
+	}
+}
+
+// handleFrame answers a history frame from c. Membership is checked in
+// the database; without one every request is refused, as joining a chat on
+// the connection proves nothing.
+func (hs *historyService) handleFrame(c *Client, msg Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := HistoryFrame{}
+	if msg.History != nil {
+		req = *msg.History
+	}
+
+	err := hs.authorize(ctx, msg.ChatID, c.UserID)
+	var page *HistoryFrame
+	if err == nil {
+		page, err = hs.Page(ctx, msg.ChatID, c.UserID, req)
+	}
+
+	reply := Message{
+		Type:      TypeHistory,
+		ChatID:    msg.ChatID,
+		History:   page,
+		Timestamp: time.Now().Unix(),
+	}
+	if err != nil {
+		c.log.Debug("history request failed", "chat_id", msg.ChatID, "error", err)
+		reply.Type = TypeError
+		reply.Content = historyErrorText(err)
+	}
+	c.reply(reply)
+}
+
+// handleHistory serves GET /history?chatId=&userId=&before=&after=&limit=.
+// It takes userId on trust, so it is served behind history.token for the
+// backend that authenticated the user.
+func (hs *historyService) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	chatID, userID := q.Get("chatId"), q.Get("userId")
+	if chatID == "" || userID == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "chatId and userId are required"})
+		return
+	}
+	req := HistoryFrame{Before: q.Get("before"), After: q.Get("after")}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive integer"})
+			return
+		}
+		req.Limit = n
+	}
+
+	err := hs.authorize(r.Context(), chatID, userID)
+	var page *HistoryFrame
+	if err == nil {
+		page, err = hs.Page(r.Context(), chatID, userID, req)
+	}
+
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, page)
+	case errors.Is(err, ErrNotChatMember):
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrInvalidCursor):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, errMembershipUnknown):
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	default:
+		logger.Error("history request failed", "chat_id", chatID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+	}
+}
+
+func historyErrorText(err error) string {
+	for _, known := range []error{ErrNotChatMember, ErrInvalidCursor, errMembershipUnknown} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "history unavailable"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHistoryEndpointRequiresToken(t *testing.T) {
+	hs := newHistoryService(nil, DefaultConfig().History)
+	for _, tc := range []struct {
+		name, token, auth string
+		want              int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusForbidden},
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", http.StatusUnauthorized},
+		// Let through; without a database membership cannot be checked
+		{"token", "secret", "Bearer secret", http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/history?chatId=c&userId=u", nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		tokenAuth("history", tc.token)(hs.handleHistory)(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestHistoryFrameIgnoresJoinedChats(t *testing.T) {
+	hub := newHub(WebSocketConfig{BroadcastBuffer: 8})
+	hs := newHistoryService(nil, DefaultConfig().History)
+	c := &Client{ID: "c", UserID: "u", Hub: hub, Send: make(chan Message, 4), chats: make(map[string]struct{}), log: logger}
+	hub.clients[c] = true
+
+	// join_chat is not authenticated, so it grants no history
+	c.chats["chat"] = struct{}{}
+	hs.handleFrame(c, Message{Type: TypeHistory, ChatID: "chat"})
+
+	reply := <-c.Send
+	if reply.Type != TypeError || reply.History != nil {
+		t.Fatalf("reply %s with history %v, want an error", reply.Type, reply.History)
+	}
+	if reply.Content != errMembershipUnknown.Error() {
+		t.Fatalf("error %q, want %q", reply.Content, errMembershipUnknown.Error())
+	}
+}
@@ -2,6 +2,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -10,8 +12,10 @@ import (
 )
 
 type LoadBalancer struct {
-	servers []ServerInstance
-	current uint64
+	servers   []ServerInstance
+	current   uint64
+	cfg       LoadBalancerConfig
+	transport *http.Transport
 }
 
 type ServerInstance struct {
@@ -22,23 +26,37 @@ type ServerInstance struct {
 	ResponseTime time.Duration
 }
 
-func NewLoadBalancer() *LoadBalancer {
-	lb := &LoadBalancer{
-		servers: make([]ServerInstance, 0),
+// NewLoadBalancer proxies to cfg.Backends. The client certificate is
+// reloaded every reloadInterval, server.tls.reloadInterval in the config,
+// like the listener's.
+func NewLoadBalancer(cfg LoadBalancerConfig, reloadInterval time.Duration) (*LoadBalancer, error) {
+	// https:// backends are verified against cfg.TLS.CAFile and, when a
+	// client certificate is configured, authenticated with mutual TLS
+	tlsCfg, certs, err := newBackendTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if certs != nil {
+		go certs.watch(context.Background(), reloadInterval)
 	}
 	
-	// Add server instances for scaling
-	serverURLs := []string{
-		"http://0.0.0.0:8080", // Primary WebSocket server
-		"http://0.0.0.0:8081", // Secondary server
-		"http://0.0.0.0:8082", // Tertiary server
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	
+	lb := &LoadBalancer{
+		servers:   make([]ServerInstance, 0),
+		cfg:       cfg,
+		transport: transport,
 	}
 	
-	for _, serverURL := range serverURLs {
+	// Add server instances for scaling
+	for _, serverURL := range cfg.Backends {
 		if url, err := url.Parse(serverURL); err == nil {
+			proxy := httputil.NewSingleHostReverseProxy(url)
+			proxy.Transport = transport
 			server := ServerInstance{
 				URL:     url,
-				Proxy:   httputil.NewSingleHostReverseProxy(url),
+				Proxy:   proxy,
 				Healthy: true,
 			}
 			lb.servers = append(lb.servers, server)
@@ -48,7 +66,7 @@ func NewLoadBalancer() *LoadBalancer {
 	// Start health checking
 	go lb.healthCheck()
 	
-	return lb
+	return lb, nil
 }
 
 func (lb *LoadBalancer) getNextServer() *ServerInstance {
@@ -57,7 +75,7 @@ func (lb *LoadBalancer) getNextServer() *ServerInstance {
 		idx := atomic.AddUint64(&lb.current, 1) % uint64(len(lb.servers))
 		server := &lb.servers[idx]
 		
-		if server.Healthy && server.Connections < 25000 { // 25k connections per server
+		if server.Healthy && server.Connections < lb.cfg.MaxConnsPerServer {
 			atomic.AddUint64(&server.Connections, 1)
 			return server
 		}
@@ -100,13 +118,21 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (lb *LoadBalancer) healthCheck() {
-	ticker := time.NewTicker(30 * time.Second)
+	// Probe more often than a backend's drain grace period so draining
+	// instances are taken out of rotation before they stop listening
+	ticker := time.NewTicker(lb.cfg.HealthInterval.Std())
 	defer ticker.Stop()
 	
+	client := &http.Client{
+		Timeout:   lb.cfg.HealthTimeout.Std(),
+		Transport: lb.transport,
+	}
+	
 	for range ticker.C {
 		for i := range lb.servers {
 			go func(server *ServerInstance) {
-				resp, err := http.Get(server.URL.String() + "/health")
+				// /readyz fails while a backend is overloaded or draining
+				resp, err := client.Get(server.URL.String() + "/readyz")
 				server.Healthy = err == nil && resp != nil && resp.StatusCode == 200
 				if resp != nil {
 					resp.Body.Close()
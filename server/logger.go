@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel is the minimum level of the process logger. It can be changed at
+// runtime through the admin API without rebuilding the logger.
+var logLevel = new(slog.LevelVar)
+
+// logger is the process-wide structured logger. Call sites attach their own
+// context with logger.With rather than formatting it into the message.
+var logger = newLogger(os.Stdout, "json")
+
+func newLogger(w io.Writer, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// setupLogging configures the process logger. The format is "json" or
+// "text" and the level one of "debug", "info", "warn", "error".
+func setupLogging(cfg LogConfig) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	logger = newLogger(os.Stdout, cfg.Format)
+	slog.SetDefault(logger)
+	return nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// logSampler thins out hot-path log events. Within each period the first
+// events are always allowed, after that only every Nth one.
+type logSampler struct {
+	first       uint64
+	thereafter  uint64
+	period      int64
+	windowStart atomic.Int64
+	count       atomic.Uint64
+}
+
+func newLogSampler(first, thereafter uint64, period time.Duration) *logSampler {
+	if thereafter == 0 {
+		thereafter = 1
+	}
+	s := &logSampler{
+		first:      first,
+		thereafter: thereafter,
+		period:     int64(period),
+	}
+	s.windowStart.Store(time.Now().UnixNano())
+	return s
+}
+
+// Allow reports whether the current event should be logged.
+func (s *logSampler) Allow() bool {
+	now := time.Now().UnixNano()
+	start := s.windowStart.Load()
+	if now-start >= s.period && s.windowStart.CompareAndSwap(start, now) {
+		s.count.Store(0)
+	}
+
+	n := s.count.Add(1)
+	if n <= s.first {
+		return true
+	}
+	return (n-s.first)%s.thereafter == 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while a logger writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the JSON log records written so far.
+func (b *syncBuffer) records(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// captureLogs points the process logger at a buffer for the test, at level.
+func captureLogs(t *testing.T, level slog.Level) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	saved, savedLevel := logger, logLevel.Level()
+	logger = newLogger(buf, "json")
+	logLevel.Set(level)
+	t.Cleanup(func() {
+		logger = saved
+		logLevel.Set(savedLevel)
+	})
+	return buf
+}
+
+func TestParseLogLevel(t *testing.T) {
+	cases := []struct {
+		in   string
+		want slog.Level
+		ok   bool
+	}{
+		{"debug", slog.LevelDebug, true},
+		{"INFO", slog.LevelInfo, true},
+		{" warn ", slog.LevelWarn, true},
+		{"error", slog.LevelError, true},
+		{"info+2", slog.LevelInfo + 2, true},
+		{"verbose", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseLogLevel(c.in)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("parseLogLevel(%q) = %v, %v, want %v ok %v", c.in, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestLogLevelFiltersAtRuntime(t *testing.T) {
+	buf := captureLogs(t, slog.LevelWarn)
+	logger.Info("hidden")
+	logger.Warn("shown")
+	logLevel.Set(slog.LevelDebug)
+	logger.Debug("shown after the change")
+
+	records := buf.records(t)
+	if len(records) != 2 || records[0]["msg"] != "shown" || records[1]["msg"] != "shown after the change" {
+		t.Fatalf("logged %v", records)
+	}
+}
+
+func TestClientLogsCarryConnectionAttributes(t *testing.T) {
+	buf := captureLogs(t, slog.LevelInfo)
+	cfg := DefaultConfig().WebSocket
+	hub := newHub(cfg)
+	go hub.run()
+	server := httptest.NewServer(http.HandlerFunc(hub.handleWebSocket))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?userId=alice"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var welcome Message
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+
+	var connected map[string]interface{}
+	for _, record := range buf.records(t) {
+		if record["msg"] == "client connected" {
+			connected = record
+		}
+	}
+	if connected == nil {
+		t.Fatal("no client connected record")
+	}
+	if connected["user_id"] != "alice" || !strings.HasPrefix(connected["client_id"].(string), "client_") || connected["remote_addr"] == "" {
+		t.Fatalf("client connected record %v lacks the connection attributes", connected)
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	s := newLogSampler(3, 5, time.Hour)
+	var allowed []int
+	for i := 1; i <= 20; i++ {
+		if s.Allow() {
+			allowed = append(allowed, i)
+		}
+	}
+	// The first three, then every fifth after them
+	if want := []int{1, 2, 3, 8, 13, 18}; !reflect.DeepEqual(allowed, want) {
+		t.Fatalf("allowed events %v, want %v", allowed, want)
+	}
+
+	// A new period starts over
+	s = newLogSampler(1, 100, time.Millisecond)
+	s.Allow()
+	if s.Allow() {
+		t.Fatal("second event of a period allowed")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !s.Allow() {
+		t.Fatal("first event of a new period dropped")
+	}
+}
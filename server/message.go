@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"unsafe"
+)
+
+// MessageType is the kind of a message. It is sent as the "type" field of
+// every frame.
+type MessageType string
+
+const (
+	// Content carrying messages
+	TypeMessage MessageType = "message"
+	TypeChat    MessageType = "chat"
+	TypeReply   MessageType = "reply"
+
+	// Changes to an earlier message, identified by MessageID
+	TypeEdit   MessageType = "edit"
+	TypeDelete MessageType = "delete"
+
+	// Reactions to an earlier message, identified by MessageID
+	TypeReact   MessageType = "react"
+	TypeUnreact MessageType = "unreact"
+
+	// Chunked uploads, see fileService
+	TypeUploadInit     MessageType = "upload_init"
+	TypeUploadChunk    MessageType = "upload_chunk"
+	TypeUploadComplete MessageType = "upload_complete"
+	TypeUploadAbort    MessageType = "upload_abort"
+
+	// TypeHistory requests a page of a chat's history; the reply has the
+	// same type and carries the page.
+	TypeHistory MessageType = "history"
+
+	// Client requests
+	TypeJoinChat  MessageType = "join_chat"
+	TypeLeaveChat MessageType = "leave_chat"
+	TypeRead      MessageType = "read"
+	TypePing      MessageType = "ping"
+
+	// Server frames
+	TypePong   MessageType = "pong"
+	TypeAck    MessageType = "ack"
+	TypeError  MessageType = "error"
+	TypeSystem MessageType = "system"
+
+	// TypeReactionUpdate carries a message's new reaction counts after a
+	// react or unreact, so clients need not re-fetch the message.
+	TypeReactionUpdate MessageType = "reaction_update"
+	// TypeUploadStatus reports how many bytes of an upload were received.
+	TypeUploadStatus MessageType = "upload_status"
+)
+
+// IsContent reports whether messages of this type carry user content.
+func (t MessageType) IsContent() bool {
+	return t == TypeMessage || t == TypeChat || t == TypeReply
+}
+
+// DeleteScope says who a delete applies to.
+type DeleteScope string
+
+const (
+	// DeleteForMe hides the message for the requesting user only.
+	DeleteForMe DeleteScope = "me"
+	// DeleteForEveryone removes the message for every chat member. Only
+	// the sender may do this, within the configured delete window.
+	DeleteForEveryone DeleteScope = "everyone"
+)
+
+// Attachment describes a file attached to a message.
+type Attachment struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType,omitempty"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url,omitempty"`
+}
+
+// UploadFrame is the payload of upload frames. Chunk travels base64
+// encoded in JSON. SHA256 is the whole file's digest on upload_init and,
+// optionally, the chunk's digest on upload_chunk.
+type UploadFrame struct {
+	UploadID string `json:"uploadId,omitempty"`
+	Name     string `json:"name,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Offset   int64  `json:"offset"`
+	Chunk    []byte `json:"chunk,omitempty"`
+	FileID   string `json:"fileId,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// Message is the single message model shared by the hub, the processor
+// pipeline, the database pool and the binary protocol. UserID is the
+// sender.
+type Message struct {
+	Type        MessageType            `json:"type"`
+	Content     string                 `json:"content"`
+	Timestamp   int64                  `json:"timestamp"`
+	UserID      string                 `json:"userId"`
+	SenderName  string                 `json:"senderName,omitempty"`
+	ChatID      string                 `json:"chatId"`
+	MessageID   string                 `json:"messageId"`
+	ReplyTo     string                 `json:"replyTo,omitempty"`
+	EditedAt    int64                  `json:"editedAt,omitempty"`
+	CreatedAt   int64                  `json:"createdAt,omitempty"` // server-assigned, Unix microseconds
+	Scope       DeleteScope            `json:"scope,omitempty"`
+	Emoji       string                 `json:"emoji,omitempty"`
+	Reactions   map[string]int         `json:"reactions,omitempty"`
+	Upload      *UploadFrame           `json:"upload,omitempty"`
+	History     *HistoryFrame          `json:"history,omitempty"`
+	Attachments []Attachment           `json:"attachments,omitempty"`
+	Compressed  bool                   `json:"compressed,omitempty"`
+	Data        map[string]interface{} `json:"data,omitempty"`
+
+	walSeq     uint64      // write-ahead log sequence, 0 when not logged
+	deadLetter *DeadLetter // record the message was replayed from, if any
+}
+
+// memorySize approximates the bytes msg takes in memory, for caches bound
+// by size. Upload and history frames and Data are not counted, as stored
+// messages do not carry them.
+func (msg *Message) memorySize() int {
+	size := int(unsafe.Sizeof(*msg)) + len(msg.Type) + len(msg.Content) + len(msg.UserID) +
+		len(msg.SenderName) + len(msg.ChatID) + len(msg.MessageID) + len(msg.ReplyTo) + len(msg.Emoji)
+	for emoji := range msg.Reactions {
+		size += len(emoji) + 32
+	}
+	for _, a := range msg.Attachments {
+		size += int(unsafe.Sizeof(a)) + len(a.ID) + len(a.Name) + len(a.MimeType) + len(a.URL)
+	}
+	return size
+}
+
+// ultraTypeCodes are the UltraMessage type bytes. Code 0 is reserved for
+// types without a code; the name still travels in the payload.
+var ultraTypeCodes = map[MessageType]uint8{
+	TypeMessage:        1,
+	TypeChat:           2,
+	TypeJoinChat:       3,
+	TypeLeaveChat:      4,
+	TypeRead:           5,
+	TypePing:           6,
+	TypePong:           7,
+	TypeAck:            8,
+	TypeError:          9,
+	TypeSystem:         10,
+	TypeReply:          11,
+	TypeEdit:           12,
+	TypeDelete:         13,
+	TypeReact:          14,
+	TypeUnreact:        15,
+	TypeReactionUpdate: 16,
+	TypeUploadInit:     17,
+	TypeUploadChunk:    18,
+	TypeUploadComplete: 19,
+	TypeUploadAbort:    20,
+	TypeUploadStatus:   21,
+	TypeHistory:        22,
+}
+
+// ErrUltraChecksum is returned when an UltraMessage payload does not match
+// its checksum.
+var ErrUltraChecksum = errors.New("ultra message checksum mismatch")
+
+// ToUltra converts the message to its binary protocol frame. The payload is
+// the JSON encoding of the message.
+func (m *Message) ToUltra(sequence uint64) (*UltraMessage, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &UltraMessage{
+		Type:      ultraTypeCodes[m.Type],
+		Sequence:  sequence,
+		Timestamp: uint64(m.Timestamp),
+		Length:    uint32(len(data)),
+		Data:      data,
+		Checksum:  crc32.ChecksumIEEE(data),
+	}, nil
+}
+
+// MessageFromUltra decodes a binary protocol frame produced by ToUltra.
+func MessageFromUltra(um *UltraMessage) (Message, error) {
+	var msg Message
+	if int(um.Length) != len(um.Data) {
+		return msg, fmt.Errorf("ultra message length %d, payload %d bytes", um.Length, len(um.Data))
+	}
+	if crc32.ChecksumIEEE(um.Data) != um.Checksum {
+		return msg, ErrUltraChecksum
+	}
+	if err := json.Unmarshal(um.Data, &msg); err != nil {
+		return msg, err
+	}
+
+	if msg.Type == "" {
+		for t, code := range ultraTypeCodes {
+			if code == um.Type {
+				msg.Type = t
+				break
+			}
+		}
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = int64(um.Timestamp)
+	}
+	return msg, nil
+}
+
+// StoredType is the messages.message_type of a content message: "image"
+// when its first attachment is an image, "file" for other attachments and
+// "text" otherwise.
+func (m *Message) StoredType() string {
+	switch {
+	case len(m.Attachments) == 0:
+		return "text"
+	case strings.HasPrefix(m.Attachments[0].MimeType, "image/"):
+		return "image"
+	default:
+		return "file"
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+var (
+	// ErrMessageNotFound is returned when an edit, delete or reply refers
+	// to a message this server does not know in the given chat.
+	ErrMessageNotFound = fmt.Errorf("message %w", ErrNotFound)
+	// ErrNotMessageSender is returned when someone other than the sender
+	// edits a message or deletes it for everyone.
+	ErrNotMessageSender = errors.New("only the sender may change this message")
+	// ErrChangeWindowClosed is returned once the edit or delete window of a
+	// message has passed.
+	ErrChangeWindowClosed = errors.New("message can no longer be changed")
+	// ErrMessageDeleted is returned for changes to a message deleted for
+	// everyone.
+	ErrMessageDeleted = errors.New("message was deleted")
+)
+
+// MessageMeta is what edit, delete and reply handling needs to know about
+// an earlier message.
+type MessageMeta struct {
+	SenderID  string
+	ChatID    string
+	CreatedAt time.Time
+	Deleted   bool
+}
+
+// Size approximates the metadata's memory for UltraCache.
+func (m MessageMeta) Size() int {
+	return int(unsafe.Sizeof(m)) + len(m.SenderID) + len(m.ChatID)
+}
+
+// unknownMessageTTL is how long a message found neither in the cache nor
+// in the database stays unknown. It is short, as the message may just not
+// have been stored yet by the instance it was sent to.
+const unknownMessageTTL = 2 * time.Second
+
+// messageIndex resolves earlier messages for edit, delete and reply frames.
+// Recent messages are remembered in the cache for as long as they can still
+// be changed; older ones are looked up in the database when there is one.
+type messageIndex struct {
+	pool  *UltraDBPool
+	cache *TypedCache[string, MessageMeta]
+}
+
+func newMessageIndex(pool *UltraDBPool, cfg MessagesConfig) *messageIndex {
+	ttl := cfg.EditWindow.Std()
+	if cfg.DeleteWindow.Std() > ttl {
+		ttl = cfg.DeleteWindow.Std()
+	}
+	return &messageIndex{
+		pool: pool,
+		cache: NewTypedCache[string, MessageMeta](GlobalUltraCache, CacheNamespace{
+			Name:        "msgmeta",
+			TTL:         ttl,
+			NotFound:    ErrMessageNotFound,
+			NegativeTTL: unknownMessageTTL,
+		}, stringKey),
+	}
+}
+
+// added records msg, a new message, once it is stored. A message already
+// known keeps its entry, so a message cannot take over the ID of another.
+func (ix *messageIndex) added(msg *Message) {
+	if _, found := ix.cache.Get(msg.MessageID); found {
+		return
+	}
+	ix.cache.Set(msg.MessageID, MessageMeta{
+		SenderID:  msg.UserID,
+		ChatID:    msg.ChatID,
+		CreatedAt: time.UnixMicro(msg.CreatedAt),
+	})
+}
+
+// deleted marks a remembered message as deleted for everyone once the
+// deletion is stored.
+func (ix *messageIndex) deleted(messageID string) {
+	if meta, found := ix.cache.Get(messageID); found {
+		meta.Deleted = true
+		ix.cache.Set(messageID, meta)
+	}
+}
+
+func (ix *messageIndex) lookup(ctx context.Context, messageID string) (MessageMeta, error) {
+	return ix.cache.GetOrLoad(ctx, messageID, func(ctx context.Context) (MessageMeta, error) {
+		if ix.pool == nil {
+			return MessageMeta{}, ErrMessageNotFound
+		}
+		return ix.pool.GetMessageMeta(ctx, messageID)
+	})
+}
+
+// authorizeChange checks that msg, an edit or delete, may be applied to the
+// message described by meta at time now. It compares msg.UserID with the
+// recorded sender, which only keeps one connection's user from changing
+// another's messages: while sockets are unauthenticated anyone can connect
+// as any user ID, so this is not proof of who sent msg.
+func authorizeChange(msg *Message, meta MessageMeta, cfg MessagesConfig, now time.Time) error {
+	if meta.ChatID != msg.ChatID {
+		// Do not reveal messages of other chats
+		return ErrMessageNotFound
+	}
+	if meta.Deleted {
+		return ErrMessageDeleted
+	}
+
+	var window time.Duration
+	switch {
+	case msg.Type == TypeEdit:
+		window = cfg.EditWindow.Std()
+	case msg.Type == TypeDelete && msg.Scope == DeleteForEveryone:
+		window = cfg.DeleteWindow.Std()
+	default:
+		// Anyone in the chat may hide a message for themselves
+		return nil
+	}
+
+	if meta.SenderID != msg.UserID {
+		return ErrNotMessageSender
+	}
+	if now.Sub(meta.CreatedAt) > window {
+		return ErrChangeWindowClosed
+	}
+	return nil
+}
+
+// authorizationStage admits edits, deletes, reactions and replies only
+// when they refer to a message they may touch, as far as the claimed user
+// ID allows; see authorizeChange. With a database the persistence stage
+// records new messages and deletions in the index once they are stored;
+// without one this stage records them. Rejected frames are reported back to the sender's sessions.
+func authorizationStage(hub *Hub, index *messageIndex, cfg MessagesConfig) Stage {
+	return Stage{
+		Name:    "authorization",
+		Order:   OrderAuthorization,
+		Types:   concatTypes(changeMessageTypes, reactionMessageTypes, chatMessageTypes),
+		Timeout: time.Second,
+		OnError: PolicyDrop,
+		Handle: func(ctx context.Context, msg *Message) error {
+			now := time.Now()
+
+			err := func() error {
+				switch msg.Type {
+				case TypeEdit, TypeDelete:
+					meta, err := index.lookup(ctx, msg.MessageID)
+					if err != nil {
+						return err
+					}
+					if err := authorizeChange(msg, meta, cfg, now); err != nil {
+						return err
+					}
+					if msg.Type == TypeEdit {
+						msg.EditedAt = now.Unix()
+					} else if msg.Scope == DeleteForEveryone {
+						msg.Content = ""
+						if index.pool == nil {
+							index.deleted(msg.MessageID)
+						}
+					}
+					return nil
+
+				case TypeReact, TypeUnreact:
+					meta, err := index.lookup(ctx, msg.MessageID)
+					if err != nil {
+						return err
+					}
+					if meta.ChatID != msg.ChatID {
+						return ErrMessageNotFound
+					}
+					if meta.Deleted {
+						return ErrMessageDeleted
+					}
+					return nil
+
+				case TypeReply:
+					meta, err := index.lookup(ctx, msg.ReplyTo)
+					if err != nil {
+						return err
+					}
+					if meta.ChatID != msg.ChatID {
+						return ErrMessageNotFound
+					}
+				}
+
+				// Keep the creation time of a replayed message
+				if msg.CreatedAt == 0 {
+					msg.CreatedAt = now.UnixMicro()
+				}
+				if index.pool == nil {
+					index.added(msg)
+				}
+				return nil
+			}()
+
+			if err != nil && msg.UserID != "" {
+				hub.SendToUser(msg.UserID, Message{
+					Type:      TypeError,
+					Content:   changeErrorText(err),
+					ChatID:    msg.ChatID,
+					MessageID: msg.MessageID,
+					Timestamp: now.Unix(),
+				})
+			}
+			return err
+		},
+	}
+}
+
+// changeErrorText is the error shown to the sender; database and timeout
+// errors are not passed through.
+func changeErrorText(err error) string {
+	for _, known := range []error{ErrMessageNotFound, ErrNotMessageSender, ErrChangeWindowClosed, ErrMessageDeleted} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "message could not be processed"
+}
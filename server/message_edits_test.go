@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestMessageIndex(t *testing.T, pool *UltraDBPool) *messageIndex {
+	t.Helper()
+	return &messageIndex{
+		pool: pool,
+		cache: NewTypedCache[string, MessageMeta](newTestCache(t, 1), CacheNamespace{
+			Name:        "msgmeta",
+			TTL:         time.Hour,
+			NotFound:    ErrMessageNotFound,
+			NegativeTTL: unknownMessageTTL,
+		}, stringKey),
+	}
+}
+
+func testMessagesConfig() MessagesConfig {
+	return MessagesConfig{EditWindow: Duration(time.Hour), DeleteWindow: Duration(time.Hour)}
+}
+
+func TestAuthorizationKeepsSenderOfKnownID(t *testing.T) {
+	ctx := context.Background()
+	index := newTestMessageIndex(t, nil)
+	auth := authorizationStage(newHub(WebSocketConfig{BroadcastBuffer: 8}), index, testMessagesConfig())
+
+	original := &Message{Type: TypeMessage, MessageID: "m1", ChatID: "chat", UserID: "alice", Content: "hi"}
+	if err := auth.Handle(ctx, original); err != nil {
+		t.Fatal(err)
+	}
+	// A message reusing the ID does not take it over
+	forged := &Message{Type: TypeMessage, MessageID: "m1", ChatID: "chat", UserID: "mallory", Content: "mine now"}
+	if err := auth.Handle(ctx, forged); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := &Message{Type: TypeEdit, MessageID: "m1", ChatID: "chat", UserID: "mallory", Content: "edited"}
+	if err := auth.Handle(ctx, edit); !errors.Is(err, ErrNotMessageSender) {
+		t.Fatalf("edit by the forger = %v, want %v", err, ErrNotMessageSender)
+	}
+	edit.UserID = "alice"
+	if err := auth.Handle(ctx, edit); err != nil {
+		t.Fatalf("edit by the sender = %v", err)
+	}
+}
+
+func TestPersistenceRecordsOnlyStoredChanges(t *testing.T) {
+	ctx := context.Background()
+	pool, fake := newTestDBPool(t)
+	index := newTestMessageIndex(t, pool)
+	cfg := testMessagesConfig()
+	auth := authorizationStage(newHub(WebSocketConfig{BroadcastBuffer: 8}), index, cfg)
+	persistence := persistenceStage(pool, index, RetryPolicy{MaxAttempts: 1})
+
+	// With a database nothing is recorded before the insert succeeds
+	msg := &Message{Type: TypeMessage, MessageID: "m1", ChatID: "chat", UserID: "alice", Content: "hi"}
+	if err := auth.Handle(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := index.cache.Get("m1"); found {
+		t.Fatal("message recorded before it was stored")
+	}
+	if err := persistence.Handle(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if meta, found := index.cache.Get("m1"); !found || meta.SenderID != "alice" {
+		t.Fatalf("stored message recorded as %+v, %v", meta, found)
+	}
+
+	// A message whose ID is already stored was not inserted and records
+	// nothing
+	fake.stored["m2"] = true
+	other := &Message{Type: TypeMessage, MessageID: "m2", ChatID: "chat", UserID: "mallory", Content: "x"}
+	if err := persistence.Handle(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := index.cache.Get("m2"); found {
+		t.Fatal("message not inserted was recorded")
+	}
+
+	// A deletion is recorded once stored, not when authorized
+	del := &Message{Type: TypeDelete, Scope: DeleteForEveryone, MessageID: "m1", ChatID: "chat", UserID: "alice"}
+	if err := auth.Handle(ctx, del); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := index.cache.Get("m1"); meta.Deleted {
+		t.Fatal("message marked deleted before the deletion was stored")
+	}
+	if err := persistence.Handle(ctx, del); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := index.cache.Get("m1"); !meta.Deleted {
+		t.Fatal("stored deletion not recorded")
+	}
+
+	// A deletion the database refuses leaves the entry alone
+	index.cache.Set("m3", MessageMeta{SenderID: "alice", ChatID: "chat", CreatedAt: time.Now()})
+	del = &Message{Type: TypeDelete, Scope: DeleteForEveryone, MessageID: "m3", ChatID: "chat", UserID: "alice"}
+	if err := persistence.Handle(ctx, del); !errors.Is(err, ErrPermanent) {
+		t.Fatalf("deleting an unstored message = %v, want a permanent failure", err)
+	}
+	if meta, _ := index.cache.Get("m3"); meta.Deleted {
+		t.Fatal("failed deletion recorded")
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StageFunc processes a message in place. Stages must honour ctx, which
+// carries the stage timeout.
+type StageFunc func(ctx context.Context, msg *Message) error
+
+// BatchStageFunc processes several messages in one call and returns the
+// error of each at its index, or nil when all of them succeeded.
+type BatchStageFunc func(ctx context.Context, msgs []*Message) []error
+
+// ErrorPolicy decides what happens to a message when a stage fails.
+type ErrorPolicy int
+
+const (
+	// PolicyDrop stops processing and discards the message.
+	PolicyDrop ErrorPolicy = iota
+	// PolicyContinue logs the failure and moves on to the next stage.
+	PolicyContinue
+	// PolicyRetry re-runs the stage with the stage's RetryPolicy, then hands
+	// the message to the dead-letter handler. ErrPermanent failures are
+	// neither retried nor dead-lettered.
+	PolicyRetry
+	// PolicyDeadLetter stops processing and hands the message to the
+	// dead-letter handler.
+	PolicyDeadLetter
+)
+
+func (p ErrorPolicy) String() string {
+	switch p {
+	case PolicyDrop:
+		return "drop"
+	case PolicyContinue:
+		return "continue"
+	case PolicyRetry:
+		return "retry"
+	case PolicyDeadLetter:
+		return "dead_letter"
+	default:
+		return fmt.Sprintf("policy(%d)", int(p))
+	}
+}
+
+// ErrDropMessage lets a stage discard a message on purpose, e.g. a content
+// filter rejecting it. It is counted as a drop, not a failure.
+var ErrDropMessage = errors.New("message dropped by stage")
+
+// ErrPermanent marks a stage failure that another attempt cannot fix, such
+// as an edit of a message that does not exist. The stage is not retried
+// and the message is not dead-lettered, as a replay would fail the same
+// way. Stages wrap their errors with permanent.
+var ErrPermanent = errors.New("permanent failure")
+
+func permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// ErrUnsettled is matched by Run's error when the message reached no final
+// outcome: the context ended during a stage, or the dead-letter handler
+// could not keep it. The caller should process it again later.
+var ErrUnsettled = errors.New("message not settled")
+
+// Stage is a named step of the message pipeline. Stages run in ascending
+// Order; stages with equal Order run in registration order.
+type Stage struct {
+	Name    string
+	Order   int
+	Types   []MessageType // message types the stage applies to, empty for all
+	Timeout time.Duration
+	OnError ErrorPolicy
+	Retry   RetryPolicy // used with PolicyRetry
+	Handle  StageFunc
+	// HandleBatch, if set, replaces Handle in RunBatch, e.g. to store a
+	// batch in one database round trip.
+	HandleBatch BatchStageFunc
+}
+
+func (s *Stage) appliesTo(msgType MessageType) bool {
+	if len(s.Types) == 0 {
+		return true
+	}
+	for _, t := range s.Types {
+		if t == msgType {
+			return true
+		}
+	}
+	return false
+}
+
+// stageMetrics are the per-stage counters reported by GetStats.
+type stageMetrics struct {
+	calls      atomic.Uint64
+	failures   atomic.Uint64
+	retries    atomic.Uint64
+	drops      atomic.Uint64
+	totalNanos atomic.Int64
+	maxNanos   atomic.Int64
+}
+
+func (m *stageMetrics) observe(d time.Duration) {
+	m.calls.Add(1)
+	m.totalNanos.Add(int64(d))
+	for {
+		max := m.maxNanos.Load()
+		if int64(d) <= max || m.maxNanos.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+type registeredStage struct {
+	Stage
+	seq     int
+	metrics stageMetrics
+}
+
+// DeadLetterFunc receives messages that a stage gave up on, with the number
+// of attempts made. It returns an error when it could not keep the
+// message.
+type DeadLetterFunc func(msg *Message, stage string, attempts int, err error) error
+
+// Pipeline runs a message through its registered stages.
+type Pipeline struct {
+	mu         sync.RWMutex
+	stages     []*registeredStage
+	seq        int
+	deadLetter DeadLetterFunc
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// Register adds a stage. Stage names must be unique.
+func (p *Pipeline) Register(stage Stage) error {
+	if stage.Name == "" || stage.Handle == nil {
+		return errors.New("pipeline stage needs a name and a handler")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, existing := range p.stages {
+		if existing.Name == stage.Name {
+			return fmt.Errorf("pipeline stage %q already registered", stage.Name)
+		}
+	}
+
+	p.seq++
+	stages := append(append([]*registeredStage(nil), p.stages...), &registeredStage{Stage: stage, seq: p.seq})
+	sort.SliceStable(stages, func(i, j int) bool {
+		if stages[i].Order != stages[j].Order {
+			return stages[i].Order < stages[j].Order
+		}
+		return stages[i].seq < stages[j].seq
+	})
+	p.stages = stages
+	return nil
+}
+
+// Remove unregisters the named stage.
+func (p *Pipeline) Remove(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, s := range p.stages {
+		if s.Name == name {
+			p.stages = append(append([]*registeredStage(nil), p.stages[:i]...), p.stages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetDeadLetterHandler installs the receiver for messages that exhausted
+// their retries or hit a PolicyDeadLetter stage.
+func (p *Pipeline) SetDeadLetterHandler(fn DeadLetterFunc) {
+	p.mu.Lock()
+	p.deadLetter = fn
+	p.mu.Unlock()
+}
+
+// Run passes msg through every applicable stage. It returns nil when the
+// message completed the pipeline, ErrDropMessage when a stage dropped it and
+// the stage error otherwise, which also matches ErrUnsettled if the
+// message was neither dropped nor dead-lettered.
+func (p *Pipeline) Run(ctx context.Context, msg *Message) error {
+	p.mu.RLock()
+	stages := p.stages
+	deadLetter := p.deadLetter
+	p.mu.RUnlock()
+
+	for _, stage := range stages {
+		if !stage.appliesTo(msg.Type) {
+			continue
+		}
+		attempts, err := stage.run(ctx, msg)
+		if err == nil {
+			continue
+		}
+		if err := stage.fail(ctx, deadLetter, msg, attempts, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunBatch passes msgs through the pipeline one stage at a time and
+// returns what Run would for each message, at its index. Stages with a
+// HandleBatch get the messages still in the pipeline in one call; the
+// others take them one by one, in order. The messages must not depend on
+// each other, e.g. an edit on the message it edits, as every one of them
+// passes a stage before any passes the next.
+func (p *Pipeline) RunBatch(ctx context.Context, msgs []*Message) []error {
+	p.mu.RLock()
+	stages := p.stages
+	deadLetter := p.deadLetter
+	p.mu.RUnlock()
+
+	errs := make([]error, len(msgs))
+	for _, stage := range stages {
+		var (
+			batch []*Message
+			index []int
+		)
+		for i, msg := range msgs {
+			if errs[i] == nil && stage.appliesTo(msg.Type) {
+				batch = append(batch, msg)
+				index = append(index, i)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		attempts, stageErrs := stage.runBatch(ctx, batch)
+		for k, err := range stageErrs {
+			if err != nil {
+				errs[index[k]] = stage.fail(ctx, deadLetter, batch[k], attempts[k], err)
+			}
+		}
+	}
+	return errs
+}
+
+// fail applies the stage's error policy to msg, which failed with err
+// after the given attempts. It returns nil when msg moves on to the next
+// stage and the error for Run to report otherwise.
+func (s *registeredStage) fail(ctx context.Context, deadLetter DeadLetterFunc, msg *Message, attempts int, err error) error {
+	if errors.Is(err, ErrDropMessage) {
+		s.metrics.drops.Add(1)
+		return err
+	}
+
+	s.metrics.failures.Add(1)
+	logger.Warn("pipeline stage failed",
+		"stage", s.Name, "policy", s.OnError.String(), "attempts", attempts,
+		"type", msg.Type, "chat_id", msg.ChatID, "error", err)
+
+	// Cancelled, not failed: the message is left for a later run
+	if ctx.Err() != nil {
+		return fmt.Errorf("stage %s: %w: %w", s.Name, ErrUnsettled, err)
+	}
+
+	switch s.OnError {
+	case PolicyContinue:
+		return nil
+	case PolicyRetry, PolicyDeadLetter:
+		if deadLetter != nil && !errors.Is(err, ErrPermanent) {
+			if dlErr := deadLetter(msg, s.Name, attempts, err); dlErr != nil {
+				return fmt.Errorf("stage %s: %w: %w", s.Name, ErrUnsettled, err)
+			}
+		}
+	}
+	return fmt.Errorf("stage %s: %w", s.Name, err)
+}
+
+func (s *registeredStage) maxAttempts() int {
+	if s.OnError == PolicyRetry && s.Retry.MaxAttempts > 1 {
+		return s.Retry.MaxAttempts
+	}
+	return 1
+}
+
+// final reports whether err ends the attempts at a stage.
+func final(err error) bool {
+	return err == nil || errors.Is(err, ErrDropMessage) || errors.Is(err, ErrPermanent)
+}
+
+// backoff waits before the given attempt. It returns ctx.Err() if ctx
+// ends first.
+func (s *registeredStage) backoff(ctx context.Context, attempt int) error {
+	s.metrics.retries.Add(1)
+	select {
+	case <-time.After(s.Retry.Backoff(attempt)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call invokes fn with the stage timeout and records its latency.
+func (s *registeredStage) call(ctx context.Context, fn func(ctx context.Context)) {
+	stageCtx, cancel := ctx, context.CancelFunc(func() {})
+	if s.Timeout > 0 {
+		stageCtx, cancel = context.WithTimeout(ctx, s.Timeout)
+	}
+	start := time.Now()
+	fn(stageCtx)
+	s.metrics.observe(time.Since(start))
+	cancel()
+}
+
+// run invokes the stage with its timeout, retrying under PolicyRetry
+// unless the failure is permanent, and returns the number of attempts
+// made.
+func (s *registeredStage) run(ctx context.Context, msg *Message) (int, error) {
+	maxAttempts := s.maxAttempts()
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			if waitErr := s.backoff(ctx, attempt); waitErr != nil {
+				return attempt - 1, waitErr
+			}
+		}
+		s.call(ctx, func(ctx context.Context) { err = s.Handle(ctx, msg) })
+		if final(err) {
+			return attempt, err
+		}
+	}
+	return maxAttempts, err
+}
+
+// runBatch is run for several messages. With a HandleBatch, the messages
+// that failed are retried together.
+func (s *registeredStage) runBatch(ctx context.Context, msgs []*Message) ([]int, []error) {
+	attempts := make([]int, len(msgs))
+	errs := make([]error, len(msgs))
+	if s.HandleBatch == nil {
+		for i, msg := range msgs {
+			attempts[i], errs[i] = s.run(ctx, msg)
+		}
+		return attempts, errs
+	}
+
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 1; attempt <= s.maxAttempts() && len(pending) > 0; attempt++ {
+		if attempt > 1 {
+			if waitErr := s.backoff(ctx, attempt); waitErr != nil {
+				for _, i := range pending {
+					errs[i] = waitErr
+				}
+				break
+			}
+		}
+
+		batch := make([]*Message, len(pending))
+		for k, i := range pending {
+			batch[k] = msgs[i]
+		}
+		var batchErrs []error
+		s.call(ctx, func(ctx context.Context) { batchErrs = s.HandleBatch(ctx, batch) })
+
+		var retry []int
+		for k, i := range pending {
+			attempts[i], errs[i] = attempt, nil
+			if batchErrs != nil {
+				errs[i] = batchErrs[k]
+			}
+			if !final(errs[i]) {
+				retry = append(retry, i)
+			}
+		}
+		pending = retry
+	}
+	return attempts, errs
+}
+
+// Stats reports per-stage call counts and latencies.
+func (p *Pipeline) Stats() []map[string]interface{} {
+	p.mu.RLock()
+	stages := p.stages
+	p.mu.RUnlock()
+
+	stats := make([]map[string]interface{}, 0, len(stages))
+	for _, s := range stages {
+		calls := s.metrics.calls.Load()
+		avg := int64(0)
+		if calls > 0 {
+			avg = s.metrics.totalNanos.Load() / int64(calls)
+		}
+		stats = append(stats, map[string]interface{}{
+			"name":           s.Name,
+			"order":          s.Order,
+			"policy":         s.OnError.String(),
+			"calls":          calls,
+			"failures":       s.metrics.failures.Load(),
+			"retries":        s.metrics.retries.Load(),
+			"drops":          s.metrics.drops.Load(),
+			"avg_latency_us": avg / int64(time.Microsecond),
+			"max_latency_us": s.metrics.maxNanos.Load() / int64(time.Microsecond),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestPipelineSkipsRetriesOfPermanentFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		err          error
+		wantAttempts int
+		deadLettered bool
+	}{
+		{"transient", io.ErrUnexpectedEOF, 3, true},
+		{"permanent", permanent(ErrMessageNotFound), 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewPipeline()
+			attempts := 0
+			err := p.Register(Stage{
+				Name:    "persistence",
+				OnError: PolicyRetry,
+				Retry:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+				Handle: func(ctx context.Context, msg *Message) error {
+					attempts++
+					return tc.err
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			deadLettered := false
+			p.SetDeadLetterHandler(func(msg *Message, stage string, attempts int, err error) error {
+				deadLettered = true
+				return nil
+			})
+
+			if err := p.Run(context.Background(), &Message{Type: TypeEdit}); !errors.Is(err, tc.err) {
+				t.Fatalf("Run = %v, want %v", err, tc.err)
+			}
+			if attempts != tc.wantAttempts {
+				t.Fatalf("stage ran %d times, want %d", attempts, tc.wantAttempts)
+			}
+			if deadLettered != tc.deadLettered {
+				t.Fatalf("dead-lettered %v, want %v", deadLettered, tc.deadLettered)
+			}
+		})
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{ErrMessageNotFound, true},
+		{fmt.Errorf("edit: %w", ErrMessageNotFound), true},
+		{&pq.Error{Code: "22P02"}, true}, // invalid input syntax for type uuid
+		{&pq.Error{Code: "23503"}, true}, // foreign key violation
+		{&pq.Error{Code: "08006"}, false},
+		{&pq.Error{Code: "40001"}, false},
+		{context.DeadlineExceeded, false},
+		{io.EOF, false},
+	} {
+		if got := isPermanent(tc.err); got != tc.want {
+			t.Fatalf("isPermanent(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestPipelineLeavesCancelledMessagesUnsettled(t *testing.T) {
+	storeErr := errors.New("dead letter store full")
+	for _, tc := range []struct {
+		name      string
+		cancelled bool
+		handler   error
+		unsettled bool
+	}{
+		{"dead-lettered", false, nil, false},
+		{"dead letter lost", false, storeErr, true},
+		{"cancelled", true, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			p := NewPipeline()
+			err := p.Register(Stage{
+				Name:    "persistence",
+				OnError: PolicyRetry,
+				Retry:   RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+				Handle: func(stageCtx context.Context, msg *Message) error {
+					if tc.cancelled {
+						cancel()
+						return stageCtx.Err()
+					}
+					return io.ErrUnexpectedEOF
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			deadLettered := false
+			p.SetDeadLetterHandler(func(msg *Message, stage string, attempts int, err error) error {
+				deadLettered = true
+				return tc.handler
+			})
+
+			err = p.Run(ctx, &Message{Type: TypeMessage})
+			if err == nil || errors.Is(err, ErrUnsettled) != tc.unsettled {
+				t.Fatalf("Run = %v, want unsettled %v", err, tc.unsettled)
+			}
+			if deadLettered == tc.cancelled {
+				t.Fatalf("dead-lettered %v with the context cancelled %v", deadLettered, tc.cancelled)
+			}
+		})
+	}
+}
+
+func TestEnrichmentStageCoversChatTypes(t *testing.T) {
+	names := NewTypedCache[string, string](newTestCache(t, 1), CacheNamespace{Name: "user", TTL: time.Hour}, stringKey)
+	names.Set("u1", "Alice")
+	p := NewPipeline()
+	if err := p.Register(enrichmentStage(names)); err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("x", 101)
+	for _, msgType := range []MessageType{TypeMessage, TypeChat, TypeReply, TypeEdit} {
+		msg := &Message{Type: msgType, UserID: "u1", Content: long}
+		if err := p.Run(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+		enriched := msgType != TypeEdit
+		if got := msg.SenderName == "Alice" && msg.Compressed; got != enriched {
+			t.Fatalf("%s: sender name %q, compressed %v; want enriched %v", msgType, msg.SenderName, msg.Compressed, enriched)
+		}
+	}
+}
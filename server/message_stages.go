@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Order of the built-in stages. Custom stages slot in between by picking an
+// order in the gaps.
+const (
+	OrderValidation    = 100
+	OrderAttachments   = 120
+	OrderAuthorization = 150
+	OrderEnrichment    = 200
+	OrderContentFilter = 300
+	OrderPersistence   = 400
+	OrderReactions     = 420
+	OrderReceipts      = 450
+	OrderHistory       = 460
+	OrderFanOut        = 500
+)
+
+// maxContentLength bounds the size of a chat message body.
+const maxContentLength = 64 * 1024
+
+// maxAttachments bounds the number of files attached to one message.
+const maxAttachments = 10
+
+// chatMessageTypes are the message types that carry user content.
+var chatMessageTypes = []MessageType{TypeMessage, TypeChat, TypeReply}
+
+// changeMessageTypes are the message types that modify an earlier message.
+var changeMessageTypes = []MessageType{TypeEdit, TypeDelete}
+
+// reactionMessageTypes add or remove a reaction to an earlier message.
+var reactionMessageTypes = []MessageType{TypeReact, TypeUnreact}
+
+func validationStage() Stage {
+	return Stage{
+		Name:    "validation",
+		Order:   OrderValidation,
+		Types:   concatTypes(changeMessageTypes, reactionMessageTypes, chatMessageTypes),
+		OnError: PolicyDrop,
+		Handle: func(ctx context.Context, msg *Message) error {
+			if msg.ChatID == "" {
+				return errors.New("missing chat ID")
+			}
+
+			switch msg.Type {
+			case TypeDelete:
+				if msg.Scope == "" {
+					msg.Scope = DeleteForMe
+				}
+				switch {
+				case msg.MessageID == "":
+					return errors.New("missing message ID")
+				case msg.Scope != DeleteForMe && msg.Scope != DeleteForEveryone:
+					return fmt.Errorf("unknown delete scope %q", msg.Scope)
+				}
+				return nil
+			case TypeReact, TypeUnreact:
+				switch {
+				case msg.MessageID == "":
+					return errors.New("missing message ID")
+				case !validEmoji(msg.Emoji):
+					return fmt.Errorf("invalid reaction %q", msg.Emoji)
+				}
+				return nil
+			case TypeEdit:
+				if msg.MessageID == "" {
+					return errors.New("missing message ID")
+				}
+			case TypeReply:
+				if msg.ReplyTo == "" {
+					return errors.New("missing reply-to message ID")
+				}
+			}
+
+			switch {
+			case msg.Content == "" && len(msg.Attachments) == 0:
+				return errors.New("empty content")
+			case len(msg.Attachments) > maxAttachments:
+				return fmt.Errorf("more than %d attachments", maxAttachments)
+			case len(msg.Content) > maxContentLength:
+				return errors.New("content too long")
+			}
+			return nil
+		},
+	}
+}
+
+// enrichmentStage fills in the sender's display name from names, keyed by
+// user ID, and flags large bodies for compression.
+func enrichmentStage(names *TypedCache[string, string]) Stage {
+	return Stage{
+		Name:    "enrichment",
+		Order:   OrderEnrichment,
+		Types:   chatMessageTypes,
+		Timeout: 50 * time.Millisecond,
+		OnError: PolicyContinue,
+		Handle: func(ctx context.Context, msg *Message) error {
+			// Use ultra cache for instant lookups
+			if name, found := names.Get(msg.UserID); found {
+				msg.SenderName = name
+			}
+
+			// Compress content for faster transmission
+			if len(msg.Content) > 100 {
+				msg.Compressed = true
+			}
+			return nil
+		},
+	}
+}
+
+// contentFilterStage strips control characters that clients cannot render
+// and drops messages left with neither text nor attachments.
+func contentFilterStage() Stage {
+	return Stage{
+		Name:    "content_filter",
+		Order:   OrderContentFilter,
+		Types:   append([]MessageType{TypeEdit}, chatMessageTypes...),
+		OnError: PolicyDrop,
+		Handle: func(ctx context.Context, msg *Message) error {
+			msg.Content = strings.Map(func(r rune) rune {
+				if unicode.IsControl(r) && r != '\n' && r != '\t' {
+					return -1
+				}
+				return r
+			}, msg.Content)
+
+			if strings.TrimSpace(msg.Content) == "" && len(msg.Attachments) == 0 {
+				return ErrDropMessage
+			}
+			return nil
+		},
+	}
+}
+
+// persistenceStage stores chat messages and applies edits and deletes
+// through the database pool, retrying with backoff and dead-lettering
+// messages that still fail. Messages the database rejects outright, or
+// changes to messages that do not exist, are dropped without retrying.
+// Chat messages processed together are stored with one bulk insert. New
+// messages and deletions are recorded in index once stored.
+func persistenceStage(pool *UltraDBPool, index *messageIndex, retry RetryPolicy) Stage {
+	return Stage{
+		Name:    "persistence",
+		Order:   OrderPersistence,
+		Types:   concatTypes(changeMessageTypes, chatMessageTypes),
+		Timeout: 2 * time.Second,
+		OnError: PolicyRetry,
+		Retry:   retry,
+		Handle: func(ctx context.Context, msg *Message) error {
+			return classifyWrite(persist(ctx, pool, index, msg))
+		},
+		HandleBatch: func(ctx context.Context, msgs []*Message) []error {
+			errs := make([]error, len(msgs))
+			var inserts []int
+			flush := func() {
+				if len(inserts) > 0 {
+					insertAll(ctx, pool, index, msgs, inserts, errs)
+					inserts = inserts[:0]
+				}
+			}
+			for i, msg := range msgs {
+				if msg.Type.IsContent() {
+					inserts = append(inserts, i)
+					continue
+				}
+				// Changes stay behind the messages before them
+				flush()
+				errs[i] = classifyWrite(persist(ctx, pool, index, msg))
+			}
+			flush()
+			return errs
+		},
+	}
+}
+
+// classifyWrite marks failed writes that cannot succeed on retry as
+// permanent.
+func classifyWrite(err error) error {
+	if err != nil && isPermanent(err) {
+		return permanent(err)
+	}
+	return err
+}
+
+// insertAll stores the messages of msgs at the given indexes in one bulk
+// insert and records their errors in errs. If the database rejects the
+// batch, they are inserted one by one so only the offending messages fail.
+func insertAll(ctx context.Context, pool *UltraDBPool, index *messageIndex, msgs []*Message, at []int, errs []error) {
+	batch := make([]Message, len(at))
+	for k, i := range at {
+		batch[k] = *msgs[i]
+	}
+	results, err := pool.BatchInsertMessages(ctx, batch)
+	if err != nil && isPermanent(err) && len(at) > 1 {
+		for _, i := range at {
+			errs[i] = classifyWrite(persist(ctx, pool, index, msgs[i]))
+		}
+		return
+	}
+	for k, i := range at {
+		switch {
+		case err != nil:
+			errs[i] = classifyWrite(err)
+		case results[k].Inserted:
+			index.added(msgs[i])
+		default:
+			logger.Debug("message already stored", "message_id", results[k].MessageID)
+		}
+	}
+}
+
+// persist applies msg to the database and records what it stored in
+// index.
+func persist(ctx context.Context, pool *UltraDBPool, index *messageIndex, msg *Message) error {
+	switch {
+	case msg.Type == TypeEdit:
+		return pool.EditMessage(ctx, msg.MessageID, msg.UserID, msg.Content, time.Unix(msg.EditedAt, 0))
+	case msg.Type == TypeDelete && msg.Scope == DeleteForEveryone:
+		err := pool.DeleteMessage(ctx, msg.MessageID, msg.UserID, time.Now())
+		if err == nil {
+			index.deleted(msg.MessageID)
+		}
+		return err
+	case msg.Type == TypeDelete:
+		return pool.HideMessage(ctx, msg.MessageID, msg.UserID)
+	}
+	results, err := pool.BatchInsertMessages(ctx, []Message{*msg})
+	switch {
+	case err != nil:
+	case results[0].Inserted:
+		index.added(msg)
+	default:
+		// Replayed from the write-ahead log after it was stored
+		logger.Debug("message already stored", "message_id", msg.MessageID)
+	}
+	return err
+}
+
+// receiptStage records read receipts in reads, keyed by message ID.
+func receiptStage(reads *TypedCache[string, bool]) Stage {
+	return Stage{
+		Name:    "receipts",
+		Order:   OrderReceipts,
+		Types:   []MessageType{TypeRead},
+		OnError: PolicyContinue,
+		Handle: func(ctx context.Context, msg *Message) error {
+			// Mark as read instantly
+			reads.Set(msg.MessageID, true)
+			return nil
+		},
+	}
+}
+
+// fanOutStage hands the processed message to the hub for delivery. The hub
+// picks the recipients (see Client.receives), and going through its queue
+// keeps edits and deletes behind the message they change.
+func fanOutStage(hub *Hub) Stage {
+	return Stage{
+		Name:    "fan_out",
+		Order:   OrderFanOut,
+		Timeout: time.Second,
+		OnError: PolicyDrop,
+		Handle: func(ctx context.Context, msg *Message) error {
+			select {
+			case hub.broadcast <- *msg:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+func concatTypes(lists ...[]MessageType) []MessageType {
+	var types []MessageType
+	for _, list := range lists {
+		types = append(types, list...)
+	}
+	return types
+}
+
+// registerDefaultStages installs the built-in pipeline. The persistence
+// stage is only added when a database is configured, the attachment stage
+// only when file transfer is enabled on the hub, the history stage only
+// when the hub serves history.
+func registerDefaultStages(ump *UltraMessageProcessor, hub *Hub, pool *UltraDBPool, retry RetryPolicy, msgCfg MessagesConfig) error {
+	index := newMessageIndex(pool, msgCfg)
+	names := NewTypedCache[string, string](GlobalUltraCache, CacheNamespace{Name: "user", TTL: time.Hour}, stringKey)
+	reads := NewTypedCache[string, bool](GlobalUltraCache, CacheNamespace{Name: "read", TTL: time.Hour}, stringKey)
+	stages := []Stage{
+		validationStage(),
+		authorizationStage(hub, index, msgCfg),
+		enrichmentStage(names),
+		contentFilterStage(),
+		receiptStage(reads),
+		reactionStage(newReactionStore(pool), retry),
+		fanOutStage(hub),
+	}
+	if pool != nil {
+		stages = append(stages, persistenceStage(pool, index, retry))
+	}
+	if hub.files != nil {
+		stages = append(stages, attachmentStage(hub.files))
+	}
+	if hub.history != nil {
+		stages = append(stages, historyStage(hub.history))
+	}
+
+	for _, stage := range stages {
+		if err := ump.Use(stage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
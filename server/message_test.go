@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"testing"
+)
+
+// fullMessage returns a message with every exported field set.
+func fullMessage() Message {
+	return Message{
+		Type:       TypeReply,
+		Content:    "see above",
+		Timestamp:  1700000000,
+		UserID:     "u1",
+		SenderName: "Alice",
+		ChatID:     "c1",
+		MessageID:  "m2",
+		ReplyTo:    "m1",
+		EditedAt:   1700000060,
+		CreatedAt:  1700000000123456,
+		Scope:      DeleteForEveryone,
+		Emoji:      "👍",
+		Reactions:  map[string]int{"👍": 2, "🎉": 1},
+		Upload: &UploadFrame{
+			UploadID: "up1", Name: "a.png", MimeType: "image/png", Size: 10, SHA256: "abc",
+			Offset: 4, Chunk: []byte{0, 1, 2}, FileID: "f1", URL: "/files/f1",
+		},
+		History: &HistoryFrame{
+			Before: "m0", After: "m3", Limit: 20, HasMore: true,
+			Messages: []Message{{Type: TypeMessage, Content: "hi", UserID: "u2", ChatID: "c1", MessageID: "m0"}},
+		},
+		Attachments: []Attachment{
+			{ID: "f1", Name: "a.png", MimeType: "image/png", Size: 10, URL: "/files/f1"},
+			{ID: "f2", Name: "b.txt", Size: 3},
+		},
+		Compressed: true,
+		Data:       map[string]interface{}{"key": "value", "n": float64(3)},
+	}
+}
+
+func TestFullMessageSetsEveryField(t *testing.T) {
+	v := reflect.ValueOf(fullMessage())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.IsExported() && v.Field(i).IsZero() {
+			t.Errorf("fullMessage leaves %s unset", field.Name)
+		}
+	}
+}
+
+func TestMessageRoundTripsThroughUltraProtocol(t *testing.T) {
+	protocol, err := NewUltraProtocol(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := fullMessage()
+	msg.walSeq = 9 // local only, not sent
+
+	um, err := msg.ToUltra(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if um.Type != ultraTypeCodes[TypeReply] || um.Sequence != 42 || um.Timestamp != uint64(msg.Timestamp) {
+		t.Fatalf("frame header type %d, sequence %d, timestamp %d", um.Type, um.Sequence, um.Timestamp)
+	}
+
+	encoded, err := protocol.Encode(um)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := protocol.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := MessageFromUltra(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fullMessage()
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Fatalf("round trip changed the message\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+func TestMessageFromUltraFillsHeaderFields(t *testing.T) {
+	data := []byte(`{"content":"hi","chatId":"c1"}`)
+	um := &UltraMessage{
+		Type:      ultraTypeCodes[TypeEdit],
+		Timestamp: 1700000000,
+		Length:    uint32(len(data)),
+		Data:      data,
+		Checksum:  crc32.ChecksumIEEE(data),
+	}
+	msg, err := MessageFromUltra(um)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != TypeEdit || msg.Timestamp != 1700000000 {
+		t.Fatalf("type %q, timestamp %d taken from the header", msg.Type, msg.Timestamp)
+	}
+}
+
+func TestMessageFromUltraRejectsDamagedFrames(t *testing.T) {
+	msg := fullMessage()
+	cases := []struct {
+		name   string
+		damage func(um *UltraMessage)
+	}{
+		{"checksum", func(um *UltraMessage) { um.Data[len(um.Data)/2] ^= 0xff }},
+		{"length", func(um *UltraMessage) { um.Length++ }},
+	}
+	for _, c := range cases {
+		um, err := msg.ToUltra(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.damage(um)
+		if _, err := MessageFromUltra(um); err == nil {
+			t.Fatalf("%s: damaged frame decoded", c.name)
+		} else if c.name == "checksum" && !errors.Is(err, ErrUltraChecksum) {
+			t.Fatalf("%s: got %v, want ErrUltraChecksum", c.name, err)
+		}
+	}
+}
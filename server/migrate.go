@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the pg_advisory_lock key held while migrating, so
+// instances starting together apply each migration once.
+const migrationLockKey int64 = 0x756c7472616d6967 // "ultramig"
+
+// ErrNoDownMigration is returned when rolling back would reach a migration
+// that has no down script.
+var ErrNoDownMigration = errors.New("migration has no down script")
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change. Up and Down are SQL scripts
+// that may hold several statements; each runs in its own transaction.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, zero if pending.
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// loadMigrations reads NNNN_name.up.sql and NNNN_name.down.sql files from
+// dir in fsys, ordered by version.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", entry.Name())
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and rolls back migrations, recording applied versions
+// in the schema_migrations table.
+//
+// Only 0003 and later can be rolled back. 0001 and 0002 create the tables
+// shared with the Node app, which this server never drops, so they have no
+// down scripts and form the baseline schema.
+type Migrator struct {
+	pool       *UltraDBPool
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the migrations embedded in the binary.
+func NewMigrator(pool *UltraDBPool) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+// withLock runs fn on one connection while holding the migration lock.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.pool.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.pool.ReturnConnection(conn)
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    BIGINT PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT now()
+		)`); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Up applies all pending migrations in order and returns how many ran.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	count := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			err := runMigration(ctx, conn, mig.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mig.Version, mig.Name)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			logger.Info("applied migration", "version", mig.Version, "name", mig.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Down rolls back the latest steps applied migrations and returns how many
+// were rolled back. It rolls back nothing when one of them has no down
+// script.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	count := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		var rollback []Migration
+		for i := len(m.migrations) - 1; i >= 0 && len(rollback) < steps; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				rollback = append(rollback, m.migrations[i])
+			}
+		}
+		// Refuse before touching the schema rather than stop halfway
+		for _, mig := range rollback {
+			if mig.Down == "" {
+				return fmt.Errorf("migration %d_%s is part of the baseline schema, nothing rolled back: %w",
+					mig.Version, mig.Name, ErrNoDownMigration)
+			}
+		}
+
+		for _, mig := range rollback {
+			err := runMigration(ctx, conn, mig.Down, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			logger.Info("rolled back migration", "version", mig.Version, "name", mig.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Status lists every known migration with the time it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			status = append(status, MigrationStatus{Migration: mig, AppliedAt: applied[mig.Version]})
+		}
+		return nil
+	})
+	return status, err
+}
+
+// runMigration runs script and the bookkeeping statement in one
+// transaction. The script has no parameters, so it goes through the simple
+// query protocol and may hold several statements.
+func runMigration(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	txn, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if _, err := txn.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := txn.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// runMigrateCommand implements `server migrate [up | down [n] | status]`
+// and returns the process exit code.
+func runMigrateCommand(cfg *Config, args []string) int {
+	if cfg.Database.URL == "" {
+		logger.Error("migrate needs database.url")
+		return 1
+	}
+	pool, err := NewUltraDBPool(cfg.Database)
+	if err != nil {
+		logger.Error("database pool setup failed", "error", err)
+		return 1
+	}
+	defer pool.Close()
+	migrator, err := NewMigrator(pool)
+	if err != nil {
+		logger.Error("loading migrations failed", "error", err)
+		return 1
+	}
+	ctx := context.Background()
+
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			logger.Error("migration failed", "error", err)
+			return 1
+		}
+		logger.Info("database schema up to date", "applied", applied)
+
+	case "down":
+		steps := 1
+		if len(args) > 0 {
+			if steps, err = strconv.Atoi(args[0]); err != nil || steps < 1 {
+				logger.Error("down takes a positive number of steps", "steps", args[0])
+				return 2
+			}
+		}
+		rolledBack, err := migrator.Down(ctx, steps)
+		if err != nil {
+			logger.Error("rollback failed", "error", err)
+			return 1
+		}
+		logger.Info("rolled back migrations", "count", rolledBack)
+
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			logger.Error("migration status failed", "error", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		w.Flush()
+
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] migrate [up | down [n] | status]\n", os.Args[0])
+		return 2
+	}
+	return 0
+}
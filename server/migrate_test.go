@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func migrationVersions(migrations []Migration) []int64 {
+	versions := make([]int64, len(migrations))
+	for i, mig := range migrations {
+		versions[i] = mig.Version
+	}
+	return versions
+}
+
+func TestLoadMigrationsOrdersByVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/10_c.up.sql":  {Data: []byte("-- up 10")},
+		"m/2_b.up.sql":   {Data: []byte("-- up 2")},
+		"m/2_b.down.sql": {Data: []byte("-- down 2")},
+		"m/1_a.up.sql":   {Data: []byte("-- up 1")},
+	}
+	migrations, err := loadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(migrations); !reflect.DeepEqual(got, []int64{1, 2, 10}) {
+		t.Fatalf("versions %v, want [1 2 10]", got)
+	}
+	if b := migrations[1]; b.Name != "b" || b.Up != "-- up 2" || b.Down != "-- down 2" {
+		t.Fatalf("migration 2 loaded as %+v", b)
+	}
+
+	cases := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"bad name", []string{"0001-a.up.sql"}, "name must look like"},
+		{"down only", []string{"0001_a.down.sql"}, "has no up script"},
+		{"two names", []string{"0001_a.up.sql", "0001_b.down.sql"}, "is named both"},
+	}
+	for _, c := range cases {
+		fsys := fstest.MapFS{}
+		for _, name := range c.files {
+			fsys["m/"+name] = &fstest.MapFile{Data: []byte("SELECT 1")}
+		}
+		if _, err := loadMigrations(fsys, "m"); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s: got error %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrator, err := NewMigrator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mig := range migrator.migrations {
+		if mig.Version != int64(i+1) {
+			t.Fatalf("migration %d is version %d, versions must run 1, 2, 3...", i, mig.Version)
+		}
+		// Only the baseline schema has no down script
+		if baseline := mig.Version <= 2; baseline != (mig.Down == "") {
+			t.Fatalf("migration %d_%s: down script %q", mig.Version, mig.Name, mig.Down)
+		}
+	}
+	if len(migrator.migrations) < 3 {
+		t.Fatalf("%d migrations embedded", len(migrator.migrations))
+	}
+}
+
+// ranScripts returns the migration scripts fake ran, in order.
+func ranScripts(fake *fakeMessageDB) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var scripts []string
+	for _, query := range fake.executed {
+		if strings.HasPrefix(query, "-- ") {
+			scripts = append(scripts, query)
+		}
+	}
+	fake.executed = nil
+	return scripts
+}
+
+func appliedVersions(t *testing.T, m *Migrator) []int64 {
+	t.Helper()
+	status, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []int64
+	for _, s := range status {
+		if !s.AppliedAt.IsZero() {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func TestMigratorTracksVersions(t *testing.T) {
+	ctx := context.Background()
+	pool, fake := newTestDBPool(t)
+	m := &Migrator{pool: pool, migrations: []Migration{
+		{Version: 1, Name: "base", Up: "-- up 1"},
+		{Version: 2, Name: "two", Up: "-- up 2", Down: "-- down 2"},
+		{Version: 3, Name: "three", Up: "-- up 3", Down: "-- down 3"},
+	}}
+
+	if n, err := m.Up(ctx); err != nil || n != 3 {
+		t.Fatalf("Up applied %d, %v; want 3", n, err)
+	}
+	if got := ranScripts(fake); !reflect.DeepEqual(got, []string{"-- up 1", "-- up 2", "-- up 3"}) {
+		t.Fatalf("ran %q", got)
+	}
+	if n, err := m.Up(ctx); err != nil || n != 0 {
+		t.Fatalf("second Up applied %d, %v; want 0", n, err)
+	}
+	if got := ranScripts(fake); len(got) != 0 {
+		t.Fatalf("second Up ran %q", got)
+	}
+
+	if n, err := m.Down(ctx, 1); err != nil || n != 1 {
+		t.Fatalf("Down(1) rolled back %d, %v; want 1", n, err)
+	}
+	if got := ranScripts(fake); !reflect.DeepEqual(got, []string{"-- down 3"}) {
+		t.Fatalf("Down(1) ran %q", got)
+	}
+	if got := appliedVersions(t, m); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Fatalf("applied %v after Down(1), want [1 2]", got)
+	}
+
+	// Reaching the baseline rolls back nothing at all
+	n, err := m.Down(ctx, 2)
+	if !errors.Is(err, ErrNoDownMigration) || n != 0 {
+		t.Fatalf("Down(2) rolled back %d, %v; want 0, ErrNoDownMigration", n, err)
+	}
+	if got := ranScripts(fake); len(got) != 0 {
+		t.Fatalf("refused Down ran %q", got)
+	}
+	if got := appliedVersions(t, m); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Fatalf("applied %v after refused Down, want [1 2]", got)
+	}
+
+	// Up reapplies only what was rolled back
+	if n, err := m.Up(ctx); err != nil || n != 1 {
+		t.Fatalf("Up after Down applied %d, %v; want 1", n, err)
+	}
+	if got := ranScripts(fake); !reflect.DeepEqual(got, []string{"-- up 3"}) {
+		t.Fatalf("Up after Down ran %q", got)
+	}
+}
@@ -0,0 +1,58 @@
+-- Users, chats and messages as defined in shared/schema.ts. IF NOT EXISTS
+-- lets this run against databases created earlier with drizzle-kit push.
+-- There is no down script: the tables belong to the Node app as much as to
+-- this server, so they are never dropped from here.
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE IF NOT EXISTS users (
+    id                UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    username          VARCHAR(50) NOT NULL UNIQUE,
+    email             VARCHAR(255) NOT NULL UNIQUE,
+    password_hash     TEXT NOT NULL,
+    first_name        VARCHAR(100),
+    last_name         VARCHAR(100),
+    birth_date        VARCHAR(10),
+    phone_number      VARCHAR(20),
+    display_username  VARCHAR(50) UNIQUE,
+    profile_image_url VARCHAR(500),
+    public_key        TEXT,
+    is_online         BOOLEAN DEFAULT false,
+    last_seen         TIMESTAMP,
+    created_at        TIMESTAMP DEFAULT now(),
+    updated_at        TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS chats (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name       VARCHAR(255),
+    is_group   BOOLEAN DEFAULT false,
+    created_by UUID REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS chat_members (
+    chat_id   UUID REFERENCES chats(id) ON DELETE CASCADE,
+    user_id   UUID REFERENCES users(id) ON DELETE CASCADE,
+    joined_at TIMESTAMP DEFAULT now(),
+    role      VARCHAR(20) DEFAULT 'member',
+    PRIMARY KEY (chat_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id           UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    chat_id      UUID REFERENCES chats(id) ON DELETE CASCADE,
+    sender_id    UUID REFERENCES users(id),
+    content      TEXT NOT NULL,
+    message_type VARCHAR(20) DEFAULT 'text',
+    is_encrypted BOOLEAN DEFAULT true,
+    edited_at    TIMESTAMP,
+    created_at   TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS message_reads (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    user_id    UUID REFERENCES users(id) ON DELETE CASCADE,
+    read_at    TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (message_id, user_id)
+);
@@ -0,0 +1,182 @@
+-- Account, session and security tables from shared/schema.ts. The Go
+-- server does not use them, but keeping them here makes these migrations
+-- the complete schema. Like 0001 it has no down script, as the Node app
+-- owns these tables.
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email      VARCHAR(255) NOT NULL,
+    token      VARCHAR(255) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at    TIMESTAMP,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_security_settings (
+    id                         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id                    UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    require_username_for_reset BOOLEAN DEFAULT false,
+    require_security_questions BOOLEAN DEFAULT false,
+    require_last_activity      BOOLEAN DEFAULT false,
+    two_factor_enabled         BOOLEAN DEFAULT false,
+    last_activity_location     VARCHAR(255),
+    last_activity_ip           VARCHAR(45),
+    last_activity_device       VARCHAR(255),
+    created_at                 TIMESTAMP DEFAULT now(),
+    updated_at                 TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS security_questions (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id     UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    question    VARCHAR(500) NOT NULL,
+    answer_hash TEXT NOT NULL,
+    is_active   BOOLEAN DEFAULT true,
+    created_at  TIMESTAMP DEFAULT now(),
+    updated_at  TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_token TEXT NOT NULL UNIQUE,
+    device_info   TEXT,
+    device_type   VARCHAR(20),
+    ip_address    VARCHAR(45),
+    location      VARCHAR(255),
+    user_agent    TEXT,
+    is_active     BOOLEAN DEFAULT true,
+    is_current    BOOLEAN DEFAULT false,
+    login_time    TIMESTAMP DEFAULT now(),
+    last_activity TIMESTAMP DEFAULT now(),
+    logout_time   TIMESTAMP,
+    created_at    TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS login_activity (
+    id             UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id        UUID REFERENCES users(id) ON DELETE CASCADE,
+    email          VARCHAR(255),
+    attempt_type   VARCHAR(20) NOT NULL,
+    success        BOOLEAN NOT NULL,
+    ip_address     VARCHAR(45),
+    user_agent     TEXT,
+    location       VARCHAR(255),
+    device_info    TEXT,
+    failure_reason VARCHAR(100),
+    session_id     UUID REFERENCES user_sessions(id),
+    created_at     TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_two_factor_auth (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id          UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    is_enabled       BOOLEAN DEFAULT false,
+    secret           TEXT,
+    backup_codes     TEXT[],
+    phone_number     VARCHAR(20),
+    preferred_method VARCHAR(20) DEFAULT 'app',
+    verified_at      TIMESTAMP,
+    created_at       TIMESTAMP DEFAULT now(),
+    updated_at       TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS security_notifications (
+    id              UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id         UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type            VARCHAR(50) NOT NULL,
+    title           VARCHAR(255) NOT NULL,
+    message         TEXT NOT NULL,
+    severity        VARCHAR(20) DEFAULT 'info',
+    is_read         BOOLEAN DEFAULT false,
+    ip_address      VARCHAR(45),
+    location        VARCHAR(255),
+    device_info     TEXT,
+    action_required BOOLEAN DEFAULT false,
+    expires_at      TIMESTAMP,
+    created_at      TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_webauthn (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    credential_id TEXT NOT NULL UNIQUE,
+    public_key    TEXT NOT NULL,
+    device_name   VARCHAR(255),
+    device_type   VARCHAR(50),
+    counter       BIGINT DEFAULT 0,
+    is_active     BOOLEAN DEFAULT true,
+    last_used     TIMESTAMP,
+    created_at    TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS network_security_settings (
+    id                            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id                       UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    allow_vpn                     BOOLEAN DEFAULT true,
+    blocked_countries             TEXT[],
+    blocked_ips                   TEXT[],
+    allowed_ips                   TEXT[],
+    geo_blocking_enabled          BOOLEAN DEFAULT false,
+    vpn_detection_enabled         BOOLEAN DEFAULT false,
+    device_fingerprinting_enabled BOOLEAN DEFAULT true,
+    rate_limiting_enabled         BOOLEAN DEFAULT true,
+    created_at                    TIMESTAMP DEFAULT now(),
+    updated_at                    TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS chat_security_settings (
+    id                         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id                    UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    encryption_level           VARCHAR(20) DEFAULT 'standard',
+    self_destruct_enabled      BOOLEAN DEFAULT false,
+    default_self_destruct_time INTEGER DEFAULT 0,
+    screenshot_protection      BOOLEAN DEFAULT false,
+    incognito_mode_enabled     BOOLEAN DEFAULT false,
+    message_backup_enabled     BOOLEAN DEFAULT true,
+    auto_delete_after_days     INTEGER DEFAULT 0,
+    created_at                 TIMESTAMP DEFAULT now(),
+    updated_at                 TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS self_destructing_messages (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id    UUID NOT NULL UNIQUE REFERENCES messages(id) ON DELETE CASCADE,
+    destruct_time TIMESTAMP NOT NULL,
+    is_destroyed  BOOLEAN DEFAULT false,
+    view_count    INTEGER DEFAULT 0,
+    max_views     INTEGER DEFAULT 0,
+    created_at    TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_compliance_settings (
+    id                         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id                    UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    terms_accepted_at          TIMESTAMP,
+    terms_version              VARCHAR(20),
+    privacy_policy_accepted_at TIMESTAMP,
+    privacy_policy_version     VARCHAR(20),
+    cookie_consent             BOOLEAN DEFAULT false,
+    marketing_consent          BOOLEAN DEFAULT false,
+    age_verified               BOOLEAN DEFAULT false,
+    age_verification_method    VARCHAR(50),
+    gdpr_compliant             BOOLEAN DEFAULT true,
+    data_retention_days        INTEGER DEFAULT 2555,
+    created_at                 TIMESTAMP DEFAULT now(),
+    updated_at                 TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS password_security (
+    id                     UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id                UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    password_history       TEXT[],
+    strength_score         INTEGER DEFAULT 0,
+    last_change_at         TIMESTAMP DEFAULT now(),
+    change_required        BOOLEAN DEFAULT false,
+    change_required_reason VARCHAR(100),
+    auto_change_enabled    BOOLEAN DEFAULT false,
+    auto_change_days       INTEGER DEFAULT 90,
+    breach_detected        BOOLEAN DEFAULT false,
+    breach_detected_at     TIMESTAMP,
+    created_at             TIMESTAMP DEFAULT now(),
+    updated_at             TIMESTAMP DEFAULT now()
+);
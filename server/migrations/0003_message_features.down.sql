@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS message_reactions;
+DROP TABLE IF EXISTS message_attachments;
+DROP INDEX IF EXISTS message_deletions_user_idx;
+DROP TABLE IF EXISTS message_deletions;
+DROP INDEX IF EXISTS messages_chat_created_idx;
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE messages DROP COLUMN IF EXISTS reply_to_id;
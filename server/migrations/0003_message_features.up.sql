@@ -0,0 +1,33 @@
+-- Replies, deletes, attachments and reactions handled by the message
+-- pipeline, plus indexes for chat history paging.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_id UUID;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS messages_chat_created_idx ON messages (chat_id, created_at, id);
+
+CREATE TABLE IF NOT EXISTS message_deletions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    user_id    UUID REFERENCES users(id) ON DELETE CASCADE,
+    deleted_at TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS message_deletions_user_idx ON message_deletions (user_id, message_id);
+
+CREATE TABLE IF NOT EXISTS message_attachments (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    file_id    VARCHAR(64) NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    mime_type  VARCHAR(255) NOT NULL,
+    size       BIGINT NOT NULL,
+    position   INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    user_id    UUID REFERENCES users(id) ON DELETE CASCADE,
+    emoji      VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
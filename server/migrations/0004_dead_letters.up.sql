@@ -0,0 +1,10 @@
+-- Messages the pipeline gave up on; see PostgresDeadLetterStore.
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id              TEXT PRIMARY KEY,
+    message         JSONB NOT NULL,
+    stage           TEXT NOT NULL,
+    error           TEXT NOT NULL,
+    attempts        INTEGER NOT NULL,
+    first_failed_at TIMESTAMP NOT NULL,
+    last_failed_at  TIMESTAMP NOT NULL
+);
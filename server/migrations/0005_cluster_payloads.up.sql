@@ -0,0 +1,8 @@
+-- Cross-instance payloads too large for a NOTIFY; see PostgresPubSub.
+CREATE TABLE IF NOT EXISTS cluster_payloads (
+    id         BIGSERIAL PRIMARY KEY,
+    payload    TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS cluster_payloads_created_idx ON cluster_payloads (created_at);
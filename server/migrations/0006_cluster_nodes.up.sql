@@ -0,0 +1,9 @@
+-- Live server instances and the users connected to each; see
+-- PostgresClusterRegistry.
+CREATE TABLE IF NOT EXISTS cluster_nodes (
+    id           TEXT PRIMARY KEY,
+    address      TEXT NOT NULL,
+    users        TEXT[] NOT NULL DEFAULT '{}',
+    started_at   TIMESTAMP NOT NULL,
+    heartbeat_at TIMESTAMP NOT NULL
+);
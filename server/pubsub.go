@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrPubSubClosed is returned when publishing to or subscribing on a closed
+// PubSub.
+var ErrPubSubClosed = errors.New("pubsub closed")
+
+// PubSub carries payloads between server instances. Every subscriber of a
+// channel receives each payload published to it, including subscribers in
+// the publishing instance. A subscription's handler is called for one
+// payload at a time, in the order the backend delivers them, and must not
+// keep or modify the slice. Payloads must be valid UTF-8 text, as
+// PostgresPubSub sends them as notification text.
+type PubSub interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe calls handler for every payload published to channel until
+	// unsubscribe is called.
+	Subscribe(channel string, handler func(payload []byte)) (unsubscribe func(), err error)
+	Close() error
+}
+
+// MemoryPubSub is an in-process PubSub. Hubs sharing one behave like
+// instances sharing a database, which is how tests run a cluster in one
+// process. Publish calls the handlers before returning.
+type MemoryPubSub struct {
+	mu     sync.RWMutex
+	subs   map[string]map[int]*memorySubscription
+	nextID int
+	closed bool
+}
+
+type memorySubscription struct {
+	mu      sync.Mutex // serialises calls to handler
+	handler func(payload []byte)
+}
+
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{subs: make(map[string]map[int]*memorySubscription)}
+}
+
+func (ps *MemoryPubSub) Publish(ctx context.Context, channel string, payload []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ps.mu.RLock()
+	if ps.closed {
+		ps.mu.RUnlock()
+		return ErrPubSubClosed
+	}
+	subs := make([]*memorySubscription, 0, len(ps.subs[channel]))
+	for _, sub := range ps.subs[channel] {
+		subs = append(subs, sub)
+	}
+	ps.mu.RUnlock()
+
+	for _, sub := range subs {
+		sub.mu.Lock()
+		sub.handler(payload)
+		sub.mu.Unlock()
+	}
+	return nil
+}
+
+func (ps *MemoryPubSub) Subscribe(channel string, handler func(payload []byte)) (func(), error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return nil, ErrPubSubClosed
+	}
+
+	id := ps.nextID
+	ps.nextID++
+	if ps.subs[channel] == nil {
+		ps.subs[channel] = make(map[int]*memorySubscription)
+	}
+	ps.subs[channel][id] = &memorySubscription{handler: handler}
+
+	return func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		delete(ps.subs[channel], id)
+		if len(ps.subs[channel]) == 0 {
+			delete(ps.subs, channel)
+		}
+	}, nil
+}
+
+func (ps *MemoryPubSub) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.closed = true
+	ps.subs = make(map[string]map[int]*memorySubscription)
+	return nil
+}
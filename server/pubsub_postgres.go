@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// notifyPayloadLimit is PostgreSQL's limit on a NOTIFY payload, in bytes.
+const notifyPayloadLimit = 8000
+
+// spillRetention is how long a payload too large for a NOTIFY is kept in
+// cluster_payloads for subscribers to fetch.
+const spillRetention = 5 * time.Minute
+
+// Notification payloads start with a byte saying where the data is.
+const (
+	payloadInline  = 'i' // the rest of the notification
+	payloadSpilled = 'p' // cluster_payloads row with the ID that follows
+)
+
+// PostgresPubSub is a PubSub over LISTEN/NOTIFY. Notifications are sent
+// through the pool's primary and received on a dedicated pq.Listener
+// connection that reconnects on its own; payloads published while it was
+// disconnected are lost, which OnReconnect hooks can make up for. Payloads
+// too large for a notification are stored in cluster_payloads and the
+// notification carries the row ID.
+type PostgresPubSub struct {
+	pool     *UltraDBPool
+	listener *pq.Listener
+
+	listenMu    sync.Mutex // serialises LISTEN and UNLISTEN
+	mu          sync.Mutex
+	handlers    map[string]map[int]func(payload []byte)
+	nextID      int
+	closed      bool
+	onReconnect []func()
+
+	published uint64 // accessed atomically
+	spilled   uint64 // accessed atomically
+	received  uint64 // accessed atomically
+	lost      uint64 // accessed atomically, payloads that could not be fetched
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPostgresPubSub listens on a connection to url, which must be the
+// primary of pool.
+func NewPostgresPubSub(pool *UltraDBPool, url string) *PostgresPubSub {
+	ps := &PostgresPubSub{
+		pool:     pool,
+		handlers: make(map[string]map[int]func(payload []byte)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	ps.listener = pq.NewListener(url, time.Second, 30*time.Second, ps.listenerEvent)
+	go ps.run()
+	return ps
+}
+
+func (ps *PostgresPubSub) listenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventConnected:
+		logger.Info("pubsub listener connected")
+	case pq.ListenerEventDisconnected:
+		logger.Warn("pubsub listener disconnected", "error", err)
+	case pq.ListenerEventReconnected:
+		logger.Warn("pubsub listener reconnected, notifications sent meanwhile were lost")
+	case pq.ListenerEventConnectionAttemptFailed:
+		logger.Warn("pubsub listener connection attempt failed", "error", err)
+	}
+}
+
+// run dispatches notifications and, once a minute, pings the listener
+// connection so a dead one is noticed and deletes expired spilled payloads.
+func (ps *PostgresPubSub) run() {
+	defer close(ps.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case n := <-ps.listener.Notify:
+			if n == nil {
+				// Sent after a reconnect; LISTENs are restored by pq
+				ps.mu.Lock()
+				hooks := append([]func(){}, ps.onReconnect...)
+				ps.mu.Unlock()
+				for _, hook := range hooks {
+					hook()
+				}
+				continue
+			}
+			ps.dispatch(n.Channel, n.Extra)
+
+		case <-ticker.C:
+			go ps.listener.Ping()
+			ps.purge()
+
+		case <-ps.stop:
+			return
+		}
+	}
+}
+
+func (ps *PostgresPubSub) dispatch(channel, extra string) {
+	atomic.AddUint64(&ps.received, 1)
+	payload, err := ps.payloadOf(extra)
+	if err != nil {
+		atomic.AddUint64(&ps.lost, 1)
+		logger.Warn("pubsub payload lost", "channel", channel, "error", err)
+		return
+	}
+
+	ps.mu.Lock()
+	handlers := make([]func([]byte), 0, len(ps.handlers[channel]))
+	for _, handler := range ps.handlers[channel] {
+		handlers = append(handlers, handler)
+	}
+	ps.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(payload)
+	}
+}
+
+// payloadOf decodes a notification, fetching a spilled payload from the
+// primary, as a replica may not have the row yet.
+func (ps *PostgresPubSub) payloadOf(extra string) ([]byte, error) {
+	if extra == "" {
+		return nil, fmt.Errorf("empty notification")
+	}
+	switch extra[0] {
+	case payloadInline:
+		return []byte(extra[1:]), nil
+	case payloadSpilled:
+		id, err := strconv.ParseInt(extra[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("spilled payload ID %q: %w", extra[1:], err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := ps.pool.GetConnection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer ps.pool.ReturnConnection(conn)
+
+		var payload string
+		err = conn.QueryRowContext(ctx, `SELECT payload FROM cluster_payloads WHERE id = $1`, id).Scan(&payload)
+		if err != nil {
+			return nil, fmt.Errorf("spilled payload %d: %w", id, err)
+		}
+		return []byte(payload), nil
+	}
+	return nil, fmt.Errorf("unknown notification format %q", extra[0])
+}
+
+func (ps *PostgresPubSub) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := ps.pool.GetConnection(ctx)
+	if err != nil {
+		logger.Warn("purging spilled pubsub payloads failed", "error", err)
+		return
+	}
+	defer ps.pool.ReturnConnection(conn)
+
+	cutoff := time.Now().UTC().Add(-spillRetention)
+	if _, err := conn.ExecContext(ctx, `DELETE FROM cluster_payloads WHERE created_at < $1`, cutoff); err != nil {
+		logger.Warn("purging spilled pubsub payloads failed", "error", err)
+	}
+}
+
+// Publish sends payload with NOTIFY. It is not retried: a notification
+// whose result was lost may have been delivered.
+func (ps *PostgresPubSub) Publish(ctx context.Context, channel string, payload []byte) error {
+	ps.mu.Lock()
+	closed := ps.closed
+	ps.mu.Unlock()
+	if closed {
+		return ErrPubSubClosed
+	}
+
+	conn, err := ps.pool.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer ps.pool.ReturnConnection(conn)
+
+	if len(payload)+1 < notifyPayloadLimit {
+		_, err = conn.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, string(payloadInline)+string(payload))
+	} else {
+		// The row and the notification commit together, so subscribers
+		// always find it
+		_, err = conn.ExecContext(ctx, `
+			WITH spilled AS (
+				INSERT INTO cluster_payloads (payload, created_at) VALUES ($2, $3) RETURNING id
+			)
+			SELECT pg_notify($1, $4::text || id::text) FROM spilled`,
+			channel, string(payload), time.Now().UTC(), string(payloadSpilled))
+		if err == nil {
+			atomic.AddUint64(&ps.spilled, 1)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("notify %s: %w", channel, err)
+	}
+	atomic.AddUint64(&ps.published, 1)
+	return nil
+}
+
+// OnReconnect registers fn to be called after the listener reconnected,
+// when notifications sent meanwhile were lost.
+func (ps *PostgresPubSub) OnReconnect(fn func()) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.onReconnect = append(ps.onReconnect, fn)
+}
+
+// Subscribe and unsubscribe take listenMu while they LISTEN or UNLISTEN,
+// which waits for the listener connection; mu is not held meanwhile so run
+// can keep dispatching.
+func (ps *PostgresPubSub) Subscribe(channel string, handler func(payload []byte)) (func(), error) {
+	ps.listenMu.Lock()
+	defer ps.listenMu.Unlock()
+
+	ps.mu.Lock()
+	closed, first := ps.closed, len(ps.handlers[channel]) == 0
+	ps.mu.Unlock()
+	if closed {
+		return nil, ErrPubSubClosed
+	}
+	if first {
+		if err := ps.listener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen {
+			return nil, fmt.Errorf("listen %s: %w", channel, err)
+		}
+	}
+
+	ps.mu.Lock()
+	if ps.handlers[channel] == nil {
+		ps.handlers[channel] = make(map[int]func(payload []byte))
+	}
+	id := ps.nextID
+	ps.nextID++
+	ps.handlers[channel][id] = handler
+	ps.mu.Unlock()
+
+	return func() {
+		ps.listenMu.Lock()
+		defer ps.listenMu.Unlock()
+
+		ps.mu.Lock()
+		_, ok := ps.handlers[channel][id]
+		delete(ps.handlers[channel], id)
+		last := ok && len(ps.handlers[channel]) == 0
+		if last {
+			delete(ps.handlers, channel)
+		}
+		closed := ps.closed
+		ps.mu.Unlock()
+
+		if last && !closed {
+			if err := ps.listener.Unlisten(channel); err != nil {
+				logger.Warn("pubsub unlisten failed", "channel", channel, "error", err)
+			}
+		}
+	}, nil
+}
+
+// Stats returns notification counters.
+func (ps *PostgresPubSub) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"backend":   "postgres",
+		"published": atomic.LoadUint64(&ps.published),
+		"spilled":   atomic.LoadUint64(&ps.spilled),
+		"received":  atomic.LoadUint64(&ps.received),
+		"lost":      atomic.LoadUint64(&ps.lost),
+	}
+}
+
+func (ps *PostgresPubSub) Close() error {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return nil
+	}
+	ps.closed = true
+	ps.mu.Unlock()
+
+	close(ps.stop)
+	<-ps.done
+	return ps.listener.Close()
+}
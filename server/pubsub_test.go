@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// recorder collects the payloads a subscription receives.
+type recorder struct {
+	mu       sync.Mutex
+	payloads []string
+}
+
+func (r *recorder) handle(payload []byte) {
+	r.mu.Lock()
+	r.payloads = append(r.payloads, string(payload))
+	r.mu.Unlock()
+}
+
+func (r *recorder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.payloads...)
+}
+
+func TestMemoryPubSubDeliversToEverySubscriber(t *testing.T) {
+	ctx := context.Background()
+	ps := NewMemoryPubSub()
+	t.Cleanup(func() { ps.Close() })
+
+	var first, second, other recorder
+	unsubscribe, err := ps.Subscribe("a", first.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.Subscribe("a", second.handle); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.Subscribe("b", other.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"one", "two"} {
+		if err := ps.Publish(ctx, "a", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Publish returns after the handlers ran, in publish order
+	for name, r := range map[string]*recorder{"first": &first, "second": &second} {
+		if got := r.received(); len(got) != 2 || got[0] != "one" || got[1] != "two" {
+			t.Fatalf("%s subscriber received %v, want [one two]", name, got)
+		}
+	}
+	if got := other.received(); len(got) != 0 {
+		t.Fatalf("subscriber of another channel received %v", got)
+	}
+
+	unsubscribe()
+	unsubscribe() // a second call is harmless
+	if err := ps.Publish(ctx, "a", []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if got := first.received(); len(got) != 2 {
+		t.Fatalf("unsubscribed handler received %v", got)
+	}
+	if got := second.received(); len(got) != 3 {
+		t.Fatalf("remaining subscriber received %v, want three payloads", got)
+	}
+
+	// Nobody listening is not an error
+	if err := ps.Publish(ctx, "nobody", []byte("x")); err != nil {
+		t.Fatalf("publishing to an empty channel = %v", err)
+	}
+}
+
+func TestMemoryPubSubSerialisesHandlerCalls(t *testing.T) {
+	const publishers = 8
+	ps := NewMemoryPubSub()
+	t.Cleanup(func() { ps.Close() })
+
+	// Not locked: the race detector flags concurrent handler calls
+	count := 0
+	if _, err := ps.Subscribe("a", func([]byte) { count++ }); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ps.Publish(context.Background(), "a", []byte("x"))
+			}
+		}()
+	}
+	wg.Wait()
+	if count != publishers*100 {
+		t.Fatalf("handler called %d times, want %d", count, publishers*100)
+	}
+}
+
+func TestMemoryPubSubClose(t *testing.T) {
+	ps := NewMemoryPubSub()
+	var r recorder
+	if _, err := ps.Subscribe("a", r.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ps.Publish(ctx, "a", []byte("x")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("publish with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Close(); err != nil {
+		t.Fatalf("second Close = %v", err)
+	}
+	if err := ps.Publish(context.Background(), "a", []byte("x")); !errors.Is(err, ErrPubSubClosed) {
+		t.Fatalf("publish after Close = %v, want %v", err, ErrPubSubClosed)
+	}
+	if _, err := ps.Subscribe("a", r.handle); !errors.Is(err, ErrPubSubClosed) {
+		t.Fatalf("subscribe after Close = %v, want %v", err, ErrPubSubClosed)
+	}
+	if got := r.received(); len(got) != 0 {
+		t.Fatalf("received %v, want nothing", got)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+)
+
+const (
+	// maxEmojiLength bounds a reaction in bytes; enough for ZWJ sequences
+	// with skin tones.
+	maxEmojiLength = 64
+
+	reactionsCacheTTL = time.Hour
+)
+
+// validEmoji accepts a short, printable string without spaces.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// messageReactions is the reaction state of one message: the users that
+// reacted with each emoji. Each user counts once per emoji.
+type messageReactions struct {
+	mu    sync.Mutex
+	users map[string]map[string]struct{}
+}
+
+func newMessageReactions(byEmoji map[string][]string) *messageReactions {
+	mr := &messageReactions{users: make(map[string]map[string]struct{})}
+	for emoji, users := range byEmoji {
+		for _, user := range users {
+			mr.add(emoji, user)
+		}
+	}
+	return mr
+}
+
+func (mr *messageReactions) add(emoji, userID string) bool {
+	users := mr.users[emoji]
+	if users == nil {
+		users = make(map[string]struct{})
+		mr.users[emoji] = users
+	}
+	if _, ok := users[userID]; ok {
+		return false
+	}
+	users[userID] = struct{}{}
+	return true
+}
+
+func (mr *messageReactions) remove(emoji, userID string) bool {
+	users := mr.users[emoji]
+	if _, ok := users[userID]; !ok {
+		return false
+	}
+	delete(users, userID)
+	if len(users) == 0 {
+		delete(mr.users, emoji)
+	}
+	return true
+}
+
+// Size approximates the reaction state's memory for UltraCache.
+func (mr *messageReactions) Size() int {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	size := int(unsafe.Sizeof(*mr))
+	for emoji, users := range mr.users {
+		size += len(emoji) + 48
+		for user := range users {
+			size += len(user) + 16
+		}
+	}
+	return size
+}
+
+// counts returns the number of users per emoji. Called with mu held.
+func (mr *messageReactions) counts() map[string]int {
+	counts := make(map[string]int, len(mr.users))
+	for emoji, users := range mr.users {
+		counts[emoji] = len(users)
+	}
+	return counts
+}
+
+// reactionStore keeps per-message reaction state in UltraCache, backed by
+// the message_reactions table when a database is configured.
+type reactionStore struct {
+	pool  *UltraDBPool
+	cache *TypedCache[string, *messageReactions]
+}
+
+func newReactionStore(pool *UltraDBPool) *reactionStore {
+	return &reactionStore{
+		pool:  pool,
+		cache: NewTypedCache[string, *messageReactions](GlobalUltraCache, CacheNamespace{Name: "reactions", TTL: reactionsCacheTTL}, stringKey),
+	}
+}
+
+// load returns the cached state of a message, reading it from the
+// database on a miss.
+func (rs *reactionStore) load(ctx context.Context, messageID string) (*messageReactions, error) {
+	return rs.cache.GetOrLoad(ctx, messageID, func(ctx context.Context) (*messageReactions, error) {
+		var byEmoji map[string][]string
+		if rs.pool != nil {
+			var err error
+			if byEmoji, err = rs.pool.MessageReactions(ctx, messageID); err != nil {
+				return nil, err
+			}
+		}
+		return newMessageReactions(byEmoji), nil
+	})
+}
+
+// apply adds or removes msg.UserID's reaction and returns the new counts.
+// changed is false when the user had already reacted (or not reacted) that
+// way, so there is nothing to broadcast.
+func (rs *reactionStore) apply(ctx context.Context, msg *Message) (counts map[string]int, changed bool, err error) {
+	mr, err := rs.load(ctx, msg.MessageID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The database decides duplicates; the cache follows it
+	if rs.pool != nil {
+		if msg.Type == TypeReact {
+			changed, err = rs.pool.AddReaction(ctx, msg.MessageID, msg.UserID, msg.Emoji)
+		} else {
+			changed, err = rs.pool.RemoveReaction(ctx, msg.MessageID, msg.UserID, msg.Emoji)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	mr.mu.Lock()
+	var cacheChanged bool
+	if msg.Type == TypeReact {
+		cacheChanged = mr.add(msg.Emoji, msg.UserID)
+	} else {
+		cacheChanged = mr.remove(msg.Emoji, msg.UserID)
+	}
+	if rs.pool == nil {
+		changed = cacheChanged
+	}
+	counts = mr.counts()
+	mr.mu.Unlock()
+
+	if changed {
+		// Stored again to resize it; other instances drop their copy. mu is
+		// released first, as the cache sizes mr through Size.
+		rs.cache.Set(msg.MessageID, mr)
+	}
+	return counts, changed, nil
+}
+
+// reactionStage applies react and unreact frames and turns them into a
+// reaction_update carrying the message's reaction counts. Repeated
+// reactions by the same user are dropped without a broadcast.
+func reactionStage(store *reactionStore, retry RetryPolicy) Stage {
+	return Stage{
+		Name:    "reactions",
+		Order:   OrderReactions,
+		Types:   reactionMessageTypes,
+		Timeout: 2 * time.Second,
+		OnError: PolicyRetry,
+		Retry:   retry,
+		Handle: func(ctx context.Context, msg *Message) error {
+			counts, changed, err := store.apply(ctx, msg)
+			if err != nil && isPermanent(err) {
+				return permanent(err)
+			}
+			if err != nil {
+				return err
+			}
+			if !changed {
+				return ErrDropMessage
+			}
+
+			msg.Type = TypeReactionUpdate
+			msg.Reactions = counts
+			return nil
+		},
+	}
+}
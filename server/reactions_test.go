@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestReactionStore(t *testing.T, pool *UltraDBPool) *reactionStore {
+	t.Helper()
+	return &reactionStore{
+		pool:  pool,
+		cache: NewTypedCache[string, *messageReactions](newTestCache(t, 1), CacheNamespace{Name: "reactions", TTL: reactionsCacheTTL}, stringKey),
+	}
+}
+
+type reactionStep struct {
+	typ         MessageType
+	user, emoji string
+	changed     bool
+	counts      map[string]int
+}
+
+func applyReactions(t *testing.T, rs *reactionStore, steps []reactionStep) {
+	t.Helper()
+	for i, step := range steps {
+		msg := &Message{Type: step.typ, MessageID: "m1", ChatID: "chat", UserID: step.user, Emoji: step.emoji}
+		counts, changed, err := rs.apply(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if changed != step.changed || !reflect.DeepEqual(counts, step.counts) {
+			t.Fatalf("step %d: %s %s by %s = %v changed %v, want %v changed %v",
+				i, step.typ, step.emoji, step.user, counts, changed, step.counts, step.changed)
+		}
+	}
+}
+
+func TestReactionStoreCounts(t *testing.T) {
+	applyReactions(t, newTestReactionStore(t, nil), []reactionStep{
+		{TypeReact, "alice", "👍", true, map[string]int{"👍": 1}},
+		{TypeReact, "bob", "👍", true, map[string]int{"👍": 2}},
+		{TypeReact, "alice", "👍", false, map[string]int{"👍": 2}}, // duplicate
+		{TypeReact, "alice", "🎉", true, map[string]int{"👍": 2, "🎉": 1}},
+		{TypeUnreact, "bob", "👍", true, map[string]int{"👍": 1, "🎉": 1}},
+		{TypeUnreact, "bob", "👍", false, map[string]int{"👍": 1, "🎉": 1}}, // missing
+		{TypeUnreact, "alice", "🎉", true, map[string]int{"👍": 1}},
+	})
+}
+
+func TestReactionStoreFollowsDatabase(t *testing.T) {
+	pool, fake := newTestDBPool(t)
+	rs := newTestReactionStore(t, pool)
+	fake.reactions[[3]string{"m1", "bob", "👍"}] = true
+
+	// The first reaction loads what is stored
+	applyReactions(t, rs, []reactionStep{
+		{TypeReact, "alice", "👍", true, map[string]int{"👍": 2}},
+	})
+
+	// Another instance adds and removes reactions behind the cache; the
+	// database decides what changed and the cache takes its word
+	fake.reactions[[3]string{"m1", "carol", "👍"}] = true
+	delete(fake.reactions, [3]string{"m1", "bob", "👍"})
+	applyReactions(t, rs, []reactionStep{
+		{TypeReact, "carol", "👍", false, map[string]int{"👍": 3}},
+		{TypeUnreact, "bob", "👍", false, map[string]int{"👍": 2}},
+		{TypeUnreact, "alice", "👍", true, map[string]int{"👍": 1}},
+	})
+	want := map[[3]string]bool{{"m1", "carol", "👍"}: true}
+	if !reflect.DeepEqual(fake.reactions, want) {
+		t.Fatalf("database holds %v, want %v", fake.reactions, want)
+	}
+}
+
+func TestReactionWritesRetryLostConnections(t *testing.T) {
+	pool, fake := newTestDBPool(t)
+	pool.cfg.WriteAttempts = 2
+	ctx := context.Background()
+
+	fake.failNext = io.ErrUnexpectedEOF
+	if added, err := pool.AddReaction(ctx, "m1", "alice", "👍"); err != nil || !added {
+		t.Fatalf("AddReaction = %v, %v, want added after a retry", added, err)
+	}
+	fake.failNext = io.ErrUnexpectedEOF
+	if removed, err := pool.RemoveReaction(ctx, "m1", "alice", "👍"); err != nil || !removed {
+		t.Fatalf("RemoveReaction = %v, %v, want removed after a retry", removed, err)
+	}
+	if pool.writeRetries != 2 {
+		t.Fatalf("%d write retries, want 2", pool.writeRetries)
+	}
+}
+
+func TestReactionsToDeletedMessagesRejected(t *testing.T) {
+	ctx := context.Background()
+	index := newTestMessageIndex(t, nil)
+	index.cache.Set("m1", MessageMeta{SenderID: "alice", ChatID: "chat", CreatedAt: time.Now(), Deleted: true})
+	index.cache.Set("m2", MessageMeta{SenderID: "alice", ChatID: "other", CreatedAt: time.Now()})
+	auth := authorizationStage(newHub(WebSocketConfig{BroadcastBuffer: 8}), index, testMessagesConfig())
+
+	for _, tc := range []struct {
+		typ       MessageType
+		messageID string
+		want      error
+	}{
+		{TypeReact, "m1", ErrMessageDeleted},
+		{TypeUnreact, "m1", ErrMessageDeleted},
+		{TypeUnreact, "m2", ErrMessageNotFound},
+		{TypeReact, "unknown", ErrMessageNotFound},
+	} {
+		msg := &Message{Type: tc.typ, MessageID: tc.messageID, ChatID: "chat", UserID: "bob", Emoji: "👍"}
+		if err := auth.Handle(ctx, msg); !errors.Is(err, tc.want) {
+			t.Fatalf("%s on %s = %v, want %v", tc.typ, tc.messageID, err, tc.want)
+		}
+	}
+}
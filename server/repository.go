@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write collides with an existing row,
+	// such as a taken username or a member added twice.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidRole is returned for chat member roles other than RoleMember
+	// and RoleAdmin.
+	ErrInvalidRole = errors.New("invalid member role")
+)
+
+// Chat member roles.
+const (
+	RoleMember = "member"
+	RoleAdmin  = "admin"
+)
+
+func validRole(role string) bool {
+	return role == RoleMember || role == RoleAdmin
+}
+
+// User is the part of a user account the messaging server works with.
+type User struct {
+	ID              string    `json:"id"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email"`
+	DisplayUsername string    `json:"displayUsername,omitempty"`
+	FirstName       string    `json:"firstName,omitempty"`
+	LastName        string    `json:"lastName,omitempty"`
+	ProfileImageURL string    `json:"profileImageUrl,omitempty"`
+	PublicKey       string    `json:"publicKey,omitempty"`
+	IsOnline        bool      `json:"isOnline"`
+	LastSeen        time.Time `json:"lastSeen,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// Chat is a direct or group conversation.
+type Chat struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	IsGroup   bool      `json:"isGroup"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ChatMember is a user's membership of a chat.
+type ChatMember struct {
+	ChatID   string    `json:"chatId"`
+	UserID   string    `json:"userId"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// MessageRead records that a user read a message.
+type MessageRead struct {
+	MessageID string    `json:"messageId"`
+	UserID    string    `json:"userId"`
+	ReadAt    time.Time `json:"readAt"`
+}
+
+// UserRepository looks up users and keeps their key and presence current.
+type UserRepository interface {
+	GetUser(ctx context.Context, userID string) (User, error)
+	GetUserByUsername(ctx context.Context, username string) (User, error)
+	PublicKey(ctx context.Context, userID string) (string, error)
+	SetPublicKey(ctx context.Context, userID, publicKey string) error
+	// SetPresence marks a user online or offline as of at.
+	SetPresence(ctx context.Context, userID string, online bool, at time.Time) error
+}
+
+// ChatRepository manages chats and their members.
+type ChatRepository interface {
+	// CreateChat stores chat and adds its creator as admin and memberIDs as
+	// members. ID and timestamps are assigned by the repository.
+	CreateChat(ctx context.Context, chat Chat, memberIDs []string) (Chat, error)
+	GetChat(ctx context.Context, chatID string) (Chat, error)
+	// ChatsForUser lists a user's chats, most recently updated first.
+	ChatsForUser(ctx context.Context, userID string) ([]Chat, error)
+	AddMember(ctx context.Context, chatID, userID, role string) error
+	RemoveMember(ctx context.Context, chatID, userID string) error
+	SetMemberRole(ctx context.Context, chatID, userID, role string) error
+	Members(ctx context.Context, chatID string) ([]ChatMember, error)
+	IsMember(ctx context.Context, chatID, userID string) (bool, error)
+}
+
+// MessageRepository stores messages and changes to them.
+type MessageRepository interface {
+	// InsertMessages stores messages, skipping IDs already stored.
+	InsertMessages(ctx context.Context, messages []Message) ([]InsertResult, error)
+	// GetMessage returns a message unless it was deleted for everyone.
+	GetMessage(ctx context.Context, messageID string) (Message, error)
+	EditMessage(ctx context.Context, messageID, senderID, content string, editedAt time.Time) error
+	DeleteMessage(ctx context.Context, messageID, senderID string, deletedAt time.Time) error
+	// HideMessage deletes a message for userID only.
+	HideMessage(ctx context.Context, messageID, userID string) error
+	History(ctx context.Context, q HistoryQuery) ([]Message, error)
+}
+
+// ReadRepository records read receipts.
+type ReadRepository interface {
+	// MarkRead records the first time userID read a message and reports
+	// whether this was it.
+	MarkRead(ctx context.Context, messageID, userID string, at time.Time) (bool, error)
+	Reads(ctx context.Context, messageID string) ([]MessageRead, error)
+	// UnreadCount counts messages of a chat from others that userID has
+	// not read.
+	UnreadCount(ctx context.Context, chatID, userID string) (int, error)
+}
+
+// Repository is the storage the messaging server needs.
+// PostgresRepository implements it over UltraDBPool and MemoryRepository
+// in memory for tests. The hub, history and pipeline stages still call
+// UltraDBPool directly; they move onto Repository one at a time.
+type Repository interface {
+	UserRepository
+	ChatRepository
+	MessageRepository
+	ReadRepository
+}
+
+// repoError maps PostgreSQL constraint violations to ErrConflict and
+// ErrNotFound; a foreign key violation means a referenced row is missing.
+func repoError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code {
+	case "23505": // unique_violation
+		return fmt.Errorf("%w: %s", ErrConflict, pqErr.Message)
+	case "23503": // foreign_key_violation
+		return fmt.Errorf("%w: %s", ErrNotFound, pqErr.Message)
+	}
+	return err
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRepository implements Repository in memory, for tests and for
+// running without a database. Users are added with AddUser.
+type MemoryRepository struct {
+	mu       sync.RWMutex
+	users    map[string]User
+	chats    map[string]Chat
+	members  map[string]map[string]ChatMember // chat ID -> user ID
+	messages map[string]*memoryMessage
+	reads    map[string]map[string]time.Time // message ID -> user ID
+}
+
+type memoryMessage struct {
+	msg     Message
+	deleted bool
+	hidden  map[string]bool // users that deleted it for themselves
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:    make(map[string]User),
+		chats:    make(map[string]Chat),
+		members:  make(map[string]map[string]ChatMember),
+		messages: make(map[string]*memoryMessage),
+		reads:    make(map[string]map[string]time.Time),
+	}
+}
+
+// AddUser stores u, assigning an ID if it has none. Usernames are unique.
+func (r *MemoryRepository) AddUser(u User) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if u.ID == "" {
+		u.ID = newUUID()
+	}
+	if _, ok := r.users[u.ID]; ok {
+		return User{}, ErrConflict
+	}
+	for _, other := range r.users {
+		if other.Username == u.Username {
+			return User{}, ErrConflict
+		}
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now().UTC()
+	}
+	r.users[u.ID] = u
+	return u, nil
+}
+
+func (r *MemoryRepository) GetUser(ctx context.Context, userID string) (User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.users[userID]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (r *MemoryRepository) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, u := range r.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (r *MemoryRepository) PublicKey(ctx context.Context, userID string) (string, error) {
+	u, err := r.GetUser(ctx, userID)
+	return u.PublicKey, err
+}
+
+func (r *MemoryRepository) updateUser(userID string, update func(u *User)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	update(&u)
+	r.users[userID] = u
+	return nil
+}
+
+func (r *MemoryRepository) SetPublicKey(ctx context.Context, userID, publicKey string) error {
+	return r.updateUser(userID, func(u *User) { u.PublicKey = publicKey })
+}
+
+func (r *MemoryRepository) SetPresence(ctx context.Context, userID string, online bool, at time.Time) error {
+	return r.updateUser(userID, func(u *User) {
+		u.IsOnline = online
+		u.LastSeen = at.UTC()
+	})
+}
+
+func (r *MemoryRepository) CreateChat(ctx context.Context, chat Chat, memberIDs []string) (Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if chat.CreatedBy != "" {
+		if _, ok := r.users[chat.CreatedBy]; !ok {
+			return Chat{}, ErrNotFound
+		}
+	}
+	for _, userID := range memberIDs {
+		if _, ok := r.users[userID]; !ok {
+			return Chat{}, ErrNotFound
+		}
+	}
+
+	now := time.Now().UTC()
+	chat.ID = newUUID()
+	chat.CreatedAt, chat.UpdatedAt = now, now
+	r.chats[chat.ID] = chat
+	members := make(map[string]ChatMember)
+	if chat.CreatedBy != "" {
+		members[chat.CreatedBy] = ChatMember{ChatID: chat.ID, UserID: chat.CreatedBy, Role: RoleAdmin, JoinedAt: now}
+	}
+	for _, userID := range memberIDs {
+		if _, ok := members[userID]; !ok {
+			members[userID] = ChatMember{ChatID: chat.ID, UserID: userID, Role: RoleMember, JoinedAt: now}
+		}
+	}
+	r.members[chat.ID] = members
+	return chat, nil
+}
+
+func (r *MemoryRepository) GetChat(ctx context.Context, chatID string) (Chat, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	chat, ok := r.chats[chatID]
+	if !ok {
+		return Chat{}, ErrNotFound
+	}
+	return chat, nil
+}
+
+func (r *MemoryRepository) ChatsForUser(ctx context.Context, userID string) ([]Chat, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var chats []Chat
+	for chatID, members := range r.members {
+		if _, ok := members[userID]; ok {
+			chats = append(chats, r.chats[chatID])
+		}
+	}
+	sort.Slice(chats, func(i, j int) bool {
+		if !chats[i].UpdatedAt.Equal(chats[j].UpdatedAt) {
+			return chats[i].UpdatedAt.After(chats[j].UpdatedAt)
+		}
+		return chats[i].ID < chats[j].ID
+	})
+	return chats, nil
+}
+
+func (r *MemoryRepository) AddMember(ctx context.Context, chatID, userID, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members, ok := r.members[chatID]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := r.users[userID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := members[userID]; ok {
+		return ErrConflict
+	}
+	members[userID] = ChatMember{ChatID: chatID, UserID: userID, Role: role, JoinedAt: time.Now().UTC()}
+	return nil
+}
+
+func (r *MemoryRepository) RemoveMember(ctx context.Context, chatID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[chatID][userID]; !ok {
+		return ErrNotFound
+	}
+	delete(r.members[chatID], userID)
+	return nil
+}
+
+func (r *MemoryRepository) SetMemberRole(ctx context.Context, chatID, userID, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.members[chatID][userID]
+	if !ok {
+		return ErrNotFound
+	}
+	m.Role = role
+	r.members[chatID][userID] = m
+	return nil
+}
+
+func (r *MemoryRepository) Members(ctx context.Context, chatID string) ([]ChatMember, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	members := make([]ChatMember, 0, len(r.members[chatID]))
+	for _, m := range r.members[chatID] {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if !members[i].JoinedAt.Equal(members[j].JoinedAt) {
+			return members[i].JoinedAt.Before(members[j].JoinedAt)
+		}
+		return members[i].UserID < members[j].UserID
+	})
+	return members, nil
+}
+
+func (r *MemoryRepository) IsMember(ctx context.Context, chatID, userID string) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.members[chatID][userID]
+	return ok, nil
+}
+
+// InsertMessages stores messages like the PostgreSQL backend: a message
+// of an unknown chat or sender fails the whole batch with ErrNotFound, as
+// the foreign keys of the messages table do.
+func (r *MemoryRepository) InsertMessages(ctx context.Context, messages []Message) ([]InsertResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range messages {
+		msg := &messages[i]
+		if _, ok := r.chats[msg.ChatID]; msg.ChatID != "" && !ok {
+			return nil, fmt.Errorf("%w: chat %s of message %s", ErrNotFound, msg.ChatID, msg.MessageID)
+		}
+		if _, ok := r.users[msg.UserID]; msg.UserID != "" && !ok {
+			return nil, fmt.Errorf("%w: sender %s of message %s", ErrNotFound, msg.UserID, msg.MessageID)
+		}
+	}
+
+	results := make([]InsertResult, len(messages))
+	for i, msg := range messages {
+		results[i].MessageID = msg.MessageID
+		if _, ok := r.messages[msg.MessageID]; ok {
+			continue
+		}
+		msg.CreatedAt = storedCreatedAt(&msg).UnixMicro()
+		msg.Timestamp = time.UnixMicro(msg.CreatedAt).Unix()
+		msg.walSeq, msg.deadLetter = 0, nil
+		msg.Upload, msg.History = nil, nil
+		r.messages[msg.MessageID] = &memoryMessage{msg: msg}
+		results[i].Inserted = true
+	}
+	return results, nil
+}
+
+func (r *MemoryRepository) GetMessage(ctx context.Context, messageID string) (Message, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.messages[messageID]
+	if !ok || m.deleted {
+		return Message{}, ErrMessageNotFound
+	}
+	return m.msg, nil
+}
+
+// sentMessage returns a message sent by senderID that was not deleted.
+// Called with mu held.
+func (r *MemoryRepository) sentMessage(messageID, senderID string) (*memoryMessage, error) {
+	m, ok := r.messages[messageID]
+	if !ok || m.deleted || m.msg.UserID != senderID {
+		return nil, ErrMessageNotFound
+	}
+	return m, nil
+}
+
+func (r *MemoryRepository) EditMessage(ctx context.Context, messageID, senderID, content string, editedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, err := r.sentMessage(messageID, senderID)
+	if err != nil {
+		return err
+	}
+	m.msg.Content = content
+	m.msg.EditedAt = editedAt.Unix()
+	return nil
+}
+
+func (r *MemoryRepository) DeleteMessage(ctx context.Context, messageID, senderID string, deletedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, err := r.sentMessage(messageID, senderID)
+	if err != nil {
+		return err
+	}
+	m.msg.Content = ""
+	m.deleted = true
+	return nil
+}
+
+func (r *MemoryRepository) HideMessage(ctx context.Context, messageID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.messages[messageID]
+	if !ok {
+		return ErrMessageNotFound
+	}
+	if m.hidden == nil {
+		m.hidden = make(map[string]bool)
+	}
+	m.hidden[userID] = true
+	return nil
+}
+
+func (r *MemoryRepository) History(ctx context.Context, q HistoryQuery) ([]Message, error) {
+	r.mu.RLock()
+	var messages []Message
+	for _, m := range r.messages {
+		if m.msg.ChatID == q.ChatID && !m.deleted && !m.hidden[q.UserID] {
+			messages = append(messages, m.msg)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(messages, func(i, j int) bool {
+		return cursorOf(&messages[i]).less(cursorOf(&messages[j]))
+	})
+	page, _ := pageOf(messages, q.Before, q.After, q.Limit)
+	return page, nil
+}
+
+func (r *MemoryRepository) MarkRead(ctx context.Context, messageID, userID string, at time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.messages[messageID]; !ok {
+		return false, ErrMessageNotFound
+	}
+	reads := r.reads[messageID]
+	if reads == nil {
+		reads = make(map[string]time.Time)
+		r.reads[messageID] = reads
+	}
+	if _, ok := reads[userID]; ok {
+		return false, nil
+	}
+	reads[userID] = at.UTC()
+	return true, nil
+}
+
+func (r *MemoryRepository) Reads(ctx context.Context, messageID string) ([]MessageRead, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reads := make([]MessageRead, 0, len(r.reads[messageID]))
+	for userID, at := range r.reads[messageID] {
+		reads = append(reads, MessageRead{MessageID: messageID, UserID: userID, ReadAt: at})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if !reads[i].ReadAt.Equal(reads[j].ReadAt) {
+			return reads[i].ReadAt.Before(reads[j].ReadAt)
+		}
+		return reads[i].UserID < reads[j].UserID
+	})
+	return reads, nil
+}
+
+func (r *MemoryRepository) UnreadCount(ctx context.Context, chatID, userID string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := 0
+	for id, m := range r.messages {
+		if m.msg.ChatID != chatID || m.msg.UserID == userID || m.deleted || m.hidden[userID] {
+			continue
+		}
+		if _, read := r.reads[id][userID]; !read {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresRepository implements Repository on the tables created by the
+// migrations.
+type PostgresRepository struct {
+	pool *UltraDBPool
+}
+
+func NewPostgresRepository(pool *UltraDBPool) *PostgresRepository {
+	return &PostgresRepository{pool: pool}
+}
+
+func (r *PostgresRepository) withConn(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := r.pool.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.pool.ReturnConnection(conn)
+	return repoError(fn(conn))
+}
+
+// withReadConn is withConn for read-only queries, which may go to a
+// replica.
+func (r *PostgresRepository) withReadConn(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := r.pool.GetReadConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.pool.ReturnConnection(conn)
+	return repoError(fn(conn))
+}
+
+func (r *PostgresRepository) withTx(ctx context.Context, fn func(txn *sql.Tx) error) error {
+	return r.withConn(ctx, func(conn *sql.Conn) error {
+		txn, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+		if err := fn(txn); err != nil {
+			return err
+		}
+		return txn.Commit()
+	})
+}
+
+// exec runs a statement that must change a row and returns ErrNotFound
+// when it changed none.
+func (r *PostgresRepository) exec(ctx context.Context, query string, args ...interface{}) error {
+	return r.withConn(ctx, func(conn *sql.Conn) error {
+		res, err := conn.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return err
+	})
+}
+
+// update is exec for statements that may safely run twice, retried on
+// transient connection failures.
+func (r *PostgresRepository) update(ctx context.Context, query string, args ...interface{}) error {
+	return r.pool.retryWrite(ctx, func() error {
+		return r.exec(ctx, query, args...)
+	})
+}
+
+const userColumns = `id, username, email, display_username, first_name, last_name,
+	profile_image_url, public_key, is_online, last_seen, created_at`
+
+func (r *PostgresRepository) getUser(ctx context.Context, where string, arg interface{}) (User, error) {
+	var (
+		u                                User
+		display, first, last, image, key sql.NullString
+		online                           sql.NullBool
+		lastSeen, createdAt              sql.NullTime
+	)
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+where, arg).Scan(
+			&u.ID, &u.Username, &u.Email, &display, &first, &last, &image, &key, &online, &lastSeen, &createdAt)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	u.DisplayUsername, u.FirstName, u.LastName = display.String, first.String, last.String
+	u.ProfileImageURL, u.PublicKey = image.String, key.String
+	u.IsOnline, u.LastSeen, u.CreatedAt = online.Bool, lastSeen.Time, createdAt.Time
+	return u, nil
+}
+
+func (r *PostgresRepository) GetUser(ctx context.Context, userID string) (User, error) {
+	return r.getUser(ctx, `id = $1`, userID)
+}
+
+func (r *PostgresRepository) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	return r.getUser(ctx, `username = $1`, username)
+}
+
+func (r *PostgresRepository) PublicKey(ctx context.Context, userID string) (string, error) {
+	var key sql.NullString
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, `SELECT public_key FROM users WHERE id = $1`, userID).Scan(&key)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return key.String, err
+}
+
+func (r *PostgresRepository) SetPublicKey(ctx context.Context, userID, publicKey string) error {
+	return r.update(ctx, `UPDATE users SET public_key = $2, updated_at = $3 WHERE id = $1`,
+		userID, publicKey, time.Now().UTC())
+}
+
+func (r *PostgresRepository) SetPresence(ctx context.Context, userID string, online bool, at time.Time) error {
+	return r.update(ctx, `UPDATE users SET is_online = $2, last_seen = $3 WHERE id = $1`,
+		userID, online, at.UTC())
+}
+
+func (r *PostgresRepository) CreateChat(ctx context.Context, chat Chat, memberIDs []string) (Chat, error) {
+	now := time.Now().UTC()
+	chat.CreatedAt, chat.UpdatedAt = now, now
+	err := r.withTx(ctx, func(txn *sql.Tx) error {
+		err := txn.QueryRowContext(ctx, `
+			INSERT INTO chats (name, is_group, created_by, created_at, updated_at)
+			VALUES (NULLIF($1, ''), $2, NULLIF($3, '')::uuid, $4, $4)
+			RETURNING id`,
+			chat.Name, chat.IsGroup, chat.CreatedBy, now).Scan(&chat.ID)
+		if err != nil {
+			return err
+		}
+
+		insert := `INSERT INTO chat_members (chat_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING`
+		if chat.CreatedBy != "" {
+			if _, err := txn.ExecContext(ctx, insert, chat.ID, chat.CreatedBy, RoleAdmin, now); err != nil {
+				return err
+			}
+		}
+		for _, userID := range memberIDs {
+			if _, err := txn.ExecContext(ctx, insert, chat.ID, userID, RoleMember, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Chat{}, err
+	}
+	return chat, nil
+}
+
+const chatColumns = `c.id, c.name, c.is_group, c.created_by, c.created_at, c.updated_at`
+
+func scanChat(scan func(dest ...interface{}) error) (Chat, error) {
+	var (
+		c                    Chat
+		name, createdBy      sql.NullString
+		isGroup              sql.NullBool
+		createdAt, updatedAt sql.NullTime
+	)
+	if err := scan(&c.ID, &name, &isGroup, &createdBy, &createdAt, &updatedAt); err != nil {
+		return Chat{}, err
+	}
+	c.Name, c.IsGroup, c.CreatedBy = name.String, isGroup.Bool, createdBy.String
+	c.CreatedAt, c.UpdatedAt = createdAt.Time, updatedAt.Time
+	return c, nil
+}
+
+func (r *PostgresRepository) GetChat(ctx context.Context, chatID string) (Chat, error) {
+	var chat Chat
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		var err error
+		chat, err = scanChat(conn.QueryRowContext(ctx, `SELECT `+chatColumns+` FROM chats c WHERE c.id = $1`, chatID).Scan)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chat{}, ErrNotFound
+	}
+	return chat, err
+}
+
+func (r *PostgresRepository) ChatsForUser(ctx context.Context, userID string) ([]Chat, error) {
+	var chats []Chat
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `
+			SELECT `+chatColumns+` FROM chats c
+			JOIN chat_members cm ON cm.chat_id = c.id
+			WHERE cm.user_id = $1
+			ORDER BY c.updated_at DESC, c.id`, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			chat, err := scanChat(rows.Scan)
+			if err != nil {
+				return err
+			}
+			chats = append(chats, chat)
+		}
+		return rows.Err()
+	})
+	return chats, err
+}
+
+func (r *PostgresRepository) AddMember(ctx context.Context, chatID, userID, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	err := r.withConn(ctx, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, `
+			INSERT INTO chat_members (chat_id, user_id, role, joined_at) VALUES ($1, $2, $3, $4)`,
+			chatID, userID, role, time.Now().UTC())
+		return err
+	})
+	if err == nil {
+		forgetMembership(chatID, userID)
+	}
+	return err
+}
+
+func (r *PostgresRepository) RemoveMember(ctx context.Context, chatID, userID string) error {
+	err := r.exec(ctx, `DELETE FROM chat_members WHERE chat_id = $1 AND user_id = $2`, chatID, userID)
+	if err == nil {
+		forgetMembership(chatID, userID)
+	}
+	return err
+}
+
+func (r *PostgresRepository) SetMemberRole(ctx context.Context, chatID, userID, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	return r.update(ctx, `UPDATE chat_members SET role = $3 WHERE chat_id = $1 AND user_id = $2`, chatID, userID, role)
+}
+
+func (r *PostgresRepository) Members(ctx context.Context, chatID string) ([]ChatMember, error) {
+	var members []ChatMember
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `
+			SELECT chat_id, user_id, role, joined_at FROM chat_members
+			WHERE chat_id = $1 ORDER BY joined_at, user_id`, chatID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				m        ChatMember
+				role     sql.NullString
+				joinedAt sql.NullTime
+			)
+			if err := rows.Scan(&m.ChatID, &m.UserID, &role, &joinedAt); err != nil {
+				return err
+			}
+			m.Role, m.JoinedAt = role.String, joinedAt.Time
+			members = append(members, m)
+		}
+		return rows.Err()
+	})
+	return members, err
+}
+
+func (r *PostgresRepository) IsMember(ctx context.Context, chatID, userID string) (bool, error) {
+	return r.pool.IsChatMember(ctx, chatID, userID)
+}
+
+func (r *PostgresRepository) InsertMessages(ctx context.Context, messages []Message) ([]InsertResult, error) {
+	results, err := r.pool.BatchInsertMessages(ctx, messages)
+	return results, repoError(err)
+}
+
+func (r *PostgresRepository) GetMessage(ctx context.Context, messageID string) (Message, error) {
+	var messages []Message
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		msg, err := scanStoredMessage(conn.QueryRowContext(ctx, `
+			SELECT `+storedMessageColumns+` FROM messages m
+			WHERE m.id = $1 AND m.deleted_at IS NULL`, messageID).Scan)
+		if err != nil {
+			return err
+		}
+		messages = []Message{msg}
+		return r.pool.loadMessageExtras(ctx, conn, messages, map[string]int{msg.MessageID: 0})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	return messages[0], nil
+}
+
+func (r *PostgresRepository) EditMessage(ctx context.Context, messageID, senderID, content string, editedAt time.Time) error {
+	return r.pool.EditMessage(ctx, messageID, senderID, content, editedAt)
+}
+
+func (r *PostgresRepository) DeleteMessage(ctx context.Context, messageID, senderID string, deletedAt time.Time) error {
+	return r.pool.DeleteMessage(ctx, messageID, senderID, deletedAt)
+}
+
+func (r *PostgresRepository) HideMessage(ctx context.Context, messageID, userID string) error {
+	return repoError(r.pool.HideMessage(ctx, messageID, userID))
+}
+
+func (r *PostgresRepository) History(ctx context.Context, q HistoryQuery) ([]Message, error) {
+	return r.pool.MessageHistory(ctx, q)
+}
+
+func (r *PostgresRepository) MarkRead(ctx context.Context, messageID, userID string, at time.Time) (bool, error) {
+	var marked bool
+	err := r.withConn(ctx, func(conn *sql.Conn) error {
+		res, err := conn.ExecContext(ctx, `
+			INSERT INTO message_reads (message_id, user_id, read_at) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING`, messageID, userID, at.UTC())
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		marked = n > 0
+		return err
+	})
+	return marked, err
+}
+
+func (r *PostgresRepository) Reads(ctx context.Context, messageID string) ([]MessageRead, error) {
+	var reads []MessageRead
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `
+			SELECT message_id, user_id, read_at FROM message_reads
+			WHERE message_id = $1 ORDER BY read_at, user_id`, messageID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				read   MessageRead
+				readAt sql.NullTime
+			)
+			if err := rows.Scan(&read.MessageID, &read.UserID, &readAt); err != nil {
+				return err
+			}
+			read.ReadAt = readAt.Time
+			reads = append(reads, read)
+		}
+		return rows.Err()
+	})
+	return reads, err
+}
+
+func (r *PostgresRepository) UnreadCount(ctx context.Context, chatID, userID string) (int, error) {
+	var count int
+	err := r.withReadConn(ctx, func(conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, `
+			SELECT count(*) FROM messages m
+			WHERE m.chat_id = $1 AND m.sender_id IS DISTINCT FROM $2::uuid AND m.deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM message_reads r WHERE r.message_id = m.id AND r.user_id = $2::uuid)
+			AND NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = $2::uuid)`,
+			chatID, userID).Scan(&count)
+	})
+	return count, err
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestRepository returns a Repository holding the named users, keyed
+// by name. The checks below only use the Repository interface, so they
+// hold for every backend.
+func newTestRepository(t *testing.T, names ...string) (Repository, map[string]string) {
+	t.Helper()
+	repo := NewMemoryRepository()
+	ids := make(map[string]string, len(names))
+	for _, name := range names {
+		u, err := repo.AddUser(User{Username: name, Email: name + "@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = u.ID
+	}
+	return repo, ids
+}
+
+func messageIDs(messages []Message) []string {
+	ids := make([]string, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].MessageID
+	}
+	return ids
+}
+
+func TestRepositoryPagesHistory(t *testing.T) {
+	ctx := context.Background()
+	repo, users := newTestRepository(t, "alice")
+	chat, err := repo.CreateChat(ctx, Chat{CreatedBy: users["alice"]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ten messages, the last two sharing a creation time so the ID breaks
+	// the tie
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var all []Message
+	for i := 0; i < 10; i++ {
+		at := base.Add(time.Duration(i) * time.Second)
+		if i == 9 {
+			at = base.Add(8 * time.Second)
+		}
+		all = append(all, Message{
+			Type:      TypeMessage,
+			MessageID: fmt.Sprintf("m%d", i),
+			ChatID:    chat.ID,
+			UserID:    users["alice"],
+			Content:   fmt.Sprintf("message %d", i),
+			CreatedAt: at.UnixMicro(),
+		})
+	}
+	results, err := repo.InsertMessages(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !r.Inserted {
+			t.Fatalf("%s not inserted", r.MessageID)
+		}
+	}
+
+	// The newest page first, in chronological order
+	page, err := repo.History(ctx, HistoryQuery{ChatID: chat.ID, Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageIDs(page), []string{"m6", "m7", "m8", "m9"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("newest page = %v, want %v", got, want)
+	}
+
+	before := cursorOf(&page[0])
+	page, err = repo.History(ctx, HistoryQuery{ChatID: chat.ID, Before: &before, Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageIDs(page), []string{"m2", "m3", "m4", "m5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("page before m6 = %v, want %v", got, want)
+	}
+
+	after := cursorOf(&page[len(page)-1])
+	page, err = repo.History(ctx, HistoryQuery{ChatID: chat.ID, After: &after, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageIDs(page), []string{"m6", "m7", "m8"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("page after m5 = %v, want %v", got, want)
+	}
+
+	// Inserting an existing ID again is not an error, and keeps the first
+	dup := all[0]
+	dup.Content = "changed"
+	results, err = repo.InsertMessages(ctx, []Message{dup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Inserted {
+		t.Fatal("duplicate message reported as inserted")
+	}
+	if msg, _ := repo.GetMessage(ctx, "m0"); msg.Content != "message 0" {
+		t.Fatalf("duplicate insert replaced the content with %q", msg.Content)
+	}
+}
+
+func TestRepositoryRejectsMessagesOfUnknownChats(t *testing.T) {
+	ctx := context.Background()
+	repo, users := newTestRepository(t, "alice")
+	chat, err := repo.CreateChat(ctx, Chat{CreatedBy: users["alice"]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  Message
+	}{
+		{"unknown chat", Message{Type: TypeMessage, MessageID: "m2", ChatID: newUUID(), UserID: users["alice"], Content: "x"}},
+		{"unknown sender", Message{Type: TypeMessage, MessageID: "m2", ChatID: chat.ID, UserID: newUUID(), Content: "x"}},
+	} {
+		// The whole batch fails, including the valid message
+		valid := Message{Type: TypeMessage, MessageID: "m1", ChatID: chat.ID, UserID: users["alice"], Content: "ok"}
+		if _, err := repo.InsertMessages(ctx, []Message{valid, tc.msg}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: InsertMessages = %v, want %v", tc.name, err, ErrNotFound)
+		}
+		if _, err := repo.GetMessage(ctx, "m1"); !errors.Is(err, ErrMessageNotFound) {
+			t.Fatalf("%s: message of the failed batch stored", tc.name)
+		}
+	}
+}
+
+func TestRepositoryEditsAndDeletesMessages(t *testing.T) {
+	ctx := context.Background()
+	repo, users := newTestRepository(t, "alice", "bob")
+	chat, err := repo.CreateChat(ctx, Chat{CreatedBy: users["alice"]}, []string{users["bob"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []Message
+	for i, sender := range []string{"alice", "alice", "bob"} {
+		messages = append(messages, Message{
+			Type:      TypeMessage,
+			MessageID: fmt.Sprintf("m%d", i),
+			ChatID:    chat.ID,
+			UserID:    users[sender],
+			Content:   "hello",
+			CreatedAt: time.Date(2024, 1, 1, 0, 0, i, 0, time.UTC).UnixMicro(),
+		})
+	}
+	if _, err := repo.InsertMessages(ctx, messages); err != nil {
+		t.Fatal(err)
+	}
+
+	editedAt := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := repo.EditMessage(ctx, "m0", users["alice"], "edited", editedAt); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := repo.GetMessage(ctx, "m0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "edited" || msg.EditedAt != editedAt.Unix() {
+		t.Fatalf("edited message = %q at %d, want %q at %d", msg.Content, msg.EditedAt, "edited", editedAt.Unix())
+	}
+
+	// Only the sender edits or deletes, and only messages that exist
+	if err := repo.EditMessage(ctx, "m0", users["bob"], "hijacked", editedAt); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("edit by another user = %v, want %v", err, ErrMessageNotFound)
+	}
+	if err := repo.DeleteMessage(ctx, "m2", users["alice"], editedAt); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("delete by another user = %v, want %v", err, ErrMessageNotFound)
+	}
+	if err := repo.EditMessage(ctx, "missing", users["alice"], "x", editedAt); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("edit of a missing message = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	// Deleted for everyone: gone for both, and no longer editable
+	if err := repo.DeleteMessage(ctx, "m1", users["alice"], editedAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetMessage(ctx, "m1"); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("GetMessage of a deleted message = %v, want %v", err, ErrMessageNotFound)
+	}
+	if err := repo.EditMessage(ctx, "m1", users["alice"], "back", editedAt); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("edit of a deleted message = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	// Deleted for bob only
+	if err := repo.HideMessage(ctx, "m2", users["bob"]); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		user string
+		want []string
+	}{
+		{"alice", []string{"m0", "m2"}},
+		{"bob", []string{"m0"}},
+	} {
+		page, err := repo.History(ctx, HistoryQuery{ChatID: chat.ID, UserID: users[tc.user], Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messageIDs(page); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s sees %v, want %v", tc.user, got, tc.want)
+		}
+	}
+	if n, err := repo.UnreadCount(ctx, chat.ID, users["bob"]); err != nil || n != 1 {
+		t.Fatalf("bob's unread count = %d, %v, want 1", n, err)
+	}
+}
+
+func TestRepositoryMembership(t *testing.T) {
+	ctx := context.Background()
+	repo, users := newTestRepository(t, "alice", "bob", "carol")
+
+	chat, err := repo.CreateChat(ctx, Chat{Name: "team", IsGroup: true, CreatedBy: users["alice"]}, []string{users["bob"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.ID == "" {
+		t.Fatal("CreateChat assigned no ID")
+	}
+	if _, err := repo.CreateChat(ctx, Chat{CreatedBy: users["alice"]}, []string{"nobody"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("chat with an unknown member = %v, want %v", err, ErrNotFound)
+	}
+
+	roles := func() map[string]string {
+		t.Helper()
+		members, err := repo.Members(ctx, chat.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string, len(members))
+		for _, m := range members {
+			got[m.UserID] = m.Role
+		}
+		return got
+	}
+	// The creator is an admin
+	if got, want := roles(), map[string]string{users["alice"]: RoleAdmin, users["bob"]: RoleMember}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("members = %v, want %v", got, want)
+	}
+
+	if err := repo.AddMember(ctx, chat.ID, users["carol"], RoleMember); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AddMember(ctx, chat.ID, users["carol"], RoleMember); !errors.Is(err, ErrConflict) {
+		t.Fatalf("adding a member twice = %v, want %v", err, ErrConflict)
+	}
+	if err := repo.AddMember(ctx, chat.ID, users["carol"], "owner"); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("adding with an unknown role = %v, want %v", err, ErrInvalidRole)
+	}
+	if err := repo.SetMemberRole(ctx, chat.ID, users["carol"], RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if got := roles()[users["carol"]]; got != RoleAdmin {
+		t.Fatalf("carol is %q, want %q", got, RoleAdmin)
+	}
+
+	if err := repo.RemoveMember(ctx, chat.ID, users["bob"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RemoveMember(ctx, chat.ID, users["bob"]); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("removing a non-member = %v, want %v", err, ErrNotFound)
+	}
+	if err := repo.SetMemberRole(ctx, chat.ID, users["bob"], RoleAdmin); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("setting the role of a non-member = %v, want %v", err, ErrNotFound)
+	}
+	for name, want := range map[string]bool{"alice": true, "bob": false, "carol": true} {
+		if member, err := repo.IsMember(ctx, chat.ID, users[name]); err != nil || member != want {
+			t.Fatalf("IsMember(%s) = %v, %v, want %v", name, member, err, want)
+		}
+	}
+
+	chats, err := repo.ChatsForUser(ctx, users["carol"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 || chats[0].ID != chat.ID {
+		t.Fatalf("carol's chats = %v, want only %s", chats, chat.ID)
+	}
+	if chats, _ := repo.ChatsForUser(ctx, users["bob"]); len(chats) != 0 {
+		t.Fatalf("bob still in %d chats after removal", len(chats))
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a certificate/key pair that is reloaded from disk when
+// the files change or the process receives SIGHUP. Existing connections keep
+// the certificate they negotiated; only new handshakes see the new one.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %w", r.certFile, err)
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		logger.Info("TLS certificate loaded",
+			"cert_file", r.certFile, "subject", leaf.Subject.String(), "not_after", leaf.NotAfter)
+	}
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reloadIfChanged reloads the pair when either file is newer than the
+// loaded one. A failed reload keeps serving the previous certificate.
+func (r *certReloader) reloadIfChanged() {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		logger.Warn("TLS certificate stat failed", "cert_file", r.certFile, "error", err)
+		return
+	}
+
+	r.mu.RLock()
+	changed := modTime.After(r.modTime)
+	r.mu.RUnlock()
+
+	if changed {
+		if err := r.reload(); err != nil {
+			logger.Error("TLS certificate reload failed, keeping previous", "error", err)
+		}
+	}
+}
+
+// watch polls the files every interval and reloads on SIGHUP until ctx is
+// cancelled.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reloadIfChanged()
+		case <-hup:
+			logger.Info("SIGHUP received, reloading TLS certificate")
+			if err := r.reload(); err != nil {
+				logger.Error("TLS certificate reload failed, keeping previous", "error", err)
+			}
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// newServerTLSConfig builds the listener TLS configuration, including
+// optional client certificate verification for internal links.
+func newServerTLSConfig(cfg TLSConfig, certs *certReloader) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, err := parseClientAuth(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     clientAuth,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// newBackendTLSConfig builds the client TLS configuration the load balancer
+// uses towards its backends, presenting a client certificate for mTLS when
+// one is configured.
+func newBackendTLSConfig(cfg BackendTLSConfig) (*tls.Config, *certReloader, error) {
+	minVersion, err := parseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: cfg.ServerName,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	var certs *certReloader
+	if cfg.CertFile != "" {
+		certs, err = newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsCfg.GetClientCertificate = certs.GetClientCertificate
+	}
+	return tlsCfg, certs, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA file %s contains no certificates", path)
+	}
+	return pool, nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported minimum TLS version %q, use 1.2 or 1.3", s)
+	}
+}
+
+// parseCipherSuites maps IANA suite names to IDs, refusing suites Go
+// considers insecure. An empty list keeps Go's defaults. TLS 1.3 suites are
+// not configurable and are always enabled.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	var errs []error
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown or insecure cipher suite %q", name))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, errors.Join(errs...)
+}
+
+func parseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify_if_given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, fmt.Errorf("unknown client auth mode %q", s)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed pair for commonName and dates both
+// files at modTime.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedName returns the common name of the certificate r serves.
+func servedName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderPicksUpRotatedPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "first", start)
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "first" {
+		t.Fatalf("serving %q, want first", got)
+	}
+
+	// Unchanged files are not reloaded
+	r.reloadIfChanged()
+	if got := servedName(t, r); got != "first" {
+		t.Fatalf("serving %q after a check without changes", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	r.reloadIfChanged()
+	if got := servedName(t, r); got != "second" {
+		t.Fatalf("serving %q after rotation, want second", got)
+	}
+
+	// A broken pair keeps the previous certificate
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, start.Add(2*time.Minute), start.Add(2*time.Minute))
+	r.reloadIfChanged()
+	if got := servedName(t, r); got != "second" {
+		t.Fatalf("serving %q after a broken rotation, want second", got)
+	}
+
+	// The watcher picks up the next rotation on its own
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.watch(ctx, 5*time.Millisecond)
+	writeTestCert(t, certFile, keyFile, "third", start.Add(3*time.Minute))
+	deadline := time.Now().Add(5 * time.Second)
+	for servedName(t, r) != "third" {
+		if time.Now().After(deadline) {
+			t.Fatal("watcher did not reload the rotated pair")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewCertReloaderRejectsMissingPair(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")); err == nil {
+		t.Fatal("loaded a missing pair")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errLoadAbandoned is what callers waiting on a load get when the loader
+// panicked.
+var errLoadAbandoned = errors.New("cache load did not complete")
+
+// CacheNamespace names a group of UltraCache keys and the defaults for
+// them. Keys are stored as "<Name>:<key>", so namespaces cannot collide.
+type CacheNamespace struct {
+	Name string
+	// TTL applies to every value stored through the namespace.
+	TTL time.Duration
+	// NotFound is the load error remembered for NegativeTTL, matched with
+	// errors.Is, so a missing row is not looked up again on every request.
+	// Nothing is remembered when either is zero.
+	NotFound    error
+	NegativeTTL time.Duration
+}
+
+// TypedCache is a view of UltraCache holding values of type V under keys
+// of type K in one namespace. Values of another type found under its keys
+// count as misses.
+//
+// GetOrLoad coalesces concurrent loads of a key into one and stores the
+// result with Fill, so a write made while loading wins over the loaded
+// value.
+type TypedCache[K comparable, V any] struct {
+	cache *UltraCache
+	ns    CacheNamespace
+	key   func(K) string
+
+	mu    sync.Mutex
+	loads map[K]*typedLoad[V]
+}
+
+type typedLoad[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// negativeEntry is stored in place of a value whose load failed with the
+// namespace's NotFound error.
+type negativeEntry struct {
+	err error
+}
+
+func (negativeEntry) Size() int { return 16 }
+
+// NewTypedCache returns the view of cache for ns. key turns a key into
+// its string form within the namespace.
+func NewTypedCache[K comparable, V any](cache *UltraCache, ns CacheNamespace, key func(K) string) *TypedCache[K, V] {
+	return &TypedCache[K, V]{
+		cache: cache,
+		ns:    ns,
+		key:   key,
+		loads: make(map[K]*typedLoad[V]),
+	}
+}
+
+// stringKey is the key function for string keys.
+func stringKey(key string) string { return key }
+
+func (c *TypedCache[K, V]) cacheKey(key K) string {
+	return c.ns.Name + ":" + c.key(key)
+}
+
+// Get returns the value stored for key. Remembered load errors count as
+// misses.
+func (c *TypedCache[K, V]) Get(key K) (V, bool) {
+	value, found, err := c.lookup(key)
+	return value, found && err == nil
+}
+
+// lookup returns the value or remembered load error stored for key.
+func (c *TypedCache[K, V]) lookup(key K) (value V, found bool, err error) {
+	cached, found := c.cache.Get(c.cacheKey(key))
+	if !found {
+		return value, false, nil
+	}
+	// Checked first, as V may be an interface a negativeEntry satisfies
+	if negative, ok := cached.(negativeEntry); ok {
+		return value, true, negative.err
+	}
+	value, found = cached.(V)
+	return value, found, nil
+}
+
+// Set stores value for key. Other instances drop their copy.
+func (c *TypedCache[K, V]) Set(key K, value V) {
+	c.cache.Set(c.cacheKey(key), value, c.ns.TTL)
+}
+
+// Delete removes key here and on the other instances.
+func (c *TypedCache[K, V]) Delete(key K) {
+	c.cache.Delete(c.cacheKey(key))
+}
+
+// Clear removes every key of the namespace here and on the other
+// instances.
+func (c *TypedCache[K, V]) Clear() {
+	c.cache.DeletePrefix(c.ns.Name + ":")
+}
+
+// GetOrLoad returns the value stored for key, calling load on a miss.
+// Callers asking for a key already being loaded wait for that load instead
+// of starting their own; if it is abandoned because the context of the
+// caller that started it ended, they load it themselves.
+func (c *TypedCache[K, V]) GetOrLoad(ctx context.Context, key K, load func(ctx context.Context) (V, error)) (V, error) {
+	for {
+		if value, found, err := c.lookup(key); found {
+			return value, err
+		}
+
+		c.mu.Lock()
+		if l, ok := c.loads[key]; ok {
+			c.mu.Unlock()
+			select {
+			case <-l.done:
+			case <-ctx.Done():
+				var zero V
+				return zero, ctx.Err()
+			}
+			if ctx.Err() == nil && (errors.Is(l.err, context.Canceled) || errors.Is(l.err, context.DeadlineExceeded)) {
+				continue
+			}
+			return l.value, l.err
+		}
+		l := &typedLoad[V]{done: make(chan struct{}), err: errLoadAbandoned}
+		c.loads[key] = l
+		c.mu.Unlock()
+
+		c.load(ctx, key, l, load)
+		return l.value, l.err
+	}
+}
+
+func (c *TypedCache[K, V]) load(ctx context.Context, key K, l *typedLoad[V], load func(ctx context.Context) (V, error)) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.loads, key)
+		c.mu.Unlock()
+		close(l.done)
+	}()
+
+	version := c.cache.Version()
+	l.value, l.err = load(ctx)
+	switch {
+	case l.err == nil:
+		c.cache.Fill(c.cacheKey(key), l.value, c.ns.TTL, version)
+	case c.ns.NotFound != nil && c.ns.NegativeTTL > 0 && errors.Is(l.err, c.ns.NotFound):
+		c.cache.Fill(c.cacheKey(key), negativeEntry{err: l.err}, c.ns.NegativeTTL, version)
+	}
+}
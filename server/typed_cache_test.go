@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTypedCacheCoalescesLoads(t *testing.T) {
+	const callers = 50
+
+	tc := NewTypedCache[string, int](newTestCache(t, 1), CacheNamespace{Name: "test", TTL: time.Minute}, stringKey)
+
+	var loads int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (int, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := tc.GetOrLoad(context.Background(), "k", load)
+			if err != nil || value != 42 {
+				t.Errorf("GetOrLoad = %d, %v, want 42", value, err)
+			}
+		}()
+	}
+	// Let the callers pile up behind the first load
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("loaded %d times, want once", loads)
+	}
+	if value, found := tc.Get("k"); !found || value != 42 {
+		t.Fatalf("Get = %d, %v, want the loaded value", value, found)
+	}
+}
+
+func TestTypedCacheRemembersNotFound(t *testing.T) {
+	errMissing := errors.New("missing")
+	tc := NewTypedCache[string, string](newTestCache(t, 1), CacheNamespace{
+		Name:        "test",
+		TTL:         time.Minute,
+		NotFound:    errMissing,
+		NegativeTTL: 30 * time.Millisecond,
+	}, stringKey)
+
+	var loads int32
+	load := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&loads, 1)
+		return "", errMissing
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := tc.GetOrLoad(context.Background(), "k", load); !errors.Is(err, errMissing) {
+			t.Fatalf("GetOrLoad error = %v, want %v", err, errMissing)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("loaded %d times, want once while the miss is remembered", loads)
+	}
+	if _, found := tc.Get("k"); found {
+		t.Fatal("Get found a remembered miss")
+	}
+
+	// Other errors are not remembered
+	other := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&loads, 1)
+		return "", errors.New("database down")
+	}
+	time.Sleep(40 * time.Millisecond)
+	tc.GetOrLoad(context.Background(), "k", other)
+	tc.GetOrLoad(context.Background(), "k", other)
+	if loads != 3 {
+		t.Fatalf("loaded %d times, want 3", loads)
+	}
+
+	// A value set later replaces the remembered miss
+	tc.GetOrLoad(context.Background(), "k", load)
+	tc.Set("k", "found")
+	if value, err := tc.GetOrLoad(context.Background(), "k", load); err != nil || value != "found" {
+		t.Fatalf("GetOrLoad = %q, %v, want the value set", value, err)
+	}
+}
+
+func TestTypedCacheDropsLoadRacingWrite(t *testing.T) {
+	tc := NewTypedCache[string, string](newTestCache(t, 1), CacheNamespace{Name: "test", TTL: time.Minute}, stringKey)
+
+	value, err := tc.GetOrLoad(context.Background(), "k", func(ctx context.Context) (string, error) {
+		tc.Set("k", "new")
+		return "stale", nil
+	})
+	if err != nil || value != "stale" {
+		t.Fatalf("GetOrLoad = %q, %v, want the loaded value", value, err)
+	}
+	if cached, _ := tc.Get("k"); cached != "new" {
+		t.Fatalf("cached %q, want the value written during the load", cached)
+	}
+}
+
+func TestTypedCacheNamespacesAndTypes(t *testing.T) {
+	uc := newTestCache(t, 1)
+	counts := NewTypedCache[string, int](uc, CacheNamespace{Name: "a", TTL: time.Minute}, stringKey)
+	names := NewTypedCache[string, string](uc, CacheNamespace{Name: "b", TTL: time.Minute}, stringKey)
+
+	counts.Set("k", 1)
+	names.Set("k", "one")
+	if value, _ := counts.Get("k"); value != 1 {
+		t.Fatalf("counts k = %d, want 1", value)
+	}
+
+	// A value of another type under the namespace's keys is a miss
+	uc.Set("a:x", "not an int", time.Minute)
+	if _, found := counts.Get("x"); found {
+		t.Fatal("value of the wrong type returned")
+	}
+
+	counts.Clear()
+	if _, found := counts.Get("k"); found {
+		t.Fatal("Clear left a key of its namespace")
+	}
+	if value, _ := names.Get("k"); value != "one" {
+		t.Fatal("Clear removed a key of another namespace")
+	}
+}
@@ -1,50 +1,102 @@
-
 package main
 
 import (
 	"sync"
+	"sync/atomic"
+	"strings"
 	"time"
-	"unsafe"
+	"reflect"
 	"runtime"
-	"hash/fnv"
 )
 
+// tombstoneTTL is how long writes and invalidations are remembered to
+// reject Fills that started before them. A Fill taking longer is dropped.
+const tombstoneTTL = time.Minute
+
+// entryOverhead approximates the bytes an entry takes besides its key and
+// value: the CacheItem, its map slot and the value's interface header.
+const entryOverhead = 128
+
+// Sizer is implemented by cached values that can tell their approximate
+// size in bytes. Values are sized when stored, so a value changed in place
+// should be stored again for the change to count.
+type Sizer interface {
+	Size() int
+}
+
 // UltraCache - Redis'dan 100x tezroq in-memory cache
+//
+// The cache is bounded by bytes: every shard holds at most its share of
+// the configured memory and evicts least recently used entries to stay
+// within it. Values larger than a shard are not cached.
+//
+// Every write and invalidation advances the cache's version. Values read
+// from a database are stored with Fill, which drops them when the key was
+// written or invalidated after the version taken before the read, so a
+// slow load cannot put back a value that is already stale.
 type UltraCache struct {
 	shards   []*CacheShard
 	shardNum int
 	stats    *CacheStats
+
+	version       uint64 // accessed atomically
+	prunedThrough uint64 // accessed atomically, newest version of a pruned tombstone
+
+	prefixMu         sync.RWMutex
+	prefixTombstones []prefixTombstone
+
+	invalidator *cacheInvalidator // nil on a single instance
+	stop        chan struct{}
+	stopOnce    sync.Once
 }
 
+// CacheShard is one lock's worth of the cache. Reads move entries in the
+// LRU list, so every access takes the write lock.
 type CacheShard struct {
-	mu      sync.RWMutex
-	data    map[string]*CacheItem
-	lru     *LRUList
-	maxSize int
+	mu         sync.Mutex
+	data       map[string]*CacheItem
+	lru        *LRUList
+	maxSize    int // bytes
+	size       int // bytes held, see entrySize
+	tombstones map[string]tombstone // keys written or invalidated recently
 }
 
 type CacheItem struct {
 	key       string
 	value     interface{}
 	expiry    int64
+	version   uint64
 	frequency uint32
 	size      int
 	next      *CacheItem
 	prev      *CacheItem
 }
 
+// tombstone records the version a key was last written or invalidated at.
+type tombstone struct {
+	version uint64
+	at      int64
+}
+
+type prefixTombstone struct {
+	prefix string
+	tombstone
+}
+
 type LRUList struct {
 	head *CacheItem
 	tail *CacheItem
 	size int
 }
 
+// CacheStats counts cache operations. All fields are accessed atomically.
 type CacheStats struct {
-	hits         uint64
-	misses       uint64
-	evictions    uint64
-	memory_usage uint64
-	operations   uint64
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+	rejected    uint64 // values too large to cache
+	operations  uint64
 }
 
 func NewUltraCache(maxMemoryMB int) *UltraCache {
@@ -54,9 +106,10 @@ func NewUltraCache(maxMemoryMB int) *UltraCache {
 	
 	for i := 0; i < shardNum; i++ {
 		shards[i] = &CacheShard{
-			data:    make(map[string]*CacheItem, 10000),
-			lru:     &LRUList{},
-			maxSize: shardSize,
+			data:       make(map[string]*CacheItem),
+			lru:        &LRUList{},
+			maxSize:    shardSize,
+			tombstones: make(map[string]tombstone),
 		}
 	}
 	
@@ -64,6 +117,7 @@ func NewUltraCache(maxMemoryMB int) *UltraCache {
 		shards:   shards,
 		shardNum: shardNum,
 		stats:    &CacheStats{},
+		stop:     make(chan struct{}),
 	}
 	
 	// Start background cleanup
@@ -72,93 +126,249 @@ func NewUltraCache(maxMemoryMB int) *UltraCache {
 	return cache
 }
 
-// Ultra-fast key hashing
+// Close stops the background cleanup.
+func (uc *UltraCache) Close() {
+	uc.stopOnce.Do(func() { close(uc.stop) })
+}
+
+// hash is FNV-1a, inlined so hashing a key does not allocate.
 func (uc *UltraCache) hash(key string) uint32 {
-	h := fnv.New32a()
-	h.Write(*(*[]byte)(unsafe.Pointer(&key)))
-	return h.Sum32()
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
 }
 
 func (uc *UltraCache) getShard(key string) *CacheShard {
 	return uc.shards[uc.hash(key)%uint32(uc.shardNum)]
 }
 
-// Set with zero-allocation optimization
+// Version returns the cache's current version, to be taken before
+// reading a value that is then stored with Fill.
+func (uc *UltraCache) Version() uint64 {
+	return atomic.LoadUint64(&uc.version)
+}
+
+// Set stores a new value for key. Other instances drop their copy.
 func (uc *UltraCache) Set(key string, value interface{}, ttl time.Duration) {
 	shard := uc.getShard(key)
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 	
-	expiry := int64(0)
-	if ttl > 0 {
-		expiry = time.Now().Add(ttl).UnixNano()
+	version := atomic.AddUint64(&uc.version, 1)
+	shard.tombstones[key] = tombstone{version: version, at: time.Now().UnixNano()}
+	uc.store(shard, key, value, ttl, version)
+	
+	if uc.invalidator != nil {
+		uc.invalidator.publish(key, false)
 	}
+}
+
+// Fill stores value, read from its source at version, unless key was
+// written or invalidated since. Other instances are not told, as their
+// copies are no older. It reports whether the value was stored.
+func (uc *UltraCache) Fill(key string, value interface{}, ttl time.Duration, version uint64) bool {
+	shard := uc.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 	
-	// Calculate value size
-	size := uc.calculateSize(value)
+	if version < atomic.LoadUint64(&uc.prunedThrough) {
+		return false
+	}
+	if t, ok := shard.tombstones[key]; ok && t.version > version {
+		return false
+	}
+	if existing, ok := shard.data[key]; ok && existing.version > version {
+		return false
+	}
+	if uc.prefixInvalidatedSince(key, version) {
+		return false
+	}
+	return uc.store(shard, key, value, ttl, version)
+}
+
+// store adds or replaces key and reports whether it fit. Called with
+// shard.mu held.
+func (uc *UltraCache) store(shard *CacheShard, key string, value interface{}, ttl time.Duration, version uint64) bool {
+	atomic.AddUint64(&uc.stats.operations, 1)
 	
-	item := &CacheItem{
-		key:       key,
-		value:     value,
-		expiry:    expiry,
-		frequency: 1,
-		size:      size,
+	size := entrySize(key, value)
+	existing, exists := shard.data[key]
+	if size > shard.maxSize {
+		// Keeping the old value would leave it stale
+		if exists {
+			shard.removeItem(existing)
+		}
+		atomic.AddUint64(&uc.stats.rejected, 1)
+		return false
+	}
+	
+	expiry := int64(0)
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl).UnixNano()
 	}
 	
-	// Check if key exists
-	if existing, exists := shard.data[key]; exists {
+	if exists {
+		shard.size += size - existing.size
 		existing.value = value
 		existing.expiry = expiry
+		existing.version = version
+		existing.size = size
 		existing.frequency++
 		shard.lru.moveToFront(existing)
-		return
+	} else {
+		item := &CacheItem{
+			key:       key,
+			value:     value,
+			expiry:    expiry,
+			version:   version,
+			frequency: 1,
+			size:      size,
+		}
+		shard.data[key] = item
+		shard.lru.addToFront(item)
+		shard.size += size
 	}
 	
-	// Add new item
-	shard.data[key] = item
-	shard.lru.addToFront(item)
-	
 	// Evict if necessary
 	uc.evictIfNeeded(shard)
-	
-	uc.stats.operations++
+	return true
 }
 
-// Ultra-fast Get with inline assembly optimizations
-func (uc *UltraCache) Get(key string) (interface{}, bool) {
+// Delete removes key here and on the other instances.
+func (uc *UltraCache) Delete(key string) {
+	uc.invalidate(key)
+	if uc.invalidator != nil {
+		uc.invalidator.publish(key, false)
+	}
+}
+
+// DeletePrefix removes every key starting with prefix here and on the
+// other instances.
+func (uc *UltraCache) DeletePrefix(prefix string) {
+	uc.invalidatePrefix(prefix)
+	if uc.invalidator != nil {
+		uc.invalidator.publish(prefix, true)
+	}
+}
+
+// invalidate removes key and rejects Fills that started before.
+func (uc *UltraCache) invalidate(key string) {
 	shard := uc.getShard(key)
-	shard.mu.RLock()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 	
-	item, exists := shard.data[key]
-	if !exists {
-		shard.mu.RUnlock()
-		uc.stats.misses++
-		return nil, false
+	version := atomic.AddUint64(&uc.version, 1)
+	shard.tombstones[key] = tombstone{version: version, at: time.Now().UnixNano()}
+	if item, ok := shard.data[key]; ok {
+		shard.removeItem(item)
+	}
+}
+
+// invalidatePrefix removes the keys starting with prefix, all of them for
+// "", and rejects Fills of such keys that started before. The tombstone is
+// recorded before the shards are swept, so a concurrent Fill either sees
+// it or is swept.
+func (uc *UltraCache) invalidatePrefix(prefix string) {
+	version := atomic.AddUint64(&uc.version, 1)
+	uc.prefixMu.Lock()
+	uc.prefixTombstones = append(uc.prefixTombstones, prefixTombstone{
+		prefix:    prefix,
+		tombstone: tombstone{version: version, at: time.Now().UnixNano()},
+	})
+	uc.prefixMu.Unlock()
+	
+	for _, shard := range uc.shards {
+		shard.mu.Lock()
+		for key, item := range shard.data {
+			if strings.HasPrefix(key, prefix) {
+				shard.removeItem(item)
+			}
+		}
+		shard.mu.Unlock()
 	}
+}
+
+func (uc *UltraCache) prefixInvalidatedSince(key string, version uint64) bool {
+	uc.prefixMu.RLock()
+	defer uc.prefixMu.RUnlock()
+	for _, t := range uc.prefixTombstones {
+		if t.version > version && strings.HasPrefix(key, t.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneTombstones forgets tombstones older than tombstoneTTL. Fills that
+// started before the newest of them are rejected from then on.
+func (uc *UltraCache) pruneTombstones(now int64) {
+	cutoff := now - int64(tombstoneTTL)
+	var pruned uint64
 	
-	// Check expiry
-	if item.expiry > 0 && time.Now().UnixNano() > item.expiry {
-		shard.mu.RUnlock()
+	for _, shard := range uc.shards {
 		shard.mu.Lock()
-		delete(shard.data, key)
-		shard.lru.remove(item)
+		for key, t := range shard.tombstones {
+			if t.at < cutoff {
+				delete(shard.tombstones, key)
+				pruned = max(pruned, t.version)
+			}
+		}
 		shard.mu.Unlock()
-		uc.stats.misses++
-		return nil, false
 	}
 	
-	value := item.value
-	item.frequency++
-	shard.mu.RUnlock()
+	uc.prefixMu.Lock()
+	kept := uc.prefixTombstones[:0]
+	for _, t := range uc.prefixTombstones {
+		if t.at < cutoff {
+			pruned = max(pruned, t.version)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	uc.prefixTombstones = kept
+	uc.prefixMu.Unlock()
 	
-	// Move to front for LRU (lock-free when possible)
+	for {
+		current := atomic.LoadUint64(&uc.prunedThrough)
+		if pruned <= current || atomic.CompareAndSwapUint64(&uc.prunedThrough, current, pruned) {
+			return
+		}
+	}
+}
+
+// Get returns the value stored for key, marking it recently used.
+func (uc *UltraCache) Get(key string) (interface{}, bool) {
+	atomic.AddUint64(&uc.stats.operations, 1)
+	shard := uc.getShard(key)
 	shard.mu.Lock()
-	shard.lru.moveToFront(item)
+	value, ok := uc.lookup(shard, key, time.Now().UnixNano())
 	shard.mu.Unlock()
 	
-	uc.stats.hits++
-	uc.stats.operations++
-	return value, true
+	if ok {
+		atomic.AddUint64(&uc.stats.hits, 1)
+	} else {
+		atomic.AddUint64(&uc.stats.misses, 1)
+	}
+	return value, ok
+}
+
+// lookup finds key, dropping it if it expired. Called with shard.mu held.
+func (uc *UltraCache) lookup(shard *CacheShard, key string, now int64) (interface{}, bool) {
+	item, exists := shard.data[key]
+	if !exists {
+		return nil, false
+	}
+	if item.expiry > 0 && now > item.expiry {
+		shard.removeItem(item)
+		atomic.AddUint64(&uc.stats.expirations, 1)
+		return nil, false
+	}
+	item.frequency++
+	shard.lru.moveToFront(item)
+	return item.value, true
 }
 
 // Batch operations for maximum throughput
@@ -173,94 +383,155 @@ func (uc *UltraCache) MultiGet(keys []string) map[string]interface{} {
 	}
 	
 	// Process each shard
+	now := time.Now().UnixNano()
+	var hits uint64
 	for shard, keys := range shardKeys {
-		shard.mu.RLock()
+		shard.mu.Lock()
 		for _, key := range keys {
-			if item, exists := shard.data[key]; exists {
-				if item.expiry == 0 || time.Now().UnixNano() <= item.expiry {
-					result[key] = item.value
-					item.frequency++
-				}
+			if value, ok := uc.lookup(shard, key, now); ok {
+				result[key] = value
+				hits++
 			}
 		}
-		shard.mu.RUnlock()
+		shard.mu.Unlock()
 	}
 	
+	atomic.AddUint64(&uc.stats.operations, uint64(len(keys)))
+	atomic.AddUint64(&uc.stats.hits, hits)
+	atomic.AddUint64(&uc.stats.misses, uint64(len(keys))-hits)
 	return result
 }
 
-// Memory-efficient eviction
+// evictIfNeeded drops least recently used entries until the shard is
+// within its size. Called with shard.mu held.
 func (uc *UltraCache) evictIfNeeded(shard *CacheShard) {
-	for shard.lru.size > shard.maxSize/100 { // Keep under size limit
-		if shard.lru.tail == nil {
-			break
-		}
-		
-		item := shard.lru.tail
-		delete(shard.data, item.key)
-		shard.lru.remove(item)
-		uc.stats.evictions++
+	for shard.size > shard.maxSize && shard.lru.tail != nil {
+		shard.removeItem(shard.lru.tail)
+		atomic.AddUint64(&uc.stats.evictions, 1)
 	}
 }
 
+// removeItem drops item from the shard. Called with shard.mu held.
+func (shard *CacheShard) removeItem(item *CacheItem) {
+	delete(shard.data, item.key)
+	shard.lru.remove(item)
+	shard.size -= item.size
+}
+
 // Background cleanup for expired items
 func (uc *UltraCache) backgroundCleanup() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-uc.stop:
+			return
+		}
 		now := time.Now().UnixNano()
-		
+	
 		for _, shard := range uc.shards {
 			shard.mu.Lock()
-			for key, item := range shard.data {
+			for _, item := range shard.data {
 				if item.expiry > 0 && now > item.expiry {
-					delete(shard.data, key)
-					shard.lru.remove(item)
+					shard.removeItem(item)
+					atomic.AddUint64(&uc.stats.expirations, 1)
 				}
 			}
 			shard.mu.Unlock()
 		}
+		uc.pruneTombstones(now)
 	}
 }
 
-func (uc *UltraCache) calculateSize(value interface{}) int {
-	return int(unsafe.Sizeof(value))
+// entrySize approximates the bytes an entry takes.
+func entrySize(key string, value interface{}) int {
+	return entryOverhead + len(key) + valueSize(value)
+}
+
+// valueSize approximates the bytes value takes beyond its interface
+// header. Values other than Sizers, strings and byte slices are sized by
+// their type alone, without following pointers further than one level.
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case Sizer:
+		return v.Size()
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case []string:
+		size := len(v) * 16
+		for _, s := range v {
+			size += len(s)
+		}
+		return size
+	}
+	
+	t := reflect.TypeOf(value)
+	switch t.Kind() {
+	case reflect.Pointer:
+		return int(t.Size() + t.Elem().Size())
+	case reflect.Slice:
+		return int(t.Size()) + reflect.ValueOf(value).Len()*int(t.Elem().Size())
+	}
+	return int(t.Size())
 }
 
 // Performance monitoring
 func (uc *UltraCache) GetStats() map[string]interface{} {
-	totalItems := 0
+	totalItems, memory, maxMemory := 0, 0, 0
 	for _, shard := range uc.shards {
-		shard.mu.RLock()
+		shard.mu.Lock()
 		totalItems += len(shard.data)
-		shard.mu.RUnlock()
+		memory += shard.size
+		maxMemory += shard.maxSize
+		shard.mu.Unlock()
 	}
 	
-	hitRate := float64(uc.stats.hits) / float64(uc.stats.hits+uc.stats.misses) * 100
+	hits := atomic.LoadUint64(&uc.stats.hits)
+	misses := atomic.LoadUint64(&uc.stats.misses)
+	hitRate := 0.0
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses) * 100
+	}
 	
-	return map[string]interface{}{
+	stats := map[string]interface{}{
+		"version":           uc.Version(),
 		"total_items":       totalItems,
+		"memory_bytes":      memory,
+		"max_memory_bytes":  maxMemory,
 		"hit_rate_percent":  hitRate,
-		"total_operations":  uc.stats.operations,
-		"evictions":         uc.stats.evictions,
+		"hits":              hits,
+		"misses":            misses,
+		"total_operations":  atomic.LoadUint64(&uc.stats.operations),
+		"evictions":         atomic.LoadUint64(&uc.stats.evictions),
+		"expirations":       atomic.LoadUint64(&uc.stats.expirations),
+		"rejected":          atomic.LoadUint64(&uc.stats.rejected),
 		"memory_shards":     uc.shardNum,
 		"performance":       "100x faster than Redis",
 		"vs_mtproto_cache":  "1000x improvement",
 		"zero_allocations":  true,
 	}
+	if uc.invalidator != nil {
+		stats["invalidation"] = uc.invalidator.stats()
+	}
+	return stats
 }
 
 // LRU List methods
 func (lru *LRUList) addToFront(item *CacheItem) {
+	item.prev = nil
+	item.next = lru.head
 	if lru.head == nil {
-		lru.head = item
 		lru.tail = item
 	} else {
-		item.next = lru.head
 		lru.head.prev = item
-		lru.head = item
 	}
+	lru.head = item
 	lru.size++
 }
 
@@ -277,6 +548,7 @@ func (lru *LRUList) remove(item *CacheItem) {
 		lru.tail = item.prev
 	}
 	
+	item.prev, item.next = nil, nil
 	lru.size--
 }
 
@@ -289,5 +561,5 @@ func (lru *LRUList) moveToFront(item *CacheItem) {
 	lru.addToFront(item)
 }
 
-// Global cache instance
-var GlobalUltraCache = NewUltraCache(1024) // 1GB cache
+// Global cache instance, sized from the loaded configuration in main
+var GlobalUltraCache *UltraCache
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, maxMemoryMB int) *UltraCache {
+	t.Helper()
+	uc := NewUltraCache(maxMemoryMB)
+	t.Cleanup(uc.Close)
+	return uc
+}
+
+// checkShards verifies every shard's byte count, LRU list and map agree.
+func checkShards(t *testing.T, uc *UltraCache) {
+	t.Helper()
+	for i, shard := range uc.shards {
+		shard.mu.Lock()
+		size, n := 0, 0
+		var prev *CacheItem
+		for item := shard.lru.head; item != nil; item = item.next {
+			if item.prev != prev {
+				t.Errorf("shard %d: %q has a broken back link", i, item.key)
+			}
+			if shard.data[item.key] != item {
+				t.Errorf("shard %d: %q is listed but not mapped", i, item.key)
+			}
+			size += item.size
+			n++
+			prev = item
+		}
+		if shard.lru.tail != prev {
+			t.Errorf("shard %d: tail is not the last item", i)
+		}
+		if n != len(shard.data) || n != shard.lru.size {
+			t.Errorf("shard %d: %d listed, %d mapped, list size %d", i, n, len(shard.data), shard.lru.size)
+		}
+		if size != shard.size {
+			t.Errorf("shard %d: items hold %d bytes, shard counts %d", i, size, shard.size)
+		}
+		if shard.size > shard.maxSize {
+			t.Errorf("shard %d: %d bytes over its limit of %d", i, shard.size, shard.maxSize)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+type sizedValue int
+
+func (v sizedValue) Size() int { return int(v) }
+
+func TestCacheConcurrentAccess(t *testing.T) {
+	const (
+		workers = 16
+		ops     = 5000
+		keys    = 500
+	)
+
+	uc := newTestCache(t, 1)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("key-%d", rng.Intn(keys))
+				switch rng.Intn(8) {
+				case 0, 1:
+					uc.Set(key, strings.Repeat("x", rng.Intn(2048)), time.Duration(rng.Intn(50))*time.Millisecond)
+				case 2:
+					uc.Fill(key, sizedValue(rng.Intn(4096)), time.Minute, uc.Version())
+				case 3:
+					uc.Delete(key)
+				case 4:
+					uc.MultiGet([]string{key, fmt.Sprintf("key-%d", rng.Intn(keys))})
+				case 5:
+					if i%500 == 0 {
+						uc.DeletePrefix("key-1")
+					}
+				default:
+					uc.Get(key)
+				}
+			}
+		}(int64(w))
+	}
+
+	// Stats and cleanup run alongside the workers
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				uc.GetStats()
+				uc.pruneTombstones(time.Now().UnixNano())
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	background.Wait()
+
+	checkShards(t, uc)
+	stats := uc.GetStats()
+	if stats["memory_bytes"].(int) > stats["max_memory_bytes"].(int) {
+		t.Fatalf("cache holds %v bytes, limit is %v", stats["memory_bytes"], stats["max_memory_bytes"])
+	}
+}
+
+func TestCacheEvictsToByteLimit(t *testing.T) {
+	uc := newTestCache(t, 1)
+	shard := uc.shards[0]
+	value := strings.Repeat("v", shard.maxSize/10)
+
+	// Only keys of the first shard, so the eviction order is known
+	var stored []string
+	for i := 0; len(stored) < 20; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if uc.getShard(key) == shard {
+			uc.Set(key, value, 0)
+			stored = append(stored, key)
+		}
+	}
+
+	checkShards(t, uc)
+	perEntry := entrySize(stored[0], value)
+	if want := shard.maxSize / perEntry; len(shard.data) != want {
+		t.Fatalf("shard holds %d entries of %d bytes, want %d within %d bytes",
+			len(shard.data), perEntry, want, shard.maxSize)
+	}
+	for i, key := range stored {
+		_, found := uc.Get(key)
+		if kept := i >= len(stored)-len(shard.data); found != kept {
+			t.Fatalf("%s found %v, want %v", key, found, kept)
+		}
+	}
+	if evictions := uc.GetStats()["evictions"].(uint64); evictions != uint64(len(stored)-len(shard.data)) {
+		t.Fatalf("counted %d evictions, want %d", evictions, len(stored)-len(shard.data))
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	uc := newTestCache(t, 1)
+	shard := uc.shards[0]
+
+	var keys []string
+	for i := 0; len(keys) < 4; i++ {
+		if key := fmt.Sprintf("k%d", i); uc.getShard(key) == shard {
+			keys = append(keys, key)
+		}
+	}
+	third := sizedValue(shard.maxSize/3 - entryOverhead - 8)
+	uc.Set(keys[0], third, 0)
+	uc.Set(keys[1], third, 0)
+	uc.Set(keys[2], third, 0)
+
+	// Reading keys[0] makes keys[1] the least recently used
+	uc.Get(keys[0])
+	uc.Set(keys[3], third, 0)
+
+	checkShards(t, uc)
+	for i, want := range []bool{true, false, true, true} {
+		if _, found := uc.Get(keys[i]); found != want {
+			t.Fatalf("%s found %v, want %v", keys[i], found, want)
+		}
+	}
+}
+
+func TestCacheSizesValues(t *testing.T) {
+	uc := newTestCache(t, 1)
+
+	uc.Set("sized", sizedValue(1000), 0)
+	uc.Set("text", strings.Repeat("x", 500), 0)
+	uc.Set("bytes", make([]byte, 300), 0)
+
+	stats := uc.GetStats()
+	want := entrySize("sized", sizedValue(1000)) + entrySize("text", "") + 500 + entrySize("bytes", nil) + 300
+	if got := stats["memory_bytes"].(int); got != want {
+		t.Fatalf("memory_bytes = %d, want %d", got, want)
+	}
+
+	// Replacing a value accounts for the new size only
+	uc.Set("sized", sizedValue(10), 0)
+	want -= 990
+	if got := uc.GetStats()["memory_bytes"].(int); got != want {
+		t.Fatalf("memory_bytes after replace = %d, want %d", got, want)
+	}
+
+	uc.Delete("text")
+	want -= entrySize("text", "") + 500
+	if got := uc.GetStats()["memory_bytes"].(int); got != want {
+		t.Fatalf("memory_bytes after delete = %d, want %d", got, want)
+	}
+}
+
+func TestCacheRejectsOversizedValues(t *testing.T) {
+	uc := newTestCache(t, 1)
+	key := "big"
+	shard := uc.getShard(key)
+
+	uc.Set(key, "small", 0)
+	uc.Set(key, sizedValue(shard.maxSize), 0)
+	if _, found := uc.Get(key); found {
+		t.Fatal("oversized value was cached, or the old one kept")
+	}
+	if rejected := uc.GetStats()["rejected"].(uint64); rejected != 1 {
+		t.Fatalf("counted %d rejections, want 1", rejected)
+	}
+	checkShards(t, uc)
+}
+
+func TestCacheExpiresEntries(t *testing.T) {
+	uc := newTestCache(t, 1)
+
+	uc.Set("short", "v", 10*time.Millisecond)
+	uc.Set("long", "v", time.Hour)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, found := uc.Get("short"); found {
+		t.Fatal("expired entry returned")
+	}
+	if got := uc.MultiGet([]string{"short", "long"}); len(got) != 1 || got["long"] != "v" {
+		t.Fatalf("MultiGet = %v, want only long", got)
+	}
+	stats := uc.GetStats()
+	if stats["expirations"].(uint64) != 1 || stats["total_items"].(int) != 1 {
+		t.Fatalf("expirations = %v, total_items = %v, want 1 and 1", stats["expirations"], stats["total_items"])
+	}
+	checkShards(t, uc)
+}
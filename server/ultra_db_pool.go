@@ -1,97 +1,1073 @@
-
 package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"context"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-type UltraDBPool struct {
-	pool        chan *sql.DB
-	maxConns    int
-	activeConns int
+// ErrPoolTimeout is returned when no database connection frees up within
+// the acquire timeout.
+var ErrPoolTimeout = errors.New("timed out waiting for a database connection")
+
+// writeRetryBackoff is the pause before retrying a failed write; it
+// doubles with each attempt.
+const writeRetryBackoff = 50 * time.Millisecond
+
+// replicaLagQuery measures how far a standby is behind. A standby that has
+// replayed everything it received is not lagging even if the primary has
+// been idle.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+// dbNode is one PostgreSQL server: a *sql.DB, which does the pooling, and
+// the outcome of its last health check.
+type dbNode struct {
+	name    string
+	db      *sql.DB
+	replica bool
+	
+	acquired        uint64 // accessed atomically
+	acquireTimeouts uint64 // accessed atomically
+	
 	mutex       sync.RWMutex
-	connString  string
+	healthErr   error
+	lastHealthy time.Time
+	lag         time.Duration
 }
 
-func NewUltraDBPool(connString string, maxConns int) *UltraDBPool {
-	pool := &UltraDBPool{
-		pool:       make(chan *sql.DB, maxConns),
-		maxConns:   maxConns,
-		connString: connString,
+func openDBNode(connString string, replica bool, cfg DatabaseConfig) (*dbNode, error) {
+	db, err := sql.Open("postgres", connString)
+	if err != nil {
+		return nil, err
 	}
+	db.SetMaxOpenConns(cfg.MaxConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Std())
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime.Std())
 	
-	// Initialize connection pool
-	for i := 0; i < maxConns; i++ {
-		if conn, err := sql.Open("postgres", connString); err == nil {
-			// Configure for high performance
-			conn.SetMaxIdleConns(50)
-			conn.SetMaxOpenConns(100)
-			conn.SetConnMaxLifetime(time.Hour)
-			
-			pool.pool <- conn
-			pool.activeConns++
+	name := "primary"
+	if u, err := url.Parse(connString); err == nil && u.Host != "" {
+		name = u.Host
+	}
+	return &dbNode{name: name, db: db, replica: replica}, nil
+}
+
+func (n *dbNode) conn(ctx context.Context, timeout time.Duration) (*sql.Conn, error) {
+	acquireCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	
+	conn, err := n.db.Conn(acquireCtx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			atomic.AddUint64(&n.acquireTimeouts, 1)
+			return nil, ErrPoolTimeout
 		}
+		return nil, err
+	}
+	atomic.AddUint64(&n.acquired, 1)
+	return conn, nil
+}
+
+// usable reports whether the last health check passed and, for a replica,
+// found it within maxLag of the primary.
+func (n *dbNode) usable(maxLag time.Duration) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.healthErr == nil && !n.lastHealthy.IsZero() && n.lag <= maxLag
+}
+
+// markFailed records a failure seen outside the health check so the node
+// is skipped until the next check passes.
+func (n *dbNode) markFailed(err error) {
+	n.mutex.Lock()
+	n.healthErr = err
+	n.mutex.Unlock()
+}
+
+// check pings the node, measures replica lag and records the outcome.
+// After a failed check the idle connections are closed, since they most
+// likely point at a server that went away; new ones are dialled on demand.
+func (n *dbNode) check(timeout time.Duration, maxIdle int) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	
+	var lag time.Duration
+	conn, err := n.conn(ctx, timeout)
+	if err == nil {
+		if err = conn.PingContext(ctx); err == nil && n.replica {
+			var seconds float64
+			if err = conn.QueryRowContext(ctx, replicaLagQuery).Scan(&seconds); err == nil {
+				lag = time.Duration(seconds * float64(time.Second))
+			}
+		}
+		conn.Close()
 	}
 	
-	return pool
+	n.mutex.Lock()
+	first := n.healthErr == nil && n.lastHealthy.IsZero()
+	wasHealthy := n.healthErr == nil && !first
+	n.healthErr = err
+	if err == nil {
+		n.lastHealthy = time.Now()
+		n.lag = lag
+	}
+	n.mutex.Unlock()
+	
+	if err != nil {
+		n.db.SetMaxIdleConns(0)
+		n.db.SetMaxIdleConns(maxIdle)
+	}
+	switch {
+	case err != nil && wasHealthy:
+		logger.Error("database health check failed", "node", n.name, "error", err)
+	case err != nil && first:
+		logger.Warn("database unreachable", "node", n.name, "error", err)
+	case err != nil:
+		logger.Debug("database still unreachable", "node", n.name, "error", err)
+	case !wasHealthy:
+		logger.Info("database reachable", "node", n.name)
+	}
 }
 
-func (p *UltraDBPool) GetConnection(ctx context.Context) (*sql.DB, error) {
-	select {
-	case conn := <-p.pool:
-		return conn, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-time.After(100 * time.Millisecond):
-		// Create new connection if pool empty
-		return sql.Open("postgres", p.connString)
+func (n *dbNode) stats() map[string]interface{} {
+	s := n.db.Stats()
+	
+	n.mutex.RLock()
+	healthErr, lastHealthy, lag := n.healthErr, n.lastHealthy, n.lag
+	n.mutex.RUnlock()
+	
+	stats := map[string]interface{}{
+		"node":             n.name,
+		"max_open":         s.MaxOpenConnections,
+		"open":             s.OpenConnections,
+		"in_use":           s.InUse,
+		"idle":             s.Idle,
+		"wait_count":       s.WaitCount,
+		"wait_time_ms":     s.WaitDuration.Milliseconds(),
+		"acquired":         atomic.LoadUint64(&n.acquired),
+		"acquire_timeouts": atomic.LoadUint64(&n.acquireTimeouts),
+		"idle_closed":      s.MaxIdleClosed + s.MaxIdleTimeClosed,
+		"lifetime_closed":  s.MaxLifetimeClosed,
+		"healthy":          healthErr == nil && !lastHealthy.IsZero(),
+	}
+	if n.replica {
+		stats["lag_ms"] = lag.Milliseconds()
+	}
+	if healthErr != nil {
+		stats["health_error"] = healthErr.Error()
 	}
+	if !lastHealthy.IsZero() {
+		stats["last_healthy"] = lastHealthy.UTC().Format(time.RFC3339)
+	}
+	return stats
 }
 
-func (p *UltraDBPool) ReturnConnection(conn *sql.DB) {
-	select {
-	case p.pool <- conn:
-		// Connection returned to pool
-	default:
-		// Pool full, close connection
-		conn.Close()
+// UltraDBPool manages connections to a PostgreSQL primary and its read
+// replicas. Writes go to the primary. Read-only queries go round-robin to
+// replicas that passed their last health check within the allowed lag, and
+// to the primary when none did.
+type UltraDBPool struct {
+	primary  *dbNode
+	replicas []*dbNode
+	cfg      DatabaseConfig
+	
+	nextReplica      uint64 // accessed atomically
+	replicaReads     uint64 // accessed atomically
+	primaryFallbacks uint64 // accessed atomically
+	writeRetries     uint64 // accessed atomically
+	copyUnavailable  int32  // accessed atomically; set once COPY fails to set up
+	
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewUltraDBPool(cfg DatabaseConfig) (*UltraDBPool, error) {
+	primary, err := openDBNode(cfg.URL, false, cfg)
+	if err != nil {
+		return nil, err
 	}
+	pool := &UltraDBPool{
+		primary: primary,
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, connString := range cfg.Replicas {
+		replica, err := openDBNode(connString, true, cfg)
+		if err != nil {
+			pool.closeNodes()
+			return nil, err
+		}
+		pool.replicas = append(pool.replicas, replica)
+	}
+	
+	pool.checkHealth()
+	go pool.healthLoop()
+	return pool, nil
 }
 
-func (p *UltraDBPool) BatchInsertMessages(messages []Message) error {
-	conn, err := p.GetConnection(context.Background())
+// GetConnection takes a connection to the primary, waiting at most the
+// acquire timeout. Every connection must be handed back with
+// ReturnConnection.
+func (p *UltraDBPool) GetConnection(ctx context.Context) (*sql.Conn, error) {
+	return p.primary.conn(ctx, p.cfg.AcquireTimeout.Std())
+}
+
+// GetReadConnection takes a connection for read-only queries that can
+// tolerate replication lag. It tries each usable replica in turn and falls
+// back to the primary.
+func (p *UltraDBPool) GetReadConnection(ctx context.Context) (*sql.Conn, error) {
+	maxLag := p.cfg.MaxReplicaLag.Std()
+	if n := len(p.replicas); n > 0 {
+		start := atomic.AddUint64(&p.nextReplica, 1)
+		for i := 0; i < n; i++ {
+			replica := p.replicas[(start+uint64(i))%uint64(n)]
+			if !replica.usable(maxLag) {
+				continue
+			}
+			conn, err := replica.conn(ctx, p.cfg.AcquireTimeout.Std())
+			if err == nil {
+				atomic.AddUint64(&p.replicaReads, 1)
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if !errors.Is(err, ErrPoolTimeout) {
+				replica.markFailed(err)
+			}
+			logger.Debug("replica unavailable, trying next", "node", replica.name, "error", err)
+		}
+		atomic.AddUint64(&p.primaryFallbacks, 1)
+	}
+	return p.GetConnection(ctx)
+}
+
+// ReturnConnection hands a connection back to the pool. Broken connections
+// are discarded by database/sql rather than reused.
+func (p *UltraDBPool) ReturnConnection(conn *sql.Conn) {
+	conn.Close()
+}
+
+// Ping checks that the primary is reachable through a pooled connection.
+func (p *UltraDBPool) Ping(ctx context.Context) error {
+	conn, err := p.GetConnection(ctx)
 	if err != nil {
 		return err
 	}
 	defer p.ReturnConnection(conn)
 	
-	// Use COPY for ultra-fast bulk inserts
-	txn, err := conn.Begin()
-	if err != nil {
+	return conn.PingContext(ctx)
+}
+
+// retryWrite runs fn, an idempotent write, again after transient
+// connection failures, up to the configured number of attempts.
+func (p *UltraDBPool) retryWrite(ctx context.Context, fn func() error) error {
+	backoff := writeRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.cfg.WriteAttempts || !isTransient(err) {
+			return err
+		}
+		atomic.AddUint64(&p.writeRetries, 1)
+		logger.Debug("retrying database write", "attempt", attempt, "error", err)
+		
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether err is a lost or refused connection, or a
+// server shutting down, after which the statement may succeed on a fresh
+// connection.
+func isTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection_exception, admin_shutdown, crash_shutdown, cannot_connect_now
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isPermanent reports whether err is a failed write that fails the same
+// way however often it is retried: a missing message, or input the
+// database rejects, such as a malformed UUID or a reference to a missing
+// chat.
+func isPermanent(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// data_exception, which includes invalid_text_representation, and
+		// integrity_constraint_violation
+		return pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23"
+	}
+	return false
+}
+
+// healthLoop checks every node each health check interval until Close.
+func (p *UltraDBPool) healthLoop() {
+	defer close(p.done)
+	
+	ticker := time.NewTicker(p.cfg.HealthCheckInterval.Std())
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+func (p *UltraDBPool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, node := range append([]*dbNode{p.primary}, p.replicas...) {
+		wg.Add(1)
+		go func(node *dbNode) {
+			defer wg.Done()
+			node.check(p.cfg.AcquireTimeout.Std(), p.cfg.MaxIdleConns)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// Healthy returns the error of the primary's last health check, nil if it
+// passed.
+func (p *UltraDBPool) Healthy() error {
+	p.primary.mutex.RLock()
+	defer p.primary.mutex.RUnlock()
+	return p.primary.healthErr
+}
+
+// GetStats reports pool usage of the primary: connections in use and idle,
+// how often and how long callers waited for one, and how many were reaped.
+// Replicas are listed with their lag under "replicas".
+func (p *UltraDBPool) GetStats() map[string]interface{} {
+	stats := p.primary.stats()
+	stats["write_retries"] = atomic.LoadUint64(&p.writeRetries)
+	if len(p.replicas) > 0 {
+		replicas := make([]map[string]interface{}, len(p.replicas))
+		for i, replica := range p.replicas {
+			replicas[i] = replica.stats()
+		}
+		stats["replicas"] = replicas
+		stats["replica_reads"] = atomic.LoadUint64(&p.replicaReads)
+		stats["primary_fallbacks"] = atomic.LoadUint64(&p.primaryFallbacks)
+	}
+	return stats
+}
+
+// Close stops the health checks and closes all connections.
+func (p *UltraDBPool) Close() error {
+	close(p.stop)
+	<-p.done
+	return p.closeNodes()
+}
+
+func (p *UltraDBPool) closeNodes() error {
+	var errs []string
+	for _, node := range append([]*dbNode{p.primary}, p.replicas...) {
+		if err := node.db.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", node.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// copyThreshold is the batch size from which loading through COPY beats a
+// multi-row INSERT.
+const copyThreshold = 16
+
+// insertChunkRows bounds the rows of one multi-row INSERT; PostgreSQL
+// accepts at most 65535 parameters per statement.
+const insertChunkRows = 1000
+
+var (
+	messageColumns    = []string{"id", "chat_id", "sender_id", "content", "message_type", "reply_to_id", "created_at"}
+	attachmentColumns = []string{"message_id", "file_id", "name", "mime_type", "size", "position"}
+)
+
+// InsertResult tells whether one message of a batch was written. Inserted
+// is false when a message with the same ID was already stored, which makes
+// retrying a batch safe.
+type InsertResult struct {
+	MessageID string
+	Inserted  bool
+}
+
+// copyUnavailableError marks a failure to set up COPY, as opposed to a
+// failure of the data itself.
+type copyUnavailableError struct{ err error }
+
+func (e copyUnavailableError) Error() string { return "copy unavailable: " + e.err.Error() }
+func (e copyUnavailableError) Unwrap() error { return e.err }
+
+// copyUnavailable wraps err if it says this session may not create
+// temporary tables or run COPY.
+func copyUnavailable(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "42501", "0A000": // insufficient_privilege, feature_not_supported
+			return copyUnavailableError{err}
+		}
+	}
+	return err
+}
+
+// BatchInsertMessages stores messages and their attachments in one
+// transaction and reports, in order, which of them were inserted. Batches of
+// copyThreshold messages or more are streamed with COPY into a staging
+// table; smaller ones, and all of them once COPY turns out to be
+// unavailable, use multi-row INSERTs. Either way messages whose ID is
+// already stored are skipped.
+// Transient connection failures are retried; a message stored by an attempt
+// whose commit was not acknowledged then shows up as not inserted.
+func (p *UltraDBPool) BatchInsertMessages(ctx context.Context, messages []Message) ([]InsertResult, error) {
+	var results []InsertResult
+	err := p.retryWrite(ctx, func() error {
+		var err error
+		results, err = p.batchInsertMessages(ctx, messages)
 		return err
+	})
+	return results, err
+}
+
+func (p *UltraDBPool) batchInsertMessages(ctx context.Context, messages []Message) ([]InsertResult, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	conn, err := p.GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.ReturnConnection(conn)
+	
+	var inserted map[string]bool
+	useCopy := len(messages) >= copyThreshold && atomic.LoadInt32(&p.copyUnavailable) == 0
+	if useCopy {
+		inserted, err = insertInTx(ctx, conn, messages, copyMessages)
+		var unavailable copyUnavailableError
+		if errors.As(err, &unavailable) {
+			atomic.StoreInt32(&p.copyUnavailable, 1)
+			logger.Warn("COPY unavailable, bulk inserts fall back to INSERT", "error", unavailable.err)
+			useCopy = false
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if !useCopy {
+		if inserted, err = insertInTx(ctx, conn, messages, insertMessages); err != nil {
+			return nil, err
+		}
+	}
+	
+	results := make([]InsertResult, len(messages))
+	for i := range messages {
+		id := messages[i].MessageID
+		// A repeated ID within the batch counts once
+		results[i] = InsertResult{MessageID: id, Inserted: inserted[id]}
+		delete(inserted, id)
+	}
+	return results, nil
+}
+
+func insertInTx(ctx context.Context, conn *sql.Conn, messages []Message, insert func(context.Context, *sql.Tx, []Message) (map[string]bool, error)) (map[string]bool, error) {
+	txn, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
 	}
 	defer txn.Rollback()
 	
-	stmt, err := txn.Prepare(`
-		INSERT INTO messages (id, chat_id, sender_id, content, created_at) 
-		VALUES ($1, $2, $3, $4, $5)
+	inserted, err := insert(ctx, txn, messages)
+	if err != nil {
+		return nil, err
+	}
+	return inserted, txn.Commit()
+}
+
+// copyMessages loads messages into temporary staging tables with COPY and
+// moves the new ones into place.
+func copyMessages(ctx context.Context, txn *sql.Tx, messages []Message) (map[string]bool, error) {
+	if _, err := txn.ExecContext(ctx, `
+		CREATE TEMP TABLE messages_staging (
+			id uuid, chat_id uuid, sender_id uuid, content text,
+			message_type varchar(20), reply_to_id uuid, created_at timestamp
+		) ON COMMIT DROP
+	`); err != nil {
+		return nil, copyUnavailable(err)
+	}
+	if err := copyRows(ctx, txn, "messages_staging", messageColumns, messageRows(messages)); err != nil {
+		return nil, err
+	}
+	
+	rows, err := txn.QueryContext(ctx, `
+		INSERT INTO messages (id, chat_id, sender_id, content, message_type, reply_to_id, created_at)
+		SELECT id, chat_id, sender_id, content, message_type, reply_to_id, created_at FROM messages_staging
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id
 	`)
 	if err != nil {
+		return nil, err
+	}
+	inserted := make(map[string]bool, len(messages))
+	if err := scanIDs(rows, inserted); err != nil {
+		return nil, err
+	}
+	
+	attachments := attachmentRows(messages, inserted)
+	if len(attachments) == 0 {
+		return inserted, nil
+	}
+	if _, err := txn.ExecContext(ctx, `
+		CREATE TEMP TABLE message_attachments_staging (
+			message_id uuid, file_id varchar(64), name varchar(255),
+			mime_type varchar(255), size bigint, position integer
+		) ON COMMIT DROP
+	`); err != nil {
+		return nil, err
+	}
+	if err := copyRows(ctx, txn, "message_attachments_staging", attachmentColumns, attachments); err != nil {
+		return nil, err
+	}
+	_, err = txn.ExecContext(ctx, `
+		INSERT INTO message_attachments (message_id, file_id, name, mime_type, size, position)
+		SELECT message_id, file_id, name, mime_type, size, position FROM message_attachments_staging
+		ON CONFLICT DO NOTHING
+	`)
+	return inserted, err
+}
+
+func copyRows(ctx context.Context, txn *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return copyUnavailable(err)
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	// An Exec without arguments flushes the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
 		return err
 	}
-	defer stmt.Close()
+	return stmt.Close()
+}
+
+// insertMessages writes messages with multi-row INSERTs.
+func insertMessages(ctx context.Context, txn *sql.Tx, messages []Message) (map[string]bool, error) {
+	inserted := make(map[string]bool, len(messages))
+	err := insertRows(ctx, txn, "messages", messageColumns, messageRows(messages), "ON CONFLICT (id) DO NOTHING RETURNING id", func(rows *sql.Rows) error {
+		return scanIDs(rows, inserted)
+	})
+	if err != nil {
+		return nil, err
+	}
 	
-	for _, msg := range messages {
-		if _, err := stmt.Exec(msg.MessageId, msg.ChatId, msg.SenderId, msg.Content, time.Now()); err != nil {
+	attachments := attachmentRows(messages, inserted)
+	if len(attachments) == 0 {
+		return inserted, nil
+	}
+	return inserted, insertRows(ctx, txn, "message_attachments", attachmentColumns, attachments, "ON CONFLICT DO NOTHING", nil)
+}
+
+// insertRows inserts rows in chunks of insertChunkRows, appending suffix to
+// every statement. With scan set the statements are queried and their
+// results handed to scan.
+func insertRows(ctx context.Context, txn *sql.Tx, table string, columns []string, rows [][]interface{}, suffix string, scan func(*sql.Rows) error) error {
+	for len(rows) > 0 {
+		chunk := rows
+		if len(chunk) > insertChunkRows {
+			chunk = chunk[:insertChunkRows]
+		}
+		rows = rows[len(chunk):]
+		
+		var query strings.Builder
+		args := make([]interface{}, 0, len(chunk)*len(columns))
+		fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", "))
+		for i, row := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteByte('(')
+			for j := range row {
+				if j > 0 {
+					query.WriteString(", ")
+				}
+				fmt.Fprintf(&query, "$%d", len(args)+j+1)
+			}
+			query.WriteByte(')')
+			args = append(args, row...)
+		}
+		query.WriteString(" " + suffix)
+		
+		if scan == nil {
+			if _, err := txn.ExecContext(ctx, query.String(), args...); err != nil {
+				return err
+			}
+			continue
+		}
+		result, err := txn.QueryContext(ctx, query.String(), args...)
+		if err != nil {
+			return err
+		}
+		if err := scan(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanIDs collects the IDs returned by an INSERT … RETURNING id.
+func scanIDs(rows *sql.Rows, into map[string]bool) error {
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		into[id] = true
+	}
+	return rows.Err()
+}
+
+func messageRows(messages []Message) [][]interface{} {
+	rows := make([][]interface{}, len(messages))
+	for i := range messages {
+		msg := &messages[i]
+		rows[i] = []interface{}{
+			msg.MessageID, nullIfEmpty(msg.ChatID), nullIfEmpty(msg.UserID), msg.Content,
+			msg.StoredType(), nullIfEmpty(msg.ReplyTo), storedCreatedAt(msg),
+		}
+	}
+	return rows
+}
+
+// attachmentRows returns the attachments of the messages that were inserted.
+func attachmentRows(messages []Message, inserted map[string]bool) [][]interface{} {
+	var rows [][]interface{}
+	for i := range messages {
+		msg := &messages[i]
+		if !inserted[msg.MessageID] {
+			continue
+		}
+		for pos, a := range msg.Attachments {
+			rows = append(rows, []interface{}{msg.MessageID, a.ID, a.Name, a.MimeType, a.Size, pos})
+		}
+	}
+	return rows
+}
+
+// storedCreatedAt is the creation time written for msg: the server-assigned
+// CreatedAt, else the message timestamp, else now. created_at has no time
+// zone, so it is always UTC.
+func storedCreatedAt(msg *Message) time.Time {
+	switch {
+	case msg.CreatedAt != 0:
+		return time.UnixMicro(msg.CreatedAt).UTC()
+	case msg.Timestamp != 0:
+		return time.Unix(msg.Timestamp, 0).UTC()
+	}
+	return time.Now().UTC()
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// GetMessageMeta loads the sender, chat and age of a stored message.
+func (p *UltraDBPool) GetMessageMeta(ctx context.Context, messageID string) (MessageMeta, error) {
+	conn, err := p.GetConnection(ctx)
+	if err != nil {
+		return MessageMeta{}, err
+	}
+	defer p.ReturnConnection(conn)
+	
+	var (
+		meta      MessageMeta
+		senderID  sql.NullString
+		chatID    sql.NullString
+		deletedAt sql.NullTime
+	)
+	err = conn.QueryRowContext(ctx, `
+		SELECT sender_id, chat_id, created_at, deleted_at FROM messages WHERE id = $1
+	`, messageID).Scan(&senderID, &chatID, &meta.CreatedAt, &deletedAt)
+	if err == sql.ErrNoRows {
+		return MessageMeta{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return MessageMeta{}, err
+	}
+	
+	meta.SenderID = senderID.String
+	meta.ChatID = chatID.String
+	meta.Deleted = deletedAt.Valid
+	return meta, nil
+}
+
+// EditMessage replaces the content of a message sent by senderID.
+func (p *UltraDBPool) EditMessage(ctx context.Context, messageID, senderID, content string, editedAt time.Time) error {
+	return p.retryWrite(ctx, func() error {
+		return p.execOne(ctx, `
+			UPDATE messages SET content = $3, edited_at = $4
+			WHERE id = $1 AND sender_id = $2 AND deleted_at IS NULL
+		`, messageID, senderID, content, editedAt)
+	})
+}
+
+// DeleteMessage removes a message sent by senderID for everyone. The row is
+// kept as a tombstone so replies still resolve.
+func (p *UltraDBPool) DeleteMessage(ctx context.Context, messageID, senderID string, deletedAt time.Time) error {
+	return p.execOne(ctx, `
+		UPDATE messages SET content = '', deleted_at = $3
+		WHERE id = $1 AND sender_id = $2 AND deleted_at IS NULL
+	`, messageID, senderID, deletedAt)
+}
+
+// HideMessage deletes a message for userID only.
+func (p *UltraDBPool) HideMessage(ctx context.Context, messageID, userID string) error {
+	return p.retryWrite(ctx, func() error {
+		conn, err := p.GetConnection(ctx)
+		if err != nil {
 			return err
 		}
+		defer p.ReturnConnection(conn)
+		
+		_, err = conn.ExecContext(ctx, `
+			INSERT INTO message_deletions (message_id, user_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, messageID, userID)
+		return err
+	})
+}
+
+// AddReaction records userID reacting to a message with emoji and reports
+// whether the reaction is new. A retry after a lost reply reports an
+// existing reaction.
+func (p *UltraDBPool) AddReaction(ctx context.Context, messageID, userID, emoji string) (bool, error) {
+	var added bool
+	err := p.retryWrite(ctx, func() (err error) {
+		added, err = p.execChanged(ctx, `
+			INSERT INTO message_reactions (message_id, user_id, emoji) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+		`, messageID, userID, emoji)
+		return err
+	})
+	return added, err
+}
+
+// RemoveReaction withdraws a reaction and reports whether it existed.
+func (p *UltraDBPool) RemoveReaction(ctx context.Context, messageID, userID, emoji string) (bool, error) {
+	var removed bool
+	err := p.retryWrite(ctx, func() (err error) {
+		removed, err = p.execChanged(ctx, `
+			DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3
+		`, messageID, userID, emoji)
+		return err
+	})
+	return removed, err
+}
+
+// MessageReactions returns the users that reacted to a message, by emoji.
+func (p *UltraDBPool) MessageReactions(ctx context.Context, messageID string) (map[string][]string, error) {
+	conn, err := p.GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.ReturnConnection(conn)
+	
+	rows, err := conn.QueryContext(ctx, `
+		SELECT emoji, user_id FROM message_reactions WHERE message_id = $1
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	reactions := make(map[string][]string)
+	for rows.Next() {
+		var emoji, userID string
+		if err := rows.Scan(&emoji, &userID); err != nil {
+			return nil, err
+		}
+		reactions[emoji] = append(reactions[emoji], userID)
+	}
+	return reactions, rows.Err()
+}
+
+func (p *UltraDBPool) execChanged(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	conn, err := p.GetConnection(ctx)
+	if err != nil {
+		return false, err
 	}
+	defer p.ReturnConnection(conn)
 	
-	return txn.Commit()
+	res, err := conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// IsChatMember reports whether userID belongs to chatID. It may read from
+// a replica.
+func (p *UltraDBPool) IsChatMember(ctx context.Context, chatID, userID string) (bool, error) {
+	if chatID == "" || userID == "" {
+		return false, nil
+	}
+	conn, err := p.GetReadConnection(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer p.ReturnConnection(conn)
+	
+	var member bool
+	err = conn.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM chat_members WHERE chat_id = $1 AND user_id = $2)
+	`, chatID, userID).Scan(&member)
+	return member, err
+}
+
+// MessageHistory returns up to q.Limit messages of a chat in chronological
+// order, using keyset pagination on (created_at, id). Without a cursor it
+// returns the newest messages. Messages deleted for everyone, and for
+// q.UserID, are left out. It reads from a replica unless q.Primary is set.
+func (p *UltraDBPool) MessageHistory(ctx context.Context, q HistoryQuery) ([]Message, error) {
+	getConn := p.GetReadConnection
+	if q.Primary {
+		getConn = p.GetConnection
+	}
+	conn, err := getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.ReturnConnection(conn)
+	
+	query := `
+		SELECT ` + storedMessageColumns + `
+		FROM messages m
+		WHERE m.chat_id = $1 AND m.deleted_at IS NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM message_deletions d
+			WHERE d.message_id = m.id AND d.user_id = NULLIF($2, '')::uuid
+		)`
+	args := []interface{}{q.ChatID, q.UserID}
+	ascending := false
+	switch {
+	case q.After != nil:
+		query += ` AND (m.created_at, m.id) > ($3, $4) ORDER BY m.created_at, m.id LIMIT $5`
+		args = append(args, q.After.CreatedAt, q.After.ID, q.Limit)
+		ascending = true
+	case q.Before != nil:
+		query += ` AND (m.created_at, m.id) < ($3, $4) ORDER BY m.created_at DESC, m.id DESC LIMIT $5`
+		args = append(args, q.Before.CreatedAt, q.Before.ID, q.Limit)
+	default:
+		query += ` ORDER BY m.created_at DESC, m.id DESC LIMIT $3`
+		args = append(args, q.Limit)
+	}
+	
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var messages []Message
+	index := make(map[string]int)
+	for rows.Next() {
+		msg, err := scanStoredMessage(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		index[msg.MessageID] = len(messages)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	
+	if err := p.loadMessageExtras(ctx, conn, messages, index); err != nil {
+		return nil, err
+	}
+	if !ascending {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, nil
+}
+
+// storedMessageColumns are the messages columns read by scanStoredMessage.
+const storedMessageColumns = `m.id, m.chat_id, m.sender_id, m.content, m.reply_to_id, m.edited_at, m.created_at`
+
+// scanStoredMessage turns a row of storedMessageColumns into a Message.
+func scanStoredMessage(scan func(dest ...interface{}) error) (Message, error) {
+	var (
+		msg       Message
+		senderID  sql.NullString
+		replyTo   sql.NullString
+		editedAt  sql.NullTime
+		createdAt time.Time
+	)
+	if err := scan(&msg.MessageID, &msg.ChatID, &senderID, &msg.Content, &replyTo, &editedAt, &createdAt); err != nil {
+		return Message{}, err
+	}
+	msg.Type = TypeMessage
+	if replyTo.Valid {
+		msg.Type = TypeReply
+		msg.ReplyTo = replyTo.String
+	}
+	msg.UserID = senderID.String
+	if editedAt.Valid {
+		msg.EditedAt = editedAt.Time.Unix()
+	}
+	msg.CreatedAt = createdAt.UnixMicro()
+	msg.Timestamp = createdAt.Unix()
+	return msg, nil
+}
+
+// loadMessageExtras attaches attachments and reaction counts to messages.
+func (p *UltraDBPool) loadMessageExtras(ctx context.Context, conn *sql.Conn, messages []Message, index map[string]int) error {
+	ids := make([]string, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].MessageID
+	}
+	
+	rows, err := conn.QueryContext(ctx, `
+		SELECT message_id, file_id, name, mime_type, size FROM message_attachments
+		WHERE message_id = ANY($1) ORDER BY message_id, position
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var messageID string
+		var a Attachment
+		if err := rows.Scan(&messageID, &a.ID, &a.Name, &a.MimeType, &a.Size); err != nil {
+			rows.Close()
+			return err
+		}
+		a.URL = fileURL(a.ID)
+		msg := &messages[index[messageID]]
+		msg.Attachments = append(msg.Attachments, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	
+	rows, err = conn.QueryContext(ctx, `
+		SELECT message_id, emoji, count(*) FROM message_reactions
+		WHERE message_id = ANY($1) GROUP BY message_id, emoji
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID, emoji string
+		var count int
+		if err := rows.Scan(&messageID, &emoji, &count); err != nil {
+			return err
+		}
+		msg := &messages[index[messageID]]
+		if msg.Reactions == nil {
+			msg.Reactions = make(map[string]int)
+		}
+		msg.Reactions[emoji] = count
+	}
+	return rows.Err()
+}
+
+// HiddenMessages returns which of ids userID deleted for themselves. It
+// may read from a replica.
+func (p *UltraDBPool) HiddenMessages(ctx context.Context, userID string, ids []string) (map[string]bool, error) {
+	hidden := make(map[string]bool)
+	if userID == "" || len(ids) == 0 {
+		return hidden, nil
+	}
+	conn, err := p.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.ReturnConnection(conn)
+	
+	rows, err := conn.QueryContext(ctx, `
+		SELECT message_id FROM message_deletions WHERE user_id = $1 AND message_id = ANY($2)
+	`, userID, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		hidden[id] = true
+	}
+	return hidden, rows.Err()
+}
+
+// execOne runs a statement that must change exactly one message and
+// returns ErrMessageNotFound when it changed none.
+func (p *UltraDBPool) execOne(ctx context.Context, query string, args ...interface{}) error {
+	conn, err := p.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.ReturnConnection(conn)
+	
+	res, err := conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
 }
 
 // Global database pool
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// fakeMessageDB is a database/sql driver standing in for PostgreSQL in
+// the message insert paths. It keeps the stored message IDs, and answers
+// the COPY into messages_staging, the merge out of it and multi-row
+// INSERTs the way PostgreSQL would with ON CONFLICT (id) DO NOTHING.
+// Deleting a stored message for everyone succeeds once. Reactions are
+// kept as message, user and emoji. failNext, when set, fails the next
+// statement once; down fails every new connection. lag is the replication
+// lag in seconds it reports to health checks. Applied migrations are kept
+// by version, and every statement run through Exec is logged in executed.
+type fakeMessageDB struct {
+	mu        sync.Mutex
+	stored    map[string]bool
+	deleted   map[string]bool
+	reactions map[[3]string]bool
+	applied   map[int64]time.Time
+	executed  []string
+	staged    []string
+	copies    []int // rows of each COPY into messages_staging
+	insert    int   // multi-row INSERT INTO messages statements
+	failNext  error
+	down      error
+	lag       float64
+}
+
+// newFakeDB returns a fake database and a *sql.DB on it that keeps no
+// idle connections, so each connection dials the fake.
+func newFakeDB(t *testing.T) (*fakeMessageDB, *sql.DB) {
+	t.Helper()
+	fake := &fakeMessageDB{
+		stored:    make(map[string]bool),
+		deleted:   make(map[string]bool),
+		reactions: make(map[[3]string]bool),
+		applied:   make(map[int64]time.Time),
+	}
+	db := sql.OpenDB(fake)
+	db.SetMaxIdleConns(0)
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+func testDatabaseConfig() DatabaseConfig {
+	return DatabaseConfig{AcquireTimeout: Duration(time.Second), WriteAttempts: 1, MaxReplicaLag: Duration(time.Second)}
+}
+
+func newTestDBPool(t *testing.T) (*UltraDBPool, *fakeMessageDB) {
+	t.Helper()
+	fake, db := newFakeDB(t)
+	return &UltraDBPool{primary: &dbNode{name: "fake", db: db}, cfg: testDatabaseConfig()}, fake
+}
+
+// setDown makes new connections to db fail with err, or succeed for nil.
+func (db *fakeMessageDB) setDown(err error) {
+	db.mu.Lock()
+	db.down = err
+	db.mu.Unlock()
+}
+
+func (db *fakeMessageDB) Connect(context.Context) (driver.Conn, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.down != nil {
+		return nil, db.down
+	}
+	return fakeConn{db}, nil
+}
+func (db *fakeMessageDB) Driver() driver.Driver { return nil }
+
+// merge stores ids not stored yet and returns them, each once.
+func (db *fakeMessageDB) merge(ids []string) []string {
+	var inserted []string
+	for _, id := range ids {
+		if !db.stored[id] {
+			db.stored[id] = true
+			inserted = append(inserted, id)
+		}
+	}
+	return inserted
+}
+
+type fakeConn struct{ db *fakeMessageDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: strings.TrimSpace(query)}, nil
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db     *fakeMessageDB
+	query  string
+	copied int
+}
+
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Close() error {
+	if strings.HasPrefix(s.query, `COPY "messages_staging"`) {
+		s.db.mu.Lock()
+		s.db.copies = append(s.db.copies, s.copied)
+		s.db.mu.Unlock()
+	}
+	return nil
+}
+
+// fail returns failNext, once.
+func (db *fakeMessageDB) fail() error {
+	err := db.failNext
+	db.failNext = nil
+	return err
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.db.fail(); err != nil {
+		return nil, err
+	}
+	s.db.executed = append(s.db.executed, s.query)
+	switch {
+	case strings.HasPrefix(s.query, `COPY "messages_staging"`) && len(args) > 0:
+		s.db.staged = append(s.db.staged, args[0].(string))
+		s.copied++
+	case strings.HasPrefix(s.query, "UPDATE messages SET content = '', deleted_at"):
+		id := args[0].(string)
+		if s.db.stored[id] && !s.db.deleted[id] {
+			s.db.deleted[id] = true
+			return driver.RowsAffected(1), nil
+		}
+	case strings.HasPrefix(s.query, "INSERT INTO message_reactions"):
+		key := [3]string{args[0].(string), args[1].(string), args[2].(string)}
+		if !s.db.reactions[key] {
+			s.db.reactions[key] = true
+			return driver.RowsAffected(1), nil
+		}
+	case strings.HasPrefix(s.query, "DELETE FROM message_reactions"):
+		key := [3]string{args[0].(string), args[1].(string), args[2].(string)}
+		if s.db.reactions[key] {
+			delete(s.db.reactions, key)
+			return driver.RowsAffected(1), nil
+		}
+	case strings.HasPrefix(s.query, "INSERT INTO schema_migrations"):
+		s.db.applied[args[0].(int64)] = time.Now()
+	case strings.HasPrefix(s.query, "DELETE FROM schema_migrations"):
+		delete(s.db.applied, args[0].(int64))
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.db.fail(); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(s.query, "pg_is_in_recovery()"):
+		return &fakeRows{columns: []string{"lag"}, rows: [][]driver.Value{{s.db.lag}}}, nil
+	case strings.Contains(s.query, "FROM messages_staging"):
+		ids := s.db.merge(s.db.staged)
+		s.db.staged = nil
+		return idRows(ids), nil
+	case strings.HasPrefix(s.query, "INSERT INTO messages ("):
+		s.db.insert++
+		var ids []string
+		for i := 0; i < len(args); i += len(messageColumns) {
+			ids = append(ids, args[i].(string))
+		}
+		return idRows(s.db.merge(ids)), nil
+	case strings.HasPrefix(s.query, "SELECT emoji, user_id FROM message_reactions"):
+		rows := &fakeRows{columns: []string{"emoji", "user_id"}}
+		for key := range s.db.reactions {
+			if key[0] == args[0].(string) {
+				rows.rows = append(rows.rows, []driver.Value{key[2], key[1]})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(s.query, "SELECT version, applied_at FROM schema_migrations"):
+		rows := &fakeRows{columns: []string{"version", "applied_at"}}
+		for version, at := range s.db.applied {
+			rows.rows = append(rows.rows, []driver.Value{version, at})
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("fake database cannot run %q", s.query)
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// idRows returns the id column a RETURNING id clause reads.
+func idRows(ids []string) *fakeRows {
+	rows := &fakeRows{columns: []string{"id"}}
+	for _, id := range ids {
+		rows.rows = append(rows.rows, []driver.Value{id})
+	}
+	return rows
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func testMessages(n int, prefix string) []Message {
+	messages := make([]Message, n)
+	for i := range messages {
+		messages[i] = Message{Type: TypeMessage, ChatID: "chat", MessageID: fmt.Sprintf("%s%02d", prefix, i), Content: "hello"}
+	}
+	return messages
+}
+
+func TestBatchInsertMessagesCopiesLargeBatches(t *testing.T) {
+	ctx := context.Background()
+	pool, fake := newTestDBPool(t)
+	fake.stored["m03"] = true
+
+	// A repeat within the batch and one stored before are not inserted
+	messages := testMessages(copyThreshold, "m")
+	messages = append(messages, messages[5])
+	results, err := pool.BatchInsertMessages(ctx, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fake.copies, []int{len(messages)}) || fake.insert != 0 {
+		t.Fatalf("copied %v rows with %d INSERTs, want one COPY of %d", fake.copies, fake.insert, len(messages))
+	}
+	for i, r := range results {
+		want := i != 3 && i != len(messages)-1
+		if r.MessageID != messages[i].MessageID || r.Inserted != want {
+			t.Fatalf("result %d = %+v, want %s inserted %v", i, r, messages[i].MessageID, want)
+		}
+	}
+
+	// Small batches use INSERT
+	results, err = pool.BatchInsertMessages(ctx, testMessages(2, "s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.copies) != 1 || fake.insert != 1 {
+		t.Fatalf("small batch made %d COPYs and %d INSERTs, want only an INSERT", len(fake.copies)-1, fake.insert)
+	}
+	if !results[0].Inserted || !results[1].Inserted {
+		t.Fatalf("small batch results %+v", results)
+	}
+}
+
+func TestPersistenceStageInsertsLaneBatchAtOnce(t *testing.T) {
+	pool, fake := newTestDBPool(t)
+	ump := newTestProcessor(t)
+
+	// The first message holds the lane until the rest queued behind it
+	entered, release := make(chan struct{}), make(chan struct{})
+	err := ump.Use(Stage{
+		Name: "gate",
+		Handle: func(ctx context.Context, msg *Message) error {
+			if msg.Content == "first" {
+				close(entered)
+				<-release
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ump.Use(persistenceStage(pool, newTestMessageIndex(t, pool), RetryPolicy{MaxAttempts: 1})); err != nil {
+		t.Fatal(err)
+	}
+
+	first := Message{Type: TypeMessage, ChatID: "chat", MessageID: "first", Content: "first"}
+	if err := ump.Submit(context.Background(), &first); err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	messages := testMessages(copyThreshold, "m")
+	for i := range messages {
+		if err := ump.Submit(context.Background(), &messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ump.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fake.copies, []int{copyThreshold}) {
+		t.Fatalf("copied %v rows, want the %d queued messages in one COPY", fake.copies, copyThreshold)
+	}
+	if len(fake.stored) != copyThreshold+1 {
+		t.Fatalf("stored %d messages, want %d", len(fake.stored), copyThreshold+1)
+	}
+}
+
+// newTestReplicaPool returns a pool over a fake primary and n fake
+// replicas after a first health check.
+func newTestReplicaPool(t *testing.T, n int) (*UltraDBPool, *fakeMessageDB, []*fakeMessageDB) {
+	t.Helper()
+	primary, db := newFakeDB(t)
+	pool := &UltraDBPool{primary: &dbNode{name: "primary", db: db}, cfg: testDatabaseConfig()}
+	replicas := make([]*fakeMessageDB, n)
+	for i := range replicas {
+		var db *sql.DB
+		replicas[i], db = newFakeDB(t)
+		pool.replicas = append(pool.replicas, &dbNode{name: fmt.Sprintf("replica%d", i), db: db, replica: true})
+	}
+	pool.checkHealth()
+	return pool, primary, replicas
+}
+
+// readFrom returns the fake database that served a read connection.
+func readFrom(t *testing.T, pool *UltraDBPool) *fakeMessageDB {
+	t.Helper()
+	conn, err := pool.GetReadConnection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReturnConnection(conn)
+	var fake *fakeMessageDB
+	conn.Raw(func(dc interface{}) error {
+		fake = dc.(fakeConn).db
+		return nil
+	})
+	return fake
+}
+
+func TestReadsGoToHealthyReplicas(t *testing.T) {
+	pool, primary, replicas := newTestReplicaPool(t, 2)
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	name := func(fake *fakeMessageDB) string {
+		switch fake {
+		case primary:
+			return "primary"
+		case replicas[0]:
+			return "replica0"
+		case replicas[1]:
+			return "replica1"
+		}
+		return "unknown"
+	}
+	reads := func(n int) []string {
+		t.Helper()
+		served := make([]string, n)
+		for i := range served {
+			served[i] = name(readFrom(t, pool))
+		}
+		return served
+	}
+
+	// Round robin over the replicas
+	if got := reads(4); got[0] == got[1] || got[0] != got[2] || got[1] != got[3] || got[0] == "primary" || got[1] == "primary" {
+		t.Fatalf("reads served by %v, want the replicas in turn", got)
+	}
+	if pool.replicaReads != 4 || pool.primaryFallbacks != 0 {
+		t.Fatalf("%d replica reads and %d fallbacks, want 4 and 0", pool.replicaReads, pool.primaryFallbacks)
+	}
+
+	// A replica lagging too far behind is skipped after the next check
+	replicas[0].lag = 5
+	pool.checkHealth()
+	if got := reads(2); !reflect.DeepEqual(got, []string{"replica1", "replica1"}) {
+		t.Fatalf("with replica0 lagging reads served by %v", got)
+	}
+
+	// A replica failing between checks is marked failed on first use, and
+	// the read falls back to the primary as no other replica is usable
+	replicas[1].setDown(refused)
+	if got := reads(1); !reflect.DeepEqual(got, []string{"primary"}) {
+		t.Fatalf("with every replica unusable reads served by %v", got)
+	}
+	if pool.replicas[1].usable(pool.cfg.MaxReplicaLag.Std()) {
+		t.Fatal("replica that refused a connection still usable")
+	}
+	replicas[0].lag = 0
+	pool.checkHealth()
+	if got := reads(2); !reflect.DeepEqual(got, []string{"replica0", "replica0"}) {
+		t.Fatalf("with replica1 down reads served by %v", got)
+	}
+
+	replicas[0].setDown(refused)
+	pool.checkHealth()
+	if got := reads(2); !reflect.DeepEqual(got, []string{"primary", "primary"}) {
+		t.Fatalf("with every replica down reads served by %v", got)
+	}
+
+	// Recovered replicas are used again after a check
+	replicas[0].setDown(nil)
+	replicas[1].setDown(nil)
+	pool.checkHealth()
+	if got := reads(2); got[0] == "primary" || got[1] == "primary" || got[0] == got[1] {
+		t.Fatalf("after recovery reads served by %v", got)
+	}
+
+	// Writes always go to the primary
+	conn, err := pool.GetConnection(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Raw(func(dc interface{}) error {
+		if dc.(fakeConn).db != primary {
+			t.Fatal("write connection not to the primary")
+		}
+		return nil
+	})
+	pool.ReturnConnection(conn)
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{driver.ErrBadConn, true},
+		{io.EOF, true},
+		{fmt.Errorf("insert: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{&pq.Error{Code: "08006"}, true}, // connection_failure
+		{&pq.Error{Code: "57P01"}, true}, // admin_shutdown
+		{&pq.Error{Code: "57P03"}, true}, // cannot_connect_now
+		{&pq.Error{Code: "23505"}, false},
+		{&pq.Error{Code: "22P02"}, false},
+		{&pq.Error{Code: "57014"}, false}, // query_canceled
+		{ErrMessageNotFound, false},
+		{errors.New("syntax error"), false},
+	} {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Fatalf("isTransient(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryWriteRetriesOnlyTransientFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", nil, 1, nil},
+		{"transient then success", []error{io.ErrUnexpectedEOF}, 2, nil},
+		{"transient every time", []error{io.ErrUnexpectedEOF, driver.ErrBadConn, io.EOF}, 3, io.EOF},
+		{"permanent", []error{&pq.Error{Code: "23503"}, nil}, 1, &pq.Error{Code: "23503"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pool, _ := newTestDBPool(t)
+			pool.cfg.WriteAttempts = 3
+			attempts := 0
+			err := pool.retryWrite(context.Background(), func() error {
+				attempts++
+				if attempts <= len(tc.errs) {
+					return tc.errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tc.wantAttempts || !reflect.DeepEqual(err, tc.wantErr) {
+				t.Fatalf("%d attempts ending in %v, want %d ending in %v", attempts, err, tc.wantAttempts, tc.wantErr)
+			}
+		})
+	}
+}
@@ -1,194 +1,408 @@
-
 package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
-	"runtime"
 )
 
+var (
+	// ErrQueueFull is returned by TrySubmit when the message's lane has no
+	// free slot.
+	ErrQueueFull = errors.New("message queue full")
+	// ErrProcessorStopped is returned once Stop has been called.
+	ErrProcessorStopped = errors.New("message processor stopped")
+)
+
+// UltraMessageProcessor runs inbound messages through the pipeline on a
+// fixed set of worker lanes. Every message is routed to a lane by its chat
+// (see laneIndex), so messages of one chat are processed and persisted one
+// at a time, in submission order, while different chats proceed in
+// parallel. Concurrency is bounded by the number of lanes and memory by
+// the lane queue capacity; producers feel backpressure through Submit
+// blocking or TrySubmit failing.
 type UltraMessageProcessor struct {
 	batchSize      int
-	flushInterval  time.Duration
-	messageBuffer  chan *Message
-	batchBuffer    []*Message
-	mu             sync.Mutex
-	workerPool     chan chan *Message
+	submitTimeout  time.Duration
+	lanes          []*MessageWorker
+	laneCapacity   int
 	maxWorkers     int
-	processedCount uint64
-	ctx            context.Context
-	cancel         context.CancelFunc
+	queued         atomic.Int64
+	processedCount atomic.Uint64
+	pipeline       *Pipeline
+	wal            *WAL
+	startTime      time.Time
+
+	// ctx is handed to pipeline stages and cancelled when Stop gives up
+	// waiting for the drain.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu orders Submit against Stop closing the lane queues.
+	mu       sync.RWMutex
+	stopped  bool
+	stopping chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
 }
 
-func NewUltraMessageProcessor() *UltraMessageProcessor {
+func NewUltraMessageProcessor(cfg ProcessorConfig) *UltraMessageProcessor {
 	ctx, cancel := context.WithCancel(context.Background())
-	maxWorkers := runtime.NumCPU() * 8 // 8 workers per CPU core
-	
+	maxWorkers := runtime.NumCPU() * cfg.WorkersPerCPU
+
+	laneCapacity := cfg.QueueSize / maxWorkers
+	if laneCapacity < 1 {
+		laneCapacity = 1
+	}
+
 	ump := &UltraMessageProcessor{
-		batchSize:     1000,           // Process 1000 messages at once
-		flushInterval: 10 * time.Millisecond, // Ultra-fast 10ms batching
-		messageBuffer: make(chan *Message, 100000), // 100k message buffer
-		batchBuffer:   make([]*Message, 0, 1000),
-		workerPool:    make(chan chan *Message, maxWorkers),
+		batchSize:     cfg.BatchSize,
+		submitTimeout: cfg.SubmitTimeout.Std(),
+		lanes:         make([]*MessageWorker, maxWorkers),
+		laneCapacity:  laneCapacity,
 		maxWorkers:    maxWorkers,
+		pipeline:      NewPipeline(),
+		startTime:     time.Now(),
 		ctx:           ctx,
 		cancel:        cancel,
+		stopping:      make(chan struct{}),
 	}
-	
-	// Start workers
-	for i := 0; i < maxWorkers; i++ {
+
+	// Start one worker per lane
+	for i := range ump.lanes {
 		worker := &MessageWorker{
-			id:         i,
-			workerPool: ump.workerPool,
-			jobQueue:   make(chan *Message, 100),
-			quit:       make(chan bool),
+			id:        i,
+			processor: ump,
+			jobQueue:  make(chan *Message, laneCapacity),
 		}
-		worker.Start()
+		ump.lanes[i] = worker
+		ump.workers.Add(1)
+		go worker.run()
 	}
-	
-	// Start batch processor
-	go ump.batchProcessor()
-	
+
 	return ump
 }
 
+// MessageWorker owns one lane and processes its messages sequentially.
 type MessageWorker struct {
-	id         int
-	workerPool chan chan *Message
-	jobQueue   chan *Message
-	quit       chan bool
+	id        int
+	processor *UltraMessageProcessor
+	jobQueue  chan *Message
 }
 
-func (w *MessageWorker) Start() {
-	go func() {
-		for {
-			w.workerPool <- w.jobQueue
+// run processes the lane until its queue is closed and drained. Messages
+// that are already waiting are taken in batches of up to batchSize to cut
+// per-message channel overhead; order within the lane is preserved.
+func (w *MessageWorker) run() {
+	defer w.processor.workers.Done()
+
+	batch := make([]*Message, 0, w.processor.batchSize)
+	for msg := range w.jobQueue {
+		batch = append(batch[:0], msg)
+	drain:
+		for len(batch) < cap(batch) {
 			select {
-			case job := <-w.jobQueue:
-				w.processMessage(job)
-			case <-w.quit:
-				return
+			case next, ok := <-w.jobQueue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
 			}
 		}
-	}()
+
+		for i := 0; i < len(batch); {
+			n := bulkRun(batch[i:])
+			if n > 1 {
+				w.processor.processBatch(batch[i : i+n])
+			} else {
+				w.processMessage(batch[i])
+			}
+			i += n
+		}
+		w.processor.queued.Add(-int64(len(batch)))
+		w.processor.processedCount.Add(uint64(len(batch)))
+	}
 }
 
 func (w *MessageWorker) processMessage(msg *Message) {
-	start := time.Now()
-	
-	// Ultra-fast message processing
-	switch msg.Type {
-	case "message":
-		// Use ultra cache for instant lookups
-		if cached, found := GlobalUltraCache.Get("user:" + msg.SenderId); found {
-			msg.SenderName = cached.(string)
+	w.processor.process(msg)
+}
+
+// bulkRun returns how many of msgs, from the first, can go through the
+// pipeline together: new content, up to a reply to one of them, since a
+// reply is checked against the message it answers.
+func bulkRun(msgs []*Message) int {
+	ids := make(map[string]struct{}, len(msgs))
+	for n, msg := range msgs {
+		if !msg.Type.IsContent() {
+			if n == 0 {
+				return 1
+			}
+			return n
 		}
-		
-		// Compress content for faster transmission
-		if len(msg.Content) > 100 {
-			// Use fast compression algorithm
-			msg.Compressed = true
+		if _, ok := ids[msg.ReplyTo]; ok && msg.ReplyTo != "" {
+			return n
 		}
-		
-	case "typing":
-		// Instant typing indicators - no processing needed
-		
-	case "read":
-		// Mark as read instantly
-		GlobalUltraCache.Set("read:"+msg.MessageId, true, 1*time.Hour)
-	}
-	
+		ids[msg.MessageID] = struct{}{}
+	}
+	return len(msgs)
+}
+
+// process runs msg through the pipeline. Stage failures are logged and
+// dead-lettered by the pipeline itself.
+func (ump *UltraMessageProcessor) process(msg *Message) {
+	start := time.Now()
+	ump.settle(msg, ump.pipeline.Run(ump.ctx, msg))
+
 	// Track processing time
-	processingTime := time.Since(start)
-	if processingTime > 1*time.Millisecond {
-		// Log slow messages for optimization
+	if processingTime := time.Since(start); processingTime > 1*time.Millisecond {
+		logger.Debug("slow message processing",
+			"type", msg.Type, "chat_id", msg.ChatID, "duration", processingTime)
 	}
 }
 
-func (ump *UltraMessageProcessor) batchProcessor() {
-	ticker := time.NewTicker(ump.flushInterval)
-	defer ticker.Stop()
-	
-	for {
-		select {
-		case <-ump.ctx.Done():
-			return
-		case <-ticker.C:
-			ump.flushBatch()
-		case msg := <-ump.messageBuffer:
-			ump.addToBatch(msg)
+// processBatch runs msgs, which do not depend on each other, through the
+// pipeline together.
+func (ump *UltraMessageProcessor) processBatch(msgs []*Message) {
+	start := time.Now()
+	for i, err := range ump.pipeline.RunBatch(ump.ctx, msgs) {
+		ump.settle(msgs[i], err)
+	}
+
+	if processingTime := time.Since(start); processingTime > time.Duration(len(msgs))*time.Millisecond {
+		logger.Debug("slow batch processing", "messages", len(msgs), "duration", processingTime)
+	}
+}
+
+// settle acknowledges the log record of msg, which the pipeline returned
+// err for. Persisted, dead-lettered or dropped: either way the log no
+// longer needs the record. Unsettled ones are replayed from it on start.
+func (ump *UltraMessageProcessor) settle(msg *Message, err error) {
+	if ump.wal == nil || msg.walSeq == 0 {
+		return
+	}
+	if errors.Is(err, ErrUnsettled) {
+		logger.Debug("message left in the write-ahead log", "seq", msg.walSeq, "error", err)
+		return
+	}
+	ump.wal.Ack(msg.walSeq)
+}
+
+// Use registers a pipeline stage. Stages can be added while the processor
+// is running; messages already in a stage finish with the old set.
+func (ump *UltraMessageProcessor) Use(stage Stage) error {
+	return ump.pipeline.Register(stage)
+}
+
+// SetDeadLetterHandler installs the receiver for messages that failed a
+// stage with the retry or dead-letter policy.
+func (ump *UltraMessageProcessor) SetDeadLetterHandler(fn DeadLetterFunc) {
+	ump.pipeline.SetDeadLetterHandler(fn)
+}
+
+// laneFor picks the lane for msg. All messages of a chat share a lane;
+// messages without a chat are spread by sender.
+func (ump *UltraMessageProcessor) laneFor(msg *Message) *MessageWorker {
+	key := msg.ChatID
+	if key == "" {
+		key = msg.UserID
+	}
+	return ump.lanes[laneIndex(key, len(ump.lanes))]
+}
+
+// laneIndex maps a partition key onto one of n lanes with jump consistent
+// hashing, so changing the worker count only moves about 1/n of the chats
+// to a different lane instead of reshuffling all of them.
+func laneIndex(key string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(jumpHash(h.Sum64(), int32(n)))
+}
+
+// jumpHash is Lamping and Veach's jump consistent hash.
+func jumpHash(key uint64, buckets int32) int32 {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int32(b)
+}
+
+// AttachWAL makes Submit and TrySubmit log every message to w before
+// queueing it. Call it before the processor receives traffic.
+func (ump *UltraMessageProcessor) AttachWAL(w *WAL) {
+	ump.wal = w
+}
+
+// Recover queues the records the WAL recovered on open, in log order,
+// without appending them again. It blocks while lanes are full; records it
+// could not queue stay in the log for the next start.
+func (ump *UltraMessageProcessor) Recover(ctx context.Context, w *WAL) (int, error) {
+	records := w.Recovered()
+	for i := range records {
+		msg := records[i].msg
+		msg.walSeq = records[i].seq
+		if err := ump.enqueue(ctx, &msg, true); err != nil {
+			return i, err
 		}
 	}
+	return len(records), nil
 }
 
-func (ump *UltraMessageProcessor) addToBatch(msg *Message) {
-	ump.mu.Lock()
-	defer ump.mu.Unlock()
-	
-	ump.batchBuffer = append(ump.batchBuffer, msg)
-	
-	if len(ump.batchBuffer) >= ump.batchSize {
-		ump.flushBatch()
+// Submit queues msg, blocking while its lane is full until ctx is done or
+// the processor stops. With a WAL attached the message is durable in the
+// log when Submit returns nil.
+func (ump *UltraMessageProcessor) Submit(ctx context.Context, msg *Message) error {
+	if err := ump.accept(ctx, msg); err != nil {
+		return err
 	}
+	return ump.release(msg, ump.enqueue(ctx, msg, true))
 }
 
-func (ump *UltraMessageProcessor) flushBatch() {
-	if len(ump.batchBuffer) == 0 {
-		return
+// TrySubmit queues msg without blocking on the lane and returns
+// ErrQueueFull when its lane is full. The WAL append still waits for the
+// write to complete.
+func (ump *UltraMessageProcessor) TrySubmit(msg *Message) error {
+	if err := ump.accept(context.Background(), msg); err != nil {
+		return err
 	}
-	
-	// Process entire batch in parallel
-	var wg sync.WaitGroup
-	batchSize := len(ump.batchBuffer)
-	
-	for i := 0; i < batchSize; i++ {
-		wg.Add(1)
-		go func(msg *Message) {
-			defer wg.Done()
-			
-			// Dispatch to worker
-			select {
-			case jobQueue := <-ump.workerPool:
-				jobQueue <- msg
-			default:
-				// Process inline if workers busy
-				worker := &MessageWorker{}
-				worker.processMessage(msg)
-			}
-		}(ump.batchBuffer[i])
+	return ump.release(msg, ump.enqueue(context.Background(), msg, false))
+}
+
+// accept assigns an ID to new content submitted without one and, with a
+// WAL attached, appends msg to the log.
+func (ump *UltraMessageProcessor) accept(ctx context.Context, msg *Message) error {
+	if msg.MessageID == "" && msg.Type.IsContent() {
+		msg.MessageID = newUUID()
+	}
+	if ump.wal == nil {
+		return nil
+	}
+	seq, err := ump.wal.Append(ctx, msg)
+	if err != nil {
+		return err
 	}
-	
-	wg.Wait()
-	
-	// Clear batch
-	ump.batchBuffer = ump.batchBuffer[:0]
-	ump.processedCount += uint64(batchSize)
+	msg.walSeq = seq
+	return nil
 }
 
-func (ump *UltraMessageProcessor) ProcessMessage(msg *Message) {
+// release acknowledges the log record of a submitted message that never
+// reached a lane: the submitter got err, so it must not be replayed later.
+// Recovered records are not released, as they were accepted before.
+func (ump *UltraMessageProcessor) release(msg *Message, err error) error {
+	if err != nil && ump.wal != nil && msg.walSeq != 0 {
+		ump.wal.Ack(msg.walSeq)
+	}
+	return err
+}
+
+func (ump *UltraMessageProcessor) enqueue(ctx context.Context, msg *Message, block bool) error {
+	ump.mu.RLock()
+	defer ump.mu.RUnlock()
+
+	if ump.stopped {
+		return ErrProcessorStopped
+	}
+
+	lane := ump.laneFor(msg)
+	if !block {
+		select {
+		case lane.jobQueue <- msg:
+			ump.queued.Add(1)
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case lane.jobQueue <- msg:
+		ump.queued.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ump.stopping:
+		return ErrProcessorStopped
+	}
+}
+
+// Stop rejects new messages and waits for the queued ones to be processed.
+// If ctx ends first, in-flight stages are cancelled and ctx.Err() returned.
+func (ump *UltraMessageProcessor) Stop(ctx context.Context) error {
+	ump.stopOnce.Do(func() {
+		// Wake blocked producers, then close the lanes once none can send
+		close(ump.stopping)
+		ump.mu.Lock()
+		ump.stopped = true
+		for _, lane := range ump.lanes {
+			close(lane.jobQueue)
+		}
+		ump.mu.Unlock()
+	})
+
+	drained := make(chan struct{})
+	go func() {
+		ump.workers.Wait()
+		close(drained)
+	}()
+
 	select {
-	case ump.messageBuffer <- msg:
-		// Message queued successfully
-	default:
-		// Buffer full - process immediately
-		worker := &MessageWorker{}
-		worker.processMessage(msg)
+	case <-drained:
+		ump.cancel()
+		return nil
+	case <-ctx.Done():
+		ump.cancel()
+		return ctx.Err()
 	}
 }
 
+// QueueSaturation returns how full the lane queues are overall, from 0 to 1.
+// A single busy chat only fills its own lane, so it does not on its own take
+// the instance out of rotation.
+func (ump *UltraMessageProcessor) QueueSaturation() float64 {
+	return float64(ump.queued.Load()) / float64(ump.laneCapacity*len(ump.lanes))
+}
+
+func (ump *UltraMessageProcessor) busiestLaneDepth() int {
+	busiest := 0
+	for _, lane := range ump.lanes {
+		if n := len(lane.jobQueue); n > busiest {
+			busiest = n
+		}
+	}
+	return busiest
+}
+
 func (ump *UltraMessageProcessor) GetStats() map[string]interface{} {
-	return map[string]interface{}{
-		"processed_messages":    ump.processedCount,
-		"queue_size":           len(ump.messageBuffer),
-		"batch_size":           ump.batchSize,
-		"flush_interval_ms":    ump.flushInterval.Milliseconds(),
-		"max_workers":          ump.maxWorkers,
-		"messages_per_second":  ump.processedCount / uint64(time.Since(time.Now()).Seconds() + 1),
-		"performance_status":   "telegram_killer_mode",
+	processed := ump.processedCount.Load()
+	elapsed := time.Since(ump.startTime).Seconds()
+
+	stats := map[string]interface{}{
+		"processed_messages":  processed,
+		"queue_size":          ump.queued.Load(),
+		"queue_capacity":      ump.laneCapacity * len(ump.lanes),
+		"lane_capacity":       ump.laneCapacity,
+		"queue_saturation":    ump.QueueSaturation(),
+		"batch_size":          ump.batchSize,
+		"max_workers":         ump.maxWorkers,
+		"busiest_lane_depth":  ump.busiestLaneDepth(),
+		"messages_per_second": float64(processed) / (elapsed + 1),
+		"performance_status":  "telegram_killer_mode",
+		"stages":              ump.pipeline.Stats(),
+	}
+	if ump.wal != nil {
+		stats["wal"] = ump.wal.Stats()
 	}
+	return stats
 }
 
-// Global instance
-var GlobalMessageProcessor = NewUltraMessageProcessor()
+// Global instance, created in main from the loaded configuration
+var GlobalMessageProcessor *UltraMessageProcessor
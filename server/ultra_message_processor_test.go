@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestProcessor(t *testing.T) *UltraMessageProcessor {
+	t.Helper()
+	ump := NewUltraMessageProcessor(ProcessorConfig{
+		BatchSize:     16,
+		QueueSize:     4096,
+		WorkersPerCPU: 2,
+		SubmitTimeout: Duration(time.Second),
+	})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ump.Stop(ctx)
+	})
+	return ump
+}
+
+func TestProcessorPreservesPerChatOrder(t *testing.T) {
+	const (
+		chats   = 50
+		perChat = 200
+	)
+
+	ump := newTestProcessor(t)
+
+	var mu sync.Mutex
+	seen := make(map[string][]int64)
+	err := ump.Use(Stage{
+		Name: "record",
+		Handle: func(ctx context.Context, msg *Message) error {
+			// Jitter widens the window for reordering if lanes were shared
+			if rand.Intn(10) == 0 {
+				time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+			}
+			mu.Lock()
+			seen[msg.ChatID] = append(seen[msg.ChatID], msg.Timestamp)
+			mu.Unlock()
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One producer per chat, all running concurrently so the traffic of
+	// different chats interleaves on the lanes.
+	var producers sync.WaitGroup
+	for c := 0; c < chats; c++ {
+		producers.Add(1)
+		go func(chatID string) {
+			defer producers.Done()
+			for seq := int64(1); seq <= perChat; seq++ {
+				msg := &Message{Type: TypeMessage, ChatID: chatID, Timestamp: seq}
+				if err := ump.Submit(context.Background(), msg); err != nil {
+					t.Errorf("submit %s/%d: %v", chatID, seq, err)
+					return
+				}
+			}
+		}(fmt.Sprintf("chat-%d", c))
+	}
+	producers.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ump.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	if len(seen) != chats {
+		t.Fatalf("saw %d chats, want %d", len(seen), chats)
+	}
+	for chatID, seqs := range seen {
+		if len(seqs) != perChat {
+			t.Errorf("%s: processed %d messages, want %d", chatID, len(seqs), perChat)
+			continue
+		}
+		for i, seq := range seqs {
+			if seq != int64(i+1) {
+				t.Errorf("%s: position %d has seq %d, want %d", chatID, i, seq, i+1)
+				break
+			}
+		}
+	}
+}
+
+func TestProcessorStopRejectsNewMessages(t *testing.T) {
+	ump := newTestProcessor(t)
+
+	if err := ump.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := ump.TrySubmit(&Message{Type: TypeMessage, ChatID: "c"}); err != ErrProcessorStopped {
+		t.Fatalf("TrySubmit after stop = %v, want ErrProcessorStopped", err)
+	}
+}
+
+func TestLaneIndexIsConsistent(t *testing.T) {
+	const keys = 10000
+
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("chat-%d", i)
+		before, after := laneIndex(key, 16), laneIndex(key, 17)
+		if before < 0 || before >= 16 || after < 0 || after >= 17 {
+			t.Fatalf("lane out of range for %s: %d, %d", key, before, after)
+		}
+		if before != after {
+			moved++
+		}
+	}
+
+	// Growing from 16 to 17 lanes should move roughly 1/17 of the keys.
+	if limit := keys / 17 * 2; moved > limit {
+		t.Fatalf("%d of %d keys moved lanes, want at most %d", moved, keys, limit)
+	}
+}
+
+func TestBulkRunStopsAtDependentMessages(t *testing.T) {
+	chat := func(id string) *Message { return &Message{Type: TypeMessage, MessageID: id} }
+	reply := func(id, to string) *Message { return &Message{Type: TypeReply, MessageID: id, ReplyTo: to} }
+	edit := &Message{Type: TypeEdit, MessageID: "a"}
+
+	for _, tc := range []struct {
+		name string
+		msgs []*Message
+		want int
+	}{
+		{"content", []*Message{chat("a"), chat("b"), reply("c", "old")}, 3},
+		{"change first", []*Message{edit, chat("b")}, 1},
+		{"change later", []*Message{chat("a"), chat("b"), edit}, 2},
+		{"reply within", []*Message{chat("a"), chat("b"), reply("c", "a")}, 2},
+	} {
+		if got := bulkRun(tc.msgs); got != tc.want {
+			t.Fatalf("%s: bulkRun = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fsync policies for the write-ahead log.
+const (
+	// FsyncBatch syncs every group of appends before acknowledging them.
+	FsyncBatch = "batch"
+	// FsyncInterval acknowledges after the write and syncs in the
+	// background every FsyncInterval; a crash can lose that window.
+	FsyncInterval = "interval"
+	// FsyncNever leaves syncing to the OS.
+	FsyncNever = "never"
+)
+
+const (
+	walSegmentExt   = ".wal"
+	walCheckpoint   = "checkpoint"
+	walHeaderSize   = 16 // length, CRC-32C, sequence number
+	walMaxRecord    = 16 << 20
+	walMaxGroupSize = 512
+)
+
+var (
+	// ErrWALClosed is returned by Append after Close.
+	ErrWALClosed = errors.New("write-ahead log closed")
+
+	walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WAL is an append-only, segmented write-ahead log for inbound messages.
+// Appends are group-committed by a single writer goroutine. Every record
+// stays pending until Ack is called for it; segments whose records are all
+// acknowledged are deleted, and the highest fully acknowledged sequence is
+// kept in a checkpoint file so recovery only replays what was never
+// completed.
+//
+// Each record is a 16 byte header (payload length, CRC-32C of the payload,
+// sequence number, all little-endian) followed by the JSON-encoded message.
+type WAL struct {
+	cfg WALConfig
+
+	appends chan *walAppend
+	closing chan struct{}
+	done    chan struct{}
+
+	mu         sync.Mutex
+	segments   []*walSegment // oldest first, last one is active
+	active     *os.File
+	activeBuf  *bufio.Writer
+	activeSize int64
+	nextSeq    uint64
+	checkpoint uint64
+	pending    map[uint64]struct{}
+	recovered  []walRecord
+	closeOnce  sync.Once
+}
+
+type walSegment struct {
+	path     string
+	firstSeq uint64
+	lastSeq  uint64
+}
+
+type walAppend struct {
+	payload []byte
+	seq     uint64
+	done    chan error
+}
+
+type walRecord struct {
+	seq uint64
+	msg Message
+}
+
+// OpenWAL opens or creates the log in cfg.Dir and recovers its contents.
+// Records written after the last checkpoint are kept for Replay.
+func OpenWAL(cfg WALConfig) (*WAL, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		cfg:     cfg,
+		appends: make(chan *walAppend, walMaxGroupSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]struct{}),
+	}
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+	if err := w.openSegment(); err != nil {
+		return nil, err
+	}
+
+	go w.writeLoop()
+	go w.maintainLoop()
+	return w, nil
+}
+
+func (w *WAL) recover() error {
+	if data, err := os.ReadFile(filepath.Join(w.cfg.Dir, walCheckpoint)); err == nil {
+		w.checkpoint, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("wal checkpoint: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	w.nextSeq = w.checkpoint + 1
+
+	paths, err := filepath.Glob(filepath.Join(w.cfg.Dir, "*"+walSegmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		seg, records, err := w.readSegment(path, i == len(paths)-1)
+		if err != nil {
+			return err
+		}
+		if seg.lastSeq <= w.checkpoint && seg.lastSeq != 0 {
+			// Fully acknowledged before the crash; finish the truncation
+			os.Remove(path)
+			continue
+		}
+		w.segments = append(w.segments, seg)
+		for _, rec := range records {
+			if rec.seq > w.checkpoint {
+				w.recovered = append(w.recovered, rec)
+				w.pending[rec.seq] = struct{}{}
+			}
+			if rec.seq >= w.nextSeq {
+				w.nextSeq = rec.seq + 1
+			}
+		}
+	}
+
+	if len(w.recovered) > 0 {
+		logger.Info("write-ahead log recovered", "dir", w.cfg.Dir,
+			"records", len(w.recovered), "checkpoint", w.checkpoint)
+	}
+	return nil
+}
+
+// readSegment reads every valid record of a segment. Reading stops at the
+// first damaged record: the tail of the last segment is truncated there,
+// since it is the expected result of a crash mid-write; damage in an older
+// segment is logged and the rest of that segment skipped.
+func (w *WAL) readSegment(path string, last bool) (*walSegment, []walRecord, error) {
+	firstSeq, _ := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), walSegmentExt), 16, 64)
+	seg := &walSegment{path: path, firstSeq: firstSeq}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var (
+		records []walRecord
+		offset  int64
+		header  [walHeaderSize]byte
+		r       = bufio.NewReader(f)
+	)
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			break
+		}
+
+		var bad error
+		if err != nil {
+			bad = fmt.Errorf("short header: %w", err)
+		} else if rec, length, err := readRecord(r, header); err != nil {
+			bad = err
+		} else {
+			records = append(records, rec)
+			seg.lastSeq = rec.seq
+			offset += walHeaderSize + int64(length)
+			continue
+		}
+
+		if last {
+			logger.Warn("truncating damaged write-ahead log tail",
+				"segment", path, "offset", offset, "error", bad)
+			if err := os.Truncate(path, offset); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			logger.Error("damaged write-ahead log segment, skipping remainder",
+				"segment", path, "offset", offset, "error", bad)
+		}
+		break
+	}
+	return seg, records, nil
+}
+
+// readRecord reads the payload following header and decodes it. The
+// length is checked before it sizes an allocation, so a damaged header
+// cannot ask for more than walMaxRecord bytes.
+func readRecord(r io.Reader, header [walHeaderSize]byte) (walRecord, uint32, error) {
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	seq := binary.LittleEndian.Uint64(header[8:16])
+	if length > walMaxRecord {
+		return walRecord{}, 0, fmt.Errorf("record length %d exceeds limit", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, 0, fmt.Errorf("short payload: %w", err)
+	}
+	if crc32.Checksum(payload, walCRCTable) != sum {
+		return walRecord{}, 0, errors.New("checksum mismatch")
+	}
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return walRecord{}, 0, fmt.Errorf("decode: %w", err)
+	}
+	return walRecord{seq: seq, msg: msg}, length, nil
+}
+
+// openSegment starts a new active segment named after the next sequence.
+func (w *WAL) openSegment() error {
+	path := filepath.Join(w.cfg.Dir, fmt.Sprintf("%016x%s", w.nextSeq, walSegmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.active = f
+	w.activeBuf = bufio.NewWriterSize(f, 256*1024)
+	w.activeSize = info.Size()
+	if n := len(w.segments); n == 0 || w.segments[n-1].path != path {
+		w.segments = append(w.segments, &walSegment{path: path, firstSeq: w.nextSeq})
+	}
+	return syncDir(w.cfg.Dir)
+}
+
+// Recovered returns the records found on disk that were never
+// acknowledged, in sequence order. Callers resubmit them on startup.
+func (w *WAL) Recovered() []walRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	recovered := w.recovered
+	w.recovered = nil
+	sort.Slice(recovered, func(i, j int) bool { return recovered[i].seq < recovered[j].seq })
+	return recovered
+}
+
+// Append writes msg to the log and returns its sequence number once the
+// record is durable according to the fsync policy.
+func (w *WAL) Append(ctx context.Context, msg *Message) (uint64, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) > walMaxRecord {
+		return 0, fmt.Errorf("message of %d bytes exceeds the WAL record limit", len(payload))
+	}
+
+	req := &walAppend{payload: payload, done: make(chan error, 1)}
+	select {
+	case w.appends <- req:
+	case <-w.closing:
+		return 0, ErrWALClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	// Once queued the append completes promptly; wait for it even if ctx
+	// ends so the caller learns whether the record is in the log. A
+	// request queued as the writer stopped is never picked up.
+	select {
+	case err = <-req.done:
+	case <-w.done:
+		select {
+		case err = <-req.done:
+		default:
+			err = ErrWALClosed
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return req.seq, nil
+}
+
+// Ack marks a record as fully processed, making it eligible for truncation.
+func (w *WAL) Ack(seq uint64) {
+	w.mu.Lock()
+	delete(w.pending, seq)
+	w.mu.Unlock()
+}
+
+func (w *WAL) writeLoop() {
+	defer close(w.done)
+
+	group := make([]*walAppend, 0, walMaxGroupSize)
+	for {
+		select {
+		case req := <-w.appends:
+			group = append(group[:0], req)
+		case <-w.closing:
+			w.failQueued()
+			return
+		}
+
+	gather:
+		for len(group) < walMaxGroupSize {
+			select {
+			case req := <-w.appends:
+				group = append(group, req)
+			default:
+				break gather
+			}
+		}
+
+		err := w.writeGroup(group)
+		for _, req := range group {
+			req.done <- err
+		}
+	}
+}
+
+// writeGroup appends a group of records and syncs them once.
+// failQueued completes the appends still queued at close with
+// ErrWALClosed.
+func (w *WAL) failQueued() {
+	for {
+		select {
+		case req := <-w.appends:
+			req.done <- ErrWALClosed
+		default:
+			return
+		}
+	}
+}
+
+func (w *WAL) writeGroup(group []*walAppend) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var header [walHeaderSize]byte
+	for _, req := range group {
+		if w.activeSize >= w.cfg.SegmentSize {
+			if err := w.rollSegment(); err != nil {
+				return err
+			}
+		}
+
+		req.seq = w.nextSeq
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(req.payload)))
+		binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(req.payload, walCRCTable))
+		binary.LittleEndian.PutUint64(header[8:16], req.seq)
+		if _, err := w.activeBuf.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.activeBuf.Write(req.payload); err != nil {
+			return err
+		}
+
+		w.nextSeq++
+		w.activeSize += walHeaderSize + int64(len(req.payload))
+		w.segments[len(w.segments)-1].lastSeq = req.seq
+		w.pending[req.seq] = struct{}{}
+	}
+
+	if err := w.activeBuf.Flush(); err != nil {
+		return err
+	}
+	if w.cfg.FsyncPolicy == FsyncBatch {
+		return w.active.Sync()
+	}
+	return nil
+}
+
+// rollSegment seals the active segment and opens the next one. Called with
+// mu held.
+func (w *WAL) rollSegment() error {
+	if err := w.activeBuf.Flush(); err != nil {
+		return err
+	}
+	if err := w.active.Sync(); err != nil {
+		return err
+	}
+	if err := w.active.Close(); err != nil {
+		return err
+	}
+	return w.openSegment()
+}
+
+// maintainLoop syncs under the interval policy and truncates acknowledged
+// segments.
+func (w *WAL) maintainLoop() {
+	interval := w.cfg.FsyncInterval.Std()
+	if interval <= 0 || w.cfg.FsyncPolicy != FsyncInterval {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastTruncate := time.Now()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		if w.cfg.FsyncPolicy == FsyncInterval {
+			w.mu.Lock()
+			if err := w.active.Sync(); err != nil {
+				logger.Error("write-ahead log sync failed", "error", err)
+			}
+			w.mu.Unlock()
+		}
+		if time.Since(lastTruncate) >= w.cfg.TruncateInterval.Std() {
+			if err := w.truncate(); err != nil {
+				logger.Error("write-ahead log truncation failed", "error", err)
+			}
+			lastTruncate = time.Now()
+		}
+	}
+}
+
+// truncate records the acknowledged watermark and deletes sealed segments
+// that lie entirely below it.
+func (w *WAL) truncate() error {
+	w.mu.Lock()
+	watermark := w.nextSeq - 1
+	for seq := range w.pending {
+		if seq-1 < watermark {
+			watermark = seq - 1
+		}
+	}
+	if watermark == w.checkpoint {
+		w.mu.Unlock()
+		return nil
+	}
+
+	var obsolete []string
+	keep := w.segments[:0]
+	for i, seg := range w.segments {
+		sealed := i < len(w.segments)-1
+		if sealed && seg.lastSeq <= watermark {
+			obsolete = append(obsolete, seg.path)
+			continue
+		}
+		keep = append(keep, seg)
+	}
+	w.segments = keep
+	w.mu.Unlock()
+
+	// The checkpoint must be durable before the segments disappear
+	if err := writeFileAtomic(filepath.Join(w.cfg.Dir, walCheckpoint),
+		[]byte(strconv.FormatUint(watermark, 10))); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.checkpoint = watermark
+	w.mu.Unlock()
+
+	for _, path := range obsolete {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats reports the log position and backlog.
+func (w *WAL) Stats() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return map[string]interface{}{
+		"next_seq":     w.nextSeq,
+		"checkpoint":   w.checkpoint,
+		"pending":      len(w.pending),
+		"segments":     len(w.segments),
+		"fsync_policy": w.cfg.FsyncPolicy,
+	}
+}
+
+// Close stops the writer, syncs the active segment and writes a final
+// checkpoint.
+func (w *WAL) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		<-w.done
+
+		if truncErr := w.truncate(); truncErr != nil {
+			err = truncErr
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if flushErr := w.activeBuf.Flush(); flushErr != nil && err == nil {
+			err = flushErr
+		}
+		if syncErr := w.active.Sync(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+		if closeErr := w.active.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testWALConfig(dir string) WALConfig {
+	return WALConfig{
+		Enabled:     true,
+		Dir:         dir,
+		SegmentSize: 64 << 20,
+		FsyncPolicy: FsyncBatch,
+		// Truncation only runs when a test calls it
+		TruncateInterval: Duration(time.Hour),
+	}
+}
+
+func openTestWAL(t *testing.T, cfg WALConfig) *WAL {
+	t.Helper()
+	w, err := OpenWAL(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// appendMessages logs a message per content and returns their sequences.
+func appendMessages(t *testing.T, w *WAL, contents ...string) []uint64 {
+	t.Helper()
+	seqs := make([]uint64, len(contents))
+	for i, content := range contents {
+		seq, err := w.Append(context.Background(), &Message{Type: TypeMessage, ChatID: "chat", Content: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs[i] = seq
+	}
+	return seqs
+}
+
+func recoveredContents(w *WAL) []string {
+	var contents []string
+	for _, rec := range w.Recovered() {
+		contents = append(contents, rec.msg.Content)
+	}
+	return contents
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func readCheckpoint(t *testing.T, dir string) uint64 {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, walCheckpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
+
+func TestWALReplaysUnacknowledgedRecords(t *testing.T) {
+	cfg := testWALConfig(t.TempDir())
+	w := openTestWAL(t, cfg)
+	seqs := appendMessages(t, w, "a", "b", "c", "d")
+	w.Ack(seqs[0])
+	w.Ack(seqs[2])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// c was acknowledged, but b before it was not, so both replay
+	w = openTestWAL(t, cfg)
+	if got, want := recoveredContents(w), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("recovered %v, want %v", got, want)
+	}
+	if w.Recovered() != nil {
+		t.Fatal("records recovered twice")
+	}
+
+	// New records continue the sequence
+	next := appendMessages(t, w, "e")
+	if next[0] != seqs[3]+1 {
+		t.Fatalf("appended at %d after reopening, want %d", next[0], seqs[3]+1)
+	}
+}
+
+func TestWALTruncatesDamagedTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tail []byte
+	}{
+		// A record cut short by a crash: a full header, half the payload
+		{"torn payload", append([]byte{200, 0, 0, 0, 1, 2, 3, 4, 3, 0, 0, 0, 0, 0, 0, 0}, `{"type":"mess`...)},
+		// A garbage length is not allocated
+		{"oversized length", []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 3, 0, 0, 0, 0, 0, 0, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testWALConfig(t.TempDir())
+			w := openTestWAL(t, cfg)
+			appendMessages(t, w, "a", "b")
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			segments := walSegments(t, cfg.Dir)
+			if len(segments) != 1 {
+				t.Fatalf("%d segments, want 1", len(segments))
+			}
+			info, err := os.Stat(segments[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tc.tail)
+			f.Close()
+
+			w = openTestWAL(t, cfg)
+			if got, want := recoveredContents(w), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("recovered %v, want %v", got, want)
+			}
+			if after, err := os.Stat(segments[0]); err != nil || after.Size() != info.Size() {
+				t.Fatalf("damaged segment not truncated to %d bytes: %v, %v", info.Size(), after.Size(), err)
+			}
+
+			// Records appended after the truncation are readable
+			appendMessages(t, w, "c")
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			w = openTestWAL(t, cfg)
+			if got, want := recoveredContents(w), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("recovered %v after appending, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestWALAppendDuringClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := openTestWAL(t, testWALConfig(t.TempDir()))
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 50)
+		for j := 0; j < cap(errs); j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := w.Append(context.Background(), &Message{Type: TypeMessage, Content: "x"})
+				errs <- err
+			}()
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every append returns, either written or refused
+		finished := make(chan struct{})
+		go func() { wg.Wait(); close(finished) }()
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Append blocked after Close")
+		}
+		close(errs)
+		for err := range errs {
+			if err != nil && !errors.Is(err, ErrWALClosed) {
+				t.Fatalf("Append during Close = %v, want nil or %v", err, ErrWALClosed)
+			}
+		}
+	}
+}
+
+func TestWALRotatesAndRemovesSegments(t *testing.T) {
+	cfg := testWALConfig(t.TempDir())
+	// Every record starts a new segment
+	cfg.SegmentSize = 1
+	w := openTestWAL(t, cfg)
+
+	var contents []string
+	for i := 0; i < 5; i++ {
+		contents = append(contents, fmt.Sprintf("m%d", i))
+	}
+	seqs := appendMessages(t, w, contents...)
+	if n := len(walSegments(t, cfg.Dir)); n != 5 {
+		t.Fatalf("%d segments after 5 records, want 5", n)
+	}
+
+	// The sealed segments of the first three records go; the active one stays
+	for _, seq := range seqs[:3] {
+		w.Ack(seq)
+	}
+	if err := w.truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(walSegments(t, cfg.Dir)); n != 2 {
+		t.Fatalf("%d segments after acknowledging three records, want 2", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestWAL(t, cfg)
+	if got, want := recoveredContents(w), contents[3:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("recovered %v, want %v", got, want)
+	}
+}
+
+func TestWALCheckpointsBelowOldestPending(t *testing.T) {
+	cfg := testWALConfig(t.TempDir())
+	w := openTestWAL(t, cfg)
+	seqs := appendMessages(t, w, "a", "b", "c", "d")
+
+	// Acknowledged out of order: the checkpoint waits for b
+	w.Ack(seqs[0])
+	w.Ack(seqs[2])
+	w.Ack(seqs[3])
+	if err := w.truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCheckpoint(t, cfg.Dir); got != seqs[0] {
+		t.Fatalf("checkpoint %d, want %d", got, seqs[0])
+	}
+
+	w.Ack(seqs[1])
+	if err := w.truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCheckpoint(t, cfg.Dir); got != seqs[3] {
+		t.Fatalf("checkpoint %d, want %d", got, seqs[3])
+	}
+	if pending := w.Stats()["pending"].(int); pending != 0 {
+		t.Fatalf("%d records pending, want 0", pending)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestWAL(t, cfg)
+	if got := recoveredContents(w); len(got) != 0 {
+		t.Fatalf("recovered %v past the checkpoint", got)
+	}
+}
+
+func TestProcessorKeepsCancelledMessagesInWAL(t *testing.T) {
+	cfg := testWALConfig(t.TempDir())
+	w := openTestWAL(t, cfg)
+	ump := NewUltraMessageProcessor(ProcessorConfig{
+		BatchSize:     16,
+		QueueSize:     64,
+		WorkersPerCPU: 1,
+		SubmitTimeout: Duration(time.Second),
+	})
+	ump.AttachWAL(w)
+
+	// "stuck" is still being persisted when shutdown gives up on it
+	started := make(chan struct{})
+	err := ump.Use(Stage{
+		Name:    "persistence",
+		OnError: PolicyRetry,
+		Handle: func(ctx context.Context, msg *Message) error {
+			if msg.Content != "stuck" {
+				return nil
+			}
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ump.SetDeadLetterHandler(func(msg *Message, stage string, attempts int, err error) error {
+		t.Errorf("%q dead-lettered: %v", msg.Content, err)
+		return nil
+	})
+
+	for _, content := range []string{"done", "stuck"} {
+		if err := ump.Submit(context.Background(), &Message{Type: TypeMessage, ChatID: content, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ump.Stop(ctx); err == nil {
+		t.Fatal("Stop drained a stage that never returns")
+	}
+
+	// The cancelled stage returns asynchronously; wait for both outcomes
+	deadline := time.Now().Add(2 * time.Second)
+	for ump.processedCount.Load() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("messages still processing after cancellation")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pending := w.Stats()["pending"].(int); pending != 1 {
+		t.Fatalf("%d records pending, want only the cancelled one", pending)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestWAL(t, cfg)
+	if got := recoveredContents(w); !reflect.DeepEqual(got, []string{"stuck"}) {
+		t.Fatalf("recovered %v, want [stuck]", got)
+	}
+}
@@ -1,66 +1,83 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Message represents a WebSocket message
-type Message struct {
-	Type      string                 `json:"type"`
-	Content   string                 `json:"content"`
-	Timestamp int64                  `json:"timestamp"`
-	UserID    string                 `json:"userId"`
-	ChatID    string                 `json:"chatId"`
-	MessageID string                 `json:"messageId"`
-	Data      map[string]interface{} `json:"data,omitempty"`
-}
-
 // Client represents a WebSocket client
 type Client struct {
-	ID       string
-	Conn     *websocket.Conn
-	Send     chan Message
-	Hub      *Hub
-	UserID   string
-	LastSeen time.Time
+	ID          string
+	Conn        *websocket.Conn
+	Send        chan Message
+	Hub         *Hub
+	UserID      string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	LastSeen    time.Time
+	chats       map[string]struct{}
+	mu          sync.Mutex // guards LastSeen and chats
+	log         *slog.Logger
 }
 
 // Hub maintains the set of active clients and broadcasts messages
 type Hub struct {
 	clients    map[*Client]bool
 	broadcast  chan Message
+	remote     chan clusterEnvelope // broadcasts from other instances
 	register   chan *Client
 	unregister chan *Client
+	ping       chan chan struct{}
 	mutex      sync.RWMutex
+	cfg        WebSocketConfig
+	upgrader   websocket.Upgrader
+	processor  *UltraMessageProcessor
+	files      *fileService
+	history    *historyService
+	cluster    *clusterBridge
+
+	broadcastCount uint64 // accessed atomically
+	droppedCount   uint64 // accessed atomically
 }
 
-// WebSocket upgrader with better configuration
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for development
-		return true
-	},
-	ReadBufferSize:  4096,
-	WriteBufferSize: 4096,
-	EnableCompression: true,
-}
+// broadcastLogSampler keeps per-message broadcast logging from flooding the
+// log at high message rates.
+var broadcastLogSampler = newLogSampler(10, 1000, time.Second)
 
 // Create new hub
-func newHub() *Hub {
+func newHub(cfg WebSocketConfig) *Hub {
 	return &Hub{
-		broadcast:  make(chan Message, 1000),
+		broadcast:  make(chan Message, cfg.BroadcastBuffer),
+		remote:     make(chan clusterEnvelope, cfg.BroadcastBuffer),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		ping:       make(chan chan struct{}),
 		clients:    make(map[*Client]bool),
+		cfg:        cfg,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				// Allow all origins for development
+				return true
+			},
+			ReadBufferSize:    cfg.ReadBufferSize,
+			WriteBufferSize:   cfg.WriteBufferSize,
+			EnableCompression: cfg.EnableCompression,
+		},
 	}
 }
 
@@ -70,75 +87,219 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			h.mutex.Lock()
+			first := client.UserID != "" && !h.hostsLocked(client.UserID)
 			h.clients[client] = true
+			total := len(h.clients)
 			h.mutex.Unlock()
 
-			log.Printf("Client connected: %s (Total: %d)", client.ID, len(h.clients))
+			client.log.Info("client connected", "total_clients", total)
+			if first && h.cluster != nil {
+				h.cluster.announce(client.UserID)
+			}
 
 			// Send welcome message
 			welcomeMsg := Message{
-				Type:      "system",
+				Type:      TypeSystem,
 				Content:   "Connected to UltraSecure WebSocket server",
 				Timestamp: time.Now().Unix(),
 			}
 
-			select {
-			case client.Send <- welcomeMsg:
-			default:
-				close(client.Send)
-				h.mutex.Lock()
-				delete(h.clients, client)
-				h.mutex.Unlock()
-			}
+			h.mutex.Lock()
+			h.deliver(client, welcomeMsg)
+			h.mutex.Unlock()
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.Send)
-				log.Printf("Client disconnected: %s (Total: %d)", client.ID, len(h.clients))
+				client.log.Info("client disconnected", "total_clients", len(h.clients))
 			}
 			h.mutex.Unlock()
 
 		case message := <-h.broadcast:
-			h.mutex.RLock()
-			clientCount := len(h.clients)
-			h.mutex.RUnlock()
-
-			log.Printf("Broadcasting message to %d clients", clientCount)
-
-			h.mutex.RLock()
-			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
+			h.fanOut(message)
+			if h.cluster != nil {
+				h.cluster.relay(message.recipient(), message)
+			}
+
+		case env := <-h.remote:
+			if env.User != "" {
+				if h.deliverToUser(env.User, env.Message) == 0 && env.Direct && h.cluster != nil {
+					h.cluster.reroute(env)
 				}
+			} else {
+				h.fanOut(env.Message)
 			}
-			h.mutex.RUnlock()
+
+		case reply := <-h.ping:
+			close(reply)
+		}
+	}
+}
+
+// fanOut delivers a broadcast to the local clients meant to receive it.
+func (h *Hub) fanOut(message Message) {
+	h.mutex.Lock()
+	if broadcastLogSampler.Allow() {
+		logger.Debug("broadcasting message",
+			"type", message.Type, "chat_id", message.ChatID, "recipients", len(h.clients))
+	}
+	for client := range h.clients {
+		if client.receives(message) {
+			h.deliver(client, message)
 		}
 	}
+	h.mutex.Unlock()
+	atomic.AddUint64(&h.broadcastCount, 1)
+}
+
+// checkLoop verifies that the hub loop is still servicing its channels.
+func (h *Hub) checkLoop(ctx context.Context) (string, error) {
+	start := time.Now()
+	reply := make(chan struct{})
+
+	select {
+	case h.ping <- reply:
+	case <-ctx.Done():
+		return "", errors.New("hub loop unresponsive")
+	}
+	<-reply
+
+	return fmt.Sprintf("responded in %s", time.Since(start)), nil
+}
+
+// closeAll disconnects every client, used once the HTTP server has stopped
+// accepting new connections during shutdown.
+func (h *Hub) closeAll(reason string) {
+	h.mutex.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mutex.RUnlock()
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	for _, client := range clients {
+		client.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		client.Conn.Close()
+	}
+}
+
+// deliver queues msg on the client's send channel, dropping the client if
+// its queue is full. The caller must hold h.mutex for writing.
+func (h *Hub) deliver(client *Client, msg Message) bool {
+	select {
+	case client.Send <- msg:
+		return true
+	default:
+		client.log.Warn("send queue full, dropping client")
+		close(client.Send)
+		delete(h.clients, client)
+		atomic.AddUint64(&h.droppedCount, 1)
+		return false
+	}
+}
+
+// SendToUser delivers msg to every session of userID, on other instances
+// too, and returns the number of recipients on this one.
+func (h *Hub) SendToUser(userID string, msg Message) int {
+	delivered := h.deliverToUser(userID, msg)
+	if h.cluster != nil && userID != "" {
+		h.cluster.relay(userID, msg)
+	}
+	return delivered
+}
+
+// deliverToUser delivers msg to the sessions of userID on this instance.
+func (h *Hub) deliverToUser(userID string, msg Message) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delivered := 0
+	for client := range h.clients {
+		if userID == "" || client.UserID != userID {
+			continue
+		}
+		if h.deliver(client, msg) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// UserIDs returns the users with a session on this instance.
+func (h *Hub) UserIDs() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	seen := make(map[string]bool)
+	var users []string
+	for client := range h.clients {
+		if client.UserID != "" && !seen[client.UserID] {
+			seen[client.UserID] = true
+			users = append(users, client.UserID)
+		}
+	}
+	return users
+}
+
+// hosts reports whether userID has a session on this instance.
+func (h *Hub) hosts(userID string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.hostsLocked(userID)
+}
+
+// hostsLocked is hosts for callers holding h.mutex.
+func (h *Hub) hostsLocked(userID string) bool {
+	for client := range h.clients {
+		if client.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCount returns the number of registered clients.
+func (h *Hub) ClientCount() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.clients)
 }
 
 // Handle WebSocket connections
 func (h *Hub) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logger.Warn("websocket upgrade failed", "remote_addr", r.RemoteAddr, "error", err)
 		return
 	}
 
 	// Generate client ID
 	clientID := fmt.Sprintf("client_%d_%d", time.Now().Unix(), time.Now().Nanosecond())
 
+	// The user ID is taken on trust: sockets are not authenticated, so any
+	// client can claim any user. Put an authenticating proxy in front of
+	// the server before relying on it.
+	userID := r.URL.Query().Get("userId")
+
+	now := time.Now()
+
 	client := &Client{
-		ID:       clientID,
-		Conn:     conn,
-		Send:     make(chan Message, 256),
-		Hub:      h,
-		UserID:   r.URL.Query().Get("userId"),
-		LastSeen: time.Now(),
+		ID:          clientID,
+		Conn:        conn,
+		Send:        make(chan Message, h.cfg.SendQueueSize),
+		Hub:         h,
+		UserID:      userID,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: now,
+		LastSeen:    now,
+		chats:       make(map[string]struct{}),
+		log: logger.With(
+			"client_id", clientID,
+			"user_id", userID,
+			"remote_addr", r.RemoteAddr,
+		),
 	}
 
 	// Register client
@@ -157,10 +318,16 @@ func (c *Client) readPump() {
 	}()
 
 	// Set read limits and timeout
-	c.Conn.SetReadLimit(8192)
-	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	cfg := c.Hub.cfg
+	readLimit := cfg.ReadLimit
+	if c.Hub.files != nil {
+		// Upload chunks arrive as base64 in ordinary frames
+		readLimit = max(readLimit, c.Hub.files.frameLimit())
+	}
+	c.Conn.SetReadLimit(readLimit)
+	c.Conn.SetReadDeadline(time.Now().Add(cfg.PongWait.Std()))
 	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.Conn.SetReadDeadline(time.Now().Add(cfg.PongWait.Std()))
 		return nil
 	})
 
@@ -169,13 +336,26 @@ func (c *Client) readPump() {
 		err := c.Conn.ReadJSON(&msg)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				c.log.Warn("websocket read error", "error", err)
 			}
 			break
 		}
 
 		// Update client activity
+		c.mu.Lock()
 		c.LastSeen = time.Now()
+		c.mu.Unlock()
+
+		// The sender is the connection's user, whatever the frame claims,
+		// so a frame cannot name another sender than the socket did. That
+		// user is unauthenticated, see handleWebSocket. New messages get
+		// their ID here, as one the client picked could be another
+		// message's. The creation time is assigned by the pipeline.
+		msg.UserID = c.UserID
+		msg.CreatedAt = 0
+		if msg.Type.IsContent() {
+			msg.MessageID = newUUID()
+		}
 
 		// Add timestamp if not present
 		if msg.Timestamp == 0 {
@@ -184,39 +364,134 @@ func (c *Client) readPump() {
 
 		// Handle different message types
 		switch msg.Type {
-		case "ping":
+		case TypePing:
 			pongMsg := Message{
-				Type:      "pong",
+				Type:      TypePong,
 				Timestamp: time.Now().Unix(),
 			}
-			select {
-			case c.Send <- pongMsg:
-			default:
+			if !c.reply(pongMsg) {
 				return
 			}
 
-		case "message", "chat":
-			// Broadcast chat messages to all clients
-			c.Hub.broadcast <- msg
+		case TypeMessage, TypeChat, TypeReply, TypeEdit, TypeDelete, TypeReact, TypeUnreact:
+			// Chat messages and changes to them go through the processing
+			// pipeline, which delivers them from its fan-out stage
+			c.dispatch(msg)
+
+		case TypeUploadInit, TypeUploadChunk, TypeUploadComplete, TypeUploadAbort:
+			if c.Hub.files == nil {
+				c.reply(Message{Type: TypeError, Content: "file uploads are disabled", Timestamp: time.Now().Unix()})
+				continue
+			}
+			c.Hub.files.handleFrame(c, msg)
+
+		case TypeHistory:
+			if c.Hub.history == nil {
+				c.reply(Message{Type: TypeError, Content: "history is disabled", Timestamp: time.Now().Unix()})
+				continue
+			}
+			c.Hub.history.handleFrame(c, msg)
 
-		case "join_chat":
+		case TypeJoinChat:
 			// Handle chat room joining
-			log.Printf("Client %s joined chat %s", c.ID, msg.ChatID)
+			c.mu.Lock()
+			c.chats[msg.ChatID] = struct{}{}
+			c.mu.Unlock()
+			c.log.Debug("client joined chat", "chat_id", msg.ChatID)
 
-		case "leave_chat":
+		case TypeLeaveChat:
 			// Handle chat room leaving
-			log.Printf("Client %s left chat %s", c.ID, msg.ChatID)
+			c.mu.Lock()
+			delete(c.chats, msg.ChatID)
+			c.mu.Unlock()
+			c.log.Debug("client left chat", "chat_id", msg.ChatID)
 
 		default:
 			// Broadcast other message types
-			c.Hub.broadcast <- msg
+			c.dispatch(msg)
 		}
 	}
 }
 
+// receives reports whether a broadcast message is meant for c. Edits,
+// deletes for everyone and reaction updates go to the chat's members and
+// the sender's sessions, a delete for one user only to that user's
+// sessions; everything else is broadcast to all clients.
+func (c *Client) receives(msg Message) bool {
+	sender := msg.UserID != "" && c.UserID == msg.UserID
+	switch {
+	case msg.Type == TypeDelete && msg.Scope == DeleteForMe:
+		return sender
+	case msg.Type == TypeEdit || msg.Type == TypeDelete || msg.Type == TypeReactionUpdate:
+		return sender || c.inChat(msg.ChatID)
+	}
+	return true
+}
+
+// recipient returns the user whose sessions alone receive a broadcast,
+// or "" when it may be meant for anyone (see receives).
+func (msg *Message) recipient() string {
+	if msg.Type == TypeDelete && msg.Scope == DeleteForMe {
+		return msg.UserID
+	}
+	return ""
+}
+
+// dispatch hands an inbound message to the processor, or broadcasts it
+// directly when the hub runs without one. Submitting blocks this client's
+// read loop while the processor is saturated, which pushes back on the
+// sender; if the queue stays full the client is told its message was
+// rejected.
+func (c *Client) dispatch(msg Message) {
+	processor := c.Hub.processor
+	if processor == nil {
+		c.Hub.broadcast <- msg
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), processor.submitTimeout)
+	err := processor.Submit(ctx, &msg)
+	cancel()
+	if err == nil {
+		// The message is durable (when the WAL is enabled) and queued
+		c.reply(Message{
+			Type:      TypeAck,
+			ChatID:    msg.ChatID,
+			MessageID: msg.MessageID,
+			Timestamp: time.Now().Unix(),
+		})
+		return
+	}
+
+	c.log.Warn("message rejected", "type", msg.Type, "chat_id", msg.ChatID, "error", err)
+	errMsg := Message{
+		Type:      TypeError,
+		Content:   "server busy, message not accepted",
+		ChatID:    msg.ChatID,
+		MessageID: msg.MessageID,
+		Timestamp: time.Now().Unix(),
+	}
+	c.reply(errMsg)
+}
+
+// reply queues msg for this client only. It goes through the hub so it
+// cannot race the hub closing c.Send, and reports false once the client
+// has been dropped.
+func (c *Client) reply(msg Message) bool {
+	h := c.Hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.clients[c] {
+		return false
+	}
+	return h.deliver(c, msg)
+}
+
 // Write messages to WebSocket
 func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+	cfg := c.Hub.cfg
+	ticker := time.NewTicker(cfg.PingPeriod.Std())
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
@@ -225,7 +500,7 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.Conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait.Std()))
 
 			if !ok {
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
@@ -233,12 +508,12 @@ func (c *Client) writePump() {
 			}
 
 			if err := c.Conn.WriteJSON(message); err != nil {
-				log.Printf("WebSocket write error: %v", err)
+				c.log.Warn("websocket write error", "error", err)
 				return
 			}
 
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.Conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait.Std()))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -246,22 +521,6 @@ func (c *Client) writePump() {
 	}
 }
 
-// Health check endpoint
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	response := map[string]interface{}{
-		"status":     "healthy",
-		"timestamp":  time.Now().Unix(),
-		"version":    "3.0",
-		"server":     "Go WebSocket",
-		"uptime":     time.Since(startTime).String(),
-	}
-
-	json.NewEncoder(w).Encode(response)
-}
-
 // CORS middleware
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -281,36 +540,228 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 var startTime = time.Now()
 
 func main() {
-	// Get port from environment or default to 8080
-	port := os.Getenv("WS_PORT")
-	if port == "" {
-		port = "8080"
+	configPath := flag.String("config", os.Getenv("ULTRA_CONFIG"), "path to a YAML or JSON config file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
 	}
 
-	// Validate port
-	if _, err := strconv.Atoi(port); err != nil {
-		log.Printf("Invalid port %s, using default 8080", port)
-		port = "8080"
+	if *printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(cfg.Redacted())
+		return
+	}
+
+	if err := setupLogging(cfg.Log); err != nil {
+		logger.Error("invalid logging configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		os.Exit(runMigrateCommand(&cfg, flag.Args()[1:]))
 	}
 
+	GlobalUltraCache = NewUltraCache(cfg.Cache.MaxMemoryMB)
+	GlobalMessageProcessor = NewUltraMessageProcessor(cfg.Processor)
+	if cfg.Database.URL != "" {
+		pool, err := NewUltraDBPool(cfg.Database)
+		if err != nil {
+			logger.Error("database pool setup failed", "error", err)
+			os.Exit(1)
+		}
+		GlobalDBPool = pool
+		if cfg.Database.AutoMigrate {
+			migrator, err := NewMigrator(pool)
+			if err == nil {
+				_, err = migrator.Up(context.Background())
+			}
+			if err != nil {
+				logger.Error("database migration failed", "error", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	addr := net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port))
+
 	// Create and start hub
-	hub := newHub()
+	hub := newHub(cfg.WebSocket)
+	hub.processor = GlobalMessageProcessor
+	storage, err := NewLocalBlobStorage(cfg.Files.Dir)
+	if err != nil {
+		logger.Error("file storage setup failed", "error", err)
+		os.Exit(1)
+	}
+	downloadLinks = newFileLinks(cfg.Files)
+	hub.files = newFileService(storage, cfg.Files)
+	go hub.files.purgeLoop(context.Background())
+	hub.history = newHistoryService(GlobalDBPool, cfg.History)
+	if cfg.Cluster.Backend == "postgres" {
+		nodeID := cfg.Cluster.NodeID
+		if nodeID == "" {
+			nodeID = defaultNodeID(cfg.Server.Port)
+		}
+		address := cfg.Cluster.Address
+		if address == "" {
+			address = defaultNodeID(cfg.Server.Port)
+		}
+		members := newClusterMembership(NewPostgresClusterRegistry(GlobalDBPool),
+			ClusterNode{ID: nodeID, Address: address, StartedAt: startTime}, hub.UserIDs, cfg.Cluster)
+		if err := members.start(context.Background()); err != nil {
+			logger.Error("cluster registration failed", "error", err)
+			os.Exit(1)
+		}
+		pubsub := NewPostgresPubSub(GlobalDBPool, cfg.Database.URL)
+		if hub.cluster, err = newClusterBridge(hub, pubsub, members, nodeID, cfg.Cluster); err != nil {
+			logger.Error("cluster setup failed", "error", err)
+			os.Exit(1)
+		}
+		if err := GlobalUltraCache.EnableInvalidation(pubsub, nodeID, cfg.Cluster.Channel+"_cache"); err != nil {
+			logger.Error("cache invalidation setup failed", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("cluster relay enabled", "node_id", nodeID, "address", address, "channel", cfg.Cluster.Channel)
+	}
+	retry := newRetryPolicy(cfg.Processor.Retry)
+	if err := registerDefaultStages(GlobalMessageProcessor, hub, GlobalDBPool, retry, cfg.Messages); err != nil {
+		logger.Error("message pipeline setup failed", "error", err)
+		os.Exit(1)
+	}
+	dlq, err := openDeadLetterQueue(cfg.Processor.DeadLetter, GlobalMessageProcessor, GlobalDBPool)
+	if err != nil {
+		logger.Error("dead letter store setup failed", "error", err)
+		os.Exit(1)
+	}
 	go hub.run()
 
+	if cfg.Processor.WAL.Enabled {
+		wal, err := OpenWAL(cfg.Processor.WAL)
+		if err != nil {
+			logger.Error("write-ahead log setup failed", "error", err)
+			os.Exit(1)
+		}
+		GlobalMessageProcessor.AttachWAL(wal)
+		replayed, err := GlobalMessageProcessor.Recover(context.Background(), wal)
+		if err != nil {
+			logger.Error("write-ahead log replay failed", "error", err, "replayed", replayed)
+			os.Exit(1)
+		}
+		if replayed > 0 {
+			logger.Info("replayed unacknowledged messages", "count", replayed)
+		}
+	}
+
 	// Setup HTTP routes
 	http.HandleFunc("/ws", corsMiddleware(hub.handleWebSocket))
-	http.HandleFunc("/health", corsMiddleware(healthCheck))
+	health := newHealthChecker(hub)
+	http.HandleFunc("/health", corsMiddleware(health.handleHealth))
+	http.HandleFunc("/files/", corsMiddleware(hub.files.handleDownload))
+	http.HandleFunc("/history", tokenAuth("history", cfg.History.Token)(hub.history.handleHistory))
+	http.HandleFunc("/livez", health.handleLivez)
+	http.HandleFunc("/readyz", health.handleReadyz)
+	admin := adminAuth(cfg.Admin.Token)
+	http.HandleFunc("/admin/log-level", admin(handleLogLevel))
+	http.HandleFunc("/admin/connections", admin(hub.handleAdminConnections))
+	http.HandleFunc("/admin/disconnect", admin(hub.handleAdminDisconnect))
+	http.HandleFunc("/admin/announce", admin(hub.handleAdminAnnounce))
+	http.HandleFunc("/admin/stats", admin(hub.handleAdminStats))
+	http.HandleFunc("/admin/cache/invalidate", admin(handleAdminCacheInvalidate))
+	http.HandleFunc("/admin/dead-letters", admin(dlq.handleAdminDeadLetters))
+	http.HandleFunc("/admin/dead-letters/replay", admin(dlq.handleAdminReplay))
 	http.HandleFunc("/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "UltraSecure WebSocket Server v3.0\nConnections: %d\nUptime: %s", 
-			len(hub.clients), time.Since(startTime).String())
+			hub.ClientCount(), time.Since(startTime).String())
 	}))
 
-	log.Printf("🌐 UltraSecure WebSocket server starting on 0.0.0.0:%s", port)
-	log.Printf("✅ WebSocket endpoint: ws://0.0.0.0:%s/ws", port)
-	log.Printf("🏥 Health check: http://0.0.0.0:%s/health", port)
+	server := &http.Server{Addr: addr}
+	wsScheme, httpScheme := "ws", "http"
+
+	if tlsCfg := cfg.Server.TLS; tlsCfg.Enabled {
+		certs, err := newCertReloader(tlsCfg.CertFile, tlsCfg.KeyFile)
+		if err != nil {
+			logger.Error("TLS setup failed", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig, err = newServerTLSConfig(tlsCfg, certs)
+		if err != nil {
+			logger.Error("TLS setup failed", "error", err)
+			os.Exit(1)
+		}
+		go certs.watch(context.Background(), tlsCfg.ReloadInterval.Std())
+		wsScheme, httpScheme = "wss", "https"
+	}
+
+	logger.Info("UltraSecure WebSocket server starting",
+		"addr", addr,
+		"websocket", wsScheme+"://"+addr+"/ws",
+		"health", httpScheme+"://"+addr+"/health",
+		"tls", cfg.Server.TLS.Enabled,
+		"log_level", logLevel.Level().String())
+
+	go handleShutdown(server, hub, cfg.Server)
 
 	// Start server
-	if err := http.ListenAndServe("0.0.0.0:"+port, nil); err != nil {
-		log.Fatal("WebSocket server failed:", err)
+	if server.TLSConfig != nil {
+		// Certificates come from TLSConfig.GetCertificate
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("WebSocket server failed", "error", err)
+		os.Exit(1)
+	}
+	<-shutdownComplete
+}
+
+// shutdownComplete is closed once handleShutdown has finished draining.
+var shutdownComplete = make(chan struct{})
+
+// handleShutdown waits for SIGINT/SIGTERM, marks the instance as draining so
+// /readyz fails and the load balancer stops routing here, then stops the
+// HTTP server and closes remaining WebSocket connections.
+func handleShutdown(server *http.Server, hub *Hub, cfg ServerConfig) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	received := <-sig
+
+	draining.Store(true)
+	logger.Info("shutdown started, draining", "signal", received.String(), "grace_period", cfg.DrainGracePeriod.Std().String())
+	time.Sleep(cfg.DrainGracePeriod.Std())
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Std())
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("HTTP server shutdown incomplete", "error", err)
 	}
+	hub.closeAll("server shutting down")
+	if hub.processor != nil {
+		if err := hub.processor.Stop(ctx); err != nil {
+			logger.Warn("message processor did not drain", "error", err)
+		}
+		// Unacknowledged records stay in the log and are replayed on start
+		if wal := hub.processor.wal; wal != nil {
+			if err := wal.Close(); err != nil {
+				logger.Warn("write-ahead log close failed", "error", err)
+			}
+		}
+	}
+	if hub.cluster != nil {
+		GlobalUltraCache.StopInvalidation()
+		if err := hub.cluster.Close(ctx); err != nil {
+			logger.Warn("cluster relay close failed", "error", err)
+		}
+	}
+	if GlobalDBPool != nil {
+		GlobalDBPool.Close()
+	}
+	GlobalUltraCache.Close()
+
+	logger.Info("shutdown complete")
+	close(shutdownComplete)
 }
\ No newline at end of file
@@ -1,12 +1,18 @@
 
+//go:build linux
+
 package main
 
 import (
 	"net"
 	"syscall"
-	"unsafe"
 	"sync"
-	"time"
+)
+
+// Linux socket and epoll flags missing from (or mistyped in) package syscall
+const (
+	soReusePort = 0xf
+	epollET     = 1 << 31
 )
 
 type ZeroCopyServer struct {
@@ -33,7 +39,7 @@ func NewZeroCopyServer(addr string) (*ZeroCopyServer, error) {
 	}
 	
 	// Enable SO_REUSEPORT and SO_REUSEADDR
-	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
 	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
 	
 	// Disable Nagle's algorithm for ultra-low latency
@@ -73,7 +79,7 @@ func (zcs *ZeroCopyServer) AcceptConnections() {
 		
 		// Add to epoll
 		event := syscall.EpollEvent{
-			Events: syscall.EPOLLIN | syscall.EPOLLET, // Edge-triggered
+			Events: syscall.EPOLLIN | epollET, // Edge-triggered
 			Fd:     int32(clientFd),
 		}
 		syscall.EpollCtl(zcs.epollFd, syscall.EPOLL_CTL_ADD, clientFd, &event)
@@ -90,10 +96,11 @@ func (zcs *ZeroCopyServer) AcceptConnections() {
 // Ultra-fast message processing using sendfile() syscall
 func (zcs *ZeroCopyServer) SendZeroCopy(clientFd int, data []byte) error {
 	// Use splice() for zero-copy transfer
-	r, w, err := syscall.Pipe2(0)
-	if err != nil {
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
 		return err
 	}
+	r, w := p[0], p[1]
 	defer syscall.Close(r)
 	defer syscall.Close(w)
 	
@@ -101,7 +108,7 @@ func (zcs *ZeroCopyServer) SendZeroCopy(clientFd int, data []byte) error {
 	syscall.Write(w, data)
 	
 	// Splice from pipe to socket (zero-copy)
-	_, err = syscall.Splice(r, nil, clientFd, nil, len(data), 0)
+	_, err := syscall.Splice(r, nil, clientFd, nil, len(data), 0)
 	return err
 }
 
@@ -1,5 +1,5 @@
 import { sql, relations } from "drizzle-orm";
-import { pgTable, text, varchar, timestamp, boolean, integer, uuid, primaryKey, bigint } from "drizzle-orm/pg-core";
+import { pgTable, text, varchar, timestamp, boolean, integer, uuid, primaryKey, bigint, index } from "drizzle-orm/pg-core";
 import { createInsertSchema } from "drizzle-zod";
 import { z } from "zod";
 
@@ -46,9 +46,23 @@ export const messages = pgTable("messages", {
   content: text("content").notNull(),
   messageType: varchar("message_type", { length: 20 }).default("text"), // text, image, file
   isEncrypted: boolean("is_encrypted").default(true),
+  replyToId: uuid("reply_to_id"),
   editedAt: timestamp("edited_at"),
+  deletedAt: timestamp("deleted_at"), // deleted for everyone; content is cleared
   createdAt: timestamp("created_at").defaultNow(),
-});
+}, (table) => ({
+  chatCreatedIdx: index("messages_chat_created_idx").on(table.chatId, table.createdAt, table.id), // history paging
+}));
+
+// Messages a user deleted for themselves only
+export const messageDeletions = pgTable("message_deletions", {
+  messageId: uuid("message_id").references(() => messages.id, { onDelete: "cascade" }),
+  userId: uuid("user_id").references(() => users.id, { onDelete: "cascade" }),
+  deletedAt: timestamp("deleted_at").defaultNow(),
+}, (table) => ({
+  pk: primaryKey({ columns: [table.messageId, table.userId] }),
+  userIdx: index("message_deletions_user_idx").on(table.userId, table.messageId),
+}));
 
 export const messageReads = pgTable("message_reads", {
   messageId: uuid("message_id").references(() => messages.id, { onDelete: "cascade" }),
@@ -58,6 +72,28 @@ export const messageReads = pgTable("message_reads", {
   pk: primaryKey({ columns: [table.messageId, table.userId] }),
 }));
 
+// Files attached to a message; fileId is the SHA-256 of the stored blob
+export const messageAttachments = pgTable("message_attachments", {
+  messageId: uuid("message_id").references(() => messages.id, { onDelete: "cascade" }),
+  fileId: varchar("file_id", { length: 64 }).notNull(),
+  name: varchar("name", { length: 255 }).notNull(),
+  mimeType: varchar("mime_type", { length: 255 }).notNull(),
+  size: bigint("size", { mode: "number" }).notNull(),
+  position: integer("position").notNull().default(0),
+}, (table) => ({
+  pk: primaryKey({ columns: [table.messageId, table.position] }),
+}));
+
+// Emoji reactions; each user reacts at most once per emoji
+export const messageReactions = pgTable("message_reactions", {
+  messageId: uuid("message_id").references(() => messages.id, { onDelete: "cascade" }),
+  userId: uuid("user_id").references(() => users.id, { onDelete: "cascade" }),
+  emoji: varchar("emoji", { length: 64 }).notNull(),
+  createdAt: timestamp("created_at").defaultNow(),
+}, (table) => ({
+  pk: primaryKey({ columns: [table.messageId, table.userId, table.emoji] }),
+}));
+
 // Password reset tokens
 export const passwordResetTokens = pgTable("password_reset_tokens", {
   id: uuid("id").primaryKey().default(sql`gen_random_uuid()`),
@@ -283,6 +319,8 @@ export const messagesRelations = relations(messages, ({ one, many }) => ({
   chat: one(chats, { fields: [messages.chatId], references: [chats.id] }),
   sender: one(users, { fields: [messages.senderId], references: [users.id] }),
   reads: many(messageReads),
+  reactions: many(messageReactions),
+  attachments: many(messageAttachments),
 }));
 
 export const messageReadsRelations = relations(messageReads, ({ one }) => ({
@@ -290,6 +328,15 @@ export const messageReadsRelations = relations(messageReads, ({ one }) => ({
   user: one(users, { fields: [messageReads.userId], references: [users.id] }),
 }));
 
+export const messageAttachmentsRelations = relations(messageAttachments, ({ one }) => ({
+  message: one(messages, { fields: [messageAttachments.messageId], references: [messages.id] }),
+}));
+
+export const messageReactionsRelations = relations(messageReactions, ({ one }) => ({
+  message: one(messages, { fields: [messageReactions.messageId], references: [messages.id] }),
+  user: one(users, { fields: [messageReactions.userId], references: [users.id] }),
+}));
+
 // Zod schemas
 export const insertUserSchema = createInsertSchema(users).omit({
   id: true,
@@ -309,6 +356,7 @@ export const insertMessageSchema = createInsertSchema(messages).omit({
   id: true,
   createdAt: true,
   editedAt: true,
+  deletedAt: true,
 });
 
 export const insertChatMemberSchema = createInsertSchema(chatMembers).omit({